@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 
 	"github.com/jackthomas00/polaris/internal/billing"
 	"github.com/jackthomas00/polaris/pkg/db"
+	"github.com/jackthomas00/polaris/pkg/lease"
+	"github.com/jackthomas00/polaris/pkg/money"
+	"github.com/jackthomas00/polaris/pkg/nats"
+	"github.com/jackthomas00/polaris/pkg/outbox"
 	billingv1 "github.com/jackthomas00/polaris/proto/billingv1"
+	identityv1 "github.com/jackthomas00/polaris/proto/identityv1"
+	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
 )
 
 func main() {
@@ -21,13 +30,77 @@ func main() {
 		log.Fatal("BILLING_DB_DSN not set")
 	}
 
+	usageAddr := os.Getenv("USAGE_SVC_ADDR")
+	if usageAddr == "" {
+		usageAddr = "usage-svc:50052"
+	}
+
+	identityAddr := os.Getenv("IDENTITY_SVC_ADDR")
+	if identityAddr == "" {
+		identityAddr = "identity-svc:50051"
+	}
+
 	pg, err := db.Connect(dsn)
 	if err != nil {
 		log.Fatalf("db connect: %v", err)
 	}
 
+	bus, err := nats.FromEnv("billing-svc")
+	if err != nil {
+		log.Fatalf("nats connect: %v", err)
+	}
+	defer bus.Close()
+
+	rounding, err := money.ParseRoundingMode(os.Getenv("BILLING_ROUNDING_MODE"))
+	if err != nil {
+		log.Fatalf("BILLING_ROUNDING_MODE: %v", err)
+	}
+
+	numbering, err := billing.ParseInvoiceNumbering(os.Getenv("BILLING_INVOICE_NUMBER_FORMAT"), os.Getenv("BILLING_INVOICE_NUMBER_SCOPE"))
+	if err != nil {
+		log.Fatalf("invoice numbering: %v", err)
+	}
+
+	// Usage totals come from usage-svc, which owns the usage tables.
+	usageConn, err := grpc.NewClient(usageAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("usage client: %v", err)
+	}
+	defer usageConn.Close()
+
+	// Org billing addresses and tax IDs come from identity-svc.
+	identityConn, err := grpc.NewClient(identityAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("identity client: %v", err)
+	}
+	defer identityConn.Close()
+
 	store := billing.NewStore(pg)
-	svc := billing.NewService(store)
+	tax, err := billing.NewTaxCalculator(os.Getenv("BILLING_TAX_PROVIDER"), store, rounding)
+	if err != nil {
+		log.Fatalf("BILLING_TAX_PROVIDER: %v", err)
+	}
+	svc := billing.NewService(store, usagev1.NewUsageClient(usageConn), identityv1.NewIdentityClient(identityConn), tax, rounding, numbering)
+
+	// Publish queued domain events from the outbox.
+	relay := outbox.NewRelay(pg, store.Outbox(), bus, "billing-svc")
+	go relay.Run(context.Background())
+
+	// Keep draft invoices current as usage is aggregated.
+	if _, err := bus.Subscribe(billing.SubjectAggregateUpdated, billing.ConsumerQueue, svc.HandleAggregateUpdated); err != nil {
+		log.Fatalf("subscribe %s: %v", billing.SubjectAggregateUpdated, err)
+	}
+
+	// Close billing periods and finalize their invoices. Every replica runs
+	// the scheduler; the one holding the lease does the work.
+	if os.Getenv("BILLING_SCHEDULER_ENABLED") != "false" {
+		interval := durationEnv("BILLING_SCHEDULER_INTERVAL", time.Minute)
+		grace := durationEnv("BILLING_CLOSE_GRACE", time.Hour)
+		l := lease.New(pg, "billing_leases", billing.SchedulerLease, 3*interval)
+		scheduler := billing.NewScheduler(svc, l, interval, grace)
+		go scheduler.Run(context.Background())
+		log.Printf("billing scheduler running as %s (interval %s, grace %s)", l.Holder(), interval, grace)
+	}
 
 	// Start HTTP server for health and metrics
 	go func() {
@@ -58,3 +131,17 @@ func main() {
 		log.Fatalf("serve: %v", err)
 	}
 }
+
+// durationEnv parses the duration in env var name, such as "90s", returning
+// def when it is unset.
+func durationEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s: invalid duration %q", name, v)
+	}
+	return d
+}
@@ -11,9 +11,13 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 
 	"github.com/jackthomas00/polaris/internal/usage"
 	"github.com/jackthomas00/polaris/pkg/db"
+	"github.com/jackthomas00/polaris/pkg/nats"
+	"github.com/jackthomas00/polaris/pkg/outbox"
+	identityv1 "github.com/jackthomas00/polaris/proto/identityv1"
 	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
 )
 
@@ -23,15 +27,37 @@ func main() {
 		log.Fatal("USAGE_DB_DSN not set")
 	}
 
+	identityAddr := os.Getenv("IDENTITY_SVC_ADDR")
+	if identityAddr == "" {
+		identityAddr = "identity-svc:50051"
+	}
+
 	pg, err := db.Connect(dsn)
 	if err != nil {
 		log.Fatalf("db connect: %v", err)
 	}
 
+	bus, err := nats.FromEnv("usage-svc")
+	if err != nil {
+		log.Fatalf("nats connect: %v", err)
+	}
+	defer bus.Close()
+
 	store := usage.NewStore(pg)
 	svc := usage.NewService(store)
 
-	// Start HTTP server for health and metrics
+	// Publish queued domain events from the outbox.
+	relay := outbox.NewRelay(pg, store.Outbox(), bus, "usage-svc")
+	go relay.Run(context.Background())
+
+	identityConn, err := grpc.NewClient(identityAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("identity client: %v", err)
+	}
+	defer identityConn.Close()
+	ingest := usage.NewIngestHandler(identityv1.NewIdentityClient(identityConn), svc)
+
+	// Start HTTP server for health, metrics and public ingestion
 	go func() {
 		httpMux := http.NewServeMux()
 		httpMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -39,6 +65,7 @@ func main() {
 			_, _ = w.Write([]byte("ok"))
 		})
 		httpMux.Handle("/metrics", promhttp.Handler())
+		httpMux.Handle("/ingest", ingest)
 
 		httpAddr := ":9092"
 		log.Printf("usage-svc HTTP server listening on %s", httpAddr)
@@ -47,23 +74,29 @@ func main() {
 		}
 	}()
 
-	// Start periodic aggregation goroutine
+	// Start periodic aggregation goroutine. Each run folds only the events
+	// written since the last checkpoint, so restarts resume where they left off.
 	go func() {
 		ticker := time.NewTicker(60 * time.Second)
 		defer ticker.Stop()
 
-		// Run immediately on startup
-		ctx := context.Background()
-		if err := store.AggregateUsageEvents(ctx); err != nil {
-			log.Printf("aggregation error: %v", err)
+		aggregate := func() {
+			n, err := store.AggregateUsageEvents(context.Background())
+			if err != nil {
+				log.Printf("aggregation error: %v", err)
+				return
+			}
+			if n > 0 {
+				log.Printf("aggregated %d usage events", n)
+			}
 		}
 
+		// Run immediately on startup
+		aggregate()
+
 		// Then run every 60 seconds
 		for range ticker.C {
-			ctx := context.Background()
-			if err := store.AggregateUsageEvents(ctx); err != nil {
-				log.Printf("aggregation error: %v", err)
-			}
+			aggregate()
 		}
 	}()
 
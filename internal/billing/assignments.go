@@ -0,0 +1,129 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// PlanAssignment is a stretch of time a subscription spent on one price plan.
+// A plan change ends the current assignment and starts a new one, so invoices
+// can price each part of a period under the plan in effect at the time.
+type PlanAssignment struct {
+	ID             int64
+	SubscriptionID string
+	OrgID          string
+	PricePlanID    string
+	EffectiveFrom  time.Time
+	// EffectiveTo is nil while the assignment is open-ended.
+	EffectiveTo *time.Time
+	PricePlan   PricePlan
+	// AnchorDay and SubscriptionStart are the subscription's, which fix where
+	// billing periods fall.
+	AnchorDay         int
+	SubscriptionStart time.Time
+}
+
+// periodAt returns the billing period of the assignment's price plan
+// containing t.
+func (a *PlanAssignment) periodAt(t time.Time) billingPeriod {
+	return anchoredPeriod(a.AnchorDay, a.PricePlan.Interval.months(), a.SubscriptionStart, t)
+}
+
+// segment is a part of an invoice period priced under one plan assignment
+// and within one of its billing periods.
+type segment struct {
+	start, end time.Time
+	// proration is the fraction of the billing period the segment covers; nil
+	// when it covers all of it.
+	proration *big.Rat
+}
+
+// label describes the days the segment covers, e.g. "2026-03-15 to
+// 2026-03-31".
+func (s segment) label() string {
+	const day = "2006-01-02"
+	return fmt.Sprintf("%s to %s", s.start.Format(day), s.end.Add(-time.Nanosecond).Format(day))
+}
+
+// segments splits the part of [start, end) covered by the assignment at its
+// billing period boundaries.
+func (a *PlanAssignment) segments(start, end time.Time) []segment {
+	if a.EffectiveFrom.After(start) {
+		start = a.EffectiveFrom
+	}
+	if a.EffectiveTo != nil && a.EffectiveTo.Before(end) {
+		end = *a.EffectiveTo
+	}
+
+	var segs []segment
+	for t := start; t.Before(end); {
+		p := a.periodAt(t)
+		seg := segment{start: t, end: p.end}
+		if end.Before(seg.end) {
+			seg.end = end
+		}
+		if !seg.start.Equal(p.start) || !seg.end.Equal(p.end) {
+			seg.proration = big.NewRat(int64(seg.end.Sub(seg.start)/time.Second), int64(p.end.Sub(p.start)/time.Second))
+		}
+		segs = append(segs, seg)
+		t = seg.end
+	}
+	return segs
+}
+
+// prorateQuantity scales q by proration, rounding down to whole units.
+func prorateQuantity(q int64, proration *big.Rat) int64 {
+	if proration == nil {
+		return q
+	}
+	n := new(big.Int).Mul(big.NewInt(q), proration.Num())
+	return n.Quo(n, proration.Denom()).Int64()
+}
+
+// AssignmentsDuring returns the plan assignments of orgID in effect for any
+// part of [start, end), oldest first.
+func (s *Store) AssignmentsDuring(ctx context.Context, orgID string, start, end time.Time) ([]PlanAssignment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT a.id, a.subscription_id, a.org_id, a.price_plan_id, a.effective_from, a.effective_to,
+			s.anchor_day, s.started_at,
+			p.name, p.currency, p.base_fee, p.billing_interval, p.tax_code
+		FROM plan_assignments a
+		JOIN subscriptions s ON s.id = a.subscription_id
+		JOIN price_plans p ON p.id = a.price_plan_id
+		WHERE a.org_id = $1 AND a.effective_from < $3 AND (a.effective_to IS NULL OR a.effective_to > $2)
+		ORDER BY a.effective_from, a.id
+	`, orgID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assignments []PlanAssignment
+	for rows.Next() {
+		var a PlanAssignment
+		var effectiveTo sql.NullTime
+		var baseFee string
+		if err := rows.Scan(&a.ID, &a.SubscriptionID, &a.OrgID, &a.PricePlanID, &a.EffectiveFrom, &effectiveTo,
+			&a.AnchorDay, &a.SubscriptionStart,
+			&a.PricePlan.Name, &a.PricePlan.Currency, &baseFee, &a.PricePlan.Interval, &a.PricePlan.TaxCode); err != nil {
+			return nil, err
+		}
+		a.EffectiveFrom = a.EffectiveFrom.UTC()
+		a.SubscriptionStart = a.SubscriptionStart.UTC()
+		if effectiveTo.Valid {
+			t := effectiveTo.Time.UTC()
+			a.EffectiveTo = &t
+		}
+		a.PricePlan.ID = a.PricePlanID
+		if a.PricePlan.BaseFee, err = money.ParseRat(baseFee); err != nil {
+			return nil, fmt.Errorf("price plan %s: base fee: %w", a.PricePlanID, err)
+		}
+		assignments = append(assignments, a)
+	}
+	return assignments, rows.Err()
+}
@@ -0,0 +1,86 @@
+package billing
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestPlanAssignment_Segments(t *testing.T) {
+	date := func(m time.Month, d int) time.Time { return time.Date(2026, m, d, 0, 0, 0, 0, time.UTC) }
+	monthly := PricePlan{Interval: IntervalMonth}
+	changedAt := date(3, 11)
+
+	tests := []struct {
+		name       string
+		assignment PlanAssignment
+		start, end time.Time
+		expected   []segment
+	}{
+		{
+			name:       "whole period",
+			assignment: PlanAssignment{EffectiveFrom: date(1, 1), AnchorDay: 1, SubscriptionStart: date(1, 1), PricePlan: monthly},
+			start:      date(3, 1), end: date(4, 1),
+			expected: []segment{{start: date(3, 1), end: date(4, 1)}},
+		},
+		{
+			name:       "ended by a plan change",
+			assignment: PlanAssignment{EffectiveFrom: date(1, 1), EffectiveTo: &changedAt, AnchorDay: 1, SubscriptionStart: date(1, 1), PricePlan: monthly},
+			start:      date(3, 1), end: date(4, 1),
+			expected: []segment{{start: date(3, 1), end: date(3, 11), proration: big.NewRat(10, 31)}},
+		},
+		{
+			name:       "started by a plan change",
+			assignment: PlanAssignment{EffectiveFrom: changedAt, AnchorDay: 1, SubscriptionStart: date(1, 1), PricePlan: monthly},
+			start:      date(3, 1), end: date(4, 1),
+			expected: []segment{{start: date(3, 11), end: date(4, 1), proration: big.NewRat(21, 31)}},
+		},
+		{
+			name:       "split at the anchor day",
+			assignment: PlanAssignment{EffectiveFrom: date(1, 15), AnchorDay: 15, SubscriptionStart: date(1, 15), PricePlan: monthly},
+			start:      date(3, 1), end: date(4, 1),
+			expected: []segment{
+				{start: date(3, 1), end: date(3, 15), proration: big.NewRat(14, 28)},
+				{start: date(3, 15), end: date(4, 1), proration: big.NewRat(17, 31)},
+			},
+		},
+		{
+			name:       "outside the period",
+			assignment: PlanAssignment{EffectiveFrom: date(4, 1), AnchorDay: 1, SubscriptionStart: date(4, 1), PricePlan: monthly},
+			start:      date(3, 1), end: date(4, 1),
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		got := tt.assignment.segments(tt.start, tt.end)
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: expected %d segments, got %+v", tt.name, len(tt.expected), got)
+			continue
+		}
+		for i, want := range tt.expected {
+			if !got[i].start.Equal(want.start) || !got[i].end.Equal(want.end) || !ratsEqual(got[i].proration, want.proration) {
+				t.Errorf("%s: segment %d: expected %+v, got %+v", tt.name, i, want, got[i])
+			}
+		}
+	}
+}
+
+func TestProrateQuantity(t *testing.T) {
+	tests := []struct {
+		q         int64
+		proration *big.Rat
+		expected  int64
+	}{
+		{q: 1000, proration: nil, expected: 1000},
+		{q: 1000, proration: big.NewRat(21, 31), expected: 677},
+		{q: 1000, proration: big.NewRat(1, 2), expected: 500},
+		{q: 0, proration: big.NewRat(1, 3), expected: 0},
+	}
+
+	for _, tt := range tests {
+		if got := prorateQuantity(tt.q, tt.proration); got != tt.expected {
+			t.Errorf("prorateQuantity(%d, %v): expected %d, got %d", tt.q, tt.proration, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// ErrInvalidCommitment is returned for a commitment that does not fit its
+// subscription.
+var ErrInvalidCommitment = errors.New("invalid commitment")
+
+// Commitment is a minimum of usage charges a subscription commits to per
+// commitment period, e.g. 10,000.00 USD a month. Usage is drawn against it:
+// charges beyond it bill as usual, and the invoice closing a commitment period
+// adds a true-up line for what the period's usage fell short by.
+type Commitment struct {
+	// Amount is in the currency of the subscription's price plan.
+	Amount   money.Money
+	Interval BillingInterval
+}
+
+// validate checks that c fits subscriptions to pp: it is in pp's currency
+// and its periods span whole billing periods.
+func (c *Commitment) validate(pp *PricePlan) error {
+	if c.Amount.MinorUnits <= 0 {
+		return fmt.Errorf("%w: amount must be positive", ErrInvalidCommitment)
+	}
+	if c.Amount.Currency != pp.Currency {
+		return fmt.Errorf("%w: amount is in %s, the price plan in %s", ErrInvalidCommitment, c.Amount.Currency, pp.Currency)
+	}
+	if c.Interval != IntervalMonth && c.Interval != IntervalYear {
+		return fmt.Errorf("%w: unknown interval %q", ErrInvalidCommitment, c.Interval)
+	}
+	if c.Interval.months() < pp.Interval.months() {
+		return fmt.Errorf("%w: a %sly commitment is shorter than the %sly billing period", ErrInvalidCommitment, c.Interval, pp.Interval)
+	}
+	return nil
+}
+
+// commitmentPeriodAt returns the commitment period containing t. Commitment
+// periods start on the anchor day like billing periods, so an annual
+// commitment spans twelve monthly invoices.
+func (s *Subscription) commitmentPeriodAt(t time.Time) billingPeriod {
+	return anchoredPeriod(s.AnchorDay, s.Commitment.Interval.months(), s.StartedAt, t)
+}
+
+// closedCommitments returns the commitment periods the invoice for
+// [start, end) reconciles, each cut to the part the subscription covers. A
+// period is reconciled by the invoice its covered part ends in, which is
+// earlier than the period's end when the subscription ends first. Partly
+// covered periods are prorated by time.
+func (s *Subscription) closedCommitments(start, end time.Time) []segment {
+	var segs []segment
+	for p := s.commitmentPeriodAt(start); p.start.Before(end); p = s.commitmentPeriodAt(p.end) {
+		seg := segment{start: p.start, end: p.end}
+		if s.StartedAt.After(seg.start) {
+			seg.start = s.StartedAt
+		}
+		if s.EndedAt != nil && s.EndedAt.Before(seg.end) {
+			seg.end = *s.EndedAt
+		}
+		if !seg.start.Before(seg.end) || !seg.end.After(start) || seg.end.After(end) {
+			continue
+		}
+		if !seg.start.Equal(p.start) || !seg.end.Equal(p.end) {
+			seg.proration = big.NewRat(int64(seg.end.Sub(seg.start)/time.Second), int64(p.end.Sub(p.start)/time.Second))
+		}
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// trueUpLineItem returns the charge for the shortfall of usage, the usage
+// charges of the commitment period seg in minor units, against c, prorated by
+// seg's proration and rounded with rounding. It returns nil when usage met the
+// commitment.
+func trueUpLineItem(c *Commitment, seg segment, usage int64, rounding money.RoundingMode) (*LineItem, error) {
+	minimum := c.Amount.Rat()
+	if seg.proration != nil {
+		minimum.Mul(minimum, seg.proration)
+	}
+	committed, err := money.FromRat(minimum, c.Amount.Currency, rounding)
+	if err != nil {
+		return nil, fmt.Errorf("commitment: %w", err)
+	}
+	if usage >= committed.MinorUnits {
+		return nil, nil
+	}
+
+	amount := money.Money{MinorUnits: committed.MinorUnits - usage, Currency: c.Amount.Currency}
+	item := &LineItem{
+		Kind:               LineItemTrueUp,
+		Description:        fmt.Sprintf("Minimum %sly commitment true-up (%s)", c.Interval, seg.label()),
+		Quantity:           1,
+		ChargeableQuantity: 1,
+		PricingModel:       PricingPerUnit,
+		UnitPrice:          amount.Rat(),
+		Amount:             amount,
+	}
+	item.setSegment(seg)
+	return item, nil
+}
+
+// SetCommitment sets the minimum commitment of orgID's active subscription,
+// or removes it when c is nil. It applies to every commitment period not yet
+// reconciled by a finalized invoice.
+func (s *Store) SetCommitment(ctx context.Context, orgID string, c *Commitment) error {
+	var amount *int64
+	var interval *string
+	if c != nil {
+		i := string(c.Interval)
+		amount, interval = &c.Amount.MinorUnits, &i
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE subscriptions SET commitment_minor = $2, commitment_interval = $3, updated_at = NOW()
+		WHERE org_id = $1 AND status = 'active'
+	`, orgID, amount, interval)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// UsageCharges returns the usage charges in currency, in minor units, that
+// orgID's invoices other than the one for [invoiceStart, invoiceEnd) carry
+// for [start, end). Void invoices are left out. A usage line counts where its
+// segment, or else its invoice's period, starts.
+func (s *Store) UsageCharges(ctx context.Context, orgID, currency string, start, end, invoiceStart, invoiceEnd time.Time) (int64, error) {
+	var total int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(li.amount_minor), 0)
+		FROM invoice_line_items li
+		JOIN invoices i ON i.id = li.invoice_id
+		WHERE i.org_id = $1 AND i.status <> 'void' AND li.kind = 'usage' AND li.currency = $2
+			AND COALESCE(li.period_start, i.period_start) >= $3
+			AND COALESCE(li.period_start, i.period_start) < $4
+			AND NOT (i.period_start = $5 AND i.period_end = $6)
+	`, orgID, currency, start, end, invoiceStart, invoiceEnd).Scan(&total)
+	return total, err
+}
@@ -0,0 +1,168 @@
+package billing
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+func TestSubscription_ClosedCommitments(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	sub := func(interval BillingInterval, started time.Time, ended *time.Time) *Subscription {
+		return &Subscription{
+			AnchorDay:  1,
+			StartedAt:  started,
+			EndedAt:    ended,
+			PricePlan:  PricePlan{Interval: IntervalMonth},
+			Commitment: &Commitment{Interval: interval},
+		}
+	}
+	midJune := day(2026, 6, 16)
+
+	tests := []struct {
+		name       string
+		sub        *Subscription
+		start, end time.Time
+		expected   []segment
+	}{
+		{
+			name:     "monthly commitment closes with each monthly invoice",
+			sub:      sub(IntervalMonth, day(2026, 1, 1), nil),
+			start:    day(2026, 3, 1),
+			end:      day(2026, 4, 1),
+			expected: []segment{{start: day(2026, 3, 1), end: day(2026, 4, 1)}},
+		},
+		{
+			name:     "annual commitment is not reconciled mid-year",
+			sub:      sub(IntervalYear, day(2026, 1, 1), nil),
+			start:    day(2026, 3, 1),
+			end:      day(2026, 4, 1),
+			expected: nil,
+		},
+		{
+			name:     "annual commitment is reconciled by the year's last invoice",
+			sub:      sub(IntervalYear, day(2026, 1, 1), nil),
+			start:    day(2026, 12, 1),
+			end:      day(2027, 1, 1),
+			expected: []segment{{start: day(2026, 1, 1), end: day(2027, 1, 1)}},
+		},
+		{
+			name:  "first period is prorated from the subscription start",
+			sub:   sub(IntervalMonth, day(2026, 4, 11), nil),
+			start: day(2026, 4, 1),
+			end:   day(2026, 5, 1),
+			expected: []segment{{start: day(2026, 4, 11), end: day(2026, 5, 1),
+				proration: big.NewRat(20, 30)}},
+		},
+		{
+			name:  "annual commitment is reconciled early when the subscription ends",
+			sub:   sub(IntervalYear, day(2026, 1, 1), &midJune),
+			start: day(2026, 6, 1),
+			end:   day(2026, 7, 1),
+			expected: []segment{{start: day(2026, 1, 1), end: midJune,
+				proration: big.NewRat(int64(midJune.Sub(day(2026, 1, 1))/time.Second), 365*24*3600)}},
+		},
+		{
+			name:     "nothing to reconcile after the subscription ended",
+			sub:      sub(IntervalMonth, day(2026, 1, 1), &midJune),
+			start:    day(2026, 7, 1),
+			end:      day(2026, 8, 1),
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segs := tt.sub.closedCommitments(tt.start, tt.end)
+			if len(segs) != len(tt.expected) {
+				t.Fatalf("expected %d periods, got %d: %+v", len(tt.expected), len(segs), segs)
+			}
+			for i, seg := range segs {
+				want := tt.expected[i]
+				if !seg.start.Equal(want.start) || !seg.end.Equal(want.end) || !ratsEqual(seg.proration, want.proration) {
+					t.Errorf("period %d: expected %v to %v (%v), got %v to %v (%v)",
+						i, want.start, want.end, want.proration, seg.start, seg.end, seg.proration)
+				}
+			}
+		})
+	}
+}
+
+func TestTrueUpLineItem(t *testing.T) {
+	c := &Commitment{Amount: money.Money{MinorUnits: 1000000, Currency: "USD"}, Interval: IntervalMonth}
+	march := segment{start: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), end: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)}
+	prorated := march
+	prorated.proration = big.NewRat(1, 3)
+
+	tests := []struct {
+		name     string
+		seg      segment
+		usage    int64
+		expected int64 // 0 for no true-up
+	}{
+		{name: "usage short of the commitment", seg: march, usage: 750000, expected: 250000},
+		{name: "no usage", seg: march, usage: 0, expected: 1000000},
+		{name: "usage meets the commitment", seg: march, usage: 1000000, expected: 0},
+		{name: "overage needs no true-up", seg: march, usage: 1200000, expected: 0},
+		{name: "prorated commitment", seg: prorated, usage: 300000, expected: 33333},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item, err := trueUpLineItem(c, tt.seg, tt.usage, money.RoundHalfUp)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.expected == 0 {
+				if item != nil {
+					t.Errorf("expected no true-up, got %+v", item)
+				}
+				return
+			}
+			if item == nil {
+				t.Fatalf("expected a true-up of %d", tt.expected)
+			}
+			if item.Kind != LineItemTrueUp || item.Amount != (money.Money{MinorUnits: tt.expected, Currency: "USD"}) {
+				t.Errorf("expected true-up of %d USD, got %s %s", tt.expected, item.Kind, item.Amount)
+			}
+			if item.PeriodStart == nil || !item.PeriodStart.Equal(tt.seg.start) {
+				t.Errorf("expected the line to cover the commitment period, got %v", item.PeriodStart)
+			}
+		})
+	}
+}
+
+func TestCommitment_Validate(t *testing.T) {
+	monthly := &PricePlan{Currency: "USD", Interval: IntervalMonth}
+	yearly := &PricePlan{Currency: "USD", Interval: IntervalYear}
+	usd := money.Money{MinorUnits: 1000000, Currency: "USD"}
+
+	tests := []struct {
+		name    string
+		c       Commitment
+		pp      *PricePlan
+		wantErr bool
+	}{
+		{name: "monthly", c: Commitment{Amount: usd, Interval: IntervalMonth}, pp: monthly},
+		{name: "annual on monthly billing", c: Commitment{Amount: usd, Interval: IntervalYear}, pp: monthly},
+		{name: "monthly on annual billing", c: Commitment{Amount: usd, Interval: IntervalMonth}, pp: yearly, wantErr: true},
+		{name: "other currency", c: Commitment{Amount: money.Money{MinorUnits: 100, Currency: "EUR"}, Interval: IntervalMonth}, pp: monthly, wantErr: true},
+		{name: "negative amount", c: Commitment{Amount: money.Money{MinorUnits: -100, Currency: "USD"}, Interval: IntervalMonth}, pp: monthly, wantErr: true},
+		{name: "unknown interval", c: Commitment{Amount: usd, Interval: "week"}, pp: monthly, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.validate(tt.pp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidCommitment) {
+				t.Errorf("expected ErrInvalidCommitment, got %v", err)
+			}
+		})
+	}
+}
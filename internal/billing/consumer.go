@@ -0,0 +1,139 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/nats"
+)
+
+// SubjectAggregateUpdated is the usage-svc event that keeps draft invoices
+// current.
+const SubjectAggregateUpdated = "aggregate.updated"
+
+// ConsumerQueue is the queue group billing-svc replicas share, so each event
+// is handled by one of them.
+const ConsumerQueue = "billing-svc"
+
+// aggregateUpdated is the payload of aggregate.updated, as published by
+// usage-svc.
+type aggregateUpdated struct {
+	OrgID  string    `json:"org_id"`
+	Metric string    `json:"metric"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+}
+
+// billingPeriod is one invoice period, [start, end) in UTC.
+type billingPeriod struct {
+	start time.Time
+	end   time.Time
+	// current is set by draftPeriods for the period containing now, whose
+	// draft is created on demand.
+	current bool
+}
+
+// HandleAggregateUpdated refreshes the draft invoices of the org whose usage
+// changed. Drafts are recomputed from scratch rather than adjusted by the
+// event, so a redelivered or reordered event leaves them unchanged. The
+// current period's draft is created if missing; earlier periods are refreshed
+// only while their invoice is still a draft. Any other failure is returned, so
+// the bus redelivers the event; malformed events are dropped.
+func (s *Service) HandleAggregateUpdated(ctx context.Context, env nats.Envelope) error {
+	var ev aggregateUpdated
+	if err := env.Decode(&ev); err != nil {
+		return fmt.Errorf("%w: decode %s event: %v", nats.ErrDropEvent, env.Subject, err)
+	}
+	if ev.OrgID == "" || ev.Metric == "" {
+		return fmt.Errorf("%w: %s event %s: org_id and metric are required", nats.ErrDropEvent, env.Subject, env.ID)
+	}
+
+	periodAt, err := s.billingPeriods(ctx, ev.OrgID)
+	if err != nil {
+		return err
+	}
+	periods := draftPeriods(ev.From, ev.To, time.Now(), periodAt)
+	if len(periods) == 0 {
+		return nil
+	}
+
+	// Usage the org is not billed for cannot change its invoices.
+	plans, _, components, err := s.invoicePlans(ctx, ev.OrgID, periods[0].start, periods[len(periods)-1].end)
+	if err != nil {
+		return err
+	}
+	if !billsMetric(plans, ev.Metric) && !componentsBillMetric(components, ev.Metric) {
+		return nil
+	}
+
+	return refreshDrafts(ctx, ev.OrgID, periods, func(ctx context.Context, p billingPeriod) error {
+		_, err := s.RefreshDraftInvoice(ctx, ev.OrgID, p.start, p.end, p.current)
+		return err
+	})
+}
+
+// refreshDrafts calls refresh for every period. Periods whose invoice is
+// already finalized, or that overlap another invoice, are skipped: no
+// redelivery can change them. A failed period does not stop the others, and
+// the failures are returned together.
+func refreshDrafts(ctx context.Context, orgID string, periods []billingPeriod, refresh func(context.Context, billingPeriod) error) error {
+	var errs []error
+	for _, p := range periods {
+		err := refresh(ctx, p)
+		if err != nil && !errors.Is(err, ErrInvoiceLocked) && !errors.Is(err, ErrPeriodOverlaps) {
+			errs = append(errs, fmt.Errorf("refresh draft invoice of %s for %s: %w", orgID, p.start.Format("2006-01-02"), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// billingPeriods returns the function giving orgID's billing period at a
+// time: the periods of its subscription, or calendar months without one.
+func (s *Service) billingPeriods(ctx context.Context, orgID string) (func(time.Time) billingPeriod, error) {
+	sub, err := s.store.GetSubscription(ctx, orgID)
+	switch err {
+	case nil:
+		return sub.PeriodAt, nil
+	case ErrSubscriptionNotFound:
+		return calendarMonth, nil
+	default:
+		return nil, err
+	}
+}
+
+func billsMetric(plans []Plan, metric string) bool {
+	for _, p := range plans {
+		if p.Metric == metric {
+			return true
+		}
+	}
+	return false
+}
+
+func componentsBillMetric(components map[string][]Plan, metric string) bool {
+	for _, plans := range components {
+		if billsMetric(plans, metric) {
+			return true
+		}
+	}
+	return false
+}
+
+// draftPeriods returns the billing periods, as given by periodAt, overlapping
+// [from, to] up to and including the period containing now. Later periods
+// cannot have been invoiced yet.
+func draftPeriods(from, to, now time.Time, periodAt func(time.Time) billingPeriod) []billingPeriod {
+	if to.Before(from) {
+		from, to = to, from
+	}
+	current := periodAt(now)
+
+	var periods []billingPeriod
+	for p := periodAt(from); !p.start.After(to) && !p.start.After(current.start); p = periodAt(p.end) {
+		p.current = p.start.Equal(current.start)
+		periods = append(periods, p)
+	}
+	return periods
+}
@@ -0,0 +1,115 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+	"github.com/jackthomas00/polaris/pkg/nats"
+)
+
+func TestDraftPeriods(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	}
+	now := day(2026, time.March, 15)
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		expected []string // period starts, with "*" marking the current month
+	}{
+		{name: "current month", from: day(2026, time.March, 2), to: day(2026, time.March, 14), expected: []string{"2026-03*"}},
+		{name: "spans months", from: day(2026, time.January, 31), to: day(2026, time.March, 1), expected: []string{"2026-01", "2026-02", "2026-03*"}},
+		{name: "past month only", from: day(2025, time.December, 5), to: day(2025, time.December, 6), expected: []string{"2025-12"}},
+		{name: "future months dropped", from: day(2026, time.March, 30), to: day(2026, time.May, 1), expected: []string{"2026-03*"}},
+		{name: "entirely future", from: day(2026, time.April, 1), to: day(2026, time.April, 2), expected: nil},
+		{name: "reversed range", from: day(2026, time.March, 1), to: day(2026, time.February, 1), expected: []string{"2026-02", "2026-03*"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, p := range draftPeriods(tt.from, tt.to, now, calendarMonth) {
+			if !p.end.Equal(p.start.AddDate(0, 1, 0)) {
+				t.Errorf("%s: period %v does not span one month", tt.name, p)
+			}
+			label := p.start.Format("2006-01")
+			if p.current {
+				label += "*"
+			}
+			got = append(got, label)
+		}
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func TestHandleAggregateUpdated_RejectsInvalidEvents(t *testing.T) {
+	svc := NewService(nil, nil, nil, nil, money.DefaultRoundingMode, InvoiceNumbering{})
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "malformed", data: `{"org_id":`},
+		{name: "missing org", data: `{"metric":"api_calls"}`},
+		{name: "missing metric", data: `{"org_id":"org-1"}`},
+	}
+
+	for _, tt := range tests {
+		env := nats.Envelope{ID: "evt-1", Subject: SubjectAggregateUpdated, Data: []byte(tt.data)}
+		if err := svc.HandleAggregateUpdated(context.Background(), env); !errors.Is(err, nats.ErrDropEvent) {
+			t.Errorf("%s: expected the event to be dropped, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestRefreshDrafts(t *testing.T) {
+	month := func(m time.Month) billingPeriod { return calendarMonth(time.Date(2026, m, 1, 0, 0, 0, 0, time.UTC)) }
+	periods := []billingPeriod{month(time.January), month(time.February), month(time.March)}
+	errUsage := errors.New("usage-svc unavailable")
+
+	tests := []struct {
+		name    string
+		results map[time.Month]error
+		wantErr error
+	}{
+		{name: "all refreshed"},
+		{name: "finalized period is skipped", results: map[time.Month]error{time.January: ErrInvoiceLocked}},
+		{name: "overlapped period is skipped", results: map[time.Month]error{time.March: ErrPeriodOverlaps}},
+		{name: "failure surfaces", results: map[time.Month]error{time.January: ErrInvoiceLocked, time.February: errUsage}, wantErr: errUsage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var refreshed []time.Month
+			err := refreshDrafts(context.Background(), "org-1", periods, func(ctx context.Context, p billingPeriod) error {
+				refreshed = append(refreshed, p.start.Month())
+				return tt.results[p.start.Month()]
+			})
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if errors.Is(err, ErrInvoiceLocked) || errors.Is(err, ErrPeriodOverlaps) {
+				t.Errorf("expected the locked or overlapped period to be skipped, got %v", err)
+			}
+			// A failed period does not stop the later ones.
+			if len(refreshed) != len(periods) {
+				t.Errorf("expected every period refreshed, got %v", refreshed)
+			}
+		})
+	}
+}
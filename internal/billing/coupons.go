@@ -0,0 +1,428 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// CouponDuration is how many billing periods a redeemed coupon discounts.
+type CouponDuration string
+
+const (
+	// CouponOnce discounts the billing period the coupon is redeemed in.
+	CouponOnce CouponDuration = "once"
+	// CouponRepeating discounts DurationPeriods periods, starting with the
+	// one the coupon is redeemed in.
+	CouponRepeating CouponDuration = "repeating"
+	// CouponForever discounts every period from redemption on.
+	CouponForever CouponDuration = "forever"
+)
+
+var (
+	ErrCouponNotFound = errors.New("coupon not found")
+	ErrInvalidCoupon  = errors.New("invalid coupon")
+	ErrCouponExists   = errors.New("coupon already exists")
+	// ErrCouponUnavailable is returned when redeeming a coupon past its
+	// redeem-by date or redemption limit.
+	ErrCouponUnavailable = errors.New("coupon can no longer be redeemed")
+	// ErrCouponRedeemed is returned when an org redeems a coupon twice.
+	ErrCouponRedeemed = errors.New("coupon already redeemed")
+)
+
+// couponCodePattern restricts coupon IDs, which are the codes orgs redeem.
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_-]{0,63}$`)
+
+// Coupon is a discount definition orgs redeem by its code.
+type Coupon struct {
+	// ID is the code orgs redeem, e.g. "SPRING20".
+	ID   string
+	Name string
+	// PercentOff, e.g. 20 for 20% off, is set for percentage coupons and
+	// AmountOff for fixed amount coupons.
+	PercentOff *big.Rat
+	AmountOff  *money.Money
+	Duration   CouponDuration
+	// DurationPeriods is the number of periods a repeating coupon discounts.
+	DurationPeriods int
+	// Metrics restricts the discount to the usage charges of these metrics;
+	// empty discounts all charges.
+	Metrics []string
+	// MaxRedemptions caps redemptions across orgs; 0 means no limit.
+	MaxRedemptions int
+	// RedeemBy is the last moment the coupon can be redeemed; nil for none.
+	RedeemBy      *time.Time
+	TimesRedeemed int
+	CreatedAt     time.Time
+}
+
+// validate checks c before it is created, naming it after its code when it
+// has no name.
+func (c *Coupon) validate() error {
+	if !couponCodePattern.MatchString(c.ID) {
+		return fmt.Errorf("%w: code %q must be 1-64 upper-case letters, digits, '-' or '_'", ErrInvalidCoupon, c.ID)
+	}
+	if c.Name == "" {
+		c.Name = c.ID
+	}
+	switch {
+	case (c.PercentOff == nil) == (c.AmountOff == nil):
+		return fmt.Errorf("%w: exactly one of percent off and amount off is required", ErrInvalidCoupon)
+	case c.PercentOff != nil:
+		if c.PercentOff.Sign() <= 0 || c.PercentOff.Cmp(big.NewRat(100, 1)) > 0 {
+			return fmt.Errorf("%w: percent off must be above 0 and at most 100", ErrInvalidCoupon)
+		}
+		if !new(big.Rat).Mul(c.PercentOff, big.NewRat(10000, 1)).IsInt() {
+			return fmt.Errorf("%w: percent off has more than 4 decimal places", ErrInvalidCoupon)
+		}
+	default:
+		if c.AmountOff.MinorUnits <= 0 {
+			return fmt.Errorf("%w: amount off must be positive", ErrInvalidCoupon)
+		}
+		if _, err := money.Exponent(c.AmountOff.Currency); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidCoupon, err)
+		}
+	}
+	switch c.Duration {
+	case CouponOnce, CouponForever:
+		if c.DurationPeriods != 0 {
+			return fmt.Errorf("%w: only repeating coupons have a number of periods", ErrInvalidCoupon)
+		}
+	case CouponRepeating:
+		if c.DurationPeriods <= 0 {
+			return fmt.Errorf("%w: repeating coupons need a positive number of periods", ErrInvalidCoupon)
+		}
+	default:
+		return fmt.Errorf("%w: unknown duration %q", ErrInvalidCoupon, c.Duration)
+	}
+	if c.MaxRedemptions < 0 {
+		return fmt.Errorf("%w: max redemptions must not be negative", ErrInvalidCoupon)
+	}
+	return nil
+}
+
+// label describes the discount, e.g. "20% off" or "500.00 USD off".
+func (c *Coupon) label() string {
+	if c.PercentOff != nil {
+		return money.FormatRat(c.PercentOff) + "% off"
+	}
+	return c.AmountOff.String() + " off"
+}
+
+// discounts reports whether the coupon discounts a charge of metric, which is
+// empty for recurring charges.
+func (c *Coupon) discounts(metric string) bool {
+	if len(c.Metrics) == 0 {
+		return true
+	}
+	for _, m := range c.Metrics {
+		if m == metric && metric != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// CouponRedemption is a coupon redeemed by an org.
+type CouponRedemption struct {
+	ID         string
+	OrgID      string
+	Coupon     Coupon
+	Actor      string
+	RedeemedAt time.Time
+}
+
+// window returns the range of billing periods, as given by periodAt, that the
+// redemption discounts. end is the zero time for coupons that last forever.
+func (r *CouponRedemption) window(periodAt func(time.Time) billingPeriod) (start, end time.Time) {
+	first := periodAt(r.RedeemedAt)
+	periods := 1
+	switch r.Coupon.Duration {
+	case CouponForever:
+		return first.start, time.Time{}
+	case CouponRepeating:
+		periods = r.Coupon.DurationPeriods
+	}
+	end = first.end
+	for i := 1; i < periods; i++ {
+		end = periodAt(end).end
+	}
+	return first.start, end
+}
+
+// appliesTo reports whether the redemption discounts the invoice for
+// [start, end).
+func (r *CouponRedemption) appliesTo(start, end time.Time, periodAt func(time.Time) billingPeriod) bool {
+	from, until := r.window(periodAt)
+	return end.After(from) && (until.IsZero() || start.Before(until))
+}
+
+// discountLineItems returns the discount lines of redemptions in order,
+// taking each coupon off the charges among items it covers. Percentages are
+// rounded with rounding; fixed amounts only apply to invoices in their
+// currency, and what exceeds the charges is forfeited. Together the discounts
+// never exceed the charges. A discount covering charges of several tax codes
+// is split between them in proportion, one line per code, so each code is
+// taxed on its net.
+func discountLineItems(items []LineItem, currency string, redemptions []CouponRedemption, rounding money.RoundingMode) ([]LineItem, error) {
+	var charges int64
+	for _, item := range items {
+		if item.Amount.MinorUnits > 0 {
+			charges += item.Amount.MinorUnits
+		}
+	}
+
+	var discounts []LineItem
+	for _, r := range redemptions {
+		c := &r.Coupon
+		var base int64
+		var codes []string
+		bases := make(map[string]int64)
+		for _, item := range items {
+			if item.Amount.MinorUnits > 0 && (item.Kind == LineItemUsage || item.Kind == LineItemRecurring) && c.discounts(item.Metric) {
+				base += item.Amount.MinorUnits
+				if _, ok := bases[item.TaxCode]; !ok {
+					codes = append(codes, item.TaxCode)
+				}
+				bases[item.TaxCode] += item.Amount.MinorUnits
+			}
+		}
+
+		var off int64
+		if c.PercentOff != nil {
+			r := new(big.Rat).Mul(money.Money{MinorUnits: base, Currency: currency}.Rat(), c.PercentOff)
+			m, err := money.FromRat(r.Quo(r, big.NewRat(100, 1)), currency, rounding)
+			if err != nil {
+				return nil, fmt.Errorf("coupon %s: %w", c.ID, err)
+			}
+			off = m.MinorUnits
+		} else if c.AmountOff.Currency == currency {
+			off = c.AmountOff.MinorUnits
+		}
+		if off > base {
+			off = base
+		}
+		if off > charges {
+			off = charges
+		}
+		if off <= 0 {
+			continue
+		}
+		charges -= off
+
+		// Each code but the last gets its share rounded down; the last
+		// takes the rest, so the lines add up to off.
+		left := off
+		for i, code := range codes {
+			share := left
+			if i < len(codes)-1 {
+				n := new(big.Int).Mul(big.NewInt(off), big.NewInt(bases[code]))
+				share = n.Quo(n, big.NewInt(base)).Int64()
+			}
+			left -= share
+			if share == 0 {
+				continue
+			}
+
+			description := fmt.Sprintf("%s (%s)", c.Name, c.label())
+			if len(codes) > 1 {
+				name := code
+				if name == "" {
+					name = "general"
+				}
+				description = fmt.Sprintf("%s (%s, %s charges)", c.Name, c.label(), name)
+			}
+			amount := money.Money{MinorUnits: -share, Currency: currency}
+			discounts = append(discounts, LineItem{
+				Kind:               LineItemDiscount,
+				Description:        description,
+				Quantity:           1,
+				ChargeableQuantity: 1,
+				PricingModel:       PricingPerUnit,
+				UnitPrice:          amount.Rat(),
+				Amount:             amount,
+				CouponID:           c.ID,
+				TaxCode:            code,
+			})
+		}
+	}
+	return discounts, nil
+}
+
+const couponColumns = `c.id, c.name, c.percent_off, c.amount_off_minor, c.currency, c.duration,
+	COALESCE(c.duration_periods, 0), c.metrics, COALESCE(c.max_redemptions, 0), c.redeem_by, c.created_at,
+	(SELECT COUNT(*) FROM coupon_redemptions cr WHERE cr.coupon_id = c.id)`
+
+func scanCoupon(row interface{ Scan(...interface{}) error }, dest ...interface{}) (*Coupon, error) {
+	var c Coupon
+	var percentOff, currency sql.NullString
+	var amountOff sql.NullInt64
+	var redeemBy sql.NullTime
+	err := row.Scan(append([]interface{}{&c.ID, &c.Name, &percentOff, &amountOff, &currency, &c.Duration,
+		&c.DurationPeriods, pq.Array(&c.Metrics), &c.MaxRedemptions, &redeemBy, &c.CreatedAt, &c.TimesRedeemed}, dest...)...)
+	if err == sql.ErrNoRows {
+		return nil, ErrCouponNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if percentOff.Valid {
+		if c.PercentOff, err = money.ParseRat(percentOff.String); err != nil {
+			return nil, fmt.Errorf("coupon %s: %w", c.ID, err)
+		}
+	}
+	if amountOff.Valid {
+		c.AmountOff = &money.Money{MinorUnits: amountOff.Int64, Currency: currency.String}
+	}
+	if redeemBy.Valid {
+		t := redeemBy.Time.UTC()
+		c.RedeemBy = &t
+	}
+	c.CreatedAt = c.CreatedAt.UTC()
+	return &c, nil
+}
+
+// CreateCoupon validates and stores c. Coupons cannot be changed afterwards.
+func (s *Store) CreateCoupon(ctx context.Context, c *Coupon) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	var percentOff, currency sql.NullString
+	var amountOff, durationPeriods, maxRedemptions sql.NullInt64
+	var redeemBy sql.NullTime
+	if c.PercentOff != nil {
+		percentOff = sql.NullString{String: money.FormatRat(c.PercentOff), Valid: true}
+	}
+	if c.AmountOff != nil {
+		amountOff = sql.NullInt64{Int64: c.AmountOff.MinorUnits, Valid: true}
+		currency = sql.NullString{String: c.AmountOff.Currency, Valid: true}
+	}
+	if c.DurationPeriods > 0 {
+		durationPeriods = sql.NullInt64{Int64: int64(c.DurationPeriods), Valid: true}
+	}
+	if c.MaxRedemptions > 0 {
+		maxRedemptions = sql.NullInt64{Int64: int64(c.MaxRedemptions), Valid: true}
+	}
+	if c.RedeemBy != nil {
+		redeemBy = sql.NullTime{Time: *c.RedeemBy, Valid: true}
+	}
+	if c.Metrics == nil {
+		c.Metrics = []string{}
+	}
+
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO coupons (id, name, percent_off, amount_off_minor, currency, duration, duration_periods,
+			metrics, max_redemptions, redeem_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING created_at
+	`, c.ID, c.Name, percentOff, amountOff, currency, c.Duration, durationPeriods,
+		pq.Array(c.Metrics), maxRedemptions, redeemBy).Scan(&c.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return fmt.Errorf("%w: %s", ErrCouponExists, c.ID)
+	}
+	if err != nil {
+		return err
+	}
+	c.CreatedAt = c.CreatedAt.UTC()
+	return nil
+}
+
+func (s *Store) GetCoupon(ctx context.Context, id string) (*Coupon, error) {
+	return scanCoupon(s.db.QueryRowContext(ctx, `
+		SELECT `+couponColumns+`
+		FROM coupons c
+		WHERE c.id = $1
+	`, id))
+}
+
+// RedeemCoupon redeems coupon couponID for orgID at at. It fails with
+// ErrCouponUnavailable past the coupon's redeem-by date or once it has been
+// redeemed MaxRedemptions times, and with ErrCouponRedeemed if the org has
+// redeemed it before.
+func (s *Store) RedeemCoupon(ctx context.Context, orgID, couponID, actor string, at time.Time) (*CouponRedemption, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the coupon serializes its redemptions, so the limit holds.
+	c, err := scanCoupon(tx.QueryRowContext(ctx, `
+		SELECT `+couponColumns+`
+		FROM coupons c
+		WHERE c.id = $1
+		FOR UPDATE
+	`, couponID))
+	if err != nil {
+		return nil, err
+	}
+	if c.RedeemBy != nil && at.After(*c.RedeemBy) {
+		return nil, fmt.Errorf("%w: %s expired at %s", ErrCouponUnavailable, c.ID, c.RedeemBy.Format(time.RFC3339))
+	}
+	if c.MaxRedemptions > 0 && c.TimesRedeemed >= c.MaxRedemptions {
+		return nil, fmt.Errorf("%w: %s has been redeemed %d times", ErrCouponUnavailable, c.ID, c.TimesRedeemed)
+	}
+
+	r := &CouponRedemption{
+		ID:         fmt.Sprintf("redemption-%s", uuid.New().String()),
+		OrgID:      orgID,
+		Actor:      actor,
+		RedeemedAt: at.UTC(),
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO coupon_redemptions (id, coupon_id, org_id, actor, redeemed_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, r.ID, c.ID, orgID, actor, r.RedeemedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return nil, fmt.Errorf("%w: %s", ErrCouponRedeemed, c.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	c.TimesRedeemed++
+	r.Coupon = *c
+	return r, nil
+}
+
+// RedemptionsByOrg returns the coupons orgID has redeemed, oldest first.
+func (s *Store) RedemptionsByOrg(ctx context.Context, orgID string) ([]CouponRedemption, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+couponColumns+`, r.id, r.org_id, r.actor, r.redeemed_at
+		FROM coupon_redemptions r
+		JOIN coupons c ON c.id = r.coupon_id
+		WHERE r.org_id = $1
+		ORDER BY r.redeemed_at, r.id
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var redemptions []CouponRedemption
+	for rows.Next() {
+		var r CouponRedemption
+		c, err := scanCoupon(rows, &r.ID, &r.OrgID, &r.Actor, &r.RedeemedAt)
+		if err != nil {
+			return nil, err
+		}
+		r.Coupon = *c
+		r.RedeemedAt = r.RedeemedAt.UTC()
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, rows.Err()
+}
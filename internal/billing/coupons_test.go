@@ -0,0 +1,190 @@
+package billing
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+func TestDiscountLineItems(t *testing.T) {
+	usd := func(minor int64) money.Money { return money.Money{MinorUnits: minor, Currency: "USD"} }
+	percent := func(id string, pct int64, metrics ...string) CouponRedemption {
+		return CouponRedemption{Coupon: Coupon{ID: id, Name: id, PercentOff: big.NewRat(pct, 1), Metrics: metrics}}
+	}
+	fixed := func(id string, off money.Money) CouponRedemption {
+		return CouponRedemption{Coupon: Coupon{ID: id, Name: id, AmountOff: &off}}
+	}
+	items := []LineItem{
+		{Kind: LineItemRecurring, Amount: usd(10000)},
+		{Kind: LineItemUsage, Metric: "api_calls", Amount: usd(3333)},
+		{Kind: LineItemUsage, Metric: "storage_gb", Amount: usd(2000)},
+	}
+
+	tests := []struct {
+		name        string
+		items       []LineItem
+		redemptions []CouponRedemption
+		expected    []LineItem
+	}{
+		{
+			name:     "no redemptions",
+			items:    items,
+			expected: nil,
+		},
+		{
+			name:        "percent off all charges",
+			items:       items,
+			redemptions: []CouponRedemption{percent("TWENTY", 20)},
+			expected: []LineItem{
+				{Kind: LineItemDiscount, Description: "TWENTY (20% off)", Amount: usd(-3067), CouponID: "TWENTY"},
+			},
+		},
+		{
+			name:        "percent off one metric",
+			items:       items,
+			redemptions: []CouponRedemption{percent("HALFAPI", 50, "api_calls")},
+			expected: []LineItem{
+				{Kind: LineItemDiscount, Description: "HALFAPI (50% off)", Amount: usd(-1667), CouponID: "HALFAPI"},
+			},
+		},
+		{
+			name:        "fixed amount",
+			items:       items,
+			redemptions: []CouponRedemption{fixed("WELCOME", usd(5000))},
+			expected: []LineItem{
+				{Kind: LineItemDiscount, Description: "WELCOME (50.00 USD off)", Amount: usd(-5000), CouponID: "WELCOME"},
+			},
+		},
+		{
+			name:        "fixed amount is capped at the charges",
+			items:       items[1:2],
+			redemptions: []CouponRedemption{fixed("WELCOME", usd(5000))},
+			expected: []LineItem{
+				{Kind: LineItemDiscount, Description: "WELCOME (50.00 USD off)", Amount: usd(-3333), CouponID: "WELCOME"},
+			},
+		},
+		{
+			name:        "fixed amount in another currency is skipped",
+			items:       items,
+			redemptions: []CouponRedemption{fixed("EURO", money.Money{MinorUnits: 5000, Currency: "EUR"})},
+			expected:    nil,
+		},
+		{
+			name:        "discounts together never exceed the charges",
+			items:       items,
+			redemptions: []CouponRedemption{percent("ALL", 100), fixed("WELCOME", usd(5000))},
+			expected: []LineItem{
+				{Kind: LineItemDiscount, Description: "ALL (100% off)", Amount: usd(-15333), CouponID: "ALL"},
+			},
+		},
+		{
+			name: "discount is split between tax codes",
+			items: []LineItem{
+				{Kind: LineItemRecurring, Amount: usd(10000)},
+				{Kind: LineItemUsage, Metric: "ebooks", TaxCode: "ebook", Amount: usd(5000)},
+			},
+			redemptions: []CouponRedemption{fixed("WELCOME", usd(1000))},
+			expected: []LineItem{
+				{Kind: LineItemDiscount, Description: "WELCOME (10.00 USD off, general charges)", Amount: usd(-666), CouponID: "WELCOME"},
+				{Kind: LineItemDiscount, Description: "WELCOME (10.00 USD off, ebook charges)", Amount: usd(-334), CouponID: "WELCOME", TaxCode: "ebook"},
+			},
+		},
+		{
+			name:        "unmatched metric discounts nothing",
+			items:       items,
+			redemptions: []CouponRedemption{percent("GPU", 10, "gpu_hours")},
+			expected:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			discounts, err := discountLineItems(tt.items, "USD", tt.redemptions, money.RoundHalfUp)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(discounts) != len(tt.expected) {
+				t.Fatalf("expected %d discount lines, got %d: %+v", len(tt.expected), len(discounts), discounts)
+			}
+			for i, item := range discounts {
+				want := tt.expected[i]
+				if item.Kind != want.Kind || item.Description != want.Description ||
+					item.Amount != want.Amount || item.CouponID != want.CouponID || item.TaxCode != want.TaxCode {
+					t.Errorf("line %d: expected %+v, got %+v", i, want, item)
+				}
+				if item.UnitPrice == nil || item.UnitPrice.Cmp(item.Amount.Rat()) != 0 {
+					t.Errorf("line %d: unit price %v does not match amount %s", i, item.UnitPrice, item.Amount)
+				}
+			}
+		})
+	}
+}
+
+func TestCouponRedemption_AppliesTo(t *testing.T) {
+	redeemed := time.Date(2026, 3, 14, 9, 0, 0, 0, time.UTC)
+	month := func(m time.Month) (time.Time, time.Time) {
+		return time.Date(2026, m, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, m+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	redemption := func(d CouponDuration, periods int) CouponRedemption {
+		return CouponRedemption{RedeemedAt: redeemed, Coupon: Coupon{Duration: d, DurationPeriods: periods}}
+	}
+
+	tests := []struct {
+		name       string
+		redemption CouponRedemption
+		month      time.Month
+		expected   bool
+	}{
+		{name: "once, period before redemption", redemption: redemption(CouponOnce, 0), month: time.February, expected: false},
+		{name: "once, period of redemption", redemption: redemption(CouponOnce, 0), month: time.March, expected: true},
+		{name: "once, next period", redemption: redemption(CouponOnce, 0), month: time.April, expected: false},
+		{name: "repeating, last period", redemption: redemption(CouponRepeating, 3), month: time.May, expected: true},
+		{name: "repeating, after last period", redemption: redemption(CouponRepeating, 3), month: time.June, expected: false},
+		{name: "forever", redemption: redemption(CouponForever, 0), month: time.December, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := month(tt.month)
+			if got := tt.redemption.appliesTo(start, end, calendarMonth); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCoupon_Validate(t *testing.T) {
+	usd := money.Money{MinorUnits: 500, Currency: "USD"}
+
+	tests := []struct {
+		name    string
+		coupon  Coupon
+		wantErr bool
+	}{
+		{name: "percent once", coupon: Coupon{ID: "SPRING20", PercentOff: big.NewRat(20, 1), Duration: CouponOnce}},
+		{name: "amount repeating", coupon: Coupon{ID: "WELCOME", AmountOff: &usd, Duration: CouponRepeating, DurationPeriods: 3}},
+		{name: "lower-case code", coupon: Coupon{ID: "spring20", PercentOff: big.NewRat(20, 1), Duration: CouponOnce}, wantErr: true},
+		{name: "both discounts", coupon: Coupon{ID: "X", PercentOff: big.NewRat(20, 1), AmountOff: &usd, Duration: CouponOnce}, wantErr: true},
+		{name: "no discount", coupon: Coupon{ID: "X", Duration: CouponOnce}, wantErr: true},
+		{name: "over 100 percent", coupon: Coupon{ID: "X", PercentOff: big.NewRat(101, 1), Duration: CouponOnce}, wantErr: true},
+		{name: "too precise percent", coupon: Coupon{ID: "X", PercentOff: big.NewRat(1, 3), Duration: CouponOnce}, wantErr: true},
+		{name: "repeating without periods", coupon: Coupon{ID: "X", AmountOff: &usd, Duration: CouponRepeating}, wantErr: true},
+		{name: "forever with periods", coupon: Coupon{ID: "X", AmountOff: &usd, Duration: CouponForever, DurationPeriods: 2}, wantErr: true},
+		{name: "unknown duration", coupon: Coupon{ID: "X", AmountOff: &usd, Duration: "weekly"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.coupon.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidCoupon) {
+				t.Errorf("expected ErrInvalidCoupon, got %v", err)
+			}
+		})
+	}
+}
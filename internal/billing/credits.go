@@ -0,0 +1,313 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// ErrInvalidCreditGrant is returned for a grant that is not positive or that
+// expires before it takes effect.
+var ErrInvalidCreditGrant = errors.New("invalid credit grant")
+
+// CreditGrant is an amount of prepaid credit given to an org. Grants are never
+// changed; the credit lines drawn from them on invoices make up their history.
+type CreditGrant struct {
+	ID     string
+	OrgID  string
+	Amount money.Money
+	// Remaining is Amount less what invoices that are not void have drawn.
+	Remaining money.Money
+	// Priority orders grants expiring at the same time: higher is drawn first.
+	Priority    int32
+	EffectiveAt time.Time
+	// ExpiresAt is nil for credits that never expire.
+	ExpiresAt   *time.Time
+	Description string
+	// Actor identifies who granted the credits, e.g. "api_key:key-1".
+	Actor     string
+	CreatedAt time.Time
+	// Drawdowns lists the invoices that drew from the grant, oldest first.
+	Drawdowns []CreditDrawdown
+}
+
+// CreditDrawdown is the part of a grant one invoice drew.
+type CreditDrawdown struct {
+	InvoiceID     string
+	InvoiceStatus string
+	PeriodStart   time.Time
+	PeriodEnd     time.Time
+	// Amount is the credit drawn, as a positive amount.
+	Amount money.Money
+}
+
+// ExpiredAt reports whether the grant can no longer be drawn from at t.
+func (g *CreditGrant) ExpiredAt(t time.Time) bool {
+	return g.ExpiresAt != nil && !t.Before(*g.ExpiresAt)
+}
+
+// creditRemainingSQL is the unused amount of grant g, ignoring what invoice
+// exclude has drawn.
+func creditRemainingSQL(exclude string) string {
+	return `g.amount_minor + COALESCE((
+		SELECT SUM(li.amount_minor)
+		FROM invoice_line_items li
+		JOIN invoices i ON i.id = li.invoice_id
+		WHERE li.credit_grant_id = g.id AND i.status <> 'void' AND li.invoice_id <> ` + exclude + `
+	), 0)`
+}
+
+const creditGrantColumns = `g.id, g.org_id, g.currency, g.amount_minor, g.priority, g.effective_at,
+	g.expires_at, g.description, g.actor, g.created_at`
+
+func scanCreditGrant(row interface{ Scan(...interface{}) error }, dest ...interface{}) (*CreditGrant, error) {
+	var g CreditGrant
+	var expiresAt sql.NullTime
+	err := row.Scan(append([]interface{}{&g.ID, &g.OrgID, &g.Amount.Currency, &g.Amount.MinorUnits, &g.Priority,
+		&g.EffectiveAt, &expiresAt, &g.Description, &g.Actor, &g.CreatedAt}, dest...)...)
+	if err != nil {
+		return nil, err
+	}
+	g.EffectiveAt = g.EffectiveAt.UTC()
+	g.CreatedAt = g.CreatedAt.UTC()
+	if expiresAt.Valid {
+		t := expiresAt.Time.UTC()
+		g.ExpiresAt = &t
+	}
+	return &g, nil
+}
+
+// GrantCredits records g, filling in its ID, Remaining and CreatedAt. A zero
+// EffectiveAt means now.
+func (s *Store) GrantCredits(ctx context.Context, g *CreditGrant) error {
+	if g.Amount.MinorUnits <= 0 {
+		return fmt.Errorf("%w: amount must be positive", ErrInvalidCreditGrant)
+	}
+	if _, err := money.Exponent(g.Amount.Currency); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCreditGrant, err)
+	}
+	if g.EffectiveAt.IsZero() {
+		g.EffectiveAt = time.Now().UTC()
+	}
+	if g.ExpiresAt != nil && !g.ExpiresAt.After(g.EffectiveAt) {
+		return fmt.Errorf("%w: expiry must be after the grant takes effect", ErrInvalidCreditGrant)
+	}
+
+	g.ID = fmt.Sprintf("credit-%s", uuid.New().String())
+	var expiresAt sql.NullTime
+	if g.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: *g.ExpiresAt, Valid: true}
+	}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO credit_grants (id, org_id, currency, amount_minor, priority, effective_at, expires_at, description, actor)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING created_at
+	`, g.ID, g.OrgID, g.Amount.Currency, g.Amount.MinorUnits, g.Priority, g.EffectiveAt, expiresAt,
+		g.Description, g.Actor).Scan(&g.CreatedAt)
+	if err != nil {
+		return err
+	}
+	g.CreatedAt = g.CreatedAt.UTC()
+	g.Remaining = g.Amount
+	return nil
+}
+
+// ListCreditGrants returns every grant of orgID, newest first, with what is
+// left of it and the invoices that drew from it.
+func (s *Store) ListCreditGrants(ctx context.Context, orgID string) ([]CreditGrant, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+creditGrantColumns+`, `+creditRemainingSQL("''")+`
+		FROM credit_grants g
+		WHERE g.org_id = $1
+		ORDER BY g.created_at DESC, g.id
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []CreditGrant
+	for rows.Next() {
+		var remaining int64
+		g, err := scanCreditGrant(rows, &remaining)
+		if err != nil {
+			return nil, err
+		}
+		g.Remaining = money.Money{MinorUnits: remaining, Currency: g.Amount.Currency}
+		grants = append(grants, *g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	ids := make([]string, len(grants))
+	for i := range grants {
+		ids[i] = grants[i].ID
+	}
+	drawdowns, err := s.listCreditDrawdowns(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range grants {
+		grants[i].Drawdowns = drawdowns[grants[i].ID]
+	}
+	return grants, nil
+}
+
+// listCreditDrawdowns returns the credit lines drawn from the given grants,
+// keyed by grant ID. Drawdowns of void invoices are listed too; they no longer
+// count against the grant.
+func (s *Store) listCreditDrawdowns(ctx context.Context, grantIDs []string) (map[string][]CreditDrawdown, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT li.credit_grant_id, i.id, i.status, i.period_start, i.period_end, li.currency, -li.amount_minor
+		FROM invoice_line_items li
+		JOIN invoices i ON i.id = li.invoice_id
+		WHERE li.credit_grant_id = ANY($1)
+		ORDER BY li.credit_grant_id, i.period_start, i.created_at
+	`, pq.Array(grantIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drawdowns := make(map[string][]CreditDrawdown)
+	for rows.Next() {
+		var grantID string
+		var d CreditDrawdown
+		if err := rows.Scan(&grantID, &d.InvoiceID, &d.InvoiceStatus, &d.PeriodStart, &d.PeriodEnd,
+			&d.Amount.Currency, &d.Amount.MinorUnits); err != nil {
+			return nil, err
+		}
+		d.PeriodStart, d.PeriodEnd = d.PeriodStart.UTC(), d.PeriodEnd.UTC()
+		drawdowns[grantID] = append(drawdowns[grantID], d)
+	}
+	return drawdowns, rows.Err()
+}
+
+// CreditBalance returns what orgID can draw at t, one amount per currency.
+// Credits held by draft invoices are not included: they are spent unless the
+// draft is voided.
+func (s *Store) CreditBalance(ctx context.Context, orgID string, t time.Time) ([]money.Money, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT g.currency, SUM(`+creditRemainingSQL("''")+`)
+		FROM credit_grants g
+		WHERE g.org_id = $1 AND g.effective_at <= $2 AND (g.expires_at IS NULL OR g.expires_at > $2)
+		GROUP BY g.currency
+		ORDER BY g.currency
+	`, orgID, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balances []money.Money
+	for rows.Next() {
+		var m money.Money
+		if err := rows.Scan(&m.Currency, &m.MinorUnits); err != nil {
+			return nil, err
+		}
+		balances = append(balances, m)
+	}
+	return balances, rows.Err()
+}
+
+// applyCredits draws the org's credits against the charges of draft inv,
+// appending a credit line per grant drawn and lowering its total, never below
+// zero. Grants in effect before the period ends and not expiring before it
+// ends are drawn soonest expiry first, then by priority; what inv drew before
+// is returned first, so a refresh redraws from scratch. Credits are held by
+// the drafts that draw them, in the order they are refreshed, under a lock
+// per org.
+func applyCredits(ctx context.Context, tx *sql.Tx, inv *Invoice) error {
+	if inv.Total.MinorUnits <= 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "credits:"+inv.OrgID); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+creditGrantColumns+`, `+creditRemainingSQL("$4")+` AS remaining
+		FROM credit_grants g
+		WHERE g.org_id = $1 AND g.currency = $2
+		AND g.effective_at < $3 AND (g.expires_at IS NULL OR g.expires_at >= $3)
+		ORDER BY g.expires_at ASC NULLS LAST, g.priority DESC, g.effective_at, g.id
+	`, inv.OrgID, inv.Total.Currency, inv.PeriodEnd, inv.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var grants []CreditGrant
+	for rows.Next() {
+		var remaining int64
+		g, err := scanCreditGrant(rows, &remaining)
+		if err != nil {
+			return err
+		}
+		g.Remaining = money.Money{MinorUnits: remaining, Currency: g.Amount.Currency}
+		grants = append(grants, *g)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, item := range creditLineItems(inv.Total, inv.PeriodEnd, grants) {
+		if inv.Total, err = inv.Total.Add(item.Amount); err != nil {
+			return err
+		}
+		inv.LineItems = append(inv.LineItems, item)
+	}
+	return nil
+}
+
+// creditLineItems draws grants, in order, against the charges of a period
+// ending at periodEnd until they are covered or the grants are used up, and
+// returns a credit line per grant drawn. A grant expiring before the period
+// ends is not drawn at all: the charges are not split by time, so part of
+// them may have accrued after it expired.
+func creditLineItems(charges money.Money, periodEnd time.Time, grants []CreditGrant) []LineItem {
+	due := charges.MinorUnits
+	var items []LineItem
+	for _, g := range grants {
+		if due <= 0 {
+			break
+		}
+		if g.Remaining.MinorUnits <= 0 || g.Remaining.Currency != charges.Currency {
+			continue
+		}
+		if g.ExpiresAt != nil && g.ExpiresAt.Before(periodEnd) {
+			continue
+		}
+		drawn := g.Remaining.MinorUnits
+		if drawn > due {
+			drawn = due
+		}
+		due -= drawn
+
+		amount := money.Money{MinorUnits: -drawn, Currency: charges.Currency}
+		description := "Prepaid credits"
+		if g.Description != "" {
+			description = fmt.Sprintf("Prepaid credits (%s)", g.Description)
+		}
+		items = append(items, LineItem{
+			Kind:               LineItemCredit,
+			Description:        description,
+			Quantity:           1,
+			ChargeableQuantity: 1,
+			PricingModel:       PricingPerUnit,
+			UnitPrice:          amount.Rat(),
+			Amount:             amount,
+			CreditGrantID:      g.ID,
+		})
+	}
+	return items
+}
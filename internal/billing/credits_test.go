@@ -0,0 +1,132 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+func TestCreditLineItems(t *testing.T) {
+	usd := func(minor int64) money.Money { return money.Money{MinorUnits: minor, Currency: "USD"} }
+	grant := func(id string, remaining money.Money, description string) CreditGrant {
+		return CreditGrant{ID: id, Amount: remaining, Remaining: remaining, Description: description}
+	}
+	periodEnd := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	expiring := func(g CreditGrant, at time.Time) CreditGrant {
+		g.ExpiresAt = &at
+		return g
+	}
+
+	tests := []struct {
+		name     string
+		charges  money.Money
+		grants   []CreditGrant
+		expected []LineItem
+	}{
+		{
+			name:     "no grants",
+			charges:  usd(5000),
+			expected: nil,
+		},
+		{
+			name:    "grant covers part of the charges",
+			charges: usd(5000),
+			grants:  []CreditGrant{grant("g1", usd(2000), "Starter bundle")},
+			expected: []LineItem{
+				{Kind: LineItemCredit, Description: "Prepaid credits (Starter bundle)", Amount: usd(-2000), CreditGrantID: "g1"},
+			},
+		},
+		{
+			name:    "charges cap the draw",
+			charges: usd(5000),
+			grants:  []CreditGrant{grant("g1", usd(8000), "")},
+			expected: []LineItem{
+				{Kind: LineItemCredit, Description: "Prepaid credits", Amount: usd(-5000), CreditGrantID: "g1"},
+			},
+		},
+		{
+			name:    "grants are drawn in order until the charges are covered",
+			charges: usd(5000),
+			grants:  []CreditGrant{grant("g1", usd(3000), ""), grant("g2", usd(3000), ""), grant("g3", usd(3000), "")},
+			expected: []LineItem{
+				{Kind: LineItemCredit, Description: "Prepaid credits", Amount: usd(-3000), CreditGrantID: "g1"},
+				{Kind: LineItemCredit, Description: "Prepaid credits", Amount: usd(-2000), CreditGrantID: "g2"},
+			},
+		},
+		{
+			name:    "used up and other currency grants are skipped",
+			charges: usd(5000),
+			grants: []CreditGrant{
+				grant("g1", usd(0), ""),
+				grant("g2", money.Money{MinorUnits: 3000, Currency: "EUR"}, ""),
+				grant("g3", usd(1000), ""),
+			},
+			expected: []LineItem{
+				{Kind: LineItemCredit, Description: "Prepaid credits", Amount: usd(-1000), CreditGrantID: "g3"},
+			},
+		},
+		{
+			name:    "grant expiring during the period is not drawn",
+			charges: usd(5000),
+			grants: []CreditGrant{
+				expiring(grant("g1", usd(3000), ""), periodEnd.AddDate(0, 0, -10)),
+				expiring(grant("g2", usd(1000), ""), periodEnd),
+				grant("g3", usd(500), ""),
+			},
+			expected: []LineItem{
+				{Kind: LineItemCredit, Description: "Prepaid credits", Amount: usd(-1000), CreditGrantID: "g2"},
+				{Kind: LineItemCredit, Description: "Prepaid credits", Amount: usd(-500), CreditGrantID: "g3"},
+			},
+		},
+		{
+			name:     "nothing is drawn against no charges",
+			charges:  usd(0),
+			grants:   []CreditGrant{grant("g1", usd(3000), "")},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := creditLineItems(tt.charges, periodEnd, tt.grants)
+			if len(items) != len(tt.expected) {
+				t.Fatalf("expected %d credit lines, got %d: %+v", len(tt.expected), len(items), items)
+			}
+			for i, item := range items {
+				want := tt.expected[i]
+				if item.Kind != want.Kind || item.Description != want.Description ||
+					item.Amount != want.Amount || item.CreditGrantID != want.CreditGrantID {
+					t.Errorf("line %d: expected %+v, got %+v", i, want, item)
+				}
+				if item.UnitPrice == nil || item.UnitPrice.Cmp(item.Amount.Rat()) != 0 {
+					t.Errorf("line %d: unit price %v does not match amount %s", i, item.UnitPrice, item.Amount)
+				}
+			}
+		})
+	}
+}
+
+func TestCreditGrant_ExpiredAt(t *testing.T) {
+	expiry := time.Date(2026, 6, 30, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		grant    CreditGrant
+		at       time.Time
+		expected bool
+	}{
+		{name: "never expires", grant: CreditGrant{}, at: expiry.AddDate(10, 0, 0), expected: false},
+		{name: "before expiry", grant: CreditGrant{ExpiresAt: &expiry}, at: expiry.Add(-time.Second), expected: false},
+		{name: "at expiry", grant: CreditGrant{ExpiresAt: &expiry}, at: expiry, expected: true},
+		{name: "after expiry", grant: CreditGrant{ExpiresAt: &expiry}, at: expiry.AddDate(0, 1, 0), expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.grant.ExpiredAt(tt.at); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
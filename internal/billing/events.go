@@ -0,0 +1,36 @@
+package billing
+
+import (
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// Subjects of the events billing-svc publishes.
+const (
+	SubjectInvoiceUpdated = "invoice.updated"
+)
+
+// InvoiceUpdated is published whenever an invoice is created or changed. It is
+// written to the billing outbox in the same transaction as the invoice.
+type InvoiceUpdated struct {
+	ID          string      `json:"id"`
+	OrgID       string      `json:"org_id"`
+	PeriodStart time.Time   `json:"period_start"`
+	PeriodEnd   time.Time   `json:"period_end"`
+	Total       money.Money `json:"total"`
+	Status      string      `json:"status"`
+	Number      string      `json:"number,omitempty"`
+}
+
+func invoiceUpdatedEvent(inv *Invoice) InvoiceUpdated {
+	return InvoiceUpdated{
+		ID:          inv.ID,
+		OrgID:       inv.OrgID,
+		PeriodStart: inv.PeriodStart,
+		PeriodEnd:   inv.PeriodEnd,
+		Total:       inv.Total,
+		Status:      inv.Status,
+		Number:      inv.Number,
+	}
+}
@@ -0,0 +1,155 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// ErrNoExchangeRate is returned when a report needs a rate exchange_rates does
+// not have.
+var ErrNoExchangeRate = errors.New("no exchange rate")
+
+// ExchangeRate values Currency in BaseCurrency from EffectiveAt on: one unit
+// of Currency is worth Rate units of BaseCurrency.
+type ExchangeRate struct {
+	BaseCurrency string
+	Currency     string
+	Rate         *big.Rat
+	EffectiveAt  time.Time
+}
+
+// InvoiceTotals are the totals of some invoices, per currency and converted
+// to a base currency.
+type InvoiceTotals struct {
+	Total money.Money
+	// Currencies are in order of currency code.
+	Currencies []CurrencyTotal
+}
+
+// CurrencyTotal is the total of the invoices in one currency.
+type CurrencyTotal struct {
+	Total money.Money
+	// Converted is Total in the base currency.
+	Converted money.Money
+	Invoices  int
+}
+
+// rateAt returns the rate of currency in effect at t among rates, which are
+// ordered by EffectiveAt; nil when none is.
+func rateAt(rates []ExchangeRate, currency string, t time.Time) *big.Rat {
+	var rate *big.Rat
+	for _, r := range rates {
+		if r.Currency == currency && !r.EffectiveAt.After(t) {
+			rate = r.Rate
+		}
+	}
+	return rate
+}
+
+// convertTotals totals invoices per currency and in base. Each invoice is
+// converted at the rate in effect at the end of its period and rounded with
+// rounding, so a report of past periods does not change as rates are added.
+func convertTotals(invoices []Invoice, base string, rates []ExchangeRate, rounding money.RoundingMode) (*InvoiceTotals, error) {
+	totals := &InvoiceTotals{Total: money.Zero(base)}
+	byCurrency := make(map[string]*CurrencyTotal)
+	for i := range invoices {
+		inv := &invoices[i]
+		currency := inv.Total.Currency
+
+		converted := inv.Total
+		if currency != base {
+			rate := rateAt(rates, currency, inv.PeriodEnd)
+			if rate == nil {
+				return nil, fmt.Errorf("%w from %s to %s at %s (invoice %s)", ErrNoExchangeRate, currency, base, inv.PeriodEnd.Format(time.RFC3339), inv.ID)
+			}
+			var err error
+			converted, err = money.FromRat(new(big.Rat).Mul(inv.Total.Rat(), rate), base, rounding)
+			if err != nil {
+				return nil, fmt.Errorf("invoice %s: %w", inv.ID, err)
+			}
+		}
+
+		ct, ok := byCurrency[currency]
+		if !ok {
+			ct = &CurrencyTotal{Total: money.Zero(currency), Converted: money.Zero(base)}
+			byCurrency[currency] = ct
+		}
+		ct.Invoices++
+		ct.Total.MinorUnits += inv.Total.MinorUnits
+		ct.Converted.MinorUnits += converted.MinorUnits
+		totals.Total.MinorUnits += converted.MinorUnits
+	}
+
+	for _, ct := range byCurrency {
+		totals.Currencies = append(totals.Currencies, *ct)
+	}
+	sort.Slice(totals.Currencies, func(i, j int) bool {
+		return totals.Currencies[i].Total.Currency < totals.Currencies[j].Total.Currency
+	})
+	return totals, nil
+}
+
+// IssuedInvoices returns the finalized, paid and uncollectible invoices, of
+// orgID or of all orgs when it is empty, whose period starts in [start, end).
+// Line items are not loaded.
+func (s *Store) IssuedInvoices(ctx context.Context, orgID string, start, end time.Time) ([]Invoice, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+invoiceColumns+`
+		FROM invoices
+		WHERE status IN ($1, $2, $3)
+			AND period_start >= $4 AND period_start < $5
+			AND ($6 = '' OR org_id = $6)
+		ORDER BY period_start, id
+	`, InvoiceFinalized, InvoicePaid, InvoiceUncollectible, start, end, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []Invoice
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, *inv)
+	}
+	return invoices, rows.Err()
+}
+
+// ExchangeRates returns the rates of currencies in base in effect up to
+// before, ordered by effective time.
+func (s *Store) ExchangeRates(ctx context.Context, base string, currencies []string, before time.Time) ([]ExchangeRate, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT base_currency, currency, rate, effective_at
+		FROM exchange_rates
+		WHERE base_currency = $1 AND currency = ANY($2) AND effective_at <= $3
+		ORDER BY effective_at, currency
+	`, base, pq.Array(currencies), before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []ExchangeRate
+	for rows.Next() {
+		var r ExchangeRate
+		var rate string
+		if err := rows.Scan(&r.BaseCurrency, &r.Currency, &rate, &r.EffectiveAt); err != nil {
+			return nil, err
+		}
+		if r.Rate, err = money.ParseRat(rate); err != nil {
+			return nil, fmt.Errorf("exchange rate %s/%s: %w", r.Currency, r.BaseCurrency, err)
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
@@ -0,0 +1,87 @@
+package billing
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+func TestConvertTotals(t *testing.T) {
+	day := func(m time.Month, d int) time.Time { return time.Date(2026, m, d, 0, 0, 0, 0, time.UTC) }
+	invoice := func(id string, end time.Time, minor int64, currency string) Invoice {
+		return Invoice{ID: id, PeriodEnd: end, Total: money.Money{MinorUnits: minor, Currency: currency}}
+	}
+	rates := []ExchangeRate{
+		{BaseCurrency: "USD", Currency: "EUR", Rate: big.NewRat(108, 100), EffectiveAt: day(1, 1)},
+		{BaseCurrency: "USD", Currency: "JPY", Rate: big.NewRat(67, 10000), EffectiveAt: day(1, 1)},
+		{BaseCurrency: "USD", Currency: "EUR", Rate: big.NewRat(110, 100), EffectiveAt: day(3, 1)},
+	}
+
+	tests := []struct {
+		name     string
+		invoices []Invoice
+		expected *InvoiceTotals
+		wantErr  error
+	}{
+		{
+			name:     "no invoices",
+			expected: &InvoiceTotals{Total: money.Zero("USD")},
+		},
+		{
+			name: "each invoice is converted at the rate in effect at its period end",
+			invoices: []Invoice{
+				invoice("inv-1", day(2, 1), 10000, "EUR"),
+				invoice("inv-2", day(3, 1), 10000, "EUR"),
+				invoice("inv-3", day(3, 1), 2500, "USD"),
+				invoice("inv-4", day(3, 1), 150000, "JPY"),
+			},
+			expected: &InvoiceTotals{
+				Total: money.Money{MinorUnits: 10800 + 11000 + 2500 + 100500, Currency: "USD"},
+				Currencies: []CurrencyTotal{
+					{Total: money.Money{MinorUnits: 20000, Currency: "EUR"}, Converted: money.Money{MinorUnits: 21800, Currency: "USD"}, Invoices: 2},
+					{Total: money.Money{MinorUnits: 150000, Currency: "JPY"}, Converted: money.Money{MinorUnits: 100500, Currency: "USD"}, Invoices: 1},
+					{Total: money.Money{MinorUnits: 2500, Currency: "USD"}, Converted: money.Money{MinorUnits: 2500, Currency: "USD"}, Invoices: 1},
+				},
+			},
+		},
+		{
+			name:     "no rate yet",
+			invoices: []Invoice{invoice("inv-1", time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC), 10000, "EUR")},
+			wantErr:  ErrNoExchangeRate,
+		},
+		{
+			name:     "no rate for the currency",
+			invoices: []Invoice{invoice("inv-1", day(2, 1), 10000, "GBP")},
+			wantErr:  ErrNoExchangeRate,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			totals, err := convertTotals(tt.invoices, "USD", rates, money.RoundHalfUp)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if totals.Total != tt.expected.Total {
+				t.Errorf("expected total %s, got %s", tt.expected.Total, totals.Total)
+			}
+			if len(totals.Currencies) != len(tt.expected.Currencies) {
+				t.Fatalf("expected %d currencies, got %+v", len(tt.expected.Currencies), totals.Currencies)
+			}
+			for i, ct := range totals.Currencies {
+				if ct != tt.expected.Currencies[i] {
+					t.Errorf("currency %d: expected %+v, got %+v", i, tt.expected.Currencies[i], ct)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Invoice statuses.
+const (
+	// InvoiceDraft is kept current from usage; it is the only editable status.
+	InvoiceDraft = "draft"
+	// InvoiceFinalized has been issued: its amounts and line items are locked.
+	InvoiceFinalized = "finalized"
+	InvoicePaid      = "paid"
+	InvoiceVoid      = "void"
+	// InvoiceUncollectible is written off, but may still be paid or voided.
+	InvoiceUncollectible = "uncollectible"
+)
+
+var (
+	ErrInvoiceNotFound   = errors.New("invoice not found")
+	ErrInvalidTransition = errors.New("invalid invoice status transition")
+	// ErrInvoiceLocked is returned when writing the amounts of an invoice
+	// that is no longer a draft.
+	ErrInvoiceLocked = errors.New("invoice is no longer a draft")
+	// ErrIdempotencyKeyReused is returned when an idempotency key is sent
+	// again with a different period.
+	ErrIdempotencyKeyReused = errors.New("idempotency key already used for another invoice")
+	// ErrPeriodOverlaps is returned when creating an invoice whose period
+	// overlaps that of another of the org's invoices that is not void.
+	ErrPeriodOverlaps = errors.New("period overlaps another invoice")
+)
+
+// invoiceTransitions lists the statuses each status may move to. Paid and
+// void invoices are final.
+var invoiceTransitions = map[string][]string{
+	InvoiceDraft:         {InvoiceFinalized, InvoiceVoid},
+	InvoiceFinalized:     {InvoicePaid, InvoiceVoid, InvoiceUncollectible},
+	InvoiceUncollectible: {InvoicePaid, InvoiceVoid},
+}
+
+// canTransition reports whether an invoice may move from status from to to.
+func canTransition(from, to string) bool {
+	for _, s := range invoiceTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusTransition is one recorded change of an invoice's status.
+type StatusTransition struct {
+	From string
+	To   string
+	// Actor identifies who made the change, e.g. "api_key:key-1".
+	Actor  string
+	Reason string
+	At     time.Time
+}
+
+// TransitionInvoice moves invoice id of orgID to status to, recording actor
+// and reason. Finalizing assigns the invoice the next number of its sequence
+// under numbering. It fails with ErrInvalidTransition unless the invoice's
+// current status allows the move, and returns the updated invoice with its
+// line items and status history.
+func (s *Store) TransitionInvoice(ctx context.Context, orgID, id, to, actor, reason string, numbering InvoiceNumbering) (*Invoice, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Take the lock draft refreshes hold, so a refresh in flight either
+	// commits before the invoice leaves draft or sees that it has.
+	var start time.Time
+	err = tx.QueryRowContext(ctx, `SELECT period_start FROM invoices WHERE id = $1 AND org_id = $2`, id, orgID).Scan(&start)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	lockKey := "invoice:" + orgID + ":" + start.UTC().Format(time.RFC3339)
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, lockKey); err != nil {
+		return nil, err
+	}
+
+	inv, err := scanInvoice(tx.QueryRowContext(ctx, `
+		SELECT `+invoiceColumns+`
+		FROM invoices
+		WHERE id = $1
+		FOR UPDATE
+	`, id))
+	if err != nil {
+		return nil, err
+	}
+	from := inv.Status
+	if !canTransition(from, to) {
+		return nil, fmt.Errorf("%w: invoice %s is %s, cannot become %s", ErrInvalidTransition, id, from, to)
+	}
+
+	if to == InvoiceFinalized {
+		if inv.Number, err = nextInvoiceNumber(ctx, tx, numbering, orgID, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE invoices SET status = $2, number = COALESCE(number, NULLIF($3, '')), updated_at = NOW()
+		WHERE id = $1
+	`, id, to, inv.Number)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23514" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTransition, pqErr.Message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO invoice_status_transitions (invoice_id, from_status, to_status, actor, reason)
+		VALUES ($1, $2, $3, $4, $5)
+	`, id, from, to, actor, reason)
+	if err != nil {
+		return nil, err
+	}
+	inv.Status = to
+
+	if err := loadInvoiceDetails(ctx, tx, inv); err != nil {
+		return nil, err
+	}
+
+	if err := s.outbox.Add(ctx, tx, SubjectInvoiceUpdated, invoiceUpdatedEvent(inv)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// nextInvoiceNumber draws the next number from the sequence numbering assigns
+// to an invoice of orgID finalized at at. The sequence row stays locked until
+// tx ends, and rolling back tx returns the number.
+func nextInvoiceNumber(ctx context.Context, tx *sql.Tx, numbering InvoiceNumbering, orgID string, at time.Time) (string, error) {
+	key, format := numbering.sequence(orgID, at)
+	var seq int64
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO invoice_number_sequences (key, last_value)
+		VALUES ($1, 1)
+		ON CONFLICT (key) DO UPDATE SET
+			last_value = invoice_number_sequences.last_value + 1,
+			updated_at = NOW()
+		RETURNING last_value
+	`, key).Scan(&seq)
+	if err != nil {
+		return "", err
+	}
+	return format(seq), nil
+}
+
+// listTransitions returns the status history of the given invoices, oldest
+// first, keyed by invoice ID.
+func listTransitions(ctx context.Context, q queryer, invoiceIDs []string) (map[string][]StatusTransition, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT invoice_id, from_status, to_status, actor, reason, created_at
+		FROM invoice_status_transitions
+		WHERE invoice_id = ANY($1)
+		ORDER BY invoice_id, created_at, id
+	`, pq.Array(invoiceIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := make(map[string][]StatusTransition)
+	for rows.Next() {
+		var invoiceID string
+		var t StatusTransition
+		if err := rows.Scan(&invoiceID, &t.From, &t.To, &t.Actor, &t.Reason, &t.At); err != nil {
+			return nil, err
+		}
+		t.At = t.At.UTC()
+		transitions[invoiceID] = append(transitions[invoiceID], t)
+	}
+	return transitions, rows.Err()
+}
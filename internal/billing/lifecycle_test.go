@@ -0,0 +1,55 @@
+package billing
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+	billingv1 "github.com/jackthomas00/polaris/proto/billingv1"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		expected bool
+	}{
+		{from: InvoiceDraft, to: InvoiceFinalized, expected: true},
+		{from: InvoiceDraft, to: InvoiceVoid, expected: true},
+		{from: InvoiceDraft, to: InvoicePaid, expected: false},
+		{from: InvoiceDraft, to: InvoiceUncollectible, expected: false},
+		{from: InvoiceFinalized, to: InvoicePaid, expected: true},
+		{from: InvoiceFinalized, to: InvoiceVoid, expected: true},
+		{from: InvoiceFinalized, to: InvoiceUncollectible, expected: true},
+		{from: InvoiceFinalized, to: InvoiceDraft, expected: false},
+		{from: InvoiceUncollectible, to: InvoicePaid, expected: true},
+		{from: InvoiceUncollectible, to: InvoiceVoid, expected: true},
+		{from: InvoicePaid, to: InvoiceVoid, expected: false},
+		{from: InvoicePaid, to: InvoiceFinalized, expected: false},
+		{from: InvoiceVoid, to: InvoiceDraft, expected: false},
+		{from: InvoiceVoid, to: InvoicePaid, expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.expected {
+			t.Errorf("%s -> %s: expected %v, got %v", tt.from, tt.to, tt.expected, got)
+		}
+	}
+}
+
+func TestTransitionInvoice_RequiresInvoiceAndActor(t *testing.T) {
+	svc := NewService(nil, nil, nil, nil, money.DefaultRoundingMode, InvoiceNumbering{})
+
+	reqs := []*billingv1.InvoiceTransitionRequest{
+		{OrgId: "org-1", Actor: "api_key:key-1"},
+		{OrgId: "org-1", InvoiceId: "inv-1"},
+	}
+	for _, req := range reqs {
+		_, err := svc.FinalizeInvoice(context.Background(), req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%+v: expected InvalidArgument, got %v", req, err)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// Kinds of line items.
+const (
+	// LineItemUsage charges metered usage under a plan.
+	LineItemUsage = "usage"
+	// LineItemRecurring charges a subscription's base fee.
+	LineItemRecurring = "recurring"
+	// LineItemTrueUp charges the shortfall of a commitment period's usage
+	// against the subscription's minimum commitment.
+	LineItemTrueUp = "true_up"
+	// LineItemCredit draws prepaid credits; its amount is negative.
+	LineItemCredit = "credit"
+	// LineItemDiscount takes a redeemed coupon off the charges; its amount is
+	// negative.
+	LineItemDiscount = "discount"
+	// LineItemTax charges the tax on the net charges of one tax code.
+	LineItemTax = "tax"
+)
+
+// LineItem is one charge on an invoice: the usage of one plan, the base fee
+// of a subscription, a commitment true-up, a coupon discount, tax, or prepaid
+// credits drawn against the charges.
+type LineItem struct {
+	Kind        string
+	Description string
+	// PlanID is the metered plan, or the price plan of a recurring charge.
+	PlanID string
+	// Metric is empty for recurring charges.
+	Metric string
+	// Quantity is the billable usage of Metric in the invoice period.
+	Quantity int64
+	// FreeQuotaApplied is the part of Quantity covered by the plan's free quota.
+	FreeQuotaApplied   int64
+	ChargeableQuantity int64
+	PricingModel       PricingModel
+	// UnitPrice is the price per unit, per package for package pricing, or
+	// of the tier reached for volume pricing. It is nil for graduated pricing,
+	// whose Tiers carry the prices.
+	UnitPrice   *big.Rat
+	PackageSize int64
+	// Tiers details graduated and volume charges.
+	Tiers []TierCharge
+	// Amount is the charge for ChargeableQuantity, rounded to the minor unit.
+	Amount money.Money
+	// PeriodStart and PeriodEnd bound the segment of the invoice period a
+	// subscription charge covers; they are nil for charges of the org's own
+	// plans, which cover the whole invoice period.
+	PeriodStart, PeriodEnd *time.Time
+	// Proration is the fraction of a billing period the segment covers, which
+	// scaled the base fee and free quota; nil when not prorated.
+	Proration *big.Rat
+	// CreditGrantID is the grant a credit line draws from.
+	CreditGrantID string
+	// CouponID is the coupon a discount line applies.
+	CouponID string
+	// TaxCode is the product tax code of a charge or discount, or the code
+	// a tax line taxes.
+	TaxCode string
+	// Tax is what a tax line taxed; nil for other lines.
+	Tax *TaxDetail
+}
+
+// TaxDetail records how a tax line was computed.
+type TaxDetail struct {
+	// Jurisdiction is the country, or "country-region", of the rate.
+	Jurisdiction string
+	// RatePercent is the rate applied, e.g. 19 for 19%.
+	RatePercent *big.Rat
+	// Basis is the net charges of the tax code that were taxed.
+	Basis money.Money
+	// Treatment is TaxExempt or TaxReverseCharge when the org was not
+	// charged the tax; empty otherwise.
+	Treatment string
+}
+
+// setSegment records seg as the range the line item covers.
+func (li *LineItem) setSegment(seg segment) {
+	start, end := seg.start, seg.end
+	li.PeriodStart, li.PeriodEnd = &start, &end
+	li.Proration = seg.proration
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// replaceLineItems sets the line items of invoiceID to items.
+func replaceLineItems(ctx context.Context, tx *sql.Tx, invoiceID string, items []LineItem) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM invoice_line_items WHERE invoice_id = $1`, invoiceID)
+	if err != nil || len(items) == 0 {
+		return err
+	}
+
+	n := len(items)
+	positions := make([]int64, n)
+	kinds := make([]string, n)
+	descriptions := make([]string, n)
+	planIDs := make([]string, n)
+	metrics := make([]string, n)
+	quantities := make([]int64, n)
+	free := make([]int64, n)
+	chargeable := make([]int64, n)
+	models := make([]string, n)
+	unitPrices := make([]sql.NullString, n)
+	packageSizes := make([]sql.NullInt64, n)
+	currencies := make([]string, n)
+	amounts := make([]int64, n)
+	periodStarts := make([]sql.NullTime, n)
+	periodEnds := make([]sql.NullTime, n)
+	prorations := make([]sql.NullString, n)
+	grants := make([]sql.NullString, n)
+	coupons := make([]sql.NullString, n)
+	taxCodes := make([]string, n)
+	jurisdictions := make([]sql.NullString, n)
+	taxRates := make([]sql.NullString, n)
+	taxBases := make([]sql.NullInt64, n)
+	treatments := make([]sql.NullString, n)
+	var tiers tierRows
+	for i, li := range items {
+		positions[i] = int64(i)
+		kinds[i] = li.Kind
+		descriptions[i] = li.Description
+		planIDs[i] = li.PlanID
+		metrics[i] = li.Metric
+		quantities[i] = li.Quantity
+		free[i] = li.FreeQuotaApplied
+		chargeable[i] = li.ChargeableQuantity
+		models[i] = string(li.PricingModel)
+		if li.UnitPrice != nil {
+			unitPrices[i] = sql.NullString{String: money.FormatRat(li.UnitPrice), Valid: true}
+		}
+		if li.PackageSize > 0 {
+			packageSizes[i] = sql.NullInt64{Int64: li.PackageSize, Valid: true}
+		}
+		currencies[i] = li.Amount.Currency
+		amounts[i] = li.Amount.MinorUnits
+		if li.PeriodStart != nil && li.PeriodEnd != nil {
+			periodStarts[i] = sql.NullTime{Time: *li.PeriodStart, Valid: true}
+			periodEnds[i] = sql.NullTime{Time: *li.PeriodEnd, Valid: true}
+		}
+		if li.Proration != nil {
+			prorations[i] = sql.NullString{String: money.FormatRat(li.Proration), Valid: true}
+		}
+		if li.CreditGrantID != "" {
+			grants[i] = sql.NullString{String: li.CreditGrantID, Valid: true}
+		}
+		if li.CouponID != "" {
+			coupons[i] = sql.NullString{String: li.CouponID, Valid: true}
+		}
+		taxCodes[i] = li.TaxCode
+		if t := li.Tax; t != nil {
+			jurisdictions[i] = sql.NullString{String: t.Jurisdiction, Valid: true}
+			taxRates[i] = sql.NullString{String: money.FormatRat(t.RatePercent), Valid: true}
+			taxBases[i] = sql.NullInt64{Int64: t.Basis.MinorUnits, Valid: true}
+			treatments[i] = sql.NullString{String: t.Treatment, Valid: t.Treatment != ""}
+		}
+		for _, tc := range li.Tiers {
+			tiers.add(int64(i), tc)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO invoice_line_items (invoice_id, position, kind, description, plan_id, metric,
+			quantity, free_quota_applied, chargeable_quantity, pricing_model, unit_price, package_size,
+			currency, amount_minor, period_start, period_end, proration, credit_grant_id, coupon_id,
+			tax_code, tax_jurisdiction, tax_rate_percent, tax_basis_minor, tax_treatment)
+		SELECT $1, * FROM unnest($2::int[], $3::text[], $4::text[], $5::text[], $6::text[],
+			$7::bigint[], $8::bigint[], $9::bigint[], $10::text[], $11::numeric[], $12::bigint[],
+			$13::text[], $14::bigint[], $15::timestamptz[], $16::timestamptz[], $17::numeric[], $18::text[], $19::text[],
+			$20::text[], $21::text[], $22::numeric[], $23::bigint[], $24::text[])
+	`, invoiceID, pq.Array(positions), pq.Array(kinds), pq.Array(descriptions), pq.Array(planIDs), pq.Array(metrics),
+		pq.Array(quantities), pq.Array(free), pq.Array(chargeable), pq.Array(models), pq.Array(unitPrices), pq.Array(packageSizes),
+		pq.Array(currencies), pq.Array(amounts), pq.Array(periodStarts), pq.Array(periodEnds), pq.Array(prorations), pq.Array(grants), pq.Array(coupons),
+		pq.Array(taxCodes), pq.Array(jurisdictions), pq.Array(taxRates), pq.Array(taxBases), pq.Array(treatments))
+	if err != nil || len(tiers.lines) == 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO invoice_line_item_tiers (invoice_id, line_position, tier, from_quantity, up_to,
+			quantity, unit_price, flat_fee, currency, amount_minor)
+		SELECT $1, * FROM unnest($2::int[], $3::int[], $4::bigint[], $5::bigint[],
+			$6::bigint[], $7::numeric[], $8::numeric[], $9::text[], $10::bigint[])
+	`, invoiceID, pq.Array(tiers.lines), pq.Array(tiers.tiers), pq.Array(tiers.from), pq.Array(tiers.upTo),
+		pq.Array(tiers.quantities), pq.Array(tiers.unitPrices), pq.Array(tiers.flatFees),
+		pq.Array(tiers.currencies), pq.Array(tiers.amounts))
+	return err
+}
+
+// tierRows collects tier charges column by column for a bulk insert.
+type tierRows struct {
+	lines, tiers, from, quantities, amounts []int64
+	upTo                                    []sql.NullInt64
+	unitPrices, flatFees, currencies        []string
+}
+
+func (r *tierRows) add(line int64, tc TierCharge) {
+	r.lines = append(r.lines, line)
+	r.tiers = append(r.tiers, int64(tc.Tier))
+	r.from = append(r.from, tc.From)
+	var upTo sql.NullInt64
+	if tc.UpTo != nil {
+		upTo = sql.NullInt64{Int64: *tc.UpTo, Valid: true}
+	}
+	r.upTo = append(r.upTo, upTo)
+	r.quantities = append(r.quantities, tc.Quantity)
+	r.unitPrices = append(r.unitPrices, money.FormatRat(tc.UnitPrice))
+	r.flatFees = append(r.flatFees, money.FormatRat(tc.FlatFee))
+	r.currencies = append(r.currencies, tc.Amount.Currency)
+	r.amounts = append(r.amounts, tc.Amount.MinorUnits)
+}
+
+// listLineItems returns the line items of the given invoices in order, keyed
+// by invoice ID.
+func listLineItems(ctx context.Context, q queryer, invoiceIDs []string) (map[string][]LineItem, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT invoice_id, kind, description, plan_id, metric, quantity, free_quota_applied,
+			chargeable_quantity, pricing_model, unit_price, COALESCE(package_size, 0), currency, amount_minor,
+			period_start, period_end, proration, COALESCE(credit_grant_id, ''), COALESCE(coupon_id, ''),
+			tax_code, tax_jurisdiction, tax_rate_percent, tax_basis_minor, COALESCE(tax_treatment, '')
+		FROM invoice_line_items
+		WHERE invoice_id = ANY($1)
+		ORDER BY invoice_id, position
+	`, pq.Array(invoiceIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make(map[string][]LineItem)
+	for rows.Next() {
+		var invoiceID string
+		var unitPrice, proration sql.NullString
+		var periodStart, periodEnd sql.NullTime
+		var jurisdiction, taxRate sql.NullString
+		var taxBasis sql.NullInt64
+		var treatment string
+		var li LineItem
+		if err := rows.Scan(&invoiceID, &li.Kind, &li.Description, &li.PlanID, &li.Metric, &li.Quantity,
+			&li.FreeQuotaApplied, &li.ChargeableQuantity, &li.PricingModel, &unitPrice, &li.PackageSize,
+			&li.Amount.Currency, &li.Amount.MinorUnits, &periodStart, &periodEnd, &proration, &li.CreditGrantID, &li.CouponID,
+			&li.TaxCode, &jurisdiction, &taxRate, &taxBasis, &treatment); err != nil {
+			return nil, err
+		}
+		if unitPrice.Valid {
+			if li.UnitPrice, err = money.ParseRat(unitPrice.String); err != nil {
+				return nil, err
+			}
+		}
+		if periodStart.Valid && periodEnd.Valid {
+			start, end := periodStart.Time.UTC(), periodEnd.Time.UTC()
+			li.PeriodStart, li.PeriodEnd = &start, &end
+		}
+		if proration.Valid {
+			if li.Proration, err = money.ParseRat(proration.String); err != nil {
+				return nil, err
+			}
+		}
+		if taxRate.Valid {
+			li.Tax = &TaxDetail{
+				Jurisdiction: jurisdiction.String,
+				Basis:        money.Money{MinorUnits: taxBasis.Int64, Currency: li.Amount.Currency},
+				Treatment:    treatment,
+			}
+			if li.Tax.RatePercent, err = money.ParseRat(taxRate.String); err != nil {
+				return nil, err
+			}
+		}
+		items[invoiceID] = append(items[invoiceID], li)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	return items, listTierCharges(ctx, q, invoiceIDs, items)
+}
+
+// listTierCharges attaches the tier detail of the given invoices to items.
+func listTierCharges(ctx context.Context, q queryer, invoiceIDs []string, items map[string][]LineItem) error {
+	rows, err := q.QueryContext(ctx, `
+		SELECT invoice_id, line_position, tier, from_quantity, up_to, quantity,
+			unit_price, flat_fee, currency, amount_minor
+		FROM invoice_line_item_tiers
+		WHERE invoice_id = ANY($1)
+		ORDER BY invoice_id, line_position, tier
+	`, pq.Array(invoiceIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var invoiceID, unitPrice, flatFee string
+		var line int
+		var upTo sql.NullInt64
+		var tc TierCharge
+		if err := rows.Scan(&invoiceID, &line, &tc.Tier, &tc.From, &upTo, &tc.Quantity,
+			&unitPrice, &flatFee, &tc.Amount.Currency, &tc.Amount.MinorUnits); err != nil {
+			return err
+		}
+		if upTo.Valid {
+			tc.UpTo = &upTo.Int64
+		}
+		if tc.UnitPrice, err = money.ParseRat(unitPrice); err != nil {
+			return err
+		}
+		if tc.FlatFee, err = money.ParseRat(flatFee); err != nil {
+			return err
+		}
+		lines := items[invoiceID]
+		if line < 0 || line >= len(lines) {
+			return fmt.Errorf("invoice %s: tier detail for missing line %d", invoiceID, line)
+		}
+		lines[line].Tiers = append(lines[line].Tiers, tc)
+	}
+	return rows.Err()
+}
+
+// lineItemsEqual reports whether a and b describe the same charges.
+func lineItemsEqual(a, b []LineItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if x.Kind != y.Kind || x.Description != y.Description || x.PlanID != y.PlanID || x.Metric != y.Metric || x.Quantity != y.Quantity ||
+			x.FreeQuotaApplied != y.FreeQuotaApplied || x.ChargeableQuantity != y.ChargeableQuantity ||
+			x.PricingModel != y.PricingModel || !ratsEqual(x.UnitPrice, y.UnitPrice) ||
+			x.PackageSize != y.PackageSize || x.Amount != y.Amount || !timePtrsEqual(x.PeriodStart, y.PeriodStart) ||
+			!timePtrsEqual(x.PeriodEnd, y.PeriodEnd) || !ratsEqual(x.Proration, y.Proration) ||
+			x.CreditGrantID != y.CreditGrantID || x.CouponID != y.CouponID || x.TaxCode != y.TaxCode ||
+			!lineItemTaxesEqual(x.Tax, y.Tax) || len(x.Tiers) != len(y.Tiers) {
+			return false
+		}
+		for j := range x.Tiers {
+			s, t := x.Tiers[j], y.Tiers[j]
+			if s.Tier != t.Tier || s.From != t.From || !int64PtrsEqual(s.UpTo, t.UpTo) ||
+				s.Quantity != t.Quantity || !ratsEqual(s.UnitPrice, t.UnitPrice) ||
+				!ratsEqual(s.FlatFee, t.FlatFee) || s.Amount != t.Amount {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ratsEqual compares a and b at the precision they are stored with, so a
+// freshly computed proration equals its stored, rounded copy.
+func ratsEqual(a, b *big.Rat) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return money.FormatRat(a) == money.FormatRat(b)
+}
+
+func lineItemTaxesEqual(a, b *TaxDetail) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Jurisdiction == b.Jurisdiction && ratsEqual(a.RatePercent, b.RatePercent) &&
+		a.Basis == b.Basis && a.Treatment == b.Treatment
+}
+
+func timePtrsEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func int64PtrsEqual(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
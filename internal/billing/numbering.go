@@ -0,0 +1,101 @@
+package billing
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultInvoiceNumberFormat numbers invoices like POL-2026-000123.
+const DefaultInvoiceNumberFormat = "POL-{YYYY}-{SEQ:6}"
+
+// maxSequenceWidth keeps padded sequence numbers within an int64.
+const maxSequenceWidth = 18
+
+// InvoiceNumbering assigns gap-free sequential numbers to invoices as they
+// are finalized.
+type InvoiceNumbering struct {
+	// Format lays out the number: {SEQ:n} is the sequence zero-padded to n
+	// digits ({SEQ} unpadded), {YYYY} the year of finalization and {ORG} the
+	// org ID. Each distinct rendering of the other placeholders has its own
+	// sequence, so a format with {YYYY} restarts at 1 every year.
+	Format string
+	// PerOrg gives every org its own sequences instead of sharing them.
+	PerOrg bool
+}
+
+var numberPlaceholder = regexp.MustCompile(`\{([A-Z]+)(?::(\d+))?\}`)
+
+// ParseInvoiceNumbering validates a number format and a sequence scope,
+// "global" or "org". Empty values select DefaultInvoiceNumberFormat and
+// global numbering.
+func ParseInvoiceNumbering(format, scope string) (InvoiceNumbering, error) {
+	if format == "" {
+		format = DefaultInvoiceNumberFormat
+	}
+	n := InvoiceNumbering{Format: format}
+	switch scope {
+	case "", "global":
+	case "org":
+		n.PerOrg = true
+	default:
+		return InvoiceNumbering{}, fmt.Errorf("unknown invoice number scope %q", scope)
+	}
+
+	seqs := 0
+	for _, m := range numberPlaceholder.FindAllStringSubmatch(format, -1) {
+		switch m[1] {
+		case "SEQ":
+			seqs++
+			if m[2] != "" {
+				if w, _ := strconv.Atoi(m[2]); w < 1 || w > maxSequenceWidth {
+					return InvoiceNumbering{}, fmt.Errorf("invoice number format %q: sequence width must be between 1 and %d", format, maxSequenceWidth)
+				}
+			}
+		case "YYYY", "ORG":
+			if m[2] != "" {
+				return InvoiceNumbering{}, fmt.Errorf("invoice number format %q: {%s} takes no width", format, m[1])
+			}
+		default:
+			return InvoiceNumbering{}, fmt.Errorf("invoice number format %q: unknown placeholder {%s}", format, m[1])
+		}
+	}
+	if seqs != 1 {
+		return InvoiceNumbering{}, fmt.Errorf("invoice number format %q must contain {SEQ} exactly once", format)
+	}
+	return n, nil
+}
+
+// sequence returns the key of the sequence an invoice of orgID finalized at
+// at draws from, and a function formatting its number from the sequence
+// value.
+func (n InvoiceNumbering) sequence(orgID string, at time.Time) (string, func(seq int64) string) {
+	year := strconv.Itoa(at.UTC().Year())
+	var width int
+	layout := numberPlaceholder.ReplaceAllStringFunc(n.Format, func(p string) string {
+		m := numberPlaceholder.FindStringSubmatch(p)
+		switch m[1] {
+		case "YYYY":
+			return year
+		case "ORG":
+			return orgID
+		}
+		width, _ = strconv.Atoi(m[2])
+		return "{SEQ}"
+	})
+
+	scope := "global"
+	if n.PerOrg {
+		scope = "org:" + orgID
+	}
+	format := func(seq int64) string {
+		s := strconv.FormatInt(seq, 10)
+		if len(s) < width {
+			s = strings.Repeat("0", width-len(s)) + s
+		}
+		return strings.Replace(layout, "{SEQ}", s, 1)
+	}
+	return scope + "|" + layout, format
+}
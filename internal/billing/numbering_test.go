@@ -0,0 +1,89 @@
+package billing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInvoiceNumbering(t *testing.T) {
+	tests := []struct {
+		format, scope string
+		expected      InvoiceNumbering
+		wantErr       bool
+	}{
+		{expected: InvoiceNumbering{Format: DefaultInvoiceNumberFormat}},
+		{format: "INV-{SEQ}", scope: "org", expected: InvoiceNumbering{Format: "INV-{SEQ}", PerOrg: true}},
+		{format: "{ORG}/{YYYY}/{SEQ:4}", scope: "global", expected: InvoiceNumbering{Format: "{ORG}/{YYYY}/{SEQ:4}"}},
+		{format: "INV-{YYYY}", wantErr: true},
+		{format: "{SEQ}-{SEQ}", wantErr: true},
+		{format: "INV-{SEQ:0}", wantErr: true},
+		{format: "INV-{SEQ:19}", wantErr: true},
+		{format: "INV-{MM}-{SEQ}", wantErr: true},
+		{format: "INV-{YYYY:2}-{SEQ}", wantErr: true},
+		{scope: "tenant", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseInvoiceNumbering(tt.format, tt.scope)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q/%q: expected error, got %+v", tt.format, tt.scope, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q/%q: unexpected error: %v", tt.format, tt.scope, err)
+		} else if got != tt.expected {
+			t.Errorf("%q/%q: expected %+v, got %+v", tt.format, tt.scope, tt.expected, got)
+		}
+	}
+}
+
+func TestInvoiceNumbering_Sequence(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		numbering InvoiceNumbering
+		orgID     string
+		at        time.Time
+		seq       int64
+		key       string
+		number    string
+	}{
+		{
+			name:      "default",
+			numbering: InvoiceNumbering{Format: DefaultInvoiceNumberFormat},
+			orgID:     "org-1", at: at, seq: 123,
+			key: "global|POL-2026-{SEQ}", number: "POL-2026-000123",
+		},
+		{
+			name:      "new year starts a new sequence",
+			numbering: InvoiceNumbering{Format: DefaultInvoiceNumberFormat},
+			orgID:     "org-1", at: at.AddDate(1, 0, 0), seq: 1,
+			key: "global|POL-2027-{SEQ}", number: "POL-2027-000001",
+		},
+		{
+			name:      "per org",
+			numbering: InvoiceNumbering{Format: "{ORG}-{SEQ:3}", PerOrg: true},
+			orgID:     "org-2", at: at, seq: 7,
+			key: "org:org-2|org-2-{SEQ}", number: "org-2-007",
+		},
+		{
+			name:      "unpadded and overflowing the width",
+			numbering: InvoiceNumbering{Format: "INV{SEQ:2}"},
+			orgID:     "org-1", at: at, seq: 1234,
+			key: "global|INV{SEQ}", number: "INV1234",
+		},
+	}
+
+	for _, tt := range tests {
+		key, format := tt.numbering.sequence(tt.orgID, tt.at)
+		if key != tt.key {
+			t.Errorf("%s: expected key %q, got %q", tt.name, tt.key, key)
+		}
+		if got := format(tt.seq); got != tt.number {
+			t.Errorf("%s: expected number %q, got %q", tt.name, tt.number, got)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// PricingModel decides how a plan prices the usage beyond its free quota.
+type PricingModel string
+
+const (
+	// PricingPerUnit charges chargeable quantity * unit price.
+	PricingPerUnit PricingModel = "per_unit"
+	// PricingGraduated prices the units falling into each tier at that tier's
+	// price, plus the flat fee of every tier reached.
+	PricingGraduated PricingModel = "graduated"
+	// PricingVolume prices the whole quantity at the tier it lands in, plus
+	// that tier's flat fee.
+	PricingVolume PricingModel = "volume"
+	// PricingPackage charges the unit price for every started block of
+	// PackageSize units.
+	PricingPackage PricingModel = "package"
+)
+
+// ErrInvalidPricing is returned for a plan whose pricing cannot be evaluated,
+// such as a graduated plan without tiers.
+var ErrInvalidPricing = errors.New("invalid plan pricing")
+
+// Tier is one band of a graduated or volume plan.
+type Tier struct {
+	// UpTo is the inclusive upper bound of the tier; nil for the last tier.
+	UpTo      *int64
+	UnitPrice *big.Rat
+	FlatFee   *big.Rat
+}
+
+// TierCharge is the part of a line item priced by one tier.
+type TierCharge struct {
+	// Tier is the tier's index in the plan.
+	Tier int
+	// From and UpTo are the first and last unit of the tier; UpTo is nil for
+	// the unbounded last tier.
+	From      int64
+	UpTo      *int64
+	Quantity  int64
+	UnitPrice *big.Rat
+	FlatFee   *big.Rat
+	// Amount is Quantity * UnitPrice + FlatFee, rounded to the minor unit.
+	Amount money.Money
+}
+
+// validatePricing checks that plan's model and tiers can be evaluated.
+func validatePricing(plan Plan) error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: plan %s: %s", ErrInvalidPricing, plan.ID, fmt.Sprintf(format, args...))
+	}
+
+	switch plan.PricingModel {
+	case PricingPerUnit, PricingPackage:
+		if plan.UnitPrice == nil || plan.UnitPrice.Sign() < 0 {
+			return invalid("unit price must not be negative")
+		}
+		if plan.PricingModel == PricingPackage && plan.PackageSize <= 0 {
+			return invalid("package size must be positive")
+		}
+	case PricingGraduated, PricingVolume:
+		if len(plan.Tiers) == 0 {
+			return invalid("%s pricing needs tiers", plan.PricingModel)
+		}
+		var prev int64
+		for i, t := range plan.Tiers {
+			last := i == len(plan.Tiers)-1
+			if (t.UpTo == nil) != last {
+				return invalid("only the last tier is unbounded")
+			}
+			if t.UpTo != nil && *t.UpTo <= prev {
+				return invalid("tier %d must end above %d", i, prev)
+			}
+			if t.UnitPrice == nil || t.UnitPrice.Sign() < 0 || t.FlatFee == nil || t.FlatFee.Sign() < 0 {
+				return invalid("tier %d prices must not be negative", i)
+			}
+			if t.UpTo != nil {
+				prev = *t.UpTo
+			}
+		}
+	default:
+		return invalid("unknown pricing model %q", plan.PricingModel)
+	}
+	return nil
+}
+
+// priceQuantity prices chargeable units of plan into item, setting its
+// amount, unit price and tier detail. Every tier charge is rounded on its own
+// and the line amount is their sum. No usage is never charged, not even a
+// tier's flat fee.
+func priceQuantity(item *LineItem, plan Plan, chargeable int64, rounding money.RoundingMode) error {
+	if err := validatePricing(plan); err != nil {
+		return err
+	}
+	item.PricingModel = plan.PricingModel
+	item.Amount = money.Zero(plan.Currency)
+
+	round := func(r *big.Rat) (money.Money, error) {
+		m, err := money.FromRat(r, plan.Currency, rounding)
+		if err != nil {
+			return money.Money{}, fmt.Errorf("plan %s: %w", plan.ID, err)
+		}
+		return m, nil
+	}
+
+	switch plan.PricingModel {
+	case PricingPerUnit:
+		item.UnitPrice = plan.UnitPrice
+		amount, err := round(mulRat(chargeable, plan.UnitPrice))
+		if err != nil {
+			return err
+		}
+		item.Amount = amount
+
+	case PricingPackage:
+		item.UnitPrice = plan.UnitPrice
+		item.PackageSize = plan.PackageSize
+		packages := (chargeable + plan.PackageSize - 1) / plan.PackageSize
+		amount, err := round(mulRat(packages, plan.UnitPrice))
+		if err != nil {
+			return err
+		}
+		item.Amount = amount
+
+	case PricingGraduated:
+		var prev int64
+		for i, t := range plan.Tiers {
+			if chargeable <= prev {
+				break
+			}
+			end := chargeable
+			if t.UpTo != nil && *t.UpTo < end {
+				end = *t.UpTo
+			}
+			tc, err := tierCharge(i, prev, t, end-prev, round)
+			if err != nil {
+				return err
+			}
+			if item.Amount, err = item.Amount.Add(tc.Amount); err != nil {
+				return err
+			}
+			item.Tiers = append(item.Tiers, tc)
+			if t.UpTo != nil {
+				prev = *t.UpTo
+			}
+		}
+
+	case PricingVolume:
+		if chargeable == 0 {
+			return nil
+		}
+		var prev int64
+		for i, t := range plan.Tiers {
+			if t.UpTo != nil && chargeable > *t.UpTo {
+				prev = *t.UpTo
+				continue
+			}
+			tc, err := tierCharge(i, prev, t, chargeable, round)
+			if err != nil {
+				return err
+			}
+			item.UnitPrice = t.UnitPrice
+			item.Amount = tc.Amount
+			item.Tiers = []TierCharge{tc}
+			break
+		}
+	}
+	return nil
+}
+
+// tierCharge prices quantity units at tier t, the index-th tier, which starts
+// above prev.
+func tierCharge(index int, prev int64, t Tier, quantity int64, round func(*big.Rat) (money.Money, error)) (TierCharge, error) {
+	exact := new(big.Rat).Add(mulRat(quantity, t.UnitPrice), t.FlatFee)
+	amount, err := round(exact)
+	if err != nil {
+		return TierCharge{}, err
+	}
+	return TierCharge{
+		Tier:      index,
+		From:      prev + 1,
+		UpTo:      t.UpTo,
+		Quantity:  quantity,
+		UnitPrice: t.UnitPrice,
+		FlatFee:   t.FlatFee,
+		Amount:    amount,
+	}, nil
+}
+
+func mulRat(n int64, r *big.Rat) *big.Rat {
+	return new(big.Rat).Mul(new(big.Rat).SetInt64(n), r)
+}
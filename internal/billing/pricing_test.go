@@ -0,0 +1,152 @@
+package billing
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+func rat(t *testing.T, s string) *big.Rat {
+	t.Helper()
+	r, err := money.ParseRat(s)
+	if err != nil {
+		t.Fatalf("ParseRat(%q): %v", s, err)
+	}
+	return r
+}
+
+func upTo(n int64) *int64 {
+	return &n
+}
+
+// tieredPlan is the graduated/volume example from sales: first 10k at $0.01,
+// next 90k at $0.008, everything above at $0.005.
+func tieredPlan(t *testing.T, model PricingModel) Plan {
+	return Plan{
+		ID:           "plan-tiered",
+		Currency:     "USD",
+		PricingModel: model,
+		Tiers: []Tier{
+			{UpTo: upTo(10000), UnitPrice: rat(t, "0.01"), FlatFee: rat(t, "0")},
+			{UpTo: upTo(100000), UnitPrice: rat(t, "0.008"), FlatFee: rat(t, "0")},
+			{UnitPrice: rat(t, "0.005"), FlatFee: rat(t, "0")},
+		},
+	}
+}
+
+func TestPriceQuantity(t *testing.T) {
+	tests := []struct {
+		name       string
+		plan       Plan
+		chargeable int64
+		amount     int64
+		tiers      []int64 // quantity priced by each reported tier
+	}{
+		{name: "graduated within first tier", plan: tieredPlan(t, PricingGraduated), chargeable: 5000, amount: 5000, tiers: []int64{5000}},
+		{name: "graduated at tier bound", plan: tieredPlan(t, PricingGraduated), chargeable: 10000, amount: 10000, tiers: []int64{10000}},
+		{name: "graduated across tiers", plan: tieredPlan(t, PricingGraduated), chargeable: 150000, amount: 10000 + 72000 + 25000, tiers: []int64{10000, 90000, 50000}},
+		{name: "graduated no usage", plan: tieredPlan(t, PricingGraduated), chargeable: 0, amount: 0},
+		{name: "volume lands in second tier", plan: tieredPlan(t, PricingVolume), chargeable: 50000, amount: 40000, tiers: []int64{50000}},
+		{name: "volume lands in last tier", plan: tieredPlan(t, PricingVolume), chargeable: 150000, amount: 75000, tiers: []int64{150000}},
+		{name: "volume no usage", plan: tieredPlan(t, PricingVolume), chargeable: 0, amount: 0},
+		{name: "package rounds blocks up", plan: Plan{PricingModel: PricingPackage, UnitPrice: rat(t, "5"), PackageSize: 1000}, chargeable: 2001, amount: 1500},
+		{name: "package exact blocks", plan: Plan{PricingModel: PricingPackage, UnitPrice: rat(t, "5"), PackageSize: 1000}, chargeable: 2000, amount: 1000},
+		{name: "package no usage", plan: Plan{PricingModel: PricingPackage, UnitPrice: rat(t, "5"), PackageSize: 1000}, chargeable: 0, amount: 0},
+		{name: "per unit", plan: Plan{PricingModel: PricingPerUnit, UnitPrice: rat(t, "0.01")}, chargeable: 1234, amount: 1234},
+	}
+
+	for _, tt := range tests {
+		tt.plan.Currency = "USD"
+		var item LineItem
+		if err := priceQuantity(&item, tt.plan, tt.chargeable, money.RoundHalfUp); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if item.Amount != (money.Money{MinorUnits: tt.amount, Currency: "USD"}) {
+			t.Errorf("%s: expected amount %d, got %v", tt.name, tt.amount, item.Amount)
+		}
+		if item.PricingModel != tt.plan.PricingModel {
+			t.Errorf("%s: expected model %s, got %s", tt.name, tt.plan.PricingModel, item.PricingModel)
+		}
+		if len(item.Tiers) != len(tt.tiers) {
+			t.Errorf("%s: expected %d tiers, got %+v", tt.name, len(tt.tiers), item.Tiers)
+			continue
+		}
+		sum := money.Zero("USD")
+		for i, tc := range item.Tiers {
+			if tc.Quantity != tt.tiers[i] {
+				t.Errorf("%s: tier %d: expected quantity %d, got %d", tt.name, i, tt.tiers[i], tc.Quantity)
+			}
+			sum, _ = sum.Add(tc.Amount)
+		}
+		if len(item.Tiers) > 0 && sum != item.Amount {
+			t.Errorf("%s: tier amounts %v do not add up to %v", tt.name, sum, item.Amount)
+		}
+	}
+}
+
+func TestPriceQuantity_TierBoundsAndFlatFees(t *testing.T) {
+	plan := Plan{
+		ID:           "plan-fees",
+		Currency:     "USD",
+		PricingModel: PricingGraduated,
+		Tiers: []Tier{
+			{UpTo: upTo(100), UnitPrice: rat(t, "0"), FlatFee: rat(t, "10")},
+			{UnitPrice: rat(t, "0.10"), FlatFee: rat(t, "2.50")},
+		},
+	}
+
+	var item LineItem
+	if err := priceQuantity(&item, plan, 150, money.RoundHalfUp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// $10 flat for the first tier, then 50 * $0.10 + $2.50.
+	if item.Amount.MinorUnits != 1750 {
+		t.Errorf("expected 1750, got %d", item.Amount.MinorUnits)
+	}
+	if len(item.Tiers) != 2 {
+		t.Fatalf("expected 2 tiers, got %d", len(item.Tiers))
+	}
+	if item.Tiers[1].From != 101 || item.Tiers[1].UpTo != nil {
+		t.Errorf("expected second tier to start at 101 and be unbounded, got %+v", item.Tiers[1])
+	}
+	if item.UnitPrice != nil {
+		t.Errorf("expected no line unit price for graduated pricing, got %v", item.UnitPrice)
+	}
+}
+
+func TestValidatePricing(t *testing.T) {
+	zero := big.NewRat(0, 1)
+	tests := []struct {
+		name string
+		plan Plan
+	}{
+		{name: "unknown model", plan: Plan{PricingModel: "surge", UnitPrice: zero}},
+		{name: "package without size", plan: Plan{PricingModel: PricingPackage, UnitPrice: zero}},
+		{name: "negative unit price", plan: Plan{PricingModel: PricingPerUnit, UnitPrice: big.NewRat(-1, 100)}},
+		{name: "graduated without tiers", plan: Plan{PricingModel: PricingGraduated}},
+		{name: "bounded last tier", plan: Plan{PricingModel: PricingVolume, Tiers: []Tier{
+			{UpTo: upTo(10), UnitPrice: zero, FlatFee: zero},
+		}}},
+		{name: "unbounded middle tier", plan: Plan{PricingModel: PricingGraduated, Tiers: []Tier{
+			{UnitPrice: zero, FlatFee: zero},
+			{UnitPrice: zero, FlatFee: zero},
+		}}},
+		{name: "descending bounds", plan: Plan{PricingModel: PricingGraduated, Tiers: []Tier{
+			{UpTo: upTo(100), UnitPrice: zero, FlatFee: zero},
+			{UpTo: upTo(50), UnitPrice: zero, FlatFee: zero},
+			{UnitPrice: zero, FlatFee: zero},
+		}}},
+	}
+
+	for _, tt := range tests {
+		if err := validatePricing(tt.plan); !errors.Is(err, ErrInvalidPricing) {
+			t.Errorf("%s: expected ErrInvalidPricing, got %v", tt.name, err)
+		}
+	}
+
+	if err := validatePricing(tieredPlan(t, PricingGraduated)); err != nil {
+		t.Errorf("valid graduated plan: unexpected error: %v", err)
+	}
+}
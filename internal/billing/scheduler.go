@@ -0,0 +1,297 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/jackthomas00/polaris/pkg/lease"
+)
+
+// SchedulerLease is the lease the replica running the scheduler holds.
+const SchedulerLease = "billing-scheduler"
+
+// schedulerActor is recorded as the actor of the invoices the scheduler
+// finalizes.
+const schedulerActor = "scheduler"
+
+// errLeaseLost stops a pass once another replica has taken the lease over.
+var errLeaseLost = errors.New("scheduler lease lost")
+
+var (
+	schedulerRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polaris_billing_scheduler_runs_total",
+		Help: "Scheduler passes over all orgs, by result.",
+	}, []string{"result"})
+	schedulerClosedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "polaris_billing_scheduler_periods_closed_total",
+		Help: "Billing periods the scheduler closed.",
+	})
+	schedulerFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "polaris_billing_scheduler_failures_total",
+		Help: "Billing periods the scheduler failed to close; they are retried on the next pass.",
+	})
+	schedulerLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "polaris_billing_scheduler_lag_seconds",
+		Help: "How long the oldest billing period past its grace window has waited to be closed; 0 when caught up.",
+	})
+	schedulerLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "polaris_billing_scheduler_leader",
+		Help: "1 while this replica holds the scheduler lease.",
+	})
+)
+
+// Scheduler closes billing periods: once a period of an org has ended and its
+// grace window for late usage has passed, it brings the period's draft
+// invoice up to date and finalizes it. Only the replica holding the scheduler
+// lease runs it, renewing the lease before each org and stopping as soon as
+// it is lost; the steps are idempotent, so an overlap while the lease changes
+// hands cannot bill a period twice.
+type Scheduler struct {
+	svc   *Service
+	lease *lease.Lease
+	// interval is how often the scheduler looks for periods to close.
+	interval time.Duration
+	// grace is how long after a period ends usage may still arrive for it.
+	grace time.Duration
+}
+
+// NewScheduler returns a scheduler closing the periods of svc's orgs every
+// interval, grace after they end, while holding l.
+func NewScheduler(svc *Service, l *lease.Lease, interval, grace time.Duration) *Scheduler {
+	return &Scheduler{svc: svc, lease: l, interval: interval, grace: grace}
+}
+
+// Run closes due periods every interval until ctx is cancelled, on passes
+// where this replica holds the lease. It releases the lease on return.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	defer func() {
+		schedulerLeader.Set(0)
+		if err := s.lease.Release(context.Background()); err != nil {
+			log.Printf("scheduler: release lease: %v", err)
+		}
+	}()
+
+	for {
+		leader, err := s.lease.Acquire(ctx)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				log.Printf("scheduler: acquire lease: %v", err)
+			}
+			leader = false
+		case leader:
+			schedulerLeader.Set(1)
+			err := s.RunOnce(ctx, time.Now())
+			if err != nil && ctx.Err() == nil {
+				log.Printf("scheduler: %v", err)
+			}
+			if errors.Is(err, errLeaseLost) {
+				leader = false
+			}
+		}
+		if !leader {
+			schedulerLeader.Set(0)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce closes every period due at now. A period that fails to close is
+// logged and retried on the next pass; later periods of the same org wait for
+// it, so invoices are issued in order. The lease is renewed before each org,
+// and the pass stops with errLeaseLost if it can no longer be held.
+func (s *Scheduler) RunOnce(ctx context.Context, now time.Time) error {
+	cycles, err := s.svc.store.BillingCycles(ctx)
+	if err != nil {
+		schedulerRunsTotal.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	var lag time.Duration
+	failed := 0
+	for _, c := range cycles {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		held, err := s.lease.Acquire(ctx)
+		if err == nil && !held {
+			err = errLeaseLost
+		}
+		if err != nil {
+			schedulerRunsTotal.WithLabelValues("failure").Inc()
+			return fmt.Errorf("renew lease before org %s: %w", c.OrgID, err)
+		}
+		waiting, err := s.closeOrg(ctx, c, now)
+		if err != nil {
+			log.Printf("scheduler: org %s: %v", c.OrgID, err)
+			failed++
+		}
+		if waiting > lag {
+			lag = waiting
+		}
+	}
+	schedulerLag.Set(lag.Seconds())
+
+	if failed > 0 {
+		schedulerRunsTotal.WithLabelValues("failure").Inc()
+		return fmt.Errorf("%d of %d orgs failed", failed, len(cycles))
+	}
+	schedulerRunsTotal.WithLabelValues("success").Inc()
+	return nil
+}
+
+// closeOrg closes the due periods of one org, oldest first, and returns how
+// long the oldest period still due has been waiting past its grace window.
+func (s *Scheduler) closeOrg(ctx context.Context, c BillingCycle, now time.Time) (time.Duration, error) {
+	periodAt, err := s.svc.billingPeriods(ctx, c.OrgID)
+	if err != nil {
+		return 0, err
+	}
+
+	closedThrough := c.ClosedThrough
+	if closedThrough == nil {
+		start, err := s.svc.store.StartBillingCycle(ctx, c.OrgID, periodAt(now.Add(-s.grace)).start)
+		if err != nil {
+			return 0, err
+		}
+		closedThrough = &start
+	}
+
+	for _, p := range duePeriods(*closedThrough, now, s.grace, periodAt) {
+		if err := s.closePeriod(ctx, c.OrgID, p); err != nil {
+			schedulerFailuresTotal.Inc()
+			return now.Sub(p.end.Add(s.grace)), fmt.Errorf("close period %s: %w", p.start.Format(time.RFC3339), err)
+		}
+		if err := s.svc.store.AdvanceBillingCycle(ctx, c.OrgID, p.end); err != nil {
+			return now.Sub(p.end.Add(s.grace)), err
+		}
+		schedulerClosedTotal.Inc()
+	}
+	return 0, nil
+}
+
+// closePeriod brings the invoice of p up to date and finalizes it. Periods
+// in which the org was billed under no plan get no invoice. An invoice that
+// has already been finalized or voided is left alone.
+func (s *Scheduler) closePeriod(ctx context.Context, orgID string, p billingPeriod) error {
+	plans, assignments, _, err := s.svc.invoicePlans(ctx, orgID, p.start, p.end)
+	if err != nil {
+		return err
+	}
+	if len(plans) == 0 && len(assignments) == 0 {
+		return nil
+	}
+
+	// The key makes a retried close return the invoice the first attempt
+	// generated, even once it has left draft.
+	key := "scheduler:" + p.start.UTC().Format(time.RFC3339)
+	inv, err := s.svc.store.RefreshDraftInvoice(ctx, orgID, p.start, p.end, true, key, s.svc.priceInvoice)
+	if errors.Is(err, ErrInvoiceLocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if inv.Status != InvoiceDraft {
+		return nil
+	}
+
+	_, err = s.svc.store.TransitionInvoice(ctx, orgID, inv.ID, InvoiceFinalized, schedulerActor, "billing period closed", s.svc.numbering)
+	if errors.Is(err, ErrInvalidTransition) {
+		return nil
+	}
+	return err
+}
+
+// duePeriods returns the periods, as given by periodAt, from closedThrough on
+// whose grace window has passed at now. A period straddling closedThrough,
+// as after a change of billing anchor, starts at closedThrough instead.
+func duePeriods(closedThrough, now time.Time, grace time.Duration, periodAt func(time.Time) billingPeriod) []billingPeriod {
+	var periods []billingPeriod
+	for p := periodAt(closedThrough); !p.end.Add(grace).After(now); p = periodAt(p.end) {
+		if p.start.Before(closedThrough) {
+			p.start = closedThrough
+		}
+		periods = append(periods, p)
+	}
+	return periods
+}
+
+// BillingCycle is how far the scheduler has closed an org's periods.
+type BillingCycle struct {
+	OrgID string
+	// ClosedThrough is the end of the last period closed; nil for orgs the
+	// scheduler has not seen yet.
+	ClosedThrough *time.Time
+}
+
+// BillingCycles returns the cycle of every org with a subscription or
+// metered plans of its own.
+func (s *Store) BillingCycles(ctx context.Context) ([]BillingCycle, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT o.org_id, c.closed_through
+		FROM (
+			SELECT org_id FROM subscriptions
+			UNION
+			SELECT org_id FROM plans WHERE org_id IS NOT NULL
+		) o
+		LEFT JOIN billing_cycles c ON c.org_id = o.org_id
+		ORDER BY o.org_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cycles []BillingCycle
+	for rows.Next() {
+		var c BillingCycle
+		var closedThrough sql.NullTime
+		if err := rows.Scan(&c.OrgID, &closedThrough); err != nil {
+			return nil, err
+		}
+		if closedThrough.Valid {
+			t := closedThrough.Time.UTC()
+			c.ClosedThrough = &t
+		}
+		cycles = append(cycles, c)
+	}
+	return cycles, rows.Err()
+}
+
+// StartBillingCycle starts scheduling orgID's periods from start, unless it
+// is already scheduled, and returns where its cycle stands.
+func (s *Store) StartBillingCycle(ctx context.Context, orgID string, start time.Time) (time.Time, error) {
+	var closedThrough time.Time
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO billing_cycles (org_id, closed_through)
+		VALUES ($1, $2)
+		ON CONFLICT (org_id) DO UPDATE SET org_id = EXCLUDED.org_id
+		RETURNING closed_through
+	`, orgID, start).Scan(&closedThrough)
+	return closedThrough.UTC(), err
+}
+
+// AdvanceBillingCycle records that orgID's periods are closed through t.
+func (s *Store) AdvanceBillingCycle(ctx context.Context, orgID string, t time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE billing_cycles
+		SET closed_through = GREATEST(closed_through, $2), updated_at = NOW()
+		WHERE org_id = $1
+	`, orgID, t)
+	return err
+}
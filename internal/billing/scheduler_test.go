@@ -0,0 +1,124 @@
+package billing
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/db/dbtest"
+	"github.com/jackthomas00/polaris/pkg/lease"
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+func TestDuePeriods(t *testing.T) {
+	date := func(m time.Month, d, h int) time.Time { return time.Date(2026, m, d, h, 0, 0, 0, time.UTC) }
+	anchored := Subscription{AnchorDay: 15, StartedAt: date(1, 15, 0), PricePlan: PricePlan{Interval: IntervalMonth}}
+
+	tests := []struct {
+		name          string
+		closedThrough time.Time
+		now           time.Time
+		periodAt      func(time.Time) billingPeriod
+		expected      []billingPeriod
+	}{
+		{
+			name:          "within grace window",
+			closedThrough: date(3, 1, 0), now: date(4, 1, 0).Add(30 * time.Minute),
+			periodAt: calendarMonth,
+		},
+		{
+			name:          "grace window passed",
+			closedThrough: date(3, 1, 0), now: date(4, 1, 1),
+			periodAt: calendarMonth,
+			expected: []billingPeriod{{start: date(3, 1, 0), end: date(4, 1, 0)}},
+		},
+		{
+			name:          "catching up",
+			closedThrough: date(1, 1, 0), now: date(3, 10, 0),
+			periodAt: calendarMonth,
+			expected: []billingPeriod{
+				{start: date(1, 1, 0), end: date(2, 1, 0)},
+				{start: date(2, 1, 0), end: date(3, 1, 0)},
+			},
+		},
+		{
+			name:          "anchor moved mid-period",
+			closedThrough: date(3, 1, 0), now: date(4, 20, 0),
+			periodAt: anchored.PeriodAt,
+			expected: []billingPeriod{
+				{start: date(3, 1, 0), end: date(3, 15, 0)},
+				{start: date(3, 15, 0), end: date(4, 15, 0)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := duePeriods(tt.closedThrough, tt.now, time.Hour, tt.periodAt)
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: expected %d periods, got %+v", tt.name, len(tt.expected), got)
+			continue
+		}
+		for i, want := range tt.expected {
+			if !got[i].start.Equal(want.start) || !got[i].end.Equal(want.end) {
+				t.Errorf("%s: period %d: expected %+v, got %+v", tt.name, i, want, got[i])
+			}
+		}
+	}
+}
+
+func TestScheduler_RunOnce_StopsWhenLeaseIsLost(t *testing.T) {
+	now := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	closedThrough := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		// renewals answers each renewal: true while this replica keeps the lease.
+		renewals []bool
+		expected []string // orgs closed before the pass stopped
+	}{
+		{name: "lost before the first org", renewals: []bool{false}, expected: nil},
+		{name: "lost part-way", renewals: []bool{true, false}, expected: []string{"org-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l *lease.Lease
+			var renewed int
+			var closed []string
+			db := dbtest.Open(t, func(query string, args []driver.NamedValue) (*dbtest.Result, error) {
+				switch {
+				case dbtest.Contains(query, "LEFT JOIN billing_cycles"):
+					res := dbtest.Rows([]string{"org_id", "closed_through"})
+					for _, org := range []string{"org-1", "org-2", "org-3"} {
+						res.Rows = append(res.Rows, []driver.Value{org, closedThrough})
+					}
+					return res, nil
+				case dbtest.Contains(query, "INSERT INTO billing_leases"):
+					holder := "other-replica"
+					if tt.renewals[renewed] {
+						holder = l.Holder()
+					}
+					renewed++
+					return dbtest.Rows([]string{"holder"}, []driver.Value{holder}), nil
+				case dbtest.Contains(query, "FROM subscriptions s"):
+					closed = append(closed, args[0].Value.(string))
+					return dbtest.Rows(nil), nil
+				}
+				return nil, fmt.Errorf("unexpected query: %s", query)
+			})
+			l = lease.New(db, "billing_leases", SchedulerLease, time.Minute)
+			svc := NewService(NewStore(db), nil, nil, nil, money.DefaultRoundingMode, InvoiceNumbering{})
+
+			err := NewScheduler(svc, l, time.Minute, time.Hour).RunOnce(context.Background(), now)
+			if !errors.Is(err, errLeaseLost) {
+				t.Fatalf("expected errLeaseLost, got %v", err)
+			}
+			if fmt.Sprint(closed) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected orgs %v closed, got %v", tt.expected, closed)
+			}
+		})
+	}
+}
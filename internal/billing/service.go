@@ -2,73 +2,407 @@ package billing
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/big"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jackthomas00/polaris/pkg/money"
 	billingv1 "github.com/jackthomas00/polaris/proto/billingv1"
+	identityv1 "github.com/jackthomas00/polaris/proto/identityv1"
+	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
 )
 
+// ErrMixedCurrencies is returned when an org's plans are priced in more than
+// one currency, or in another than its billing currency, so its usage cannot
+// be totalled on one invoice.
+var ErrMixedCurrencies = errors.New("plans use more than one currency")
+
+// pricingTimeout bounds the calls to usage-svc, identity-svc and the tax
+// calculator made to price one invoice.
+const pricingTimeout = 30 * time.Second
+
 type Service struct {
 	store *Store
+	// usage serves the usage totals invoices are priced from; billing never
+	// reads usage-svc's tables.
+	usage usagev1.UsageClient
+	// identity serves the billing profiles invoices are taxed by.
+	identity identityv1.IdentityClient
+	// tax computes the tax of invoices; nil leaves them untaxed.
+	tax TaxCalculator
+	// rounding rounds each plan's charge to whole minor units.
+	rounding money.RoundingMode
+	// numbering numbers invoices as they are finalized.
+	numbering InvoiceNumbering
 	billingv1.UnimplementedBillingServer
 }
 
-func NewService(store *Store) *Service {
-	return &Service{store: store}
+func NewService(store *Store, usage usagev1.UsageClient, identity identityv1.IdentityClient, tax TaxCalculator, rounding money.RoundingMode, numbering InvoiceNumbering) *Service {
+	return &Service{store: store, usage: usage, identity: identity, tax: tax, rounding: rounding, numbering: numbering}
 }
 
+// GenerateInvoice computes the org's invoice for the requested period, which
+// must be one of its billing periods, so customer invoices are the ones the
+// scheduler closes and never overlap them. The period's draft is recomputed in
+// place, or created if there is none; a period whose invoice has been
+// finalized cannot be regenerated. Calls with an idempotency key seen before
+// return the invoice of the first call.
 func (s *Service) GenerateInvoice(ctx context.Context, req *billingv1.GenerateInvoiceRequest) (*billingv1.Invoice, error) {
 	periodStart := time.Unix(req.PeriodStartUnix, 0).UTC()
 	periodEnd := time.Unix(req.PeriodEndUnix, 0).UTC()
-
-	// Get all plans for this org
-	plans, err := s.store.GetPlansByOrg(ctx, req.OrgId)
+	if !periodEnd.After(periodStart) {
+		return nil, status.Errorf(codes.InvalidArgument, "period end must be after period start")
+	}
+	periodAt, err := s.billingPeriods(ctx, req.OrgId)
 	if err != nil {
 		return nil, err
 	}
+	if p := periodAt(periodStart); !p.start.Equal(periodStart) || !p.end.Equal(periodEnd) {
+		return nil, status.Errorf(codes.InvalidArgument, "period must be one of the org's billing periods, e.g. %s to %s",
+			p.start.Format(time.RFC3339), p.end.Format(time.RFC3339))
+	}
+
+	invoice, err := s.store.RefreshDraftInvoice(ctx, req.OrgId, periodStart, periodEnd, true, req.IdempotencyKey, s.priceInvoice)
+	switch {
+	case errors.Is(err, ErrMixedCurrencies), errors.Is(err, ErrInvalidPricing), errors.Is(err, ErrInvoiceLocked), errors.Is(err, ErrPeriodOverlaps):
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		return nil, status.Errorf(codes.AlreadyExists, "%v", err)
+	case errors.Is(err, ErrTaxCalculation):
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	case err != nil:
+		return nil, err
+	}
+	return invoiceToProto(invoice), nil
+}
+
+// RefreshDraftInvoice recomputes the draft invoice of orgID for the period
+// [start, end) from current usage. An existing draft is updated in place; a
+// missing one is created only when create is set. It returns nil when the
+// period has no draft to refresh, and ErrInvoiceLocked once its invoice has
+// been finalized.
+func (s *Service) RefreshDraftInvoice(ctx context.Context, orgID string, start, end time.Time, create bool) (*Invoice, error) {
+	return s.store.RefreshDraftInvoice(ctx, orgID, start, end, create, "", s.priceInvoice)
+}
+
+// priceInvoice sets the line items and total of inv from its org's plans and
+// usage in its period. Each plan assignment of its subscription is priced
+// segment by segment: the base fee prorated by time, then the usage of each
+// of the price plan's metered components within the segment. The org's own
+// metered plans follow, over the whole period. Each line's amount is computed
+// exactly and rounded to the minor unit with the service's rounding mode; the
+// total is the sum of the rounded amounts, so the lines always add up.
+// True-ups of the commitment periods the invoice closes, discounts of
+// redeemed coupons and the tax on the net charges come last. Everything is in
+// the org's billing currency; a plan priced in another fails the invoice.
+func (s *Service) priceInvoice(ctx context.Context, inv *Invoice) error {
+	ctx, cancel := context.WithTimeout(ctx, pricingTimeout)
+	defer cancel()
+
+	plans, assignments, components, err := s.invoicePlans(ctx, inv.OrgID, inv.PeriodStart, inv.PeriodEnd)
+	if err != nil {
+		return err
+	}
 
-	var totalAmount float64
+	org, err := s.organization(ctx, inv.OrgID)
+	if err != nil {
+		return err
+	}
+	currency := org.GetBillingCurrency()
+	if currency == "" {
+		currency = money.DefaultCurrency
+		switch {
+		case len(assignments) > 0:
+			currency = assignments[0].PricePlan.Currency
+		case len(plans) > 0:
+			currency = plans[0].Currency
+		}
+	}
+	total := money.Zero(currency)
+	var items []LineItem
+
+	add := func(item LineItem) error {
+		if item.Amount.Currency != currency {
+			return fmt.Errorf("%w: org %s is invoiced in %s, not %s", ErrMixedCurrencies, inv.OrgID, currency, item.Amount.Currency)
+		}
+		var err error
+		if total, err = total.Add(item.Amount); err != nil {
+			return err
+		}
+		items = append(items, item)
+		return nil
+	}
+	usageItem := func(plan Plan, start, end time.Time) (LineItem, error) {
+		if plan.Currency != currency {
+			return LineItem{}, fmt.Errorf("%w: org %s is invoiced in %s, plan %s is priced in %s", ErrMixedCurrencies, inv.OrgID, currency, plan.ID, plan.Currency)
+		}
+		usage, err := s.usageTotal(ctx, inv.OrgID, plan.Metric, start, end)
+		if err != nil {
+			return LineItem{}, err
+		}
+		return planLineItem(plan, usage, s.rounding)
+	}
+
+	for i := range assignments {
+		a := &assignments[i]
+		for _, seg := range a.segments(inv.PeriodStart, inv.PeriodEnd) {
+			item, err := feeLineItem(&a.PricePlan, seg, s.rounding)
+			if err != nil {
+				return err
+			}
+			if err := add(item); err != nil {
+				return err
+			}
+
+			for _, plan := range components[a.PricePlanID] {
+				plan.FreeQuota = prorateQuantity(plan.FreeQuota, seg.proration)
+				item, err := usageItem(plan, seg.start, seg.end)
+				if err != nil {
+					return err
+				}
+				item.setSegment(seg)
+				if seg.proration != nil {
+					item.Description = fmt.Sprintf("%s (%s)", item.Description, seg.label())
+				}
+				if err := add(item); err != nil {
+					return err
+				}
+			}
+		}
+	}
 
-	// For each plan, calculate usage and cost
 	for _, plan := range plans {
-		usage, err := s.store.GetUsageTotal(ctx, req.OrgId, plan.Metric, periodStart, periodEnd)
+		item, err := usageItem(plan, inv.PeriodStart, inv.PeriodEnd)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		if err := add(item); err != nil {
+			return err
+		}
+	}
 
-		// Calculate cost: max(0, usage - free_quota) * unit_price
-		chargeableUsage := usage - plan.FreeQuota
-		if chargeableUsage < 0 {
-			chargeableUsage = 0
+	trueUps, err := s.trueUps(ctx, inv, items, currency)
+	if err != nil {
+		return err
+	}
+	for _, item := range trueUps {
+		if err := add(item); err != nil {
+			return err
 		}
-		cost := float64(chargeableUsage) * plan.UnitPrice
-		totalAmount += cost
 	}
 
-	// Create or update invoice
-	invoiceID := fmt.Sprintf("inv-%s", uuid.New().String()[:8])
-	invoice := &Invoice{
-		ID:          invoiceID,
-		OrgID:       req.OrgId,
-		PeriodStart: periodStart,
-		PeriodEnd:   periodEnd,
-		TotalAmount: totalAmount,
-		Status:      "draft",
+	discounts, err := s.discounts(ctx, inv, items, currency)
+	if err != nil {
+		return err
+	}
+	for _, item := range discounts {
+		if err := add(item); err != nil {
+			return err
+		}
 	}
 
-	if err := s.store.CreateInvoice(ctx, invoice); err != nil {
+	taxes, err := s.taxes(ctx, inv, items, currency, org)
+	if err != nil {
+		return err
+	}
+	for _, item := range taxes {
+		if err := add(item); err != nil {
+			return err
+		}
+	}
+
+	inv.LineItems = items
+	inv.Total = total
+	return nil
+}
+
+// trueUps returns the true-up lines of the commitment periods of inv's org's
+// subscription that inv closes. A period's usage charges are those of items
+// within it plus those already on the org's other invoices.
+func (s *Service) trueUps(ctx context.Context, inv *Invoice, items []LineItem, currency string) ([]LineItem, error) {
+	sub, err := s.store.GetSubscription(ctx, inv.OrgID)
+	if err == ErrSubscriptionNotFound {
+		return nil, nil
+	}
+	if err != nil || sub.Commitment == nil {
 		return nil, err
 	}
+	if sub.Commitment.Amount.Currency != currency {
+		return nil, fmt.Errorf("%w: org %s", ErrMixedCurrencies, inv.OrgID)
+	}
 
-	return &billingv1.Invoice{
-		Id:              invoice.ID,
-		OrgId:           invoice.OrgID,
-		PeriodStartUnix: invoice.PeriodStart.Unix(),
-		PeriodEndUnix:   invoice.PeriodEnd.Unix(),
-		TotalAmount:     invoice.TotalAmount,
-		Status:          invoice.Status,
-	}, nil
+	var trueUps []LineItem
+	for _, seg := range sub.closedCommitments(inv.PeriodStart, inv.PeriodEnd) {
+		usage, err := s.store.UsageCharges(ctx, inv.OrgID, currency, seg.start, seg.end, inv.PeriodStart, inv.PeriodEnd)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			start := inv.PeriodStart
+			if item.PeriodStart != nil {
+				start = *item.PeriodStart
+			}
+			if item.Kind == LineItemUsage && !start.Before(seg.start) && start.Before(seg.end) {
+				usage += item.Amount.MinorUnits
+			}
+		}
+		item, err := trueUpLineItem(sub.Commitment, seg, usage, s.rounding)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			item.TaxCode = sub.PricePlan.TaxCode
+			trueUps = append(trueUps, *item)
+		}
+	}
+	return trueUps, nil
+}
+
+// discounts returns the discount lines of the coupons inv's org redeemed that
+// cover inv's period, counted in the org's billing periods.
+func (s *Service) discounts(ctx context.Context, inv *Invoice, items []LineItem, currency string) ([]LineItem, error) {
+	redemptions, err := s.store.RedemptionsByOrg(ctx, inv.OrgID)
+	if err != nil || len(redemptions) == 0 {
+		return nil, err
+	}
+	periodAt, err := s.billingPeriods(ctx, inv.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	var active []CouponRedemption
+	for _, r := range redemptions {
+		if r.appliesTo(inv.PeriodStart, inv.PeriodEnd, periodAt) {
+			active = append(active, r)
+		}
+	}
+	return discountLineItems(items, currency, active, s.rounding)
+}
+
+// usageTotal returns the usage of orgID's metric in [start, end) from
+// usage-svc. Usage is counted in whole seconds, the resolution events are
+// recorded at. A metric usage-svc does not know has no usage, so a plan may be
+// set up before its metric is registered.
+func (s *Service) usageTotal(ctx context.Context, orgID, metric string, start, end time.Time) (int64, error) {
+	if end.Unix() <= start.Unix() {
+		return 0, nil
+	}
+	resp, err := s.usage.GetUsageTotal(ctx, &usagev1.GetUsageTotalRequest{
+		OrgId:     orgID,
+		Metric:    metric,
+		StartUnix: start.Unix(),
+		EndUnix:   end.Unix(),
+	})
+	if status.Code(err) == codes.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("usage of %s: %w", metric, err)
+	}
+	return resp.Total, nil
+}
+
+// invoicePlans returns what orgID is billed under in [start, end): its own
+// metered plans, the plan assignments of its subscription, and the metered
+// components of the assigned price plans keyed by price plan ID.
+func (s *Service) invoicePlans(ctx context.Context, orgID string, start, end time.Time) ([]Plan, []PlanAssignment, map[string][]Plan, error) {
+	plans, err := s.store.GetPlansByOrg(ctx, orgID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	assignments, err := s.store.AssignmentsDuring(ctx, orgID, start, end)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var components map[string][]Plan
+	if len(assignments) > 0 {
+		ids := make([]string, len(assignments))
+		for i, a := range assignments {
+			ids[i] = a.PricePlanID
+		}
+		if components, err = s.store.GetPricePlanComponents(ctx, ids); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return plans, assignments, components, nil
+}
+
+// feeLineItem charges the base fee of pp for seg, prorated by the part of
+// the billing period it covers.
+func feeLineItem(pp *PricePlan, seg segment, rounding money.RoundingMode) (LineItem, error) {
+	fee := pp.BaseFee
+	description := fmt.Sprintf("%s (%sly base fee)", pp.Name, pp.Interval)
+	if seg.proration != nil {
+		fee = new(big.Rat).Mul(fee, seg.proration)
+		description = fmt.Sprintf("%s (%sly base fee, prorated %s)", pp.Name, pp.Interval, seg.label())
+	}
+	amount, err := money.FromRat(fee, pp.Currency, rounding)
+	if err != nil {
+		return LineItem{}, fmt.Errorf("price plan %s: %w", pp.ID, err)
+	}
+	item := LineItem{
+		Kind:               LineItemRecurring,
+		Description:        description,
+		PlanID:             pp.ID,
+		Quantity:           1,
+		ChargeableQuantity: 1,
+		PricingModel:       PricingPerUnit,
+		UnitPrice:          pp.BaseFee,
+		Amount:             amount,
+		TaxCode:            pp.TaxCode,
+	}
+	item.setSegment(seg)
+	return item, nil
+}
+
+// planLineItem charges the usage beyond plan's free quota with the plan's
+// pricing model.
+func planLineItem(plan Plan, usage int64, rounding money.RoundingMode) (LineItem, error) {
+	free := plan.FreeQuota
+	if free > usage {
+		free = usage
+	}
+	if free < 0 {
+		free = 0
+	}
+
+	item := LineItem{
+		Kind:               LineItemUsage,
+		Description:        plan.Name,
+		PlanID:             plan.ID,
+		Metric:             plan.Metric,
+		Quantity:           usage,
+		FreeQuotaApplied:   free,
+		ChargeableQuantity: usage - free,
+		TaxCode:            plan.TaxCode,
+	}
+	if err := priceQuantity(&item, plan, item.ChargeableQuantity, rounding); err != nil {
+		return LineItem{}, err
+	}
+	return item, nil
+}
+
+// organization returns the billing profile of orgID from identity-svc: its
+// billing currency, address and tax status. Without an identity client it
+// returns nil, and the org is invoiced in its plans' currency and not taxed.
+func (s *Service) organization(ctx context.Context, orgID string) (*identityv1.GetOrganizationResponse, error) {
+	if s.identity == nil {
+		return nil, nil
+	}
+	org, err := s.identity.GetOrganization(ctx, &identityv1.GetOrganizationRequest{OrgId: orgID})
+	if err != nil {
+		return nil, fmt.Errorf("billing profile of org %s: %w", orgID, err)
+	}
+	return org, nil
+}
+
+func newInvoiceID() string {
+	return fmt.Sprintf("inv-%s", uuid.New().String())
 }
 
 func (s *Service) ListInvoices(ctx context.Context, req *billingv1.ListInvoicesRequest) (*billingv1.ListInvoicesResponse, error) {
@@ -78,15 +412,646 @@ func (s *Service) ListInvoices(ctx context.Context, req *billingv1.ListInvoicesR
 	}
 
 	resp := &billingv1.ListInvoicesResponse{}
+	for i := range invoices {
+		resp.Invoices = append(resp.Invoices, invoiceToProto(&invoices[i]))
+	}
+	return resp, nil
+}
+
+// FinalizeInvoice issues a draft invoice, locking its amounts and line items
+// and assigning its number.
+func (s *Service) FinalizeInvoice(ctx context.Context, req *billingv1.InvoiceTransitionRequest) (*billingv1.Invoice, error) {
+	return s.transitionInvoice(ctx, req, InvoiceFinalized)
+}
+
+// VoidInvoice cancels a draft or an unpaid invoice for good.
+func (s *Service) VoidInvoice(ctx context.Context, req *billingv1.InvoiceTransitionRequest) (*billingv1.Invoice, error) {
+	return s.transitionInvoice(ctx, req, InvoiceVoid)
+}
+
+// MarkInvoicePaid records payment of a finalized or uncollectible invoice.
+func (s *Service) MarkInvoicePaid(ctx context.Context, req *billingv1.InvoiceTransitionRequest) (*billingv1.Invoice, error) {
+	return s.transitionInvoice(ctx, req, InvoicePaid)
+}
+
+// MarkUncollectible writes off a finalized invoice. It can still be paid or
+// voided afterwards.
+func (s *Service) MarkUncollectible(ctx context.Context, req *billingv1.InvoiceTransitionRequest) (*billingv1.Invoice, error) {
+	return s.transitionInvoice(ctx, req, InvoiceUncollectible)
+}
+
+func (s *Service) transitionInvoice(ctx context.Context, req *billingv1.InvoiceTransitionRequest, to string) (*billingv1.Invoice, error) {
+	if req.InvoiceId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "invoice_id is required")
+	}
+	if req.Actor == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+	}
+
+	inv, err := s.store.TransitionInvoice(ctx, req.OrgId, req.InvoiceId, to, req.Actor, req.Reason, s.numbering)
+	switch {
+	case errors.Is(err, ErrInvoiceNotFound):
+		return nil, status.Errorf(codes.NotFound, "invoice %s not found", req.InvoiceId)
+	case errors.Is(err, ErrInvalidTransition):
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	case err != nil:
+		return nil, err
+	}
+	return invoiceToProto(inv), nil
+}
+
+func (s *Service) ListPricePlans(ctx context.Context, req *billingv1.ListPricePlansRequest) (*billingv1.ListPricePlansResponse, error) {
+	plans, err := s.store.ListPricePlans(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &billingv1.ListPricePlansResponse{}
+	for i := range plans {
+		pp, err := s.pricePlanToProto(&plans[i])
+		if err != nil {
+			return nil, err
+		}
+		resp.PricePlans = append(resp.PricePlans, pp)
+	}
+	return resp, nil
+}
+
+func (s *Service) Subscribe(ctx context.Context, req *billingv1.SubscribeRequest) (*billingv1.Subscription, error) {
+	if req.PricePlanId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "price_plan_id is required")
+	}
+	if req.AnchorDay < 0 || req.AnchorDay > maxAnchorDay {
+		return nil, status.Errorf(codes.InvalidArgument, "anchor_day must be between 0 and %d (0 anchors to the start date)", maxAnchorDay)
+	}
+
+	startedAt := time.Now().UTC()
+	if req.StartUnix != 0 {
+		startedAt = time.Unix(req.StartUnix, 0).UTC()
+	}
+	anchorDay := int(req.AnchorDay)
+	if anchorDay == 0 {
+		anchorDay = startedAt.Day()
+		if anchorDay > maxAnchorDay {
+			anchorDay = maxAnchorDay
+		}
+	}
+
+	pp, err := s.store.GetPricePlan(ctx, req.PricePlanId)
+	if err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	org, err := s.organization(ctx, req.OrgId)
+	if err != nil {
+		return nil, err
+	}
+	if currency := org.GetBillingCurrency(); currency != "" && pp.Currency != currency {
+		return nil, status.Errorf(codes.FailedPrecondition, "price plan %s is in %s, the org is invoiced in %s", pp.ID, pp.Currency, currency)
+	}
+
+	sub := &Subscription{
+		ID:          fmt.Sprintf("sub-%s", uuid.New().String()[:8]),
+		OrgID:       req.OrgId,
+		PricePlanID: req.PricePlanId,
+		Status:      SubscriptionActive,
+		AnchorDay:   anchorDay,
+		StartedAt:   startedAt,
+	}
+	if err := s.store.CreateSubscription(ctx, sub); err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	return s.getSubscription(ctx, req.OrgId)
+}
+
+func (s *Service) GetSubscription(ctx context.Context, req *billingv1.GetSubscriptionRequest) (*billingv1.Subscription, error) {
+	return s.getSubscription(ctx, req.OrgId)
+}
+
+// ChangeSubscriptionPlan moves the org's active subscription to another price
+// plan in the same currency, effective immediately. The current period is
+// prorated between the two plans.
+func (s *Service) ChangeSubscriptionPlan(ctx context.Context, req *billingv1.ChangeSubscriptionPlanRequest) (*billingv1.Subscription, error) {
+	if req.PricePlanId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "price_plan_id is required")
+	}
+
+	sub, err := s.store.GetSubscription(ctx, req.OrgId)
+	if err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	if sub.Status != SubscriptionActive {
+		return nil, status.Errorf(codes.FailedPrecondition, "subscription %s is %s", sub.ID, sub.Status)
+	}
+	pp, err := s.store.GetPricePlan(ctx, req.PricePlanId)
+	if err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	if pp.Currency != sub.PricePlan.Currency {
+		return nil, status.Errorf(codes.FailedPrecondition, "price plan %s is in %s, the subscription in %s", pp.ID, pp.Currency, sub.PricePlan.Currency)
+	}
+	if sub.Commitment != nil {
+		if err := sub.Commitment.validate(pp); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "price plan %s does not fit the subscription's commitment: %v", pp.ID, err)
+		}
+	}
+
+	if err := s.store.ChangeSubscriptionPlan(ctx, req.OrgId, req.PricePlanId, time.Now().UTC()); err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	return s.getSubscription(ctx, req.OrgId)
+}
+
+func (s *Service) CancelSubscription(ctx context.Context, req *billingv1.CancelSubscriptionRequest) (*billingv1.Subscription, error) {
+	sub, err := s.store.GetSubscription(ctx, req.OrgId)
+	if err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	if sub.Status != SubscriptionActive {
+		return nil, status.Errorf(codes.FailedPrecondition, "subscription %s is already %s", sub.ID, sub.Status)
+	}
+
+	endedAt := time.Now().UTC()
+	if req.AtPeriodEnd {
+		endedAt = sub.PeriodAt(endedAt).end
+	}
+	if err := s.store.CancelSubscription(ctx, req.OrgId, endedAt); err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	return s.getSubscription(ctx, req.OrgId)
+}
+
+// SetSubscriptionCommitment sets the minimum commitment of the org's active
+// subscription, or removes it when no amount is given. Commitments are
+// contract terms, so this is for operators and is not exposed through the
+// gateway.
+func (s *Service) SetSubscriptionCommitment(ctx context.Context, req *billingv1.SetSubscriptionCommitmentRequest) (*billingv1.Subscription, error) {
+	sub, err := s.store.GetSubscription(ctx, req.OrgId)
+	if err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	if sub.Status != SubscriptionActive {
+		return nil, status.Errorf(codes.FailedPrecondition, "subscription %s is %s", sub.ID, sub.Status)
+	}
+
+	var c *Commitment
+	if req.Amount != nil && req.Amount.MinorUnits != 0 {
+		c = &Commitment{
+			Amount:   money.Money{MinorUnits: req.Amount.MinorUnits, Currency: req.Amount.Currency},
+			Interval: BillingInterval(req.Interval),
+		}
+		if c.Interval == "" {
+			c.Interval = sub.PricePlan.Interval
+		}
+		if err := c.validate(&sub.PricePlan); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	if err := s.store.SetCommitment(ctx, req.OrgId, c); err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	return s.getSubscription(ctx, req.OrgId)
+}
+
+func (s *Service) getSubscription(ctx context.Context, orgID string) (*billingv1.Subscription, error) {
+	sub, err := s.store.GetSubscription(ctx, orgID)
+	if err != nil {
+		return nil, subscriptionStatus(err)
+	}
+	pp, err := s.pricePlanToProto(&sub.PricePlan)
+	if err != nil {
+		return nil, err
+	}
+
+	period := sub.PeriodAt(time.Now())
+	resp := &billingv1.Subscription{
+		Id:                     sub.ID,
+		OrgId:                  sub.OrgID,
+		PricePlan:              pp,
+		Status:                 sub.Status,
+		AnchorDay:              int32(sub.AnchorDay),
+		StartedAtUnix:          sub.StartedAt.Unix(),
+		CurrentPeriodStartUnix: period.start.Unix(),
+		CurrentPeriodEndUnix:   period.end.Unix(),
+	}
+	if sub.EndedAt != nil {
+		resp.EndedAtUnix = sub.EndedAt.Unix()
+	}
+	if c := sub.Commitment; c != nil {
+		cp := sub.commitmentPeriodAt(time.Now())
+		resp.Commitment = &billingv1.Commitment{
+			Amount:                 moneyToProto(c.Amount),
+			Interval:               string(c.Interval),
+			CurrentPeriodStartUnix: cp.start.Unix(),
+			CurrentPeriodEndUnix:   cp.end.Unix(),
+		}
+	}
+	return resp, nil
+}
+
+func (s *Service) pricePlanToProto(pp *PricePlan) (*billingv1.PricePlan, error) {
+	fee, err := money.FromRat(pp.BaseFee, pp.Currency, s.rounding)
+	if err != nil {
+		return nil, fmt.Errorf("price plan %s: %w", pp.ID, err)
+	}
+	return &billingv1.PricePlan{
+		Id:              pp.ID,
+		Name:            pp.Name,
+		BaseFee:         moneyToProto(fee),
+		BillingInterval: string(pp.Interval),
+		Currency:        pp.Currency,
+	}, nil
+}
+
+func subscriptionStatus(err error) error {
+	switch err {
+	case ErrSubscriptionNotFound:
+		return status.Errorf(codes.NotFound, "no subscription")
+	case ErrSubscriptionExists:
+		return status.Errorf(codes.AlreadyExists, "org already has a subscription")
+	case ErrPricePlanNotFound:
+		return status.Errorf(codes.NotFound, "unknown price plan")
+	default:
+		return err
+	}
+}
+
+// GrantCredits gives the org prepaid credits. They are drawn by the org's
+// invoices the next time those are priced.
+func (s *Service) GrantCredits(ctx context.Context, req *billingv1.GrantCreditsRequest) (*billingv1.CreditGrant, error) {
+	if req.Amount == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "amount is required")
+	}
+	if req.Actor == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+	}
+
+	g := &CreditGrant{
+		OrgID:       req.OrgId,
+		Amount:      money.Money{MinorUnits: req.Amount.MinorUnits, Currency: req.Amount.Currency},
+		Priority:    req.Priority,
+		Description: req.Description,
+		Actor:       req.Actor,
+	}
+	if req.EffectiveAtUnix != 0 {
+		g.EffectiveAt = time.Unix(req.EffectiveAtUnix, 0).UTC()
+	}
+	if req.ExpiresAtUnix != 0 {
+		t := time.Unix(req.ExpiresAtUnix, 0).UTC()
+		g.ExpiresAt = &t
+	}
+	err := s.store.GrantCredits(ctx, g)
+	if errors.Is(err, ErrInvalidCreditGrant) {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return creditGrantToProto(g, time.Now()), nil
+}
+
+func (s *Service) ListCreditGrants(ctx context.Context, req *billingv1.ListCreditGrantsRequest) (*billingv1.ListCreditGrantsResponse, error) {
+	grants, err := s.store.ListCreditGrants(ctx, req.OrgId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	resp := &billingv1.ListCreditGrantsResponse{}
+	for i := range grants {
+		resp.Grants = append(resp.Grants, creditGrantToProto(&grants[i], now))
+	}
+	return resp, nil
+}
+
+// GetCreditBalance returns the credit the org can draw now, per currency.
+func (s *Service) GetCreditBalance(ctx context.Context, req *billingv1.GetCreditBalanceRequest) (*billingv1.GetCreditBalanceResponse, error) {
+	balances, err := s.store.CreditBalance(ctx, req.OrgId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &billingv1.GetCreditBalanceResponse{}
+	for _, m := range balances {
+		resp.Balances = append(resp.Balances, moneyToProto(m))
+	}
+	return resp, nil
+}
+
+// CreateCoupon defines a coupon orgs can redeem by its code.
+func (s *Service) CreateCoupon(ctx context.Context, req *billingv1.CreateCouponRequest) (*billingv1.Coupon, error) {
+	if req.Coupon == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "coupon is required")
+	}
+	c, err := couponFromProto(req.Coupon)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err := s.store.CreateCoupon(ctx, c); err != nil {
+		return nil, couponStatus(err)
+	}
+	return couponToProto(c), nil
+}
+
+func (s *Service) GetCoupon(ctx context.Context, req *billingv1.GetCouponRequest) (*billingv1.Coupon, error) {
+	c, err := s.store.GetCoupon(ctx, strings.ToUpper(req.Id))
+	if err != nil {
+		return nil, couponStatus(err)
+	}
+	return couponToProto(c), nil
+}
+
+// RedeemCoupon redeems a coupon for the org. It discounts the org's invoices
+// from the billing period it is redeemed in, the next time those are priced.
+func (s *Service) RedeemCoupon(ctx context.Context, req *billingv1.RedeemCouponRequest) (*billingv1.CouponRedemption, error) {
+	if req.CouponId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "coupon_id is required")
+	}
+	if req.Actor == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+	}
+
+	r, err := s.store.RedeemCoupon(ctx, req.OrgId, strings.ToUpper(req.CouponId), req.Actor, time.Now())
+	if err != nil {
+		return nil, couponStatus(err)
+	}
+	periodAt, err := s.billingPeriods(ctx, req.OrgId)
+	if err != nil {
+		return nil, err
+	}
+	return redemptionToProto(r, periodAt), nil
+}
+
+func (s *Service) ListCouponRedemptions(ctx context.Context, req *billingv1.ListCouponRedemptionsRequest) (*billingv1.ListCouponRedemptionsResponse, error) {
+	redemptions, err := s.store.RedemptionsByOrg(ctx, req.OrgId)
+	if err != nil {
+		return nil, err
+	}
+	periodAt, err := s.billingPeriods(ctx, req.OrgId)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &billingv1.ListCouponRedemptionsResponse{}
+	for i := range redemptions {
+		resp.Redemptions = append(resp.Redemptions, redemptionToProto(&redemptions[i], periodAt))
+	}
+	return resp, nil
+}
+
+func couponStatus(err error) error {
+	switch {
+	case errors.Is(err, ErrCouponNotFound):
+		return status.Errorf(codes.NotFound, "unknown coupon")
+	case errors.Is(err, ErrInvalidCoupon):
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	case errors.Is(err, ErrCouponExists), errors.Is(err, ErrCouponRedeemed):
+		return status.Errorf(codes.AlreadyExists, "%v", err)
+	case errors.Is(err, ErrCouponUnavailable):
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	default:
+		return err
+	}
+}
+
+// ReportInvoiceTotals totals the issued invoices whose period starts in the
+// requested range, per currency and in the base currency. Each invoice is
+// converted at the rate in effect at the end of its period.
+func (s *Service) ReportInvoiceTotals(ctx context.Context, req *billingv1.ReportInvoiceTotalsRequest) (*billingv1.ReportInvoiceTotalsResponse, error) {
+	if req.PeriodEndUnix <= req.PeriodStartUnix {
+		return nil, status.Errorf(codes.InvalidArgument, "period_end must be after period_start")
+	}
+	base := strings.ToUpper(req.BaseCurrency)
+	if base == "" {
+		base = money.DefaultCurrency
+	}
+	if _, err := money.Exponent(base); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	invoices, err := s.store.IssuedInvoices(ctx, req.OrgId, time.Unix(req.PeriodStartUnix, 0).UTC(), time.Unix(req.PeriodEndUnix, 0).UTC())
+	if err != nil {
+		return nil, err
+	}
+	var currencies []string
+	var latest time.Time
+	seen := make(map[string]bool)
 	for _, inv := range invoices {
-		resp.Invoices = append(resp.Invoices, &billingv1.Invoice{
-			Id:              inv.ID,
-			OrgId:           inv.OrgID,
-			PeriodStartUnix: inv.PeriodStart.Unix(),
-			PeriodEndUnix:   inv.PeriodEnd.Unix(),
-			TotalAmount:     inv.TotalAmount,
-			Status:          inv.Status,
+		if c := inv.Total.Currency; c != base && !seen[c] {
+			seen[c] = true
+			currencies = append(currencies, c)
+		}
+		if inv.PeriodEnd.After(latest) {
+			latest = inv.PeriodEnd
+		}
+	}
+	var rates []ExchangeRate
+	if len(currencies) > 0 {
+		if rates, err = s.store.ExchangeRates(ctx, base, currencies, latest); err != nil {
+			return nil, err
+		}
+	}
+
+	totals, err := convertTotals(invoices, base, rates, s.rounding)
+	if errors.Is(err, ErrNoExchangeRate) {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp := &billingv1.ReportInvoiceTotalsResponse{Total: moneyToProto(totals.Total)}
+	for _, ct := range totals.Currencies {
+		resp.Currencies = append(resp.Currencies, &billingv1.CurrencyTotal{
+			Total:     moneyToProto(ct.Total),
+			Converted: moneyToProto(ct.Converted),
+			Invoices:  int32(ct.Invoices),
 		})
 	}
 	return resp, nil
 }
+
+func invoiceToProto(inv *Invoice) *billingv1.Invoice {
+	return &billingv1.Invoice{
+		Id:              inv.ID,
+		OrgId:           inv.OrgID,
+		PeriodStartUnix: inv.PeriodStart.Unix(),
+		PeriodEndUnix:   inv.PeriodEnd.Unix(),
+		Total:           moneyToProto(inv.Total),
+		Status:          inv.Status,
+		Number:          inv.Number,
+		Currency:        inv.Total.Currency,
+		LineItems:       lineItemsToProto(inv.LineItems),
+		Transitions:     transitionsToProto(inv.Transitions),
+	}
+}
+
+func transitionsToProto(transitions []StatusTransition) []*billingv1.InvoiceStatusTransition {
+	res := make([]*billingv1.InvoiceStatusTransition, len(transitions))
+	for i, t := range transitions {
+		res[i] = &billingv1.InvoiceStatusTransition{
+			FromStatus: t.From,
+			ToStatus:   t.To,
+			Actor:      t.Actor,
+			Reason:     t.Reason,
+			AtUnix:     t.At.Unix(),
+		}
+	}
+	return res
+}
+
+func lineItemsToProto(items []LineItem) []*billingv1.InvoiceLineItem {
+	res := make([]*billingv1.InvoiceLineItem, len(items))
+	for i, li := range items {
+		res[i] = &billingv1.InvoiceLineItem{
+			PlanId:             li.PlanID,
+			Metric:             li.Metric,
+			Quantity:           li.Quantity,
+			FreeQuotaApplied:   li.FreeQuotaApplied,
+			ChargeableQuantity: li.ChargeableQuantity,
+			UnitPrice:          formatPrice(li.UnitPrice),
+			Amount:             moneyToProto(li.Amount),
+			PricingModel:       string(li.PricingModel),
+			PackageSize:        li.PackageSize,
+			Tiers:              tierChargesToProto(li.Tiers),
+			Kind:               li.Kind,
+			Description:        li.Description,
+			Proration:          formatPrice(li.Proration),
+			CreditGrantId:      li.CreditGrantID,
+			CouponId:           li.CouponID,
+			TaxCode:            li.TaxCode,
+		}
+		if li.PeriodStart != nil && li.PeriodEnd != nil {
+			res[i].PeriodStartUnix = li.PeriodStart.Unix()
+			res[i].PeriodEndUnix = li.PeriodEnd.Unix()
+		}
+		if li.Tax != nil {
+			res[i].Tax = &billingv1.InvoiceLineItemTax{
+				Jurisdiction: li.Tax.Jurisdiction,
+				RatePercent:  formatPrice(li.Tax.RatePercent),
+				Basis:        moneyToProto(li.Tax.Basis),
+				Treatment:    li.Tax.Treatment,
+			}
+		}
+	}
+	return res
+}
+
+func creditGrantToProto(g *CreditGrant, now time.Time) *billingv1.CreditGrant {
+	res := &billingv1.CreditGrant{
+		Id:              g.ID,
+		OrgId:           g.OrgID,
+		Amount:          moneyToProto(g.Amount),
+		Remaining:       moneyToProto(g.Remaining),
+		Priority:        g.Priority,
+		EffectiveAtUnix: g.EffectiveAt.Unix(),
+		Description:     g.Description,
+		Actor:           g.Actor,
+		CreatedAtUnix:   g.CreatedAt.Unix(),
+		Expired:         g.ExpiredAt(now),
+	}
+	if g.ExpiresAt != nil {
+		res.ExpiresAtUnix = g.ExpiresAt.Unix()
+	}
+	for _, d := range g.Drawdowns {
+		res.Drawdowns = append(res.Drawdowns, &billingv1.CreditDrawdown{
+			InvoiceId:       d.InvoiceID,
+			InvoiceStatus:   d.InvoiceStatus,
+			PeriodStartUnix: d.PeriodStart.Unix(),
+			PeriodEndUnix:   d.PeriodEnd.Unix(),
+			Amount:          moneyToProto(d.Amount),
+		})
+	}
+	return res
+}
+
+func couponFromProto(p *billingv1.Coupon) (*Coupon, error) {
+	c := &Coupon{
+		ID:              p.Id,
+		Name:            p.Name,
+		Duration:        CouponDuration(p.Duration),
+		DurationPeriods: int(p.DurationPeriods),
+		Metrics:         p.Metrics,
+		MaxRedemptions:  int(p.MaxRedemptions),
+	}
+	if p.PercentOff != "" {
+		pct, err := money.ParseRat(p.PercentOff)
+		if err != nil {
+			return nil, fmt.Errorf("percent_off: %w", err)
+		}
+		c.PercentOff = pct
+	}
+	if p.AmountOff != nil {
+		c.AmountOff = &money.Money{MinorUnits: p.AmountOff.MinorUnits, Currency: p.AmountOff.Currency}
+	}
+	if p.RedeemByUnix != 0 {
+		t := time.Unix(p.RedeemByUnix, 0).UTC()
+		c.RedeemBy = &t
+	}
+	return c, nil
+}
+
+func couponToProto(c *Coupon) *billingv1.Coupon {
+	res := &billingv1.Coupon{
+		Id:              c.ID,
+		Name:            c.Name,
+		Duration:        string(c.Duration),
+		DurationPeriods: int32(c.DurationPeriods),
+		Metrics:         c.Metrics,
+		MaxRedemptions:  int32(c.MaxRedemptions),
+		TimesRedeemed:   int32(c.TimesRedeemed),
+		CreatedAtUnix:   c.CreatedAt.Unix(),
+	}
+	if c.PercentOff != nil {
+		res.PercentOff = money.FormatRat(c.PercentOff)
+	}
+	if c.AmountOff != nil {
+		res.AmountOff = moneyToProto(*c.AmountOff)
+	}
+	if c.RedeemBy != nil {
+		res.RedeemByUnix = c.RedeemBy.Unix()
+	}
+	return res
+}
+
+func redemptionToProto(r *CouponRedemption, periodAt func(time.Time) billingPeriod) *billingv1.CouponRedemption {
+	start, end := r.window(periodAt)
+	res := &billingv1.CouponRedemption{
+		Id:                r.ID,
+		OrgId:             r.OrgID,
+		Coupon:            couponToProto(&r.Coupon),
+		Actor:             r.Actor,
+		RedeemedAtUnix:    r.RedeemedAt.Unix(),
+		DiscountStartUnix: start.Unix(),
+	}
+	if !end.IsZero() {
+		res.DiscountEndUnix = end.Unix()
+	}
+	return res
+}
+
+func tierChargesToProto(tiers []TierCharge) []*billingv1.InvoiceLineItemTier {
+	res := make([]*billingv1.InvoiceLineItemTier, len(tiers))
+	for i, tc := range tiers {
+		res[i] = &billingv1.InvoiceLineItemTier{
+			Tier:         int32(tc.Tier),
+			FromQuantity: tc.From,
+			UpTo:         tc.UpTo,
+			Quantity:     tc.Quantity,
+			UnitPrice:    formatPrice(tc.UnitPrice),
+			FlatFee:      formatPrice(tc.FlatFee),
+			Amount:       moneyToProto(tc.Amount),
+		}
+	}
+	return res
+}
+
+// formatPrice formats an optional price, returning "" for nil.
+func formatPrice(r *big.Rat) string {
+	if r == nil {
+		return ""
+	}
+	return money.FormatRat(r)
+}
+
+func moneyToProto(m money.Money) *billingv1.Money {
+	return &billingv1.Money{MinorUnits: m.MinorUnits, Currency: m.Currency}
+}
@@ -1,7 +1,21 @@
 package billing
 
 import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"math/big"
 	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jackthomas00/polaris/pkg/db/dbtest"
+	"github.com/jackthomas00/polaris/pkg/money"
+	billingv1 "github.com/jackthomas00/polaris/proto/billingv1"
+	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
 )
 
 // TestService_ListInvoices_UsesRequestOrgID verifies that the service uses req.OrgId
@@ -22,7 +36,7 @@ func TestService_ListInvoices_UsesRequestOrgID(t *testing.T) {
 func TestService_GenerateInvoice_UsesRequestOrgID(t *testing.T) {
 	// This test documents that:
 	// 1. Service receives req.OrgId from gRPC request
-	// 2. Service uses it for GetPlansByOrg and GetUsageTotal
+	// 2. Service uses it for GetPlansByOrg and usage-svc's GetUsageTotal
 	// 3. Service uses it when creating the invoice
 
 	// Important: The service trusts req.OrgId from the gRPC request
@@ -65,3 +79,169 @@ func TestService_PreventsOrgIDFaking(t *testing.T) {
 	// - Service rejects requests with org_id that doesn't match authenticated user
 	// - Service only returns data for the authenticated org
 }
+
+func TestPlanLineItem(t *testing.T) {
+	price := func(s string) *big.Rat {
+		r, err := money.ParseRat(s)
+		if err != nil {
+			t.Fatalf("ParseRat(%q): %v", s, err)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name       string
+		plan       Plan
+		usage      int64
+		free       int64
+		chargeable int64
+		amount     int64
+	}{
+		{name: "over quota", plan: Plan{FreeQuota: 1000, UnitPrice: price("0.01")}, usage: 1500, free: 1000, chargeable: 500, amount: 500},
+		{name: "under quota", plan: Plan{FreeQuota: 1000, UnitPrice: price("0.01")}, usage: 400, free: 400, chargeable: 0, amount: 0},
+		{name: "no quota", plan: Plan{UnitPrice: price("0.25")}, usage: 3, free: 0, chargeable: 3, amount: 75},
+		{name: "sub-cent price rounds once", plan: Plan{UnitPrice: price("0.0025")}, usage: 3, free: 0, chargeable: 3, amount: 1},
+	}
+
+	for _, tt := range tests {
+		tt.plan.ID, tt.plan.Metric, tt.plan.Currency = "plan-1", "api_calls", "USD"
+		tt.plan.PricingModel = PricingPerUnit
+		li, err := planLineItem(tt.plan, tt.usage, money.RoundHalfUp)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if li.Quantity != tt.usage || li.FreeQuotaApplied != tt.free || li.ChargeableQuantity != tt.chargeable {
+			t.Errorf("%s: expected quantities %d/%d/%d, got %d/%d/%d", tt.name,
+				tt.usage, tt.free, tt.chargeable, li.Quantity, li.FreeQuotaApplied, li.ChargeableQuantity)
+		}
+		if li.Amount != (money.Money{MinorUnits: tt.amount, Currency: "USD"}) {
+			t.Errorf("%s: expected amount %d, got %v", tt.name, tt.amount, li.Amount)
+		}
+		if li.PlanID != "plan-1" || li.Metric != "api_calls" {
+			t.Errorf("%s: unexpected plan fields %+v", tt.name, li)
+		}
+	}
+}
+
+func TestService_GenerateInvoice_RejectsEmptyPeriod(t *testing.T) {
+	svc := NewService(nil, nil, nil, nil, money.DefaultRoundingMode, InvoiceNumbering{})
+
+	reqs := []*billingv1.GenerateInvoiceRequest{
+		{OrgId: "org-1", PeriodStartUnix: 1767225600, PeriodEndUnix: 1767225600},
+		{OrgId: "org-1", PeriodStartUnix: 1769904000, PeriodEndUnix: 1767225600},
+	}
+	for _, req := range reqs {
+		_, err := svc.GenerateInvoice(context.Background(), req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%+v: expected InvalidArgument, got %v", req, err)
+		}
+	}
+}
+
+func TestService_GenerateInvoice_RequiresBillingPeriod(t *testing.T) {
+	day := func(m time.Month, d int) time.Time { return time.Date(2026, m, d, 0, 0, 0, 0, time.UTC) }
+	// Periods that pass the check go on to the store, which fails them.
+	errPriced := errors.New("priced")
+
+	tests := []struct {
+		name       string
+		start, end time.Time
+		expected   codes.Code
+	}{
+		{name: "a billing period", start: day(1, 1), end: day(2, 1), expected: codes.Unknown},
+		{name: "part of one", start: day(1, 1), end: day(1, 15), expected: codes.InvalidArgument},
+		{name: "straddling two", start: day(1, 15), end: day(2, 15), expected: codes.InvalidArgument},
+		{name: "two of them", start: day(1, 1), end: day(3, 1), expected: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without a subscription the org is billed by calendar month.
+			db := dbtest.Open(t, func(query string, args []driver.NamedValue) (*dbtest.Result, error) {
+				if dbtest.Contains(query, "FROM subscriptions s") {
+					return dbtest.Rows(nil), nil
+				}
+				return nil, errPriced
+			})
+			svc := NewService(NewStore(db), nil, nil, nil, money.DefaultRoundingMode, InvoiceNumbering{})
+
+			_, err := svc.GenerateInvoice(context.Background(), &billingv1.GenerateInvoiceRequest{
+				OrgId:           "org-1",
+				PeriodStartUnix: tt.start.Unix(),
+				PeriodEndUnix:   tt.end.Unix(),
+			})
+			if got := status.Code(err); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+type fakeUsageClient struct {
+	usagev1.UsageClient
+	totals map[string]int64
+	err    error
+	calls  []*usagev1.GetUsageTotalRequest
+}
+
+func (f *fakeUsageClient) GetUsageTotal(ctx context.Context, req *usagev1.GetUsageTotalRequest, opts ...grpc.CallOption) (*usagev1.GetUsageTotalResponse, error) {
+	f.calls = append(f.calls, req)
+	if f.err != nil {
+		return nil, f.err
+	}
+	total, ok := f.totals[req.Metric]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown metric %q", req.Metric)
+	}
+	return &usagev1.GetUsageTotalResponse{Total: total}, nil
+}
+
+func TestService_UsageTotal(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	unavailable := status.Error(codes.Unavailable, "usage-svc down")
+
+	tests := []struct {
+		name      string
+		metric    string
+		start     time.Time
+		end       time.Time
+		err       error
+		expected  int64
+		expectErr bool
+		calls     int
+	}{
+		{name: "registered metric", metric: "api_calls", start: start, end: end, expected: 1200, calls: 1},
+		{name: "unregistered metric has no usage", metric: "seats", start: start, end: end, expected: 0, calls: 1},
+		{name: "sub-second segment is not requested", metric: "api_calls", start: start, end: start.Add(500 * time.Millisecond), expected: 0, calls: 0},
+		{name: "usage-svc errors fail the invoice", metric: "api_calls", start: start, end: end, err: unavailable, expectErr: true, calls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := &fakeUsageClient{totals: map[string]int64{"api_calls": 1200}, err: tt.err}
+			svc := NewService(nil, usage, nil, nil, money.DefaultRoundingMode, InvoiceNumbering{})
+
+			total, err := svc.usageTotal(context.Background(), "org-1", tt.metric, tt.start, tt.end)
+			if tt.expectErr {
+				if !errors.Is(err, unavailable) {
+					t.Errorf("expected usage-svc error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if total != tt.expected {
+				t.Errorf("expected total %d, got %d", tt.expected, total)
+			}
+			if len(usage.calls) != tt.calls {
+				t.Fatalf("expected %d GetUsageTotal calls, got %d", tt.calls, len(usage.calls))
+			}
+			if tt.calls > 0 {
+				req := usage.calls[0]
+				if req.OrgId != "org-1" || req.StartUnix != tt.start.Unix() || req.EndUnix != tt.end.Unix() {
+					t.Errorf("unexpected request: %v", req)
+				}
+			}
+		})
+	}
+}
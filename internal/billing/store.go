@@ -3,24 +3,53 @@ package billing
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
 	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+	"github.com/jackthomas00/polaris/pkg/outbox"
 )
 
 type Store struct {
-	db *sql.DB
+	db     *sql.DB
+	outbox *outbox.Outbox
 }
 
 func NewStore(db *sql.DB) *Store {
-	return &Store{db: db}
+	return &Store{db: db, outbox: outbox.New(outboxTable)}
+}
+
+// outboxTable holds the events billing-svc publishes.
+const outboxTable = "billing_outbox"
+
+// Outbox returns the outbox the store writes its events to.
+func (s *Store) Outbox() *outbox.Outbox {
+	return s.outbox
 }
 
 type Plan struct {
-	ID        string
-	OrgID     string
-	Name      string
-	Metric    string
-	UnitPrice float64
-	FreeQuota int64
+	ID    string
+	OrgID string
+	// PricePlanID is set instead of OrgID for the components of a price plan.
+	PricePlanID string
+	Name        string
+	Metric      string
+	// UnitPrice is the exact price of one unit (of one package for package
+	// pricing) in major units of Currency; it may be finer than the
+	// currency's minor unit. Graduated and volume plans price by Tiers.
+	UnitPrice    *big.Rat
+	Currency     string
+	FreeQuota    int64
+	PricingModel PricingModel
+	PackageSize  int64
+	Tiers        []Tier
+	// TaxCode is the product tax code of the plan's charges; empty for the
+	// general rate.
+	TaxCode string
 }
 
 type Invoice struct {
@@ -28,16 +57,60 @@ type Invoice struct {
 	OrgID       string
 	PeriodStart time.Time
 	PeriodEnd   time.Time
-	TotalAmount float64
+	Total       money.Money
 	Status      string
+	// Number is the sequential number assigned at finalization, e.g.
+	// "POL-2026-000123"; empty for drafts.
+	Number    string
+	LineItems []LineItem
+	// Transitions is the status history, oldest first.
+	Transitions []StatusTransition
 }
 
+const invoiceColumns = `id, org_id, period_start, period_end, currency, total_minor, status, COALESCE(number, '')`
+
+func scanInvoice(row interface{ Scan(...interface{}) error }) (*Invoice, error) {
+	var inv Invoice
+	err := row.Scan(&inv.ID, &inv.OrgID, &inv.PeriodStart, &inv.PeriodEnd, &inv.Total.Currency, &inv.Total.MinorUnits, &inv.Status, &inv.Number)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	inv.PeriodStart, inv.PeriodEnd = inv.PeriodStart.UTC(), inv.PeriodEnd.UTC()
+	return &inv, nil
+}
+
+// GetPlansByOrg returns the metered plans of orgID itself. Plans included in
+// a subscription's price plan are returned by GetPricePlanComponents.
 func (s *Store) GetPlansByOrg(ctx context.Context, orgID string) ([]Plan, error) {
+	return s.queryPlans(ctx, `WHERE org_id = $1`, orgID)
+}
+
+// GetPricePlanComponents returns the metered components of the given price
+// plans, keyed by price plan ID.
+func (s *Store) GetPricePlanComponents(ctx context.Context, pricePlanIDs []string) (map[string][]Plan, error) {
+	plans, err := s.queryPlans(ctx, `WHERE price_plan_id = ANY($1)`, pq.Array(pricePlanIDs))
+	if err != nil {
+		return nil, err
+	}
+	components := make(map[string][]Plan)
+	for _, p := range plans {
+		components[p.PricePlanID] = append(components[p.PricePlanID], p)
+	}
+	return components, nil
+}
+
+// queryPlans returns the plans matching where, with their tiers.
+func (s *Store) queryPlans(ctx context.Context, where string, args ...interface{}) ([]Plan, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, org_id, name, metric, unit_price, free_quota
+		SELECT id, COALESCE(org_id, ''), COALESCE(price_plan_id, ''), name, metric, unit_price,
+			currency, free_quota, pricing_model, COALESCE(package_size, 0), tax_code
 		FROM plans
-		WHERE org_id = $1
-	`, orgID)
+		`+where+`
+		ORDER BY metric, id
+	`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -46,42 +119,266 @@ func (s *Store) GetPlansByOrg(ctx context.Context, orgID string) ([]Plan, error)
 	var plans []Plan
 	for rows.Next() {
 		var p Plan
-		if err := rows.Scan(&p.ID, &p.OrgID, &p.Name, &p.Metric, &p.UnitPrice, &p.FreeQuota); err != nil {
+		var unitPrice string
+		if err := rows.Scan(&p.ID, &p.OrgID, &p.PricePlanID, &p.Name, &p.Metric, &unitPrice,
+			&p.Currency, &p.FreeQuota, &p.PricingModel, &p.PackageSize, &p.TaxCode); err != nil {
 			return nil, err
 		}
+		if p.UnitPrice, err = money.ParseRat(unitPrice); err != nil {
+			return nil, fmt.Errorf("plan %s: unit price: %w", p.ID, err)
+		}
 		plans = append(plans, p)
 	}
-	return plans, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	ids := make([]string, len(plans))
+	for i := range plans {
+		ids[i] = plans[i].ID
+	}
+	tiers, err := s.getPlanTiers(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range plans {
+		plans[i].Tiers = tiers[plans[i].ID]
+	}
+	return plans, nil
 }
 
-func (s *Store) GetUsageTotal(ctx context.Context, orgID, metric string, start, end time.Time) (int64, error) {
-	var total int64
-	err := s.db.QueryRowContext(ctx, `
-		SELECT COALESCE(SUM(quantity), 0)
-		FROM usage_events
-		WHERE org_id = $1 AND metric = $2 
-		AND occurred_at >= $3 AND occurred_at < $4
-	`, orgID, metric, start, end).Scan(&total)
-	if err != nil && err != sql.ErrNoRows {
-		return 0, err
-	}
-	return total, nil
+// getPlanTiers returns the tiers of the given plans in order, keyed by plan ID.
+func (s *Store) getPlanTiers(ctx context.Context, planIDs []string) (map[string][]Tier, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT plan_id, up_to, unit_price, flat_fee
+		FROM plan_tiers
+		WHERE plan_id = ANY($1)
+		ORDER BY plan_id, position
+	`, pq.Array(planIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tiers := make(map[string][]Tier)
+	for rows.Next() {
+		var planID, unitPrice, flatFee string
+		var upTo sql.NullInt64
+		if err := rows.Scan(&planID, &upTo, &unitPrice, &flatFee); err != nil {
+			return nil, err
+		}
+		var t Tier
+		if upTo.Valid {
+			t.UpTo = &upTo.Int64
+		}
+		if t.UnitPrice, err = money.ParseRat(unitPrice); err != nil {
+			return nil, fmt.Errorf("plan %s: tier unit price: %w", planID, err)
+		}
+		if t.FlatFee, err = money.ParseRat(flatFee); err != nil {
+			return nil, fmt.Errorf("plan %s: tier flat fee: %w", planID, err)
+		}
+		tiers[planID] = append(tiers[planID], t)
+	}
+	return tiers, rows.Err()
 }
 
-func (s *Store) CreateInvoice(ctx context.Context, invoice *Invoice) error {
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO invoices (id, org_id, period_start, period_end, total_amount, status)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (id) DO UPDATE SET
-			total_amount = EXCLUDED.total_amount,
-			status = EXCLUDED.status
-	`, invoice.ID, invoice.OrgID, invoice.PeriodStart, invoice.PeriodEnd, invoice.TotalAmount, invoice.Status)
-	return err
+// RefreshDraftInvoice recomputes the live invoice of orgID for [start, end)
+// with price, which sets the invoice's line items and total. Each org and
+// period has at most one invoice that is not void, so an existing draft is
+// updated in place; a missing one is created only when create is set, and
+// returned as nil otherwise. An invoice that has left draft is never touched:
+// the refresh fails with ErrInvoiceLocked. Creating an invoice whose period
+// overlaps another live invoice of the org fails with ErrPeriodOverlaps.
+//
+// A non-empty idempotencyKey makes the refresh replayable: once an invoice has
+// been refreshed with a key, later calls with that key return it unchanged,
+// whatever its status. Reusing a key for another period fails with
+// ErrIdempotencyKeyReused.
+//
+// price calls other services, so it runs before the transaction and holds no
+// lock. Each draft records when the pricing it holds started; a refresh whose
+// pricing started earlier than that keeps the draft as it is, so concurrent
+// refreshes leave the one that saw the latest usage. The org's prepaid credits
+// are then drawn against the charges (see applyCredits) under an advisory lock
+// on the period. An unchanged invoice writes nothing, which makes repeated
+// refreshes free.
+func (s *Store) RefreshDraftInvoice(ctx context.Context, orgID string, start, end time.Time, create bool, idempotencyKey string, price func(context.Context, *Invoice) error) (*Invoice, error) {
+	replay, live, err := findDraft(ctx, s.db, orgID, start, end, idempotencyKey, false)
+	if err != nil || replay != nil {
+		return replay, err
+	}
+	if live == nil && !create {
+		return nil, nil
+	}
+
+	var pricedAt time.Time
+	if err := s.db.QueryRowContext(ctx, `SELECT clock_timestamp()`).Scan(&pricedAt); err != nil {
+		return nil, err
+	}
+	inv := &Invoice{OrgID: orgID, PeriodStart: start, PeriodEnd: end, Status: InvoiceDraft}
+	if err := price(ctx, inv); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	lockKey := "invoice:" + orgID + ":" + start.UTC().Format(time.RFC3339)
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, lockKey); err != nil {
+		return nil, err
+	}
+
+	// The period may have changed while price ran.
+	replay, live, err = findDraft(ctx, tx, orgID, start, end, idempotencyKey, true)
+	if err != nil || replay != nil {
+		return replay, err
+	}
+	if live == nil && !create {
+		return nil, nil
+	}
+
+	var currentItems []LineItem
+	if live != nil {
+		inv.ID = live.ID
+		items, err := listLineItems(ctx, tx, []string{inv.ID})
+		if err != nil {
+			return nil, err
+		}
+		currentItems = items[inv.ID]
+	}
+
+	if live != nil && live.pricedAt.Valid && live.pricedAt.Time.After(pricedAt) {
+		inv.LineItems, inv.Total = currentItems, live.Total
+	} else if err := applyCredits(ctx, tx, inv); err != nil {
+		return nil, err
+	}
+	// A draft keeps the first key it was generated with.
+	setKey := idempotencyKey != "" && (live == nil || !live.idempotencyKey.Valid)
+	if live != nil && inv.Total == live.Total && lineItemsEqual(inv.LineItems, currentItems) && !setKey {
+		return inv, nil
+	}
+
+	key := sql.NullString{String: idempotencyKey, Valid: idempotencyKey != ""}
+	if live != nil {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE invoices
+			SET currency = $2, total_minor = $3, idempotency_key = COALESCE(idempotency_key, $4),
+				priced_at = GREATEST(priced_at, $5), updated_at = NOW()
+			WHERE id = $1
+		`, inv.ID, inv.Total.Currency, inv.Total.MinorUnits, key, pricedAt)
+	} else {
+		inv.ID = newInvoiceID()
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO invoices (id, org_id, period_start, period_end, currency, total_minor, status, idempotency_key, priced_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`, inv.ID, inv.OrgID, inv.PeriodStart, inv.PeriodEnd, inv.Total.Currency, inv.Total.MinorUnits, inv.Status, key, pricedAt)
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "invoices_org_idempotency_key_idx" {
+		return nil, fmt.Errorf("%w: key %q", ErrIdempotencyKeyReused, idempotencyKey)
+	}
+	if errors.As(err, &pqErr) && pqErr.Code == "23P01" && pqErr.Constraint == "invoices_org_period_live_excl" {
+		return nil, fmt.Errorf("%w: org %s, %s to %s", ErrPeriodOverlaps, orgID, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := replaceLineItems(ctx, tx, inv.ID, inv.LineItems); err != nil {
+		return nil, err
+	}
+
+	if err := s.outbox.Add(ctx, tx, SubjectInvoiceUpdated, invoiceUpdatedEvent(inv)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// liveDraft is the draft of a period as findDraft found it.
+type liveDraft struct {
+	ID             string
+	Total          money.Money
+	idempotencyKey sql.NullString
+	// pricedAt is when the pricing the draft holds started; null for drafts
+	// priced before it was recorded.
+	pricedAt sql.NullTime
 }
 
+// findDraft returns the invoice of orgID that idempotencyKey was used for as
+// replay, with its details, or else the live draft of [start, end), nil when
+// the period has no live invoice. It fails with ErrIdempotencyKeyReused when
+// the key was used for another period and with ErrInvoiceLocked when the
+// period's invoice has left draft. lock locks the draft's row.
+func findDraft(ctx context.Context, q queryer, orgID string, start, end time.Time, idempotencyKey string, lock bool) (replay *Invoice, live *liveDraft, err error) {
+	if idempotencyKey != "" {
+		inv, err := scanInvoice(q.QueryRowContext(ctx, `
+			SELECT `+invoiceColumns+`
+			FROM invoices
+			WHERE org_id = $1 AND idempotency_key = $2
+		`, orgID, idempotencyKey))
+		switch {
+		case err == nil:
+			if !inv.PeriodStart.Equal(start) || !inv.PeriodEnd.Equal(end) {
+				return nil, nil, fmt.Errorf("%w: key %q was used for invoice %s", ErrIdempotencyKeyReused, idempotencyKey, inv.ID)
+			}
+			if err := loadInvoiceDetails(ctx, q, inv); err != nil {
+				return nil, nil, err
+			}
+			return inv, nil, nil
+		case err != ErrInvoiceNotFound:
+			return nil, nil, err
+		}
+	}
+
+	query := `
+		SELECT id, currency, total_minor, status, idempotency_key, priced_at
+		FROM invoices
+		WHERE org_id = $1 AND period_start = $2 AND period_end = $3 AND status <> 'void'`
+	if lock {
+		query += `
+		FOR UPDATE`
+	}
+	var d liveDraft
+	var invStatus string
+	err = q.QueryRowContext(ctx, query, orgID, start, end).Scan(&d.ID, &d.Total.Currency, &d.Total.MinorUnits, &invStatus, &d.idempotencyKey, &d.pricedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if invStatus != InvoiceDraft {
+		return nil, nil, fmt.Errorf("%w: invoice %s is %s", ErrInvoiceLocked, d.ID, invStatus)
+	}
+	return nil, &d, nil
+}
+
+// loadInvoiceDetails attaches the line items and status history of inv.
+func loadInvoiceDetails(ctx context.Context, q queryer, inv *Invoice) error {
+	items, err := listLineItems(ctx, q, []string{inv.ID})
+	if err != nil {
+		return err
+	}
+	transitions, err := listTransitions(ctx, q, []string{inv.ID})
+	if err != nil {
+		return err
+	}
+	inv.LineItems = items[inv.ID]
+	inv.Transitions = transitions[inv.ID]
+	return nil
+}
+
+// ListInvoices returns the latest invoices of orgID with their line items and
+// status history.
 func (s *Store) ListInvoices(ctx context.Context, orgID string) ([]Invoice, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, org_id, period_start, period_end, total_amount, status
+		SELECT `+invoiceColumns+`
 		FROM invoices
 		WHERE org_id = $1
 		ORDER BY created_at DESC
@@ -94,11 +391,32 @@ func (s *Store) ListInvoices(ctx context.Context, orgID string) ([]Invoice, erro
 
 	var invoices []Invoice
 	for rows.Next() {
-		var inv Invoice
-		if err := rows.Scan(&inv.ID, &inv.OrgID, &inv.PeriodStart, &inv.PeriodEnd, &inv.TotalAmount, &inv.Status); err != nil {
+		inv, err := scanInvoice(rows)
+		if err != nil {
 			return nil, err
 		}
-		invoices = append(invoices, inv)
+		invoices = append(invoices, *inv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	ids := make([]string, len(invoices))
+	for i := range invoices {
+		ids[i] = invoices[i].ID
+	}
+	items, err := listLineItems(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+	transitions, err := listTransitions(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range invoices {
+		invoices[i].LineItems = items[invoices[i].ID]
+		invoices[i].Transitions = transitions[invoices[i].ID]
 	}
-	return invoices, rows.Err()
+	return invoices, nil
 }
@@ -0,0 +1,367 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+var (
+	ErrPricePlanNotFound    = errors.New("price plan not found")
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	ErrSubscriptionExists   = errors.New("org already has a subscription")
+)
+
+// BillingInterval is how often a price plan charges its base fee.
+type BillingInterval string
+
+const (
+	IntervalMonth BillingInterval = "month"
+	IntervalYear  BillingInterval = "year"
+)
+
+// months returns the length of the interval in months.
+func (i BillingInterval) months() int {
+	if i == IntervalYear {
+		return 12
+	}
+	return 1
+}
+
+// PricePlan is a price-book entry an org can subscribe to. Its metered
+// components are Plans with PricePlanID set.
+type PricePlan struct {
+	ID       string
+	Name     string
+	Currency string
+	// BaseFee is charged once per billing interval.
+	BaseFee  *big.Rat
+	Interval BillingInterval
+	// TaxCode is the product tax code of the base fee and commitment
+	// true-ups; empty for the general rate.
+	TaxCode string
+}
+
+const (
+	SubscriptionActive   = "active"
+	SubscriptionCanceled = "canceled"
+)
+
+// maxAnchorDay keeps every anchor day present in every month.
+const maxAnchorDay = 28
+
+type Subscription struct {
+	ID          string
+	OrgID       string
+	PricePlanID string
+	Status      string
+	// AnchorDay is the day of the month billing periods start on.
+	AnchorDay int
+	StartedAt time.Time
+	// EndedAt is when billing stops; nil until the subscription is cancelled.
+	EndedAt   *time.Time
+	PricePlan PricePlan
+	// Commitment is the minimum spend the subscription commits to; nil for
+	// none.
+	Commitment *Commitment
+}
+
+// PeriodAt returns the billing period containing t. Periods start on the
+// anchor day and last one billing interval, counted from the subscription's
+// first anchor date, so yearly periods recur in the month the subscription
+// started.
+func (s *Subscription) PeriodAt(t time.Time) billingPeriod {
+	return anchoredPeriod(s.AnchorDay, s.PricePlan.Interval.months(), s.StartedAt, t)
+}
+
+// ActiveDuring reports whether the subscription is billed for any part of
+// [start, end).
+func (s *Subscription) ActiveDuring(start, end time.Time) bool {
+	return s.StartedAt.Before(end) && (s.EndedAt == nil || s.EndedAt.After(start))
+}
+
+// calendarMonth is the billing period of orgs without a subscription.
+func calendarMonth(t time.Time) billingPeriod {
+	return anchoredPeriod(1, 1, time.Time{}, t)
+}
+
+// anchoredPeriod returns the period of months months containing t whose
+// boundaries fall on anchorDay, aligned to the first anchor date at or before
+// origin.
+func anchoredPeriod(anchorDay, months int, origin, t time.Time) billingPeriod {
+	origin, t = origin.UTC(), t.UTC()
+	base := time.Date(origin.Year(), origin.Month(), anchorDay, 0, 0, 0, 0, time.UTC)
+	if base.After(origin) {
+		base = base.AddDate(0, -1, 0)
+	}
+
+	elapsed := (t.Year()-base.Year())*12 + int(t.Month()-base.Month())
+	k := elapsed / months
+	if elapsed < 0 && elapsed%months != 0 {
+		k--
+	}
+	start := base.AddDate(0, k*months, 0)
+	if start.After(t) {
+		start = start.AddDate(0, -months, 0)
+	}
+	return billingPeriod{start: start, end: start.AddDate(0, months, 0)}
+}
+
+const subscriptionColumns = `s.id, s.org_id, s.price_plan_id, s.status, s.anchor_day, s.started_at, s.ended_at,
+	s.commitment_minor, s.commitment_interval, p.name, p.currency, p.base_fee, p.billing_interval, p.tax_code`
+
+func scanSubscription(row interface{ Scan(...interface{}) error }) (*Subscription, error) {
+	var sub Subscription
+	var endedAt sql.NullTime
+	var commitment sql.NullInt64
+	var commitmentInterval sql.NullString
+	var baseFee string
+	err := row.Scan(&sub.ID, &sub.OrgID, &sub.PricePlanID, &sub.Status, &sub.AnchorDay, &sub.StartedAt, &endedAt,
+		&commitment, &commitmentInterval, &sub.PricePlan.Name, &sub.PricePlan.Currency, &baseFee, &sub.PricePlan.Interval,
+		&sub.PricePlan.TaxCode)
+	if err != nil {
+		return nil, err
+	}
+	sub.StartedAt = sub.StartedAt.UTC()
+	if endedAt.Valid {
+		t := endedAt.Time.UTC()
+		sub.EndedAt = &t
+	}
+	sub.PricePlan.ID = sub.PricePlanID
+	if commitment.Valid {
+		sub.Commitment = &Commitment{
+			Amount:   money.Money{MinorUnits: commitment.Int64, Currency: sub.PricePlan.Currency},
+			Interval: BillingInterval(commitmentInterval.String),
+		}
+	}
+	if sub.PricePlan.BaseFee, err = money.ParseRat(baseFee); err != nil {
+		return nil, fmt.Errorf("price plan %s: base fee: %w", sub.PricePlanID, err)
+	}
+	return &sub, nil
+}
+
+const pricePlanColumns = `id, name, currency, base_fee, billing_interval, tax_code`
+
+func scanPricePlan(row interface{ Scan(...interface{}) error }) (*PricePlan, error) {
+	var p PricePlan
+	var baseFee string
+	if err := row.Scan(&p.ID, &p.Name, &p.Currency, &baseFee, &p.Interval, &p.TaxCode); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.BaseFee, err = money.ParseRat(baseFee); err != nil {
+		return nil, fmt.Errorf("price plan %s: base fee: %w", p.ID, err)
+	}
+	return &p, nil
+}
+
+func (s *Store) GetPricePlan(ctx context.Context, id string) (*PricePlan, error) {
+	p, err := scanPricePlan(s.db.QueryRowContext(ctx, `
+		SELECT `+pricePlanColumns+`
+		FROM price_plans
+		WHERE id = $1
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrPricePlanNotFound
+	}
+	return p, err
+}
+
+func (s *Store) ListPricePlans(ctx context.Context) ([]PricePlan, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+pricePlanColumns+`
+		FROM price_plans
+		ORDER BY name, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []PricePlan
+	for rows.Next() {
+		p, err := scanPricePlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, *p)
+	}
+	return plans, rows.Err()
+}
+
+// CreateSubscription starts sub. An org can only have one subscription
+// billed at a time: it fails with ErrSubscriptionExists while another one is
+// active or has not reached its end yet.
+func (s *Store) CreateSubscription(ctx context.Context, sub *Subscription) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "subscription:"+sub.OrgID); err != nil {
+		return err
+	}
+
+	var overlapping bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM subscriptions
+			WHERE org_id = $1 AND (ended_at IS NULL OR ended_at > $2)
+		)
+	`, sub.OrgID, sub.StartedAt).Scan(&overlapping)
+	if err != nil {
+		return err
+	}
+	if overlapping {
+		return ErrSubscriptionExists
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO subscriptions (id, org_id, price_plan_id, status, anchor_day, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, sub.ID, sub.OrgID, sub.PricePlanID, sub.Status, sub.AnchorDay, sub.StartedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505":
+			return ErrSubscriptionExists
+		case "23503":
+			return ErrPricePlanNotFound
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO plan_assignments (subscription_id, org_id, price_plan_id, effective_from)
+		VALUES ($1, $2, $3, $4)
+	`, sub.ID, sub.OrgID, sub.PricePlanID, sub.StartedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetSubscription returns the org's current subscription: the active one, or
+// else the most recently started.
+func (s *Store) GetSubscription(ctx context.Context, orgID string) (*Subscription, error) {
+	sub, err := scanSubscription(s.db.QueryRowContext(ctx, `
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions s
+		JOIN price_plans p ON p.id = s.price_plan_id
+		WHERE s.org_id = $1
+		ORDER BY s.status = 'active' DESC, s.started_at DESC
+		LIMIT 1
+	`, orgID))
+	if err == sql.ErrNoRows {
+		return nil, ErrSubscriptionNotFound
+	}
+	return sub, err
+}
+
+// ChangeSubscriptionPlan moves the org's active subscription to pricePlanID
+// from at on. The current plan assignment ends at at, or at the start of the
+// subscription if it has not started yet, and assignments scheduled after it
+// are dropped.
+func (s *Store) ChangeSubscriptionPlan(ctx context.Context, orgID, pricePlanID string, at time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "subscription:"+orgID); err != nil {
+		return err
+	}
+
+	var subID string
+	var startedAt time.Time
+	err = tx.QueryRowContext(ctx, `
+		UPDATE subscriptions SET price_plan_id = $2, updated_at = NOW()
+		WHERE org_id = $1 AND status = 'active'
+		RETURNING id, started_at
+	`, orgID, pricePlanID).Scan(&subID, &startedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrPricePlanNotFound
+	}
+	if err == sql.ErrNoRows {
+		return ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if at.Before(startedAt) {
+		at = startedAt
+	}
+
+	if err := endAssignments(ctx, tx, subID, at); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO plan_assignments (subscription_id, org_id, price_plan_id, effective_from)
+		VALUES ($1, $2, $3, $4)
+	`, subID, orgID, pricePlanID, at)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelSubscription cancels the org's active subscription, ending it and its
+// plan assignments at endedAt.
+func (s *Store) CancelSubscription(ctx context.Context, orgID string, endedAt time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "subscription:"+orgID); err != nil {
+		return err
+	}
+
+	var subID string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE subscriptions SET status = 'canceled', ended_at = $2, updated_at = NOW()
+		WHERE org_id = $1 AND status = 'active'
+		RETURNING id
+	`, orgID, endedAt).Scan(&subID)
+	if err == sql.ErrNoRows {
+		return ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := endAssignments(ctx, tx, subID, endedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// endAssignments cuts the plan assignments of subID off at t: those starting
+// at or after t are deleted and the one in effect at t ends there.
+func endAssignments(ctx context.Context, tx *sql.Tx, subID string, t time.Time) error {
+	_, err := tx.ExecContext(ctx, `
+		DELETE FROM plan_assignments
+		WHERE subscription_id = $1 AND effective_from >= $2
+	`, subID, t)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE plan_assignments SET effective_to = $2
+		WHERE subscription_id = $1 AND (effective_to IS NULL OR effective_to > $2)
+	`, subID, t)
+	return err
+}
@@ -0,0 +1,135 @@
+package billing
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+func TestSubscription_PeriodAt(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name      string
+		anchorDay int
+		interval  BillingInterval
+		started   time.Time
+		at        time.Time
+		start     time.Time
+		end       time.Time
+	}{
+		{name: "monthly after anchor", anchorDay: 15, interval: IntervalMonth, started: date(2026, 1, 15),
+			at: date(2026, 3, 20), start: date(2026, 3, 15), end: date(2026, 4, 15)},
+		{name: "monthly before anchor", anchorDay: 15, interval: IntervalMonth, started: date(2026, 1, 15),
+			at: date(2026, 3, 14), start: date(2026, 2, 15), end: date(2026, 3, 15)},
+		{name: "monthly on anchor", anchorDay: 15, interval: IntervalMonth, started: date(2026, 1, 15),
+			at: date(2026, 3, 15), start: date(2026, 3, 15), end: date(2026, 4, 15)},
+		{name: "started before anchor day", anchorDay: 20, interval: IntervalMonth, started: date(2026, 1, 10),
+			at: date(2026, 1, 12), start: date(2025, 12, 20), end: date(2026, 1, 20)},
+		{name: "yearly aligned to start month", anchorDay: 1, interval: IntervalYear, started: date(2025, 6, 1),
+			at: date(2026, 5, 31), start: date(2025, 6, 1), end: date(2026, 6, 1)},
+		{name: "yearly second period", anchorDay: 1, interval: IntervalYear, started: date(2025, 6, 1),
+			at: date(2026, 6, 1), start: date(2026, 6, 1), end: date(2027, 6, 1)},
+		{name: "before start", anchorDay: 1, interval: IntervalYear, started: date(2025, 6, 1),
+			at: date(2025, 2, 1), start: date(2024, 6, 1), end: date(2025, 6, 1)},
+	}
+
+	for _, tt := range tests {
+		sub := Subscription{AnchorDay: tt.anchorDay, StartedAt: tt.started, PricePlan: PricePlan{Interval: tt.interval}}
+		p := sub.PeriodAt(tt.at)
+		if !p.start.Equal(tt.start) || !p.end.Equal(tt.end) {
+			t.Errorf("%s: expected [%s, %s), got [%s, %s)", tt.name, tt.start, tt.end, p.start, p.end)
+		}
+	}
+}
+
+func TestCalendarMonth(t *testing.T) {
+	p := calendarMonth(time.Date(2026, 2, 28, 23, 59, 0, 0, time.UTC))
+	if !p.start.Equal(time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)) || !p.end.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected period [%s, %s)", p.start, p.end)
+	}
+}
+
+func TestSubscription_ActiveDuring(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	ended := start.AddDate(0, 0, 10)
+	endedBefore := start
+
+	tests := []struct {
+		name     string
+		sub      Subscription
+		expected bool
+	}{
+		{name: "open ended", sub: Subscription{StartedAt: start.AddDate(0, -2, 0)}, expected: true},
+		{name: "starts after period", sub: Subscription{StartedAt: end}, expected: false},
+		{name: "ends within period", sub: Subscription{StartedAt: start.AddDate(0, -1, 0), EndedAt: &ended}, expected: true},
+		{name: "ended at period start", sub: Subscription{StartedAt: start.AddDate(0, -1, 0), EndedAt: &endedBefore}, expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.sub.ActiveDuring(start, end); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestFeeLineItem(t *testing.T) {
+	pp := &PricePlan{ID: "platform-monthly", Name: "Platform", Currency: "USD", BaseFee: rat(t, "49"), Interval: IntervalMonth}
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		seg         segment
+		amount      int64
+		description string
+	}{
+		{name: "full period", seg: segment{start: start, end: end}, amount: 4900, description: "Platform (monthly base fee)"},
+		{
+			name:        "prorated",
+			seg:         segment{start: start.AddDate(0, 0, 10), end: end, proration: big.NewRat(21, 31)},
+			amount:      3319, // 49 * 21/31 = 33.19...
+			description: "Platform (monthly base fee, prorated 2026-03-11 to 2026-03-31)",
+		},
+	}
+
+	for _, tt := range tests {
+		item, err := feeLineItem(pp, tt.seg, money.RoundHalfUp)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if item.Kind != LineItemRecurring || item.PlanID != "platform-monthly" || item.Metric != "" {
+			t.Errorf("%s: unexpected line item %+v", tt.name, item)
+		}
+		if item.Amount != (money.Money{MinorUnits: tt.amount, Currency: "USD"}) {
+			t.Errorf("%s: expected %d cents, got %v", tt.name, tt.amount, item.Amount)
+		}
+		if item.Description != tt.description {
+			t.Errorf("%s: unexpected description %q", tt.name, item.Description)
+		}
+		if !ratsEqual(item.Proration, tt.seg.proration) || !item.PeriodStart.Equal(tt.seg.start) {
+			t.Errorf("%s: segment not recorded: %+v", tt.name, item)
+		}
+	}
+}
+
+func TestDraftPeriods_FollowsAnchorDay(t *testing.T) {
+	sub := Subscription{AnchorDay: 15, StartedAt: time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC), PricePlan: PricePlan{Interval: IntervalMonth}}
+	now := time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC)
+
+	periods := draftPeriods(time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 18, 0, 0, 0, 0, time.UTC), now, sub.PeriodAt)
+	if len(periods) != 2 {
+		t.Fatalf("expected 2 periods, got %+v", periods)
+	}
+	if !periods[0].start.Equal(time.Date(2026, 2, 15, 0, 0, 0, 0, time.UTC)) || periods[0].current {
+		t.Errorf("unexpected first period %+v", periods[0])
+	}
+	if !periods[1].start.Equal(time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)) || !periods[1].current {
+		t.Errorf("unexpected second period %+v", periods[1])
+	}
+}
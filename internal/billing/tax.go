@@ -0,0 +1,216 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+	identityv1 "github.com/jackthomas00/polaris/proto/identityv1"
+)
+
+// Treatments of tax not charged to an org, from its tax status in
+// identity-svc.
+const (
+	// TaxExempt orgs are not charged tax.
+	TaxExempt = "exempt"
+	// TaxReverseCharge orgs account for the tax themselves, e.g. businesses
+	// buying across EU borders.
+	TaxReverseCharge = "reverse_charge"
+)
+
+// ErrTaxCalculation is returned when the tax of an invoice cannot be
+// computed. The invoice is not priced without its tax.
+var ErrTaxCalculation = errors.New("tax calculation failed")
+
+// TaxCalculator computes the tax on an invoice's charges. It is called every
+// time an invoice is priced, after discounts and before prepaid credits,
+// which pay for the tax like any other charge.
+type TaxCalculator interface {
+	// Calculate returns the tax on each of req's items. Items it returns
+	// nothing for are not taxed.
+	Calculate(ctx context.Context, req *TaxRequest) ([]Tax, error)
+}
+
+// TaxRequest asks for the tax on an invoice's charges.
+type TaxRequest struct {
+	Customer TaxCustomer
+	Currency string
+	// Date is the tax point: the end of the invoice period.
+	Date time.Time
+	// Items are the invoice's net charges per tax code, after discounts.
+	Items []TaxableItem
+}
+
+// TaxCustomer is the org an invoice is taxed for, from its billing profile.
+type TaxCustomer struct {
+	OrgID   string
+	Address Address
+	TaxID   string
+	// Status is "taxable", TaxExempt or TaxReverseCharge.
+	Status string
+}
+
+type Address struct {
+	Line1      string
+	Line2      string
+	City       string
+	Region     string
+	PostalCode string
+	// Country is an ISO 3166-1 alpha-2 code; empty when the org has not
+	// given a billing address.
+	Country string
+}
+
+// TaxableItem is the net of the charges of one tax code.
+type TaxableItem struct {
+	TaxCode string
+	Amount  money.Money
+}
+
+// Tax is the tax on one TaxableItem.
+type Tax struct {
+	TaxCode string
+	// Jurisdiction is the country, or "country-region", of the rate.
+	Jurisdiction string
+	// Name is the tax's name on invoices, e.g. "VAT".
+	Name        string
+	RatePercent *big.Rat
+	// Basis is the amount taxed.
+	Basis  money.Money
+	Amount money.Money
+	// Treatment is TaxExempt or TaxReverseCharge when the customer is not
+	// charged the tax, whose Amount is then zero.
+	Treatment string
+}
+
+// taxes returns the tax lines of items, the charges and discounts of inv,
+// from the service's tax calculator. org is the billing profile of inv's org,
+// nil when unknown. It returns nil without a calculator.
+func (s *Service) taxes(ctx context.Context, inv *Invoice, items []LineItem, currency string, org *identityv1.GetOrganizationResponse) ([]LineItem, error) {
+	if s.tax == nil {
+		return nil, nil
+	}
+	taxable := taxableItems(items, currency)
+	if len(taxable) == 0 {
+		return nil, nil
+	}
+	customer := taxCustomer(inv.OrgID, org)
+
+	taxes, err := s.tax.Calculate(ctx, &TaxRequest{
+		Customer: *customer,
+		Currency: currency,
+		Date:     inv.PeriodEnd,
+		Items:    taxable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTaxCalculation, err)
+	}
+	lines := make([]LineItem, len(taxes))
+	for i, t := range taxes {
+		if t.Amount.Currency != currency || t.Basis.Currency != currency {
+			return nil, fmt.Errorf("%w: tax in %s on an invoice in %s", ErrTaxCalculation, t.Amount.Currency, currency)
+		}
+		lines[i] = taxLineItem(t, customer)
+	}
+	return lines, nil
+}
+
+// taxCustomer returns orgID as a tax customer, from its billing profile org.
+// Without a profile the org has no address, so it is not taxed.
+func taxCustomer(orgID string, org *identityv1.GetOrganizationResponse) *TaxCustomer {
+	customer := &TaxCustomer{OrgID: orgID}
+	if org == nil {
+		return customer
+	}
+	if a := org.BillingAddress; a != nil {
+		customer.Address = Address{
+			Line1:      a.Line1,
+			Line2:      a.Line2,
+			City:       a.City,
+			Region:     a.Region,
+			PostalCode: a.PostalCode,
+			Country:    a.Country,
+		}
+	}
+	customer.TaxID = org.TaxId
+	customer.Status = org.TaxStatus
+	return customer
+}
+
+// taxableItems sums the charges and discounts among items by tax code, in the
+// order the codes first appear. Codes whose net is not positive are left out.
+// Credits draw on the taxed total, so they are not part of it.
+func taxableItems(items []LineItem, currency string) []TaxableItem {
+	var codes []string
+	net := make(map[string]int64)
+	for _, item := range items {
+		switch item.Kind {
+		case LineItemUsage, LineItemRecurring, LineItemTrueUp, LineItemDiscount:
+		default:
+			continue
+		}
+		if _, ok := net[item.TaxCode]; !ok {
+			codes = append(codes, item.TaxCode)
+		}
+		net[item.TaxCode] += item.Amount.MinorUnits
+	}
+
+	var taxable []TaxableItem
+	for _, code := range codes {
+		if net[code] > 0 {
+			taxable = append(taxable, TaxableItem{TaxCode: code, Amount: money.Money{MinorUnits: net[code], Currency: currency}})
+		}
+	}
+	return taxable
+}
+
+// taxLineItem returns the line item charging t to customer. Lines of tax
+// not charged say why, naming the tax ID a reverse charge relies on.
+func taxLineItem(t Tax, customer *TaxCustomer) LineItem {
+	var description string
+	switch t.Treatment {
+	case TaxExempt:
+		description = fmt.Sprintf("%s exempt (%s)", t.Name, t.Jurisdiction)
+	case TaxReverseCharge:
+		description = fmt.Sprintf("%s reverse charge (%s, customer tax ID %s)", t.Name, t.Jurisdiction, customer.TaxID)
+	default:
+		description = fmt.Sprintf("%s %s%% (%s)", t.Name, money.FormatRat(t.RatePercent), t.Jurisdiction)
+	}
+	if t.TaxCode != "" {
+		description = fmt.Sprintf("%s on %s", description, t.TaxCode)
+	}
+	return LineItem{
+		Kind:               LineItemTax,
+		Description:        description,
+		Quantity:           1,
+		ChargeableQuantity: 1,
+		PricingModel:       PricingPerUnit,
+		UnitPrice:          t.Amount.Rat(),
+		Amount:             t.Amount,
+		TaxCode:            t.TaxCode,
+		Tax: &TaxDetail{
+			Jurisdiction: t.Jurisdiction,
+			RatePercent:  t.RatePercent,
+			Basis:        t.Basis,
+			Treatment:    t.Treatment,
+		},
+	}
+}
+
+// NewTaxCalculator returns the built-in tax calculator named provider:
+// "rules" (the default) taxes by the tax_rules table, and "none" returns nil,
+// which leaves invoices untaxed. External providers are wired in with
+// NewProviderTaxCalculator.
+func NewTaxCalculator(provider string, store *Store, rounding money.RoundingMode) (TaxCalculator, error) {
+	switch provider {
+	case "", "rules":
+		return NewRuleTaxCalculator(store, rounding), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown tax provider %q; expected rules or none", provider)
+	}
+}
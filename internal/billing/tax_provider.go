@@ -0,0 +1,104 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// TaxProviderClient is the transport to an external tax service, typically a
+// thin wrapper around the vendor's API client. Amounts cross it as decimal
+// strings in major units, the form tax APIs take and return.
+type TaxProviderClient interface {
+	Quote(ctx context.Context, req *TaxQuoteRequest) (*TaxQuoteResponse, error)
+}
+
+// TaxQuoteRequest asks the provider for the tax on some lines.
+type TaxQuoteRequest struct {
+	Customer TaxCustomer
+	Currency string
+	Date     time.Time
+	Lines    []TaxQuoteLine
+}
+
+type TaxQuoteLine struct {
+	// Ref identifies the line in the response.
+	Ref     string
+	TaxCode string
+	// Amount is a decimal in major units, e.g. "120.00".
+	Amount string
+}
+
+type TaxQuoteResponse struct {
+	Lines []TaxQuoteResult
+}
+
+// TaxQuoteResult is the tax on one line of the request. A line may have
+// several, e.g. state and county sales tax.
+type TaxQuoteResult struct {
+	Ref          string
+	Jurisdiction string
+	Name         string
+	// RatePercent is a decimal, e.g. "7.25".
+	RatePercent   string
+	TaxableAmount string
+	TaxAmount     string
+	// Treatment is TaxExempt, TaxReverseCharge or empty.
+	Treatment string
+}
+
+// ProviderTaxCalculator adapts an external tax service to TaxCalculator. The
+// provider decides jurisdictions, rates and exemptions; the adapter only maps
+// the request and checks the response refers to lines it asked about.
+type ProviderTaxCalculator struct {
+	client TaxProviderClient
+}
+
+func NewProviderTaxCalculator(client TaxProviderClient) *ProviderTaxCalculator {
+	return &ProviderTaxCalculator{client: client}
+}
+
+func (c *ProviderTaxCalculator) Calculate(ctx context.Context, req *TaxRequest) ([]Tax, error) {
+	quote := &TaxQuoteRequest{
+		Customer: req.Customer,
+		Currency: req.Currency,
+		Date:     req.Date,
+		Lines:    make([]TaxQuoteLine, len(req.Items)),
+	}
+	for i, item := range req.Items {
+		quote.Lines[i] = TaxQuoteLine{Ref: strconv.Itoa(i), TaxCode: item.TaxCode, Amount: item.Amount.Decimal()}
+	}
+
+	resp, err := c.client.Quote(ctx, quote)
+	if err != nil {
+		return nil, err
+	}
+
+	taxes := make([]Tax, 0, len(resp.Lines))
+	for _, r := range resp.Lines {
+		i, err := strconv.Atoi(r.Ref)
+		if err != nil || i < 0 || i >= len(req.Items) {
+			return nil, fmt.Errorf("tax provider returned unknown line %q", r.Ref)
+		}
+		t := Tax{
+			TaxCode:      req.Items[i].TaxCode,
+			Jurisdiction: r.Jurisdiction,
+			Name:         r.Name,
+			Treatment:    r.Treatment,
+		}
+		if t.RatePercent, err = money.ParseRat(r.RatePercent); err != nil {
+			return nil, fmt.Errorf("tax provider line %s: rate: %w", r.Ref, err)
+		}
+		if t.Basis, err = money.ParseDecimal(r.TaxableAmount, req.Currency); err != nil {
+			return nil, fmt.Errorf("tax provider line %s: taxable amount: %w", r.Ref, err)
+		}
+		if t.Amount, err = money.ParseDecimal(r.TaxAmount, req.Currency); err != nil {
+			return nil, fmt.Errorf("tax provider line %s: tax amount: %w", r.Ref, err)
+		}
+		taxes = append(taxes, t)
+	}
+	return taxes, nil
+}
@@ -0,0 +1,140 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+)
+
+// TaxRule is a rate charged in a jurisdiction on a tax code. An empty Region
+// or TaxCode matches any.
+type TaxRule struct {
+	ID          string
+	Country     string
+	Region      string
+	TaxCode     string
+	Name        string
+	RatePercent *big.Rat
+}
+
+// jurisdiction names where the rule applies, e.g. "DE" or "US-CA".
+func (r *TaxRule) jurisdiction() string {
+	if r.Region == "" {
+		return r.Country
+	}
+	return r.Country + "-" + r.Region
+}
+
+// RuleTaxCalculator is the built-in TaxCalculator. It charges the rate of the
+// most specific rule in tax_rules matching the customer's billing address
+// and each item's tax code, rounded with its rounding mode. Customers without
+// an address, and items no rule matches, are not taxed.
+type RuleTaxCalculator struct {
+	store    *Store
+	rounding money.RoundingMode
+}
+
+func NewRuleTaxCalculator(store *Store, rounding money.RoundingMode) *RuleTaxCalculator {
+	return &RuleTaxCalculator{store: store, rounding: rounding}
+}
+
+func (c *RuleTaxCalculator) Calculate(ctx context.Context, req *TaxRequest) ([]Tax, error) {
+	if req.Customer.Address.Country == "" {
+		return nil, nil
+	}
+	rules, err := c.store.TaxRules(ctx, req.Customer.Address.Country)
+	if err != nil {
+		return nil, err
+	}
+	return applyTaxRules(rules, req, c.rounding)
+}
+
+// applyTaxRules returns the tax on each of req's items under the most specific
+// of rules. Exempt and reverse charged customers get zero-amount lines that
+// still record the basis and rate.
+func applyTaxRules(rules []TaxRule, req *TaxRequest, rounding money.RoundingMode) ([]Tax, error) {
+	var taxes []Tax
+	for _, item := range req.Items {
+		rule := matchTaxRule(rules, req.Customer.Address.Region, item.TaxCode)
+		if rule == nil {
+			continue
+		}
+		t := Tax{
+			TaxCode:      item.TaxCode,
+			Jurisdiction: rule.jurisdiction(),
+			Name:         rule.Name,
+			RatePercent:  rule.RatePercent,
+			Basis:        item.Amount,
+			Amount:       money.Zero(item.Amount.Currency),
+		}
+		switch req.Customer.Status {
+		case TaxExempt, TaxReverseCharge:
+			t.Treatment = req.Customer.Status
+		default:
+			r := new(big.Rat).Mul(item.Amount.Rat(), rule.RatePercent)
+			amount, err := money.FromRat(r.Quo(r, big.NewRat(100, 1)), item.Amount.Currency, rounding)
+			if err != nil {
+				return nil, fmt.Errorf("tax rule %s: %w", rule.ID, err)
+			}
+			t.Amount = amount
+		}
+		taxes = append(taxes, t)
+	}
+	return taxes, nil
+}
+
+// matchTaxRule returns the rule among rules, all of the customer's country,
+// that applies to taxCode in region: a rule for the region beats one for the
+// whole country, then a rule for the tax code beats a general one. It returns
+// nil when none applies.
+func matchTaxRule(rules []TaxRule, region, taxCode string) *TaxRule {
+	var best *TaxRule
+	bestScore := -1
+	for i := range rules {
+		r := &rules[i]
+		if (r.Region != "" && r.Region != region) || (r.TaxCode != "" && r.TaxCode != taxCode) {
+			continue
+		}
+		score := 0
+		if r.Region != "" {
+			score += 2
+		}
+		if r.TaxCode != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = r, score
+		}
+	}
+	return best
+}
+
+// TaxRules returns the tax rules of country.
+func (s *Store) TaxRules(ctx context.Context, country string) ([]TaxRule, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, country, region, tax_code, name, rate_percent
+		FROM tax_rules
+		WHERE country = $1
+		ORDER BY region, tax_code, id
+	`, country)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []TaxRule
+	for rows.Next() {
+		var r TaxRule
+		var rate string
+		if err := rows.Scan(&r.ID, &r.Country, &r.Region, &r.TaxCode, &r.Name, &rate); err != nil {
+			return nil, err
+		}
+		if r.RatePercent, err = money.ParseRat(rate); err != nil {
+			return nil, fmt.Errorf("tax rule %s: rate: %w", r.ID, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
@@ -0,0 +1,214 @@
+package billing
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/jackthomas00/polaris/pkg/money"
+	identityv1 "github.com/jackthomas00/polaris/proto/identityv1"
+)
+
+func TestApplyTaxRules(t *testing.T) {
+	eur := func(minor int64) money.Money { return money.Money{MinorUnits: minor, Currency: "EUR"} }
+	rules := []TaxRule{
+		{ID: "de-vat", Country: "DE", Name: "VAT", RatePercent: big.NewRat(19, 1)},
+		{ID: "de-vat-ebook", Country: "DE", TaxCode: "ebook", Name: "VAT", RatePercent: big.NewRat(7, 1)},
+		{ID: "de-by", Country: "DE", Region: "BY", Name: "VAT", RatePercent: big.NewRat(16, 1)},
+	}
+	items := []TaxableItem{{Amount: eur(10000)}, {TaxCode: "ebook", Amount: eur(1999)}}
+	customer := func(region, status string) TaxCustomer {
+		return TaxCustomer{Address: Address{Country: "DE", Region: region}, Status: status}
+	}
+
+	tests := []struct {
+		name     string
+		customer TaxCustomer
+		items    []TaxableItem
+		expected []Tax
+	}{
+		{
+			name:     "tax code rule beats the general rate",
+			customer: customer("", "taxable"),
+			items:    items,
+			expected: []Tax{
+				{Jurisdiction: "DE", RatePercent: big.NewRat(19, 1), Basis: eur(10000), Amount: eur(1900)},
+				{TaxCode: "ebook", Jurisdiction: "DE", RatePercent: big.NewRat(7, 1), Basis: eur(1999), Amount: eur(140)},
+			},
+		},
+		{
+			name:     "region rule beats the country's",
+			customer: customer("BY", "taxable"),
+			items:    items,
+			expected: []Tax{
+				{Jurisdiction: "DE-BY", RatePercent: big.NewRat(16, 1), Basis: eur(10000), Amount: eur(1600)},
+				{TaxCode: "ebook", Jurisdiction: "DE-BY", RatePercent: big.NewRat(16, 1), Basis: eur(1999), Amount: eur(320)},
+			},
+		},
+		{
+			name:     "exempt customer is charged nothing",
+			customer: customer("", TaxExempt),
+			items:    items[:1],
+			expected: []Tax{
+				{Jurisdiction: "DE", RatePercent: big.NewRat(19, 1), Basis: eur(10000), Amount: eur(0), Treatment: TaxExempt},
+			},
+		},
+		{
+			name:     "reverse charge keeps the basis",
+			customer: customer("", TaxReverseCharge),
+			items:    items[:1],
+			expected: []Tax{
+				{Jurisdiction: "DE", RatePercent: big.NewRat(19, 1), Basis: eur(10000), Amount: eur(0), Treatment: TaxReverseCharge},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &TaxRequest{Customer: tt.customer, Currency: "EUR", Items: tt.items}
+			taxes, err := applyTaxRules(rules, req, money.RoundHalfUp)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(taxes) != len(tt.expected) {
+				t.Fatalf("expected %d taxes, got %d: %+v", len(tt.expected), len(taxes), taxes)
+			}
+			for i, tax := range taxes {
+				want := tt.expected[i]
+				if tax.TaxCode != want.TaxCode || tax.Jurisdiction != want.Jurisdiction || !ratsEqual(tax.RatePercent, want.RatePercent) ||
+					tax.Basis != want.Basis || tax.Amount != want.Amount || tax.Treatment != want.Treatment {
+					t.Errorf("tax %d: expected %+v, got %+v", i, want, tax)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchTaxRule(t *testing.T) {
+	rules := []TaxRule{
+		{ID: "us-ca", Country: "US", Region: "CA"},
+		{ID: "us-ca-saas", Country: "US", Region: "CA", TaxCode: "saas"},
+		{ID: "us-saas", Country: "US", TaxCode: "saas"},
+	}
+
+	tests := []struct {
+		name     string
+		region   string
+		taxCode  string
+		expected string // empty for no match
+	}{
+		{name: "region and code", region: "CA", taxCode: "saas", expected: "us-ca-saas"},
+		{name: "region only", region: "CA", taxCode: "", expected: "us-ca"},
+		{name: "code only", region: "NY", taxCode: "saas", expected: "us-saas"},
+		{name: "no match", region: "NY", taxCode: "", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			if r := matchTaxRule(rules, tt.region, tt.taxCode); r != nil {
+				got = r.ID
+			}
+			if got != tt.expected {
+				t.Errorf("expected rule %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTaxableItems(t *testing.T) {
+	usd := func(minor int64) money.Money { return money.Money{MinorUnits: minor, Currency: "USD"} }
+	items := []LineItem{
+		{Kind: LineItemRecurring, Amount: usd(10000)},
+		{Kind: LineItemUsage, TaxCode: "ebook", Amount: usd(3000)},
+		{Kind: LineItemTrueUp, Amount: usd(500)},
+		{Kind: LineItemDiscount, Amount: usd(-2000)},
+		{Kind: LineItemDiscount, TaxCode: "ebook", Amount: usd(-3000)},
+		{Kind: LineItemCredit, Amount: usd(-1000)},
+	}
+
+	taxable := taxableItems(items, "USD")
+	expected := []TaxableItem{{Amount: usd(8500)}}
+	if len(taxable) != len(expected) {
+		t.Fatalf("expected %d taxable items, got %+v", len(expected), taxable)
+	}
+	for i, item := range taxable {
+		if item != expected[i] {
+			t.Errorf("item %d: expected %+v, got %+v", i, expected[i], item)
+		}
+	}
+}
+
+func TestTaxCustomer(t *testing.T) {
+	t.Run("no billing profile", func(t *testing.T) {
+		if got := taxCustomer("org-1", nil); *got != (TaxCustomer{OrgID: "org-1"}) {
+			t.Errorf("expected an org without an address, got %+v", got)
+		}
+	})
+
+	t.Run("billing profile", func(t *testing.T) {
+		org := &identityv1.GetOrganizationResponse{
+			BillingAddress: &identityv1.Address{City: "Munich", Region: "BY", Country: "DE"},
+			TaxId:          "DE123456789",
+			TaxStatus:      TaxReverseCharge,
+		}
+		expected := TaxCustomer{
+			OrgID:   "org-1",
+			Address: Address{City: "Munich", Region: "BY", Country: "DE"},
+			TaxID:   "DE123456789",
+			Status:  TaxReverseCharge,
+		}
+		if got := taxCustomer("org-1", org); *got != expected {
+			t.Errorf("expected %+v, got %+v", expected, got)
+		}
+	})
+}
+
+type fakeTaxProvider struct {
+	TaxProviderClient
+	req  *TaxQuoteRequest
+	resp *TaxQuoteResponse
+}
+
+func (f *fakeTaxProvider) Quote(ctx context.Context, req *TaxQuoteRequest) (*TaxQuoteResponse, error) {
+	f.req = req
+	return f.resp, nil
+}
+
+func TestProviderTaxCalculator(t *testing.T) {
+	usd := func(minor int64) money.Money { return money.Money{MinorUnits: minor, Currency: "USD"} }
+	req := &TaxRequest{
+		Currency: "USD",
+		Items:    []TaxableItem{{Amount: usd(12000)}, {TaxCode: "saas", Amount: usd(5000)}},
+	}
+
+	t.Run("maps quotes back to items", func(t *testing.T) {
+		provider := &fakeTaxProvider{resp: &TaxQuoteResponse{Lines: []TaxQuoteResult{
+			{Ref: "1", Jurisdiction: "US-CA", Name: "State tax", RatePercent: "6", TaxableAmount: "50.00", TaxAmount: "3.00"},
+			{Ref: "1", Jurisdiction: "US-CA-LA", Name: "County tax", RatePercent: "1.25", TaxableAmount: "50.00", TaxAmount: "0.63"},
+		}}}
+		taxes, err := NewProviderTaxCalculator(provider).Calculate(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := provider.req.Lines; len(got) != 2 || got[0].Amount != "120.00" || got[1].TaxCode != "saas" {
+			t.Errorf("unexpected quote lines %+v", got)
+		}
+		if len(taxes) != 2 {
+			t.Fatalf("expected 2 taxes, got %+v", taxes)
+		}
+		if taxes[1].TaxCode != "saas" || taxes[1].Amount != usd(63) || taxes[1].Basis != usd(5000) ||
+			!ratsEqual(taxes[1].RatePercent, big.NewRat(5, 4)) {
+			t.Errorf("unexpected tax %+v", taxes[1])
+		}
+	})
+
+	t.Run("unknown line", func(t *testing.T) {
+		provider := &fakeTaxProvider{resp: &TaxQuoteResponse{Lines: []TaxQuoteResult{
+			{Ref: "2", RatePercent: "6", TaxableAmount: "50.00", TaxAmount: "3.00"},
+		}}}
+		if _, err := NewProviderTaxCalculator(provider).Calculate(context.Background(), req); err == nil {
+			t.Error("expected an error for a line the request did not have")
+		}
+	})
+}
@@ -12,8 +12,17 @@ import (
 )
 
 type AuthContext struct {
-	OrgID  string
-	APIKey string
+	OrgID    string
+	APIKey   string
+	APIKeyID string
+	// Operator is set for the keys of the platform's operators, who may void
+	// any org's invoices, record their payment and write them off.
+	Operator bool
+}
+
+// Actor identifies the caller in audit records without exposing its key.
+func (a *AuthContext) Actor() string {
+	return "api_key:" + a.APIKeyID
 }
 
 func ValidateAPIKey(ctx context.Context, identityAddr, apiKey string) (*AuthContext, error) {
@@ -41,8 +50,10 @@ func ValidateAPIKey(ctx context.Context, identityAddr, apiKey string) (*AuthCont
 	}
 
 	return &AuthContext{
-		OrgID:  resp.OrgId,
-		APIKey: apiKey,
+		OrgID:    resp.OrgId,
+		APIKey:   apiKey,
+		APIKeyID: resp.ApiKeyId,
+		Operator: resp.Operator,
 	}, nil
 }
 
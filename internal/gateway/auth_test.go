@@ -71,3 +71,10 @@ func TestAuthContext_OrgIDNotFromClient(t *testing.T) {
 	// - All resolvers use authCtx.OrgID from context
 	// - authCtx is only set by AuthMiddleware after validating API key with identity service
 }
+
+func TestAuthContext_Actor(t *testing.T) {
+	authCtx := &AuthContext{OrgID: "org-1", APIKey: "test-api-key-12345", APIKeyID: "key-1"}
+	if got := authCtx.Actor(); got != "api_key:key-1" {
+		t.Errorf("expected %q, got %q", "api_key:key-1", got)
+	}
+}
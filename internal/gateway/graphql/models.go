@@ -1,21 +1,240 @@
 package graphql
 
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
 type Organization struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	BillingAddress  *Address `json:"billingAddress,omitempty"`
+	TaxID           *string  `json:"taxId,omitempty"`
+	TaxStatus       string   `json:"taxStatus"`
+	BillingCurrency string   `json:"billingCurrency"`
+}
+
+type Address struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"`
+}
+
+type AddressInput struct {
+	Line1      string  `json:"line1"`
+	Line2      *string `json:"line2,omitempty"`
+	City       string  `json:"city"`
+	Region     *string `json:"region,omitempty"`
+	PostalCode string  `json:"postalCode"`
+	Country    string  `json:"country"`
 }
 
 type UsageAggregate struct {
-	Metric      string  `json:"metric"`
-	Total       float64 `json:"total"`
-	PeriodStart string  `json:"periodStart"`
-	PeriodEnd   string  `json:"periodEnd"`
+	Metric      string       `json:"metric"`
+	Granularity Granularity  `json:"granularity"`
+	Total       float64      `json:"total"`
+	PeriodStart string       `json:"periodStart"`
+	PeriodEnd   string       `json:"periodEnd"`
+	Dimensions  []*Dimension `json:"dimensions"`
+}
+
+type Dimension struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type DimensionInput struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type UsageAggregateConnection struct {
+	Edges    []*UsageAggregateEdge `json:"edges"`
+	PageInfo *PageInfo             `json:"pageInfo"`
+}
+
+type UsageAggregateEdge struct {
+	Cursor string          `json:"cursor"`
+	Node   *UsageAggregate `json:"node"`
+}
+
+type PageInfo struct {
+	HasNextPage     bool    `json:"hasNextPage"`
+	HasPreviousPage bool    `json:"hasPreviousPage"`
+	StartCursor     *string `json:"startCursor,omitempty"`
+	EndCursor       *string `json:"endCursor,omitempty"`
 }
 
 type Invoice struct {
-	ID          string  `json:"id"`
-	TotalAmount float64 `json:"totalAmount"`
-	Status      string  `json:"status"`
-	PeriodStart string  `json:"periodStart"`
-	PeriodEnd   string  `json:"periodEnd"`
+	ID            string                     `json:"id"`
+	Number        *string                    `json:"number,omitempty"`
+	Currency      string                     `json:"currency"`
+	TotalAmount   *Money                     `json:"totalAmount"`
+	Status        string                     `json:"status"`
+	PeriodStart   string                     `json:"periodStart"`
+	PeriodEnd     string                     `json:"periodEnd"`
+	LineItems     []*InvoiceLineItem         `json:"lineItems"`
+	StatusHistory []*InvoiceStatusTransition `json:"statusHistory"`
+}
+
+type InvoiceStatusTransition struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+	At     string `json:"at"`
+}
+
+type InvoiceLineItem struct {
+	Kind               string                 `json:"kind"`
+	Description        string                 `json:"description"`
+	PlanID             string                 `json:"planId"`
+	Metric             string                 `json:"metric"`
+	Quantity           float64                `json:"quantity"`
+	FreeQuotaApplied   float64                `json:"freeQuotaApplied"`
+	ChargeableQuantity float64                `json:"chargeableQuantity"`
+	PricingModel       string                 `json:"pricingModel"`
+	UnitPrice          *string                `json:"unitPrice,omitempty"`
+	PackageSize        *float64               `json:"packageSize,omitempty"`
+	Tiers              []*InvoiceLineItemTier `json:"tiers"`
+	Amount             *Money                 `json:"amount"`
+	PeriodStart        *string                `json:"periodStart,omitempty"`
+	PeriodEnd          *string                `json:"periodEnd,omitempty"`
+	Proration          *string                `json:"proration,omitempty"`
+	CreditGrantID      *string                `json:"creditGrantId,omitempty"`
+	CouponCode         *string                `json:"couponCode,omitempty"`
+	TaxCode            *string                `json:"taxCode,omitempty"`
+	Tax                *InvoiceLineItemTax    `json:"tax,omitempty"`
+}
+
+type InvoiceLineItemTax struct {
+	Jurisdiction string  `json:"jurisdiction"`
+	RatePercent  string  `json:"ratePercent"`
+	Basis        *Money  `json:"basis"`
+	Treatment    *string `json:"treatment,omitempty"`
+}
+
+type InvoiceLineItemTier struct {
+	Tier      int      `json:"tier"`
+	From      float64  `json:"from"`
+	UpTo      *float64 `json:"upTo,omitempty"`
+	Quantity  float64  `json:"quantity"`
+	UnitPrice string   `json:"unitPrice"`
+	FlatFee   string   `json:"flatFee"`
+	Amount    *Money   `json:"amount"`
+}
+
+type PricePlan struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	BaseFee         *Money `json:"baseFee"`
+	BillingInterval string `json:"billingInterval"`
+	Currency        string `json:"currency"`
+}
+
+type BillingSubscription struct {
+	ID                 string      `json:"id"`
+	PricePlan          *PricePlan  `json:"pricePlan"`
+	Status             string      `json:"status"`
+	AnchorDay          int         `json:"anchorDay"`
+	StartedAt          string      `json:"startedAt"`
+	EndedAt            *string     `json:"endedAt,omitempty"`
+	CurrentPeriodStart string      `json:"currentPeriodStart"`
+	CurrentPeriodEnd   string      `json:"currentPeriodEnd"`
+	Commitment         *Commitment `json:"commitment,omitempty"`
+}
+
+type Commitment struct {
+	Amount             *Money `json:"amount"`
+	Interval           string `json:"interval"`
+	CurrentPeriodStart string `json:"currentPeriodStart"`
+	CurrentPeriodEnd   string `json:"currentPeriodEnd"`
+}
+
+type CreditGrant struct {
+	ID          string            `json:"id"`
+	Amount      *Money            `json:"amount"`
+	Remaining   *Money            `json:"remaining"`
+	Priority    int               `json:"priority"`
+	EffectiveAt string            `json:"effectiveAt"`
+	ExpiresAt   *string           `json:"expiresAt,omitempty"`
+	Expired     bool              `json:"expired"`
+	Description string            `json:"description"`
+	GrantedBy   string            `json:"grantedBy"`
+	CreatedAt   string            `json:"createdAt"`
+	Drawdowns   []*CreditDrawdown `json:"drawdowns"`
+}
+
+type CreditDrawdown struct {
+	InvoiceID     string `json:"invoiceId"`
+	InvoiceStatus string `json:"invoiceStatus"`
+	PeriodStart   string `json:"periodStart"`
+	PeriodEnd     string `json:"periodEnd"`
+	Amount        *Money `json:"amount"`
+}
+
+type Coupon struct {
+	Code            string   `json:"code"`
+	Name            string   `json:"name"`
+	PercentOff      *string  `json:"percentOff,omitempty"`
+	AmountOff       *Money   `json:"amountOff,omitempty"`
+	Duration        string   `json:"duration"`
+	DurationPeriods *int     `json:"durationPeriods,omitempty"`
+	Metrics         []string `json:"metrics"`
+}
+
+type CouponRedemption struct {
+	ID            string  `json:"id"`
+	Coupon        *Coupon `json:"coupon"`
+	RedeemedBy    string  `json:"redeemedBy"`
+	RedeemedAt    string  `json:"redeemedAt"`
+	DiscountStart string  `json:"discountStart"`
+	DiscountEnd   *string `json:"discountEnd,omitempty"`
+}
+
+type Money struct {
+	Amount     string `json:"amount"`
+	Currency   string `json:"currency"`
+	MinorUnits string `json:"minorUnits"`
+}
+
+type Granularity string
+
+const (
+	GranularityHour  Granularity = "HOUR"
+	GranularityDay   Granularity = "DAY"
+	GranularityMonth Granularity = "MONTH"
+)
+
+func (e Granularity) IsValid() bool {
+	switch e {
+	case GranularityHour, GranularityDay, GranularityMonth:
+		return true
+	}
+	return false
+}
+
+func (e Granularity) String() string {
+	return string(e)
+}
+
+func (e *Granularity) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = Granularity(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid Granularity", str)
+	}
+	return nil
+}
+
+func (e Granularity) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
 }
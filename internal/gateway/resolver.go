@@ -4,11 +4,16 @@ package gateway
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
+	graphql1 "github.com/jackthomas00/polaris/internal/gateway/graphql"
+	"github.com/jackthomas00/polaris/pkg/money"
 	billingv1 "github.com/jackthomas00/polaris/proto/billingv1"
 	identityv1 "github.com/jackthomas00/polaris/proto/identityv1"
 	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
@@ -70,45 +75,151 @@ func (r *Resolver) Me(ctx context.Context) (*Organization, error) {
 	if err != nil {
 		return nil, err
 	}
+	return organizationFromProto(resp), nil
+}
 
-	return &Organization{
-		ID:   resp.OrgId,
-		Name: resp.Name,
-	}, nil
+// BillingProfile is the billing address and tax ID set by updateBillingProfile.
+type BillingProfile struct {
+	Address Address
+	TaxID   string
 }
 
-func (r *Resolver) Usage(ctx context.Context, metric string) ([]*UsageAggregate, error) {
+func (r *Resolver) UpdateBillingProfile(ctx context.Context, profile BillingProfile) (*Organization, error) {
 	authCtx := GetAuthContext(ctx)
 	if authCtx == nil {
 		return nil, fmt.Errorf("unauthorized")
 	}
 
-	client, close, err := r.getUsageClient()
+	client, close, err := r.getIdentityClient()
 	if err != nil {
 		return nil, err
 	}
 	defer close()
 
-	resp, err := client.GetUsageSummary(ctx, &usagev1.GetUsageSummaryRequest{
-		OrgId:  authCtx.OrgID,
-		Metric: metric,
+	a := profile.Address
+	resp, err := client.UpdateBillingProfile(ctx, &identityv1.UpdateBillingProfileRequest{
+		OrgId: authCtx.OrgID,
+		BillingAddress: &identityv1.Address{
+			Line1:      a.Line1,
+			Line2:      a.Line2,
+			City:       a.City,
+			Region:     a.Region,
+			PostalCode: a.PostalCode,
+			Country:    a.Country,
+		},
+		TaxId: profile.TaxID,
 	})
 	if err != nil {
 		return nil, err
 	}
+	return organizationFromProto(resp), nil
+}
+
+// UsageArgs are the optional arguments of the usage query.
+type UsageArgs struct {
+	Granularity string // "HOUR", "DAY" or "MONTH"; empty means "DAY"
+	Start       string // RFC3339; empty leaves the window open
+	End         string // RFC3339; empty leaves the window open
+	First       int    // page size; 0 uses the usage-svc default
+	After       string // cursor from a previous page
+	Filters     map[string]string
+	GroupBy     []string
+}
+
+// UsagePage is one page of aggregates, newest period first.
+type UsagePage struct {
+	Aggregates  []*UsageAggregate
+	HasNextPage bool
+}
+
+func (r *Resolver) Usage(ctx context.Context, metric string, args UsageArgs) (*UsagePage, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	g, err := granularityToProto(args.Granularity)
+	if err != nil {
+		return nil, err
+	}
+	if args.First < 0 {
+		return nil, fmt.Errorf("first must not be negative")
+	}
 
-	var aggregates []*UsageAggregate
+	req := &usagev1.GetUsageSummaryRequest{
+		OrgId:       authCtx.OrgID,
+		Metric:      metric,
+		Granularity: g,
+		PageSize:    int32(args.First),
+		PageToken:   args.After,
+		Filters:     args.Filters,
+		GroupBy:     args.GroupBy,
+	}
+	if args.Start != "" {
+		start, err := time.Parse(time.RFC3339, args.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start format: %w", err)
+		}
+		req.StartUnix = start.Unix()
+	}
+	if args.End != "" {
+		end, err := time.Parse(time.RFC3339, args.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end format: %w", err)
+		}
+		req.EndUnix = end.Unix()
+	}
+
+	client, close, err := r.getUsageClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.GetUsageSummary(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &UsagePage{HasNextPage: resp.NextPageToken != ""}
 	for _, agg := range resp.Aggregates {
-		aggregates = append(aggregates, &UsageAggregate{
+		page.Aggregates = append(page.Aggregates, &UsageAggregate{
 			Metric:      agg.Metric,
+			Granularity: granularityFromProto(agg.Granularity),
 			Total:       float64(agg.Total),
 			PeriodStart: time.Unix(agg.PeriodStartUnix, 0).UTC().Format(time.RFC3339),
 			PeriodEnd:   time.Unix(agg.PeriodEndUnix, 0).UTC().Format(time.RFC3339),
+			Cursor:      agg.Cursor,
+			Dimensions:  agg.Dimensions,
 		})
 	}
 
-	// If no aggregates, return empty list (not an error)
-	return aggregates, nil
+	// If no aggregates, return an empty page (not an error)
+	return page, nil
+}
+
+func granularityToProto(granularity string) (usagev1.Granularity, error) {
+	switch granularity {
+	case "HOUR":
+		return usagev1.Granularity_GRANULARITY_HOUR, nil
+	case "", "DAY":
+		return usagev1.Granularity_GRANULARITY_DAY, nil
+	case "MONTH":
+		return usagev1.Granularity_GRANULARITY_MONTH, nil
+	default:
+		return usagev1.Granularity_GRANULARITY_UNSPECIFIED, fmt.Errorf("invalid granularity %q", granularity)
+	}
+}
+
+func granularityFromProto(g usagev1.Granularity) string {
+	switch g {
+	case usagev1.Granularity_GRANULARITY_HOUR:
+		return "HOUR"
+	case usagev1.Granularity_GRANULARITY_MONTH:
+		return "MONTH"
+	default:
+		return "DAY"
+	}
 }
 
 func (r *Resolver) Invoices(ctx context.Context) ([]*Invoice, error) {
@@ -132,13 +243,7 @@ func (r *Resolver) Invoices(ctx context.Context) ([]*Invoice, error) {
 
 	var invoices []*Invoice
 	for _, inv := range resp.Invoices {
-		invoices = append(invoices, &Invoice{
-			ID:          inv.Id,
-			TotalAmount: inv.TotalAmount,
-			Status:      inv.Status,
-			PeriodStart: time.Unix(inv.PeriodStartUnix, 0).UTC().Format(time.RFC3339),
-			PeriodEnd:   time.Unix(inv.PeriodEndUnix, 0).Format(time.RFC3339),
-		})
+		invoices = append(invoices, invoiceFromProto(inv))
 	}
 
 	return invoices, nil
@@ -170,7 +275,7 @@ func (r *Resolver) RecordUsage(ctx context.Context, metric string, quantity int)
 	return resp.Success, nil
 }
 
-func (r *Resolver) GenerateInvoice(ctx context.Context, periodStart, periodEnd string) (*Invoice, error) {
+func (r *Resolver) GenerateInvoice(ctx context.Context, periodStart, periodEnd, idempotencyKey string) (*Invoice, error) {
 	authCtx := GetAuthContext(ctx)
 	if authCtx == nil {
 		return nil, fmt.Errorf("unauthorized")
@@ -197,38 +302,896 @@ func (r *Resolver) GenerateInvoice(ctx context.Context, periodStart, periodEnd s
 		OrgId:           authCtx.OrgID,
 		PeriodStartUnix: startTime.Unix(),
 		PeriodEndUnix:   endTime.Unix(),
+		IdempotencyKey:  idempotencyKey,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &Invoice{
-		ID:          resp.Id,
-		TotalAmount: resp.TotalAmount,
-		Status:      resp.Status,
-		PeriodStart: time.Unix(resp.PeriodStartUnix, 0).UTC().Format(time.RFC3339),
-		PeriodEnd:   time.Unix(resp.PeriodEndUnix, 0).UTC().Format(time.RFC3339),
-	}, nil
+	return invoiceFromProto(resp), nil
+}
+
+// FinalizeInvoice issues one of the org's draft invoices, recording the
+// caller's API key as the actor. Voiding, recording payment and writing off
+// are for operators; see TransitionInvoice.
+func (r *Resolver) FinalizeInvoice(ctx context.Context, invoiceID string) (*Invoice, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.FinalizeInvoice(ctx, &billingv1.InvoiceTransitionRequest{
+		OrgId:     authCtx.OrgID,
+		InvoiceId: invoiceID,
+		Actor:     authCtx.Actor(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invoiceFromProto(resp), nil
+}
+
+// TransitionInvoice moves an invoice of orgID to status to, one of "void",
+// "paid" or "uncollectible", recording the caller's API key as the actor
+// along with the optional reason. Only operator keys may, for any org.
+func (r *Resolver) TransitionInvoice(ctx context.Context, orgID, invoiceID, to string, reason *string) (*Invoice, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+	if !authCtx.Operator {
+		return nil, fmt.Errorf("forbidden: operator API key required")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	req := &billingv1.InvoiceTransitionRequest{
+		OrgId:     orgID,
+		InvoiceId: invoiceID,
+		Actor:     authCtx.Actor(),
+	}
+	if reason != nil {
+		req.Reason = *reason
+	}
+	var resp *billingv1.Invoice
+	switch to {
+	case "void":
+		resp, err = client.VoidInvoice(ctx, req)
+	case "paid":
+		resp, err = client.MarkInvoicePaid(ctx, req)
+	case "uncollectible":
+		resp, err = client.MarkUncollectible(ctx, req)
+	default:
+		return nil, fmt.Errorf("unknown invoice status %q", to)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return invoiceFromProto(resp), nil
+}
+
+func (r *Resolver) PricePlans(ctx context.Context) ([]*PricePlan, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.ListPricePlans(ctx, &billingv1.ListPricePlansRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	plans := make([]*PricePlan, len(resp.PricePlans))
+	for i, pp := range resp.PricePlans {
+		plans[i] = pricePlanFromProto(pp)
+	}
+	return plans, nil
+}
+
+// Subscription returns the org's current subscription, or nil if it never
+// subscribed.
+func (r *Resolver) Subscription(ctx context.Context) (*Subscription, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.GetSubscription(ctx, &billingv1.GetSubscriptionRequest{
+		OrgId: authCtx.OrgID,
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return subscriptionFromProto(resp), nil
+}
+
+// Subscribe subscribes the org to a price plan from now on. anchorDay is the
+// day of the month billing periods start; 0 uses today's.
+func (r *Resolver) Subscribe(ctx context.Context, pricePlanID string, anchorDay int) (*Subscription, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.Subscribe(ctx, &billingv1.SubscribeRequest{
+		OrgId:       authCtx.OrgID,
+		PricePlanId: pricePlanID,
+		AnchorDay:   int32(anchorDay),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscriptionFromProto(resp), nil
+}
+
+func (r *Resolver) ChangePlan(ctx context.Context, pricePlanID string) (*Subscription, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.ChangeSubscriptionPlan(ctx, &billingv1.ChangeSubscriptionPlanRequest{
+		OrgId:       authCtx.OrgID,
+		PricePlanId: pricePlanID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscriptionFromProto(resp), nil
+}
+
+func (r *Resolver) CancelSubscription(ctx context.Context, atPeriodEnd bool) (*Subscription, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.CancelSubscription(ctx, &billingv1.CancelSubscriptionRequest{
+		OrgId:       authCtx.OrgID,
+		AtPeriodEnd: atPeriodEnd,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscriptionFromProto(resp), nil
+}
+
+func (r *Resolver) CreditGrants(ctx context.Context) ([]*CreditGrant, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.ListCreditGrants(ctx, &billingv1.ListCreditGrantsRequest{
+		OrgId: authCtx.OrgID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	grants := make([]*CreditGrant, len(resp.Grants))
+	for i, g := range resp.Grants {
+		grants[i] = creditGrantFromProto(g)
+	}
+	return grants, nil
+}
+
+// CreditBalance returns the credit the org can draw now, per currency.
+func (r *Resolver) CreditBalance(ctx context.Context) ([]money.Money, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.GetCreditBalance(ctx, &billingv1.GetCreditBalanceRequest{
+		OrgId: authCtx.OrgID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make([]money.Money, len(resp.Balances))
+	for i, m := range resp.Balances {
+		balances[i] = moneyFromProto(m)
+	}
+	return balances, nil
+}
+
+// RedeemCoupon redeems the coupon with code for the org, recording the
+// caller's API key as the redeemer.
+func (r *Resolver) RedeemCoupon(ctx context.Context, code string) (*CouponRedemption, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.RedeemCoupon(ctx, &billingv1.RedeemCouponRequest{
+		OrgId:    authCtx.OrgID,
+		CouponId: code,
+		Actor:    authCtx.Actor(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redemptionFromProto(resp), nil
+}
+
+func (r *Resolver) CouponRedemptions(ctx context.Context) ([]*CouponRedemption, error) {
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	client, close, err := r.getBillingClient()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	resp, err := client.ListCouponRedemptions(ctx, &billingv1.ListCouponRedemptionsRequest{
+		OrgId: authCtx.OrgID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	redemptions := make([]*CouponRedemption, len(resp.Redemptions))
+	for i, rd := range resp.Redemptions {
+		redemptions[i] = redemptionFromProto(rd)
+	}
+	return redemptions, nil
 }
 
 type Organization struct {
 	ID   string
 	Name string
+	// BillingAddress is nil until the org sets a billing profile.
+	BillingAddress *Address
+	TaxID          string
+	TaxStatus      string
+	// BillingCurrency is the ISO 4217 code the org is invoiced in, empty until
+	// an operator sets it.
+	BillingCurrency string
+}
+
+type Address struct {
+	Line1      string
+	Line2      string
+	City       string
+	Region     string
+	PostalCode string
+	Country    string
+}
+
+func organizationFromProto(resp *identityv1.GetOrganizationResponse) *Organization {
+	org := &Organization{
+		ID:              resp.OrgId,
+		Name:            resp.Name,
+		TaxID:           resp.TaxId,
+		TaxStatus:       resp.TaxStatus,
+		BillingCurrency: resp.BillingCurrency,
+	}
+	if a := resp.BillingAddress; a != nil && a.Country != "" {
+		org.BillingAddress = &Address{
+			Line1:      a.Line1,
+			Line2:      a.Line2,
+			City:       a.City,
+			Region:     a.Region,
+			PostalCode: a.PostalCode,
+			Country:    a.Country,
+		}
+	}
+	return org
 }
 
 type UsageAggregate struct {
 	Metric      string
+	Granularity string
 	Total       float64
 	PeriodStart string
 	PeriodEnd   string
+	Cursor      string
+	Dimensions  map[string]string
 }
 
 type Invoice struct {
 	ID          string
-	TotalAmount float64
+	Currency    string
+	Total       money.Money
 	Status      string
+	Number      string
 	PeriodStart string
 	PeriodEnd   string
+	LineItems   []InvoiceLineItem
+	Transitions []InvoiceStatusTransition
+}
+
+type InvoiceStatusTransition struct {
+	From   string
+	To     string
+	Actor  string
+	Reason string
+	At     string
+}
+
+func invoiceFromProto(inv *billingv1.Invoice) *Invoice {
+	transitions := make([]InvoiceStatusTransition, len(inv.Transitions))
+	for i, t := range inv.Transitions {
+		transitions[i] = InvoiceStatusTransition{
+			From:   t.FromStatus,
+			To:     t.ToStatus,
+			Actor:  t.Actor,
+			Reason: t.Reason,
+			At:     time.Unix(t.AtUnix, 0).UTC().Format(time.RFC3339),
+		}
+	}
+	return &Invoice{
+		ID:          inv.Id,
+		Currency:    inv.Currency,
+		Total:       moneyFromProto(inv.Total),
+		LineItems:   lineItemsFromProto(inv.LineItems),
+		Status:      inv.Status,
+		Number:      inv.Number,
+		PeriodStart: time.Unix(inv.PeriodStartUnix, 0).UTC().Format(time.RFC3339),
+		PeriodEnd:   time.Unix(inv.PeriodEndUnix, 0).UTC().Format(time.RFC3339),
+		Transitions: transitions,
+	}
+}
+
+type InvoiceLineItem struct {
+	Kind               string
+	Description        string
+	PlanID             string
+	Metric             string
+	Quantity           int64
+	FreeQuotaApplied   int64
+	ChargeableQuantity int64
+	PricingModel       string
+	UnitPrice          string
+	PackageSize        int64
+	Tiers              []InvoiceLineItemTier
+	Amount             money.Money
+	// PeriodStart and PeriodEnd are RFC3339, empty for charges of the org's
+	// own plans.
+	PeriodStart string
+	PeriodEnd   string
+	// Proration is empty unless the charge was prorated.
+	Proration string
+	// CreditGrantID is set on credit lines only.
+	CreditGrantID string
+	// CouponID is set on discount lines only.
+	CouponID string
+	TaxCode  string
+	// Tax is set on tax lines only.
+	Tax *InvoiceLineItemTax
+}
+
+type InvoiceLineItemTax struct {
+	Jurisdiction string
+	RatePercent  string
+	Basis        money.Money
+	// Treatment is "exempt" or "reverse_charge" when the tax was not
+	// charged; empty otherwise.
+	Treatment string
+}
+
+type InvoiceLineItemTier struct {
+	Tier         int
+	FromQuantity int64
+	UpTo         *int64
+	Quantity     int64
+	UnitPrice    string
+	FlatFee      string
+	Amount       money.Money
+}
+
+func lineItemsFromProto(items []*billingv1.InvoiceLineItem) []InvoiceLineItem {
+	res := make([]InvoiceLineItem, len(items))
+	for i, li := range items {
+		res[i] = InvoiceLineItem{
+			Kind:               li.Kind,
+			Description:        li.Description,
+			PlanID:             li.PlanId,
+			Metric:             li.Metric,
+			Quantity:           li.Quantity,
+			FreeQuotaApplied:   li.FreeQuotaApplied,
+			ChargeableQuantity: li.ChargeableQuantity,
+			PricingModel:       li.PricingModel,
+			UnitPrice:          li.UnitPrice,
+			PackageSize:        li.PackageSize,
+			Tiers:              tiersFromProto(li.Tiers),
+			Amount:             moneyFromProto(li.Amount),
+			Proration:          li.Proration,
+			CreditGrantID:      li.CreditGrantId,
+			CouponID:           li.CouponId,
+			TaxCode:            li.TaxCode,
+		}
+		if li.PeriodStartUnix != 0 || li.PeriodEndUnix != 0 {
+			res[i].PeriodStart = time.Unix(li.PeriodStartUnix, 0).UTC().Format(time.RFC3339)
+			res[i].PeriodEnd = time.Unix(li.PeriodEndUnix, 0).UTC().Format(time.RFC3339)
+		}
+		if t := li.Tax; t != nil {
+			res[i].Tax = &InvoiceLineItemTax{
+				Jurisdiction: t.Jurisdiction,
+				RatePercent:  t.RatePercent,
+				Basis:        moneyFromProto(t.Basis),
+				Treatment:    t.Treatment,
+			}
+		}
+	}
+	return res
+}
+
+func tiersFromProto(tiers []*billingv1.InvoiceLineItemTier) []InvoiceLineItemTier {
+	res := make([]InvoiceLineItemTier, len(tiers))
+	for i, tc := range tiers {
+		res[i] = InvoiceLineItemTier{
+			Tier:         int(tc.Tier),
+			FromQuantity: tc.FromQuantity,
+			UpTo:         tc.UpTo,
+			Quantity:     tc.Quantity,
+			UnitPrice:    tc.UnitPrice,
+			FlatFee:      tc.FlatFee,
+			Amount:       moneyFromProto(tc.Amount),
+		}
+	}
+	return res
+}
+
+type PricePlan struct {
+	ID              string
+	Name            string
+	BaseFee         money.Money
+	BillingInterval string
+	Currency        string
+}
+
+type Subscription struct {
+	ID                 string
+	PricePlan          *PricePlan
+	Status             string
+	AnchorDay          int
+	StartedAt          string
+	EndedAt            string // empty while not cancelled
+	CurrentPeriodStart string
+	CurrentPeriodEnd   string
+	Commitment         *Commitment // nil without a minimum commitment
+}
+
+type Commitment struct {
+	Amount             money.Money
+	Interval           string
+	CurrentPeriodStart string
+	CurrentPeriodEnd   string
+}
+
+type CreditGrant struct {
+	ID          string
+	Amount      money.Money
+	Remaining   money.Money
+	Priority    int
+	EffectiveAt string
+	ExpiresAt   string // empty for credits that never expire
+	Expired     bool
+	Description string
+	GrantedBy   string
+	CreatedAt   string
+	Drawdowns   []CreditDrawdown
+}
+
+type CreditDrawdown struct {
+	InvoiceID     string
+	InvoiceStatus string
+	PeriodStart   string
+	PeriodEnd     string
+	Amount        money.Money
+}
+
+func creditGrantFromProto(g *billingv1.CreditGrant) *CreditGrant {
+	res := &CreditGrant{
+		ID:          g.Id,
+		Amount:      moneyFromProto(g.Amount),
+		Remaining:   moneyFromProto(g.Remaining),
+		Priority:    int(g.Priority),
+		EffectiveAt: time.Unix(g.EffectiveAtUnix, 0).UTC().Format(time.RFC3339),
+		Expired:     g.Expired,
+		Description: g.Description,
+		GrantedBy:   g.Actor,
+		CreatedAt:   time.Unix(g.CreatedAtUnix, 0).UTC().Format(time.RFC3339),
+	}
+	if g.ExpiresAtUnix != 0 {
+		res.ExpiresAt = time.Unix(g.ExpiresAtUnix, 0).UTC().Format(time.RFC3339)
+	}
+	for _, d := range g.Drawdowns {
+		res.Drawdowns = append(res.Drawdowns, CreditDrawdown{
+			InvoiceID:     d.InvoiceId,
+			InvoiceStatus: d.InvoiceStatus,
+			PeriodStart:   time.Unix(d.PeriodStartUnix, 0).UTC().Format(time.RFC3339),
+			PeriodEnd:     time.Unix(d.PeriodEndUnix, 0).UTC().Format(time.RFC3339),
+			Amount:        moneyFromProto(d.Amount),
+		})
+	}
+	return res
+}
+
+func creditGrantToGraphQL(g *CreditGrant) *graphql1.CreditGrant {
+	res := &graphql1.CreditGrant{
+		ID:          g.ID,
+		Amount:      moneyToGraphQL(g.Amount),
+		Remaining:   moneyToGraphQL(g.Remaining),
+		Priority:    g.Priority,
+		EffectiveAt: g.EffectiveAt,
+		Expired:     g.Expired,
+		Description: g.Description,
+		GrantedBy:   g.GrantedBy,
+		CreatedAt:   g.CreatedAt,
+		Drawdowns:   make([]*graphql1.CreditDrawdown, len(g.Drawdowns)),
+	}
+	if g.ExpiresAt != "" {
+		expiresAt := g.ExpiresAt
+		res.ExpiresAt = &expiresAt
+	}
+	for i, d := range g.Drawdowns {
+		res.Drawdowns[i] = &graphql1.CreditDrawdown{
+			InvoiceID:     d.InvoiceID,
+			InvoiceStatus: d.InvoiceStatus,
+			PeriodStart:   d.PeriodStart,
+			PeriodEnd:     d.PeriodEnd,
+			Amount:        moneyToGraphQL(d.Amount),
+		}
+	}
+	return res
+}
+
+type Coupon struct {
+	Code            string
+	Name            string
+	PercentOff      string // empty for fixed amount coupons
+	AmountOff       *money.Money
+	Duration        string
+	DurationPeriods int
+	Metrics         []string
+}
+
+type CouponRedemption struct {
+	ID            string
+	Coupon        Coupon
+	RedeemedBy    string
+	RedeemedAt    string
+	DiscountStart string
+	DiscountEnd   string // empty for coupons that last forever
+}
+
+func redemptionFromProto(r *billingv1.CouponRedemption) *CouponRedemption {
+	res := &CouponRedemption{
+		ID:            r.Id,
+		RedeemedBy:    r.Actor,
+		RedeemedAt:    time.Unix(r.RedeemedAtUnix, 0).UTC().Format(time.RFC3339),
+		DiscountStart: time.Unix(r.DiscountStartUnix, 0).UTC().Format(time.RFC3339),
+	}
+	if r.DiscountEndUnix != 0 {
+		res.DiscountEnd = time.Unix(r.DiscountEndUnix, 0).UTC().Format(time.RFC3339)
+	}
+	if c := r.Coupon; c != nil {
+		res.Coupon = Coupon{
+			Code:            c.Id,
+			Name:            c.Name,
+			PercentOff:      c.PercentOff,
+			Duration:        c.Duration,
+			DurationPeriods: int(c.DurationPeriods),
+			Metrics:         c.Metrics,
+		}
+		if c.AmountOff != nil {
+			m := moneyFromProto(c.AmountOff)
+			res.Coupon.AmountOff = &m
+		}
+	}
+	return res
+}
+
+func redemptionToGraphQL(r *CouponRedemption) *graphql1.CouponRedemption {
+	c := &graphql1.Coupon{
+		Code:     r.Coupon.Code,
+		Name:     r.Coupon.Name,
+		Duration: r.Coupon.Duration,
+		Metrics:  r.Coupon.Metrics,
+	}
+	if c.Metrics == nil {
+		c.Metrics = []string{}
+	}
+	if r.Coupon.PercentOff != "" {
+		percentOff := r.Coupon.PercentOff
+		c.PercentOff = &percentOff
+	}
+	if r.Coupon.AmountOff != nil {
+		c.AmountOff = moneyToGraphQL(*r.Coupon.AmountOff)
+	}
+	if r.Coupon.DurationPeriods > 0 {
+		periods := r.Coupon.DurationPeriods
+		c.DurationPeriods = &periods
+	}
+	res := &graphql1.CouponRedemption{
+		ID:            r.ID,
+		Coupon:        c,
+		RedeemedBy:    r.RedeemedBy,
+		RedeemedAt:    r.RedeemedAt,
+		DiscountStart: r.DiscountStart,
+	}
+	if r.DiscountEnd != "" {
+		discountEnd := r.DiscountEnd
+		res.DiscountEnd = &discountEnd
+	}
+	return res
+}
+
+func pricePlanFromProto(pp *billingv1.PricePlan) *PricePlan {
+	return &PricePlan{
+		ID:              pp.GetId(),
+		Name:            pp.GetName(),
+		BaseFee:         moneyFromProto(pp.GetBaseFee()),
+		BillingInterval: pp.GetBillingInterval(),
+		Currency:        pp.GetCurrency(),
+	}
+}
+
+func subscriptionFromProto(sub *billingv1.Subscription) *Subscription {
+	res := &Subscription{
+		ID:                 sub.Id,
+		PricePlan:          pricePlanFromProto(sub.PricePlan),
+		Status:             sub.Status,
+		AnchorDay:          int(sub.AnchorDay),
+		StartedAt:          time.Unix(sub.StartedAtUnix, 0).UTC().Format(time.RFC3339),
+		CurrentPeriodStart: time.Unix(sub.CurrentPeriodStartUnix, 0).UTC().Format(time.RFC3339),
+		CurrentPeriodEnd:   time.Unix(sub.CurrentPeriodEndUnix, 0).UTC().Format(time.RFC3339),
+	}
+	if sub.EndedAtUnix != 0 {
+		res.EndedAt = time.Unix(sub.EndedAtUnix, 0).UTC().Format(time.RFC3339)
+	}
+	if c := sub.Commitment; c != nil {
+		res.Commitment = &Commitment{
+			Amount:             moneyFromProto(c.Amount),
+			Interval:           c.Interval,
+			CurrentPeriodStart: time.Unix(c.CurrentPeriodStartUnix, 0).UTC().Format(time.RFC3339),
+			CurrentPeriodEnd:   time.Unix(c.CurrentPeriodEndUnix, 0).UTC().Format(time.RFC3339),
+		}
+	}
+	return res
+}
+
+func pricePlanToGraphQL(pp *PricePlan) *graphql1.PricePlan {
+	return &graphql1.PricePlan{
+		ID:              pp.ID,
+		Name:            pp.Name,
+		BaseFee:         moneyToGraphQL(pp.BaseFee),
+		BillingInterval: pp.BillingInterval,
+		Currency:        pp.Currency,
+	}
+}
+
+func subscriptionToGraphQL(sub *Subscription) *graphql1.BillingSubscription {
+	res := &graphql1.BillingSubscription{
+		ID:                 sub.ID,
+		PricePlan:          pricePlanToGraphQL(sub.PricePlan),
+		Status:             sub.Status,
+		AnchorDay:          sub.AnchorDay,
+		StartedAt:          sub.StartedAt,
+		CurrentPeriodStart: sub.CurrentPeriodStart,
+		CurrentPeriodEnd:   sub.CurrentPeriodEnd,
+	}
+	if sub.EndedAt != "" {
+		endedAt := sub.EndedAt
+		res.EndedAt = &endedAt
+	}
+	if c := sub.Commitment; c != nil {
+		res.Commitment = &graphql1.Commitment{
+			Amount:             moneyToGraphQL(c.Amount),
+			Interval:           c.Interval,
+			CurrentPeriodStart: c.CurrentPeriodStart,
+			CurrentPeriodEnd:   c.CurrentPeriodEnd,
+		}
+	}
+	return res
+}
+
+func moneyFromProto(m *billingv1.Money) money.Money {
+	return money.Money{MinorUnits: m.GetMinorUnits(), Currency: m.GetCurrency()}
+}
+
+func organizationToGraphQL(org *Organization) *graphql1.Organization {
+	res := &graphql1.Organization{
+		ID:              org.ID,
+		Name:            org.Name,
+		TaxStatus:       org.TaxStatus,
+		BillingCurrency: org.BillingCurrency,
+	}
+	if org.TaxID != "" {
+		res.TaxID = &org.TaxID
+	}
+	if a := org.BillingAddress; a != nil {
+		res.BillingAddress = &graphql1.Address{
+			Line1:      a.Line1,
+			Line2:      a.Line2,
+			City:       a.City,
+			Region:     a.Region,
+			PostalCode: a.PostalCode,
+			Country:    a.Country,
+		}
+	}
+	return res
+}
+
+func invoiceToGraphQL(inv *Invoice) *graphql1.Invoice {
+	items := make([]*graphql1.InvoiceLineItem, len(inv.LineItems))
+	for i, li := range inv.LineItems {
+		tiers := make([]*graphql1.InvoiceLineItemTier, len(li.Tiers))
+		for j, tc := range li.Tiers {
+			var upTo *float64
+			if tc.UpTo != nil {
+				v := float64(*tc.UpTo)
+				upTo = &v
+			}
+			tiers[j] = &graphql1.InvoiceLineItemTier{
+				Tier:      tc.Tier,
+				From:      float64(tc.FromQuantity),
+				UpTo:      upTo,
+				Quantity:  float64(tc.Quantity),
+				UnitPrice: tc.UnitPrice,
+				FlatFee:   tc.FlatFee,
+				Amount:    moneyToGraphQL(tc.Amount),
+			}
+		}
+		var unitPrice *string
+		if li.UnitPrice != "" {
+			unitPrice = &li.UnitPrice
+		}
+		var packageSize *float64
+		if li.PackageSize > 0 {
+			v := float64(li.PackageSize)
+			packageSize = &v
+		}
+		var periodStart, periodEnd, proration, creditGrantID, couponCode, taxCode *string
+		if li.PeriodStart != "" {
+			periodStart, periodEnd = &li.PeriodStart, &li.PeriodEnd
+		}
+		if li.Proration != "" {
+			proration = &li.Proration
+		}
+		if li.CreditGrantID != "" {
+			creditGrantID = &li.CreditGrantID
+		}
+		if li.CouponID != "" {
+			couponCode = &li.CouponID
+		}
+		if li.TaxCode != "" {
+			taxCode = &li.TaxCode
+		}
+		var tax *graphql1.InvoiceLineItemTax
+		if li.Tax != nil {
+			tax = &graphql1.InvoiceLineItemTax{
+				Jurisdiction: li.Tax.Jurisdiction,
+				RatePercent:  li.Tax.RatePercent,
+				Basis:        moneyToGraphQL(li.Tax.Basis),
+			}
+			if li.Tax.Treatment != "" {
+				tax.Treatment = &li.Tax.Treatment
+			}
+		}
+		items[i] = &graphql1.InvoiceLineItem{
+			Kind:               li.Kind,
+			Description:        li.Description,
+			PlanID:             li.PlanID,
+			Metric:             li.Metric,
+			Quantity:           float64(li.Quantity),
+			FreeQuotaApplied:   float64(li.FreeQuotaApplied),
+			ChargeableQuantity: float64(li.ChargeableQuantity),
+			PricingModel:       li.PricingModel,
+			UnitPrice:          unitPrice,
+			PackageSize:        packageSize,
+			Tiers:              tiers,
+			Amount:             moneyToGraphQL(li.Amount),
+			PeriodStart:        periodStart,
+			PeriodEnd:          periodEnd,
+			Proration:          proration,
+			CreditGrantID:      creditGrantID,
+			CouponCode:         couponCode,
+			TaxCode:            taxCode,
+			Tax:                tax,
+		}
+	}
+	history := make([]*graphql1.InvoiceStatusTransition, len(inv.Transitions))
+	for i, t := range inv.Transitions {
+		history[i] = &graphql1.InvoiceStatusTransition{
+			From:   t.From,
+			To:     t.To,
+			Actor:  t.Actor,
+			Reason: t.Reason,
+			At:     t.At,
+		}
+	}
+	var number *string
+	if inv.Number != "" {
+		number = &inv.Number
+	}
+	return &graphql1.Invoice{
+		ID:            inv.ID,
+		Number:        number,
+		Currency:      inv.Currency,
+		TotalAmount:   moneyToGraphQL(inv.Total),
+		Status:        inv.Status,
+		PeriodStart:   inv.PeriodStart,
+		PeriodEnd:     inv.PeriodEnd,
+		LineItems:     items,
+		StatusHistory: history,
+	}
+}
+
+func moneyToGraphQL(m money.Money) *graphql1.Money {
+	return &graphql1.Money{
+		Amount:     m.Decimal(),
+		Currency:   m.Currency,
+		MinorUnits: strconv.FormatInt(m.MinorUnits, 10),
+	}
 }
 
 type contextKey string
@@ -3,6 +3,8 @@ package gateway
 import (
 	"context"
 	"testing"
+
+	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
 )
 
 func TestResolver_Me_RequiresAuth(t *testing.T) {
@@ -24,7 +26,7 @@ func TestResolver_Usage_RequiresAuth(t *testing.T) {
 
 	// Test without auth context
 	ctx := context.Background()
-	_, err := resolver.Usage(ctx, "test-metric")
+	_, err := resolver.Usage(ctx, "test-metric", UsageArgs{Granularity: "DAY"})
 	if err == nil {
 		t.Error("expected error when no auth context present")
 	}
@@ -66,7 +68,7 @@ func TestResolver_GenerateInvoice_RequiresAuth(t *testing.T) {
 
 	// Test without auth context
 	ctx := context.Background()
-	_, err := resolver.GenerateInvoice(ctx, "2024-01-01T00:00:00Z", "2024-01-31T23:59:59Z")
+	_, err := resolver.GenerateInvoice(ctx, "2024-01-01T00:00:00Z", "2024-01-31T23:59:59Z", "")
 	if err == nil {
 		t.Error("expected error when no auth context present")
 	}
@@ -75,6 +77,68 @@ func TestResolver_GenerateInvoice_RequiresAuth(t *testing.T) {
 	}
 }
 
+func TestResolver_Subscriptions_RequireAuth(t *testing.T) {
+	resolver := NewResolver("identity-svc:50051", "usage-svc:50052", "billing-svc:50053")
+	ctx := context.Background()
+
+	calls := map[string]func() error{
+		"PricePlans": func() error {
+			_, err := resolver.PricePlans(ctx)
+			return err
+		},
+		"Subscription": func() error {
+			_, err := resolver.Subscription(ctx)
+			return err
+		},
+		"Subscribe": func() error {
+			_, err := resolver.Subscribe(ctx, "platform-monthly", 0)
+			return err
+		},
+		"ChangePlan": func() error {
+			_, err := resolver.ChangePlan(ctx, "platform-monthly")
+			return err
+		},
+		"CancelSubscription": func() error {
+			_, err := resolver.CancelSubscription(ctx, true)
+			return err
+		},
+		"FinalizeInvoice": func() error {
+			_, err := resolver.FinalizeInvoice(ctx, "inv-1")
+			return err
+		},
+		"TransitionInvoice": func() error {
+			_, err := resolver.TransitionInvoice(ctx, "org-1", "inv-1", "void", nil)
+			return err
+		},
+		"CreditGrants": func() error {
+			_, err := resolver.CreditGrants(ctx)
+			return err
+		},
+		"RedeemCoupon": func() error {
+			_, err := resolver.RedeemCoupon(ctx, "SPRING20")
+			return err
+		},
+		"CouponRedemptions": func() error {
+			_, err := resolver.CouponRedemptions(ctx)
+			return err
+		},
+		"UpdateBillingProfile": func() error {
+			_, err := resolver.UpdateBillingProfile(ctx, BillingProfile{Address: Address{Country: "DE"}})
+			return err
+		},
+		"CreditBalance": func() error {
+			_, err := resolver.CreditBalance(ctx)
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		if err := call(); err == nil || err.Error() != "unauthorized" {
+			t.Errorf("%s: expected 'unauthorized' error, got: %v", name, err)
+		}
+	}
+}
+
 func TestResolver_UsesAuthContextOrgID(t *testing.T) {
 	resolver := NewResolver("identity-svc:50051", "usage-svc:50052", "billing-svc:50053")
 
@@ -98,6 +162,23 @@ func TestResolver_UsesAuthContextOrgID(t *testing.T) {
 	}
 }
 
+func TestResolver_TransitionInvoice_RequiresOperatorKey(t *testing.T) {
+	resolver := NewResolver("identity-svc:50051", "usage-svc:50052", "billing-svc:50053")
+	ctx := WithAuthContext(context.Background(), &AuthContext{
+		OrgID:  "org-1",
+		APIKey: "test-key",
+	})
+
+	// A customer's key may not void, mark paid or write off even its own
+	// org's invoices.
+	for _, to := range []string{"void", "paid", "uncollectible"} {
+		_, err := resolver.TransitionInvoice(ctx, "org-1", "inv-1", to, nil)
+		if err == nil || err.Error() != "forbidden: operator API key required" {
+			t.Errorf("%s: expected 'forbidden' error, got: %v", to, err)
+		}
+	}
+}
+
 func TestGetAuthContext(t *testing.T) {
 	ctx := context.Background()
 
@@ -126,3 +207,36 @@ func TestGetAuthContext(t *testing.T) {
 		t.Errorf("expected api_key %s, got %s", expectedAPIKey, authCtx.APIKey)
 	}
 }
+
+func TestGranularityToProto(t *testing.T) {
+	tests := []struct {
+		name        string
+		granularity string
+		expected    usagev1.Granularity
+		wantErr     bool
+	}{
+		{name: "hour", granularity: "HOUR", expected: usagev1.Granularity_GRANULARITY_HOUR},
+		{name: "day", granularity: "DAY", expected: usagev1.Granularity_GRANULARITY_DAY},
+		{name: "month", granularity: "MONTH", expected: usagev1.Granularity_GRANULARITY_MONTH},
+		{name: "empty defaults to day", granularity: "", expected: usagev1.Granularity_GRANULARITY_DAY},
+		{name: "invalid", granularity: "WEEK", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := granularityToProto(tt.granularity)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error for invalid granularity")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
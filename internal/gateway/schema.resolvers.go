@@ -17,21 +17,121 @@ func (r *mutationResolver) RecordUsage(ctx context.Context, metric string, quant
 }
 
 // GenerateInvoice is the resolver for the generateInvoice field.
-func (r *mutationResolver) GenerateInvoice(ctx context.Context, periodStart string, periodEnd string) (*graphql1.Invoice, error) {
-	invoice, err := r.Resolver.GenerateInvoice(ctx, periodStart, periodEnd)
+func (r *mutationResolver) GenerateInvoice(ctx context.Context, periodStart string, periodEnd string, idempotencyKey *string) (*graphql1.Invoice, error) {
+	key := ""
+	if idempotencyKey != nil {
+		key = *idempotencyKey
+	}
+	invoice, err := r.Resolver.GenerateInvoice(ctx, periodStart, periodEnd, key)
 	if err != nil {
 		return nil, err
 	}
 	if invoice == nil {
 		return nil, nil
 	}
-	return &graphql1.Invoice{
-		ID:          invoice.ID,
-		TotalAmount: invoice.TotalAmount,
-		Status:      invoice.Status,
-		PeriodStart: invoice.PeriodStart,
-		PeriodEnd:   invoice.PeriodEnd,
-	}, nil
+	return invoiceToGraphQL(invoice), nil
+}
+
+// Subscribe is the resolver for the subscribe field.
+func (r *mutationResolver) Subscribe(ctx context.Context, pricePlanID string, anchorDay *int) (*graphql1.BillingSubscription, error) {
+	day := 0
+	if anchorDay != nil {
+		day = *anchorDay
+	}
+	sub, err := r.Resolver.Subscribe(ctx, pricePlanID, day)
+	if err != nil {
+		return nil, err
+	}
+	return subscriptionToGraphQL(sub), nil
+}
+
+// ChangePlan is the resolver for the changePlan field.
+func (r *mutationResolver) ChangePlan(ctx context.Context, pricePlanID string) (*graphql1.BillingSubscription, error) {
+	sub, err := r.Resolver.ChangePlan(ctx, pricePlanID)
+	if err != nil {
+		return nil, err
+	}
+	return subscriptionToGraphQL(sub), nil
+}
+
+// CancelSubscription is the resolver for the cancelSubscription field.
+func (r *mutationResolver) CancelSubscription(ctx context.Context, atPeriodEnd *bool) (*graphql1.BillingSubscription, error) {
+	sub, err := r.Resolver.CancelSubscription(ctx, atPeriodEnd == nil || *atPeriodEnd)
+	if err != nil {
+		return nil, err
+	}
+	return subscriptionToGraphQL(sub), nil
+}
+
+// FinalizeInvoice is the resolver for the finalizeInvoice field.
+func (r *mutationResolver) FinalizeInvoice(ctx context.Context, id string) (*graphql1.Invoice, error) {
+	inv, err := r.Resolver.FinalizeInvoice(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return invoiceToGraphQL(inv), nil
+}
+
+// VoidInvoice is the resolver for the voidInvoice field.
+func (r *mutationResolver) VoidInvoice(ctx context.Context, orgID string, id string, reason *string) (*graphql1.Invoice, error) {
+	inv, err := r.Resolver.TransitionInvoice(ctx, orgID, id, "void", reason)
+	if err != nil {
+		return nil, err
+	}
+	return invoiceToGraphQL(inv), nil
+}
+
+// MarkInvoicePaid is the resolver for the markInvoicePaid field.
+func (r *mutationResolver) MarkInvoicePaid(ctx context.Context, orgID string, id string, reason *string) (*graphql1.Invoice, error) {
+	inv, err := r.Resolver.TransitionInvoice(ctx, orgID, id, "paid", reason)
+	if err != nil {
+		return nil, err
+	}
+	return invoiceToGraphQL(inv), nil
+}
+
+// MarkInvoiceUncollectible is the resolver for the markInvoiceUncollectible field.
+func (r *mutationResolver) MarkInvoiceUncollectible(ctx context.Context, orgID string, id string, reason *string) (*graphql1.Invoice, error) {
+	inv, err := r.Resolver.TransitionInvoice(ctx, orgID, id, "uncollectible", reason)
+	if err != nil {
+		return nil, err
+	}
+	return invoiceToGraphQL(inv), nil
+}
+
+// RedeemCoupon is the resolver for the redeemCoupon field.
+func (r *mutationResolver) RedeemCoupon(ctx context.Context, code string) (*graphql1.CouponRedemption, error) {
+	rd, err := r.Resolver.RedeemCoupon(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return redemptionToGraphQL(rd), nil
+}
+
+// UpdateBillingProfile is the resolver for the updateBillingProfile field.
+func (r *mutationResolver) UpdateBillingProfile(ctx context.Context, address graphql1.AddressInput, taxID *string) (*graphql1.Organization, error) {
+	profile := BillingProfile{
+		Address: Address{
+			Line1:      address.Line1,
+			City:       address.City,
+			PostalCode: address.PostalCode,
+			Country:    address.Country,
+		},
+	}
+	if address.Line2 != nil {
+		profile.Address.Line2 = *address.Line2
+	}
+	if address.Region != nil {
+		profile.Address.Region = *address.Region
+	}
+	if taxID != nil {
+		profile.TaxID = *taxID
+	}
+	org, err := r.Resolver.UpdateBillingProfile(ctx, profile)
+	if err != nil {
+		return nil, err
+	}
+	return organizationToGraphQL(org), nil
 }
 
 // Me is the resolver for the me field.
@@ -43,28 +143,71 @@ func (r *queryResolver) Me(ctx context.Context) (*graphql1.Organization, error)
 	if org == nil {
 		return nil, nil
 	}
-	return &graphql1.Organization{
-		ID:   org.ID,
-		Name: org.Name,
-	}, nil
+	return organizationToGraphQL(org), nil
 }
 
 // Usage is the resolver for the usage field.
-func (r *queryResolver) Usage(ctx context.Context, metric string) ([]*graphql1.UsageAggregate, error) {
-	aggregates, err := r.Resolver.Usage(ctx, metric)
+func (r *queryResolver) Usage(ctx context.Context, metric string, granularity *graphql1.Granularity, start *string, end *string, first *int, after *string, filter []*graphql1.DimensionInput, groupBy []string) (*graphql1.UsageAggregateConnection, error) {
+	args := UsageArgs{Granularity: graphql1.GranularityDay.String()}
+	if granularity != nil {
+		args.Granularity = granularity.String()
+	}
+	if start != nil {
+		args.Start = *start
+	}
+	if end != nil {
+		args.End = *end
+	}
+	if first != nil {
+		args.First = *first
+	}
+	if after != nil {
+		args.After = *after
+	}
+	if len(filter) > 0 {
+		args.Filters = make(map[string]string, len(filter))
+		for _, d := range filter {
+			args.Filters[d.Key] = d.Value
+		}
+	}
+	args.GroupBy = groupBy
+
+	page, err := r.Resolver.Usage(ctx, metric, args)
 	if err != nil {
 		return nil, err
 	}
-	result := make([]*graphql1.UsageAggregate, len(aggregates))
-	for i, agg := range aggregates {
-		result[i] = &graphql1.UsageAggregate{
-			Metric:      agg.Metric,
-			Total:       agg.Total,
-			PeriodStart: agg.PeriodStart,
-			PeriodEnd:   agg.PeriodEnd,
+
+	conn := &graphql1.UsageAggregateConnection{
+		Edges: make([]*graphql1.UsageAggregateEdge, len(page.Aggregates)),
+		PageInfo: &graphql1.PageInfo{
+			HasNextPage: page.HasNextPage,
+			// Pagination is forward-only; Relay allows false when paging with after.
+			HasPreviousPage: false,
+		},
+	}
+	for i, agg := range page.Aggregates {
+		conn.Edges[i] = &graphql1.UsageAggregateEdge{
+			Cursor: agg.Cursor,
+			Node: &graphql1.UsageAggregate{
+				Metric:      agg.Metric,
+				Granularity: graphql1.Granularity(agg.Granularity),
+				Total:       agg.Total,
+				PeriodStart: agg.PeriodStart,
+				PeriodEnd:   agg.PeriodEnd,
+				Dimensions:  make([]*graphql1.Dimension, 0, len(agg.Dimensions)),
+			},
+		}
+		for _, key := range groupBy {
+			if value, ok := agg.Dimensions[key]; ok {
+				conn.Edges[i].Node.Dimensions = append(conn.Edges[i].Node.Dimensions, &graphql1.Dimension{Key: key, Value: value})
+			}
 		}
 	}
-	return result, nil
+	if n := len(conn.Edges); n > 0 {
+		conn.PageInfo.StartCursor = &conn.Edges[0].Cursor
+		conn.PageInfo.EndCursor = &conn.Edges[n-1].Cursor
+	}
+	return conn, nil
 }
 
 // Invoices is the resolver for the invoices field.
@@ -75,13 +218,68 @@ func (r *queryResolver) Invoices(ctx context.Context) ([]*graphql1.Invoice, erro
 	}
 	result := make([]*graphql1.Invoice, len(invoices))
 	for i, inv := range invoices {
-		result[i] = &graphql1.Invoice{
-			ID:          inv.ID,
-			TotalAmount: inv.TotalAmount,
-			Status:      inv.Status,
-			PeriodStart: inv.PeriodStart,
-			PeriodEnd:   inv.PeriodEnd,
-		}
+		result[i] = invoiceToGraphQL(inv)
+	}
+	return result, nil
+}
+
+// PricePlans is the resolver for the pricePlans field.
+func (r *queryResolver) PricePlans(ctx context.Context) ([]*graphql1.PricePlan, error) {
+	plans, err := r.Resolver.PricePlans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphql1.PricePlan, len(plans))
+	for i, pp := range plans {
+		result[i] = pricePlanToGraphQL(pp)
+	}
+	return result, nil
+}
+
+// Subscription is the resolver for the subscription field.
+func (r *queryResolver) Subscription(ctx context.Context) (*graphql1.BillingSubscription, error) {
+	sub, err := r.Resolver.Subscription(ctx)
+	if err != nil || sub == nil {
+		return nil, err
+	}
+	return subscriptionToGraphQL(sub), nil
+}
+
+// CreditGrants is the resolver for the creditGrants field.
+func (r *queryResolver) CreditGrants(ctx context.Context) ([]*graphql1.CreditGrant, error) {
+	grants, err := r.Resolver.CreditGrants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphql1.CreditGrant, len(grants))
+	for i, g := range grants {
+		result[i] = creditGrantToGraphQL(g)
+	}
+	return result, nil
+}
+
+// CreditBalance is the resolver for the creditBalance field.
+func (r *queryResolver) CreditBalance(ctx context.Context) ([]*graphql1.Money, error) {
+	balances, err := r.Resolver.CreditBalance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphql1.Money, len(balances))
+	for i, m := range balances {
+		result[i] = moneyToGraphQL(m)
+	}
+	return result, nil
+}
+
+// CouponRedemptions is the resolver for the couponRedemptions field.
+func (r *queryResolver) CouponRedemptions(ctx context.Context) ([]*graphql1.CouponRedemption, error) {
+	redemptions, err := r.Resolver.CouponRedemptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphql1.CouponRedemption, len(redemptions))
+	for i, rd := range redemptions {
+		result[i] = redemptionToGraphQL(rd)
 	}
 	return result, nil
 }
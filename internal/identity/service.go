@@ -2,10 +2,19 @@ package identity
 
 import (
 	"context"
+	"regexp"
+	"strings"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jackthomas00/polaris/pkg/money"
 	identityv1 "github.com/jackthomas00/polaris/proto/identityv1"
 )
 
+// countryPattern matches ISO 3166-1 alpha-2 country codes.
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
 type Service struct {
 	store *Store
 	identityv1.UnimplementedIdentityServer
@@ -24,8 +33,10 @@ func (s *Service) ValidateApiKey(ctx context.Context, req *identityv1.ValidateAp
 		return &identityv1.ValidateApiKeyResponse{Valid: false}, nil
 	}
 	return &identityv1.ValidateApiKeyResponse{
-		Valid: true,
-		OrgId: ak.OrgID,
+		Valid:    true,
+		OrgId:    ak.OrgID,
+		ApiKeyId: ak.ID,
+		Operator: ak.Operator,
 	}, nil
 }
 
@@ -37,8 +48,99 @@ func (s *Service) GetOrganization(ctx context.Context, req *identityv1.GetOrgani
 	if org == nil {
 		return &identityv1.GetOrganizationResponse{}, nil
 	}
+	return organizationToProto(org), nil
+}
+
+// UpdateBillingProfile replaces the org's billing address and tax ID. An
+// address needs a country, which decides how invoices are taxed.
+func (s *Service) UpdateBillingProfile(ctx context.Context, req *identityv1.UpdateBillingProfileRequest) (*identityv1.GetOrganizationResponse, error) {
+	var address Address
+	if a := req.BillingAddress; a != nil {
+		address = Address{
+			Line1:      strings.TrimSpace(a.Line1),
+			Line2:      strings.TrimSpace(a.Line2),
+			City:       strings.TrimSpace(a.City),
+			Region:     strings.ToUpper(strings.TrimSpace(a.Region)),
+			PostalCode: strings.TrimSpace(a.PostalCode),
+			Country:    strings.ToUpper(strings.TrimSpace(a.Country)),
+		}
+	}
+	if address != (Address{}) && !countryPattern.MatchString(address.Country) {
+		return nil, status.Errorf(codes.InvalidArgument, "country must be an ISO 3166-1 alpha-2 code, e.g. \"DE\"")
+	}
+
+	org, err := s.store.UpdateBillingProfile(ctx, req.OrgId, address, strings.ToUpper(strings.Join(strings.Fields(req.TaxId), "")))
+	if err == ErrOrganizationNotFound {
+		return nil, status.Errorf(codes.NotFound, "unknown organization")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return organizationToProto(org), nil
+}
+
+// SetTaxStatus sets whether the org is taxed, exempt, or reverse charged.
+// Reverse charge needs the tax ID it was verified for.
+func (s *Service) SetTaxStatus(ctx context.Context, req *identityv1.SetTaxStatusRequest) (*identityv1.GetOrganizationResponse, error) {
+	switch req.TaxStatus {
+	case TaxStatusTaxable, TaxStatusExempt, TaxStatusReverseCharge:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "tax_status must be taxable, exempt or reverse_charge")
+	}
+
+	if req.TaxStatus == TaxStatusReverseCharge {
+		org, err := s.store.GetOrganization(ctx, req.OrgId)
+		if err != nil {
+			return nil, err
+		}
+		if org != nil && org.TaxID == "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "reverse charge needs the org's tax ID")
+		}
+	}
+
+	org, err := s.store.SetTaxStatus(ctx, req.OrgId, req.TaxStatus)
+	if err == ErrOrganizationNotFound {
+		return nil, status.Errorf(codes.NotFound, "unknown organization")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return organizationToProto(org), nil
+}
+
+// SetBillingCurrency sets the currency the org is invoiced in. Its plans and
+// price plan must be priced in it, or billing-svc refuses to invoice it.
+func (s *Service) SetBillingCurrency(ctx context.Context, req *identityv1.SetBillingCurrencyRequest) (*identityv1.GetOrganizationResponse, error) {
+	currency := strings.ToUpper(strings.TrimSpace(req.Currency))
+	if _, err := money.Exponent(currency); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	org, err := s.store.SetBillingCurrency(ctx, req.OrgId, currency)
+	if err == ErrOrganizationNotFound {
+		return nil, status.Errorf(codes.NotFound, "unknown organization")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return organizationToProto(org), nil
+}
+
+func organizationToProto(org *Organization) *identityv1.GetOrganizationResponse {
+	a := org.BillingAddress
 	return &identityv1.GetOrganizationResponse{
 		OrgId: org.ID,
 		Name:  org.Name,
-	}, nil
+		BillingAddress: &identityv1.Address{
+			Line1:      a.Line1,
+			Line2:      a.Line2,
+			City:       a.City,
+			Region:     a.Region,
+			PostalCode: a.PostalCode,
+			Country:    a.Country,
+		},
+		TaxId:           org.TaxID,
+		TaxStatus:       org.TaxStatus,
+		BillingCurrency: org.BillingCurrency,
+	}
 }
@@ -3,6 +3,19 @@ package identity
 import (
 	"context"
 	"database/sql"
+	"errors"
+)
+
+var ErrOrganizationNotFound = errors.New("organization not found")
+
+// Tax statuses of an org.
+const (
+	TaxStatusTaxable = "taxable"
+	// TaxStatusExempt orgs are not charged tax.
+	TaxStatusExempt = "exempt"
+	// TaxStatusReverseCharge orgs account for the tax themselves, e.g.
+	// businesses buying across EU borders.
+	TaxStatusReverseCharge = "reverse_charge"
 )
 
 type Store struct {
@@ -17,20 +30,38 @@ type APIKey struct {
 	ID    string
 	OrgID string
 	Key   string
+	// Operator is set on the keys of the platform's operators.
+	Operator bool
 }
 
 type Organization struct {
-	ID   string
-	Name string
+	ID             string
+	Name           string
+	BillingAddress Address
+	TaxID          string
+	TaxStatus      string
+	// BillingCurrency is the ISO 4217 code the org is invoiced in, empty until
+	// an operator sets it.
+	BillingCurrency string
+}
+
+type Address struct {
+	Line1      string
+	Line2      string
+	City       string
+	Region     string
+	PostalCode string
+	// Country is an ISO 3166-1 alpha-2 code.
+	Country string
 }
 
 func (s *Store) ValidateAPIKey(ctx context.Context, apiKey string) (*APIKey, error) {
 	var ak APIKey
 	err := s.db.QueryRowContext(ctx, `
-		SELECT id, org_id, key
+		SELECT id, org_id, key, operator
 		FROM api_keys
 		WHERE key = $1
-	`, apiKey).Scan(&ak.ID, &ak.OrgID, &ak.Key)
+	`, apiKey).Scan(&ak.ID, &ak.OrgID, &ak.Key, &ak.Operator)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -41,17 +72,69 @@ func (s *Store) ValidateAPIKey(ctx context.Context, apiKey string) (*APIKey, err
 }
 
 func (s *Store) GetOrganization(ctx context.Context, orgID string) (*Organization, error) {
-	var org Organization
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, name
+	org, err := scanOrganization(s.db.QueryRowContext(ctx, `
+		SELECT `+organizationColumns+`
 		FROM organizations
 		WHERE id = $1
-	`, orgID).Scan(&org.ID, &org.Name)
+	`, orgID))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
+	return org, err
+}
+
+const organizationColumns = `id, name, address_line1, address_line2, city, region, postal_code, country, tax_id, tax_status, billing_currency`
+
+func scanOrganization(row interface{ Scan(...interface{}) error }) (*Organization, error) {
+	var org Organization
+	a := &org.BillingAddress
+	err := row.Scan(&org.ID, &org.Name, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country,
+		&org.TaxID, &org.TaxStatus, &org.BillingCurrency)
 	if err != nil {
 		return nil, err
 	}
 	return &org, nil
 }
+
+// UpdateBillingProfile sets the billing address and tax ID of orgID. A
+// reverse_charge status was verified for the old tax ID, so changing the ID
+// resets it to taxable.
+func (s *Store) UpdateBillingProfile(ctx context.Context, orgID string, address Address, taxID string) (*Organization, error) {
+	org, err := scanOrganization(s.db.QueryRowContext(ctx, `
+		UPDATE organizations
+		SET address_line1 = $2, address_line2 = $3, city = $4, region = $5, postal_code = $6, country = $7, tax_id = $8,
+			tax_status = CASE WHEN tax_status = 'reverse_charge' AND tax_id <> $8 THEN 'taxable' ELSE tax_status END
+		WHERE id = $1
+		RETURNING `+organizationColumns+`
+	`, orgID, address.Line1, address.Line2, address.City, address.Region, address.PostalCode, address.Country, taxID))
+	if err == sql.ErrNoRows {
+		return nil, ErrOrganizationNotFound
+	}
+	return org, err
+}
+
+// SetTaxStatus sets the tax status of orgID.
+func (s *Store) SetTaxStatus(ctx context.Context, orgID, taxStatus string) (*Organization, error) {
+	org, err := scanOrganization(s.db.QueryRowContext(ctx, `
+		UPDATE organizations SET tax_status = $2
+		WHERE id = $1
+		RETURNING `+organizationColumns+`
+	`, orgID, taxStatus))
+	if err == sql.ErrNoRows {
+		return nil, ErrOrganizationNotFound
+	}
+	return org, err
+}
+
+// SetBillingCurrency sets the currency orgID is invoiced in.
+func (s *Store) SetBillingCurrency(ctx context.Context, orgID, currency string) (*Organization, error) {
+	org, err := scanOrganization(s.db.QueryRowContext(ctx, `
+		UPDATE organizations SET billing_currency = $2
+		WHERE id = $1
+		RETURNING `+organizationColumns+`
+	`, orgID, currency))
+	if err == sql.ErrNoRows {
+		return nil, ErrOrganizationNotFound
+	}
+	return org, err
+}
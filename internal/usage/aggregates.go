@@ -0,0 +1,514 @@
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Granularity is the length of a usage_aggregates period. Values match the
+// field names accepted by Postgres DATE_TRUNC.
+type Granularity string
+
+const (
+	GranularityHour  Granularity = "hour"
+	GranularityDay   Granularity = "day"
+	GranularityMonth Granularity = "month"
+)
+
+type Aggregate struct {
+	Metric      string
+	Granularity Granularity
+	Total       int64
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	// Dimensions holds the group-by dimension values of this row; empty for the metric total.
+	Dimensions map[string]string
+
+	group string
+}
+
+// Cursor returns the keyset position right after a.
+func (a Aggregate) Cursor() AggregateCursor {
+	return AggregateCursor{PeriodStart: a.PeriodStart, Group: a.group}
+}
+
+// AggregateCursor is a keyset position in a listing ordered by period_start
+// descending, then by group ascending.
+type AggregateCursor struct {
+	PeriodStart time.Time
+	// Group is the canonical JSON of the row's group-by dimensions ("{}" when ungrouped).
+	Group string
+}
+
+// IsZero reports whether c is the start of a listing.
+func (c AggregateCursor) IsZero() bool {
+	return c.PeriodStart.IsZero()
+}
+
+// AggregateQuery selects aggregates for one org, metric and granularity.
+// Zero times leave the corresponding bound open.
+type AggregateQuery struct {
+	OrgID       string
+	Metric      string
+	Granularity Granularity
+	// Start and End select periods overlapping [Start, End).
+	Start time.Time
+	End   time.Time
+	// Filters keeps only events whose dimensions contain every key/value pair.
+	Filters map[string]string
+	// GroupBy splits each period by the values of these dimension keys.
+	GroupBy []string
+	After   AggregateCursor
+	Limit   int
+}
+
+// GetAggregates returns up to q.Limit aggregates, newest period first, combined
+// with the metric's aggregation type. Totals and single-key group-bys are
+// served from usage_aggregates; filtered or multi-key queries are computed from
+// the raw events, so callers should bound them with a window.
+func (s *Store) GetAggregates(ctx context.Context, q AggregateQuery) ([]Aggregate, error) {
+	def, err := s.GetMetric(ctx, q.Metric)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(q.Filters) == 0 && len(q.GroupBy) == 0 {
+		return s.queryRollups(ctx, q, "")
+	}
+	if len(q.Filters) == 0 && len(q.GroupBy) == 1 && def.HasRollup(q.GroupBy[0]) {
+		return s.queryRollups(ctx, q, q.GroupBy[0])
+	}
+	return s.queryEvents(ctx, q, def)
+}
+
+// queryRollups reads usage_aggregates rows for dimensionKey ("" for the metric total).
+func (s *Store) queryRollups(ctx context.Context, q AggregateQuery, dimensionKey string) ([]Aggregate, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT metric, granularity, total, period_start, period_end, group_key
+		FROM (
+			SELECT metric, granularity, total, period_start, period_end,
+				CASE WHEN dimension_key = '' THEN '{}'
+					ELSE jsonb_build_object(dimension_key, dimension_value)::text
+				END AS group_key
+			FROM usage_aggregates
+			WHERE org_id = $1 AND metric = $2 AND granularity = $3 AND dimension_key = $4
+			AND ($5::timestamptz IS NULL OR period_end > $5)
+			AND ($6::timestamptz IS NULL OR period_start < $6)
+		) AS a
+		WHERE ($7::timestamptz IS NULL OR period_start < $7 OR (period_start = $7 AND group_key > $8))
+		ORDER BY period_start DESC, group_key
+		LIMIT $9
+	`, q.OrgID, q.Metric, q.Granularity, dimensionKey, nullTime(q.Start), nullTime(q.End),
+		nullTime(q.After.PeriodStart), q.After.Group, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanAggregates(rows)
+}
+
+// eventAggregateExpr is the SQL aggregate that combines the events (alias e) of
+// one period for agg. Unique counts read the dimension named by parameter param.
+func eventAggregateExpr(agg AggregationType, param string) string {
+	switch agg {
+	case AggregationMax:
+		return "MAX(e.quantity)"
+	case AggregationLast:
+		return "(ARRAY_AGG(e.quantity ORDER BY e.occurred_at DESC, e.id DESC))[1]"
+	case AggregationUniqueCount:
+		return "COUNT(DISTINCT e.dimensions->>" + param + ")"
+	default:
+		return "SUM(e.quantity)"
+	}
+}
+
+// queryEvents computes aggregates directly from usage_events.
+func (s *Store) queryEvents(ctx context.Context, q AggregateQuery, def *MetricDefinition) ([]Aggregate, error) {
+	filters, err := dimensionsJSON(q.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT metric, $3::text, total, period_start, period_end, group_key
+		FROM (
+			SELECT metric,
+				bucket AT TIME ZONE 'UTC' AS period_start,
+				(bucket + ('1 ' || $3::text)::interval) AT TIME ZONE 'UTC' AS period_end,
+				group_key,
+				`+eventAggregateExpr(def.Aggregation, "$11::text")+` AS total
+			FROM (
+				SELECT e.*,
+					DATE_TRUNC($3::text, e.occurred_at AT TIME ZONE 'UTC') AS bucket,
+					COALESCE((
+						SELECT jsonb_object_agg(u.k, e.dimensions->u.k)
+						FROM unnest($4::text[]) AS u(k)
+						WHERE e.dimensions ? u.k
+					), '{}'::jsonb)::text AS group_key
+				FROM usage_events e
+				WHERE e.org_id = $1 AND e.metric = $2
+				AND e.dimensions @> $5::jsonb
+				AND ($11::text = '' OR e.dimensions ? $11::text)
+				AND ($6::timestamptz IS NULL
+					OR e.occurred_at >= DATE_TRUNC($3::text, $6::timestamptz AT TIME ZONE 'UTC') AT TIME ZONE 'UTC')
+				AND ($7::timestamptz IS NULL OR e.occurred_at < $7::timestamptz + ('1 ' || $3::text)::interval)
+			) AS e
+			GROUP BY metric, bucket, group_key
+		) AS a
+		WHERE ($7::timestamptz IS NULL OR period_start < $7)
+		AND ($8::timestamptz IS NULL OR period_start < $8 OR (period_start = $8 AND group_key > $9))
+		ORDER BY period_start DESC, group_key
+		LIMIT $10
+	`, q.OrgID, q.Metric, string(q.Granularity), pq.Array(q.GroupBy), filters,
+		nullTime(q.Start), nullTime(q.End), nullTime(q.After.PeriodStart), q.After.Group, q.Limit,
+		def.UniqueDimension)
+	if err != nil {
+		return nil, err
+	}
+	return scanAggregates(rows)
+}
+
+// GetUsageTotal returns the usage of orgID's metric in [start, end), combined
+// with the metric's aggregation type. It reads the raw events rather than the
+// rollups, so periods need not align with aggregate buckets and late events
+// count as soon as they are recorded.
+func (s *Store) GetUsageTotal(ctx context.Context, orgID, metric string, start, end time.Time) (int64, error) {
+	def, err := s.GetMetric(ctx, metric)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(`+eventAggregateExpr(def.Aggregation, "$5::text")+`, 0)
+		FROM usage_events e
+		WHERE e.org_id = $1 AND e.metric = $2
+		AND e.occurred_at >= $3 AND e.occurred_at < $4
+	`, orgID, metric, start, end, def.UniqueDimension).Scan(&total)
+	return total, err
+}
+
+func scanAggregates(rows *sql.Rows) ([]Aggregate, error) {
+	defer rows.Close()
+
+	var res []Aggregate
+	for rows.Next() {
+		var a Aggregate
+		if err := rows.Scan(&a.Metric, &a.Granularity, &a.Total, &a.PeriodStart, &a.PeriodEnd, &a.group); err != nil {
+			return nil, err
+		}
+		if a.group != ungroupedGroup {
+			if err := json.Unmarshal([]byte(a.group), &a.Dimensions); err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
+
+// nullTime maps the zero time to SQL NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+const (
+	// aggregationCheckpoint names the usage_aggregation_checkpoints row owned by AggregateUsageEvents.
+	aggregationCheckpoint = "usage_aggregates"
+	// aggregationBatchSize bounds how many events a single aggregation pass folds.
+	aggregationBatchSize = 100000
+)
+
+// aggregationPosition is an event's place in the order the aggregator folds
+// events in: by the transaction that wrote it, then by id. Event ids are
+// assigned at insert but become visible at commit, so ordering by id alone
+// would let a slow transaction commit events behind the checkpoint. Only
+// events of transactions older than the oldest running one (the snapshot
+// xmin) are folded; no event can appear before those any more.
+type aggregationPosition struct {
+	XID int64
+	ID  int64
+}
+
+// foldBucketsSQL expands each event (alias e, joined to its metric m) into one
+// row per granularity and per rollup: the metric total, plus one for every
+// dimension declared on the metric that the event carries. Buckets are
+// computed in UTC regardless of the session time zone.
+const foldBucketsSQL = `
+	CROSS JOIN LATERAL (
+		SELECT '' AS dimension_key, '' AS dimension_value
+		UNION ALL
+		SELECT u.k, e.dimensions->>u.k
+		FROM unnest(m.dimensions) AS u(k)
+		WHERE e.dimensions ? u.k
+	) AS d
+	CROSS JOIN (VALUES ('hour'), ('day'), ('month')) AS g(granularity)
+`
+
+// foldEventsSQL builds the upsert that folds the usage_events selected by
+// eventFilter into usage_aggregates for sum, max and last metrics. bucketFilter
+// restricts the produced buckets. Existing rows are combined according to the
+// aggregation they were created with.
+func foldEventsSQL(eventFilter, bucketFilter string) string {
+	return fmt.Sprintf(`
+		INSERT INTO usage_aggregates (org_id, metric, granularity, dimension_key, dimension_value, period_start, period_end, aggregation, total, last_occurred_at)
+		SELECT
+			org_id,
+			metric,
+			granularity,
+			dimension_key,
+			dimension_value,
+			bucket AT TIME ZONE 'UTC' AS period_start,
+			(bucket + ('1 ' || granularity)::interval) AT TIME ZONE 'UTC' AS period_end,
+			aggregation,
+			CASE aggregation
+				WHEN 'max' THEN MAX(quantity)
+				WHEN 'last' THEN (ARRAY_AGG(quantity ORDER BY occurred_at DESC, id DESC))[1]
+				ELSE SUM(quantity)
+			END AS total,
+			MAX(occurred_at) AS last_occurred_at
+		FROM (
+			SELECT e.id, e.org_id, e.metric, e.quantity, e.occurred_at, m.aggregation,
+				g.granularity, d.dimension_key, d.dimension_value,
+				DATE_TRUNC(g.granularity, e.occurred_at AT TIME ZONE 'UTC') AS bucket
+			FROM usage_events e
+			JOIN metrics m ON m.key = e.metric AND m.aggregation <> 'unique_count'
+			%s
+			WHERE %s
+		) AS b
+		WHERE %s
+		GROUP BY org_id, metric, aggregation, granularity, dimension_key, dimension_value, bucket
+		ON CONFLICT (org_id, metric, granularity, dimension_key, dimension_value, period_start)
+		DO UPDATE SET
+			total = CASE usage_aggregates.aggregation
+				WHEN 'max' THEN GREATEST(usage_aggregates.total, EXCLUDED.total)
+				WHEN 'last' THEN CASE
+					WHEN EXCLUDED.last_occurred_at >= usage_aggregates.last_occurred_at THEN EXCLUDED.total
+					ELSE usage_aggregates.total
+				END
+				ELSE usage_aggregates.total + EXCLUDED.total
+			END,
+			last_occurred_at = GREATEST(usage_aggregates.last_occurred_at, EXCLUDED.last_occurred_at)
+	`, foldBucketsSQL, eventFilter, bucketFilter)
+}
+
+// foldUniqueValuesSQL builds the statement that folds the usage_events selected
+// by eventFilter into unique_count aggregates. Values are first recorded in
+// usage_aggregate_distinct_values; only values new to a bucket increment its total.
+func foldUniqueValuesSQL(eventFilter, bucketFilter string) string {
+	return fmt.Sprintf(`
+		WITH new_values AS (
+			INSERT INTO usage_aggregate_distinct_values (org_id, metric, granularity, dimension_key, dimension_value, period_start, value)
+			SELECT DISTINCT org_id, metric, granularity, dimension_key, dimension_value, bucket AT TIME ZONE 'UTC', value
+			FROM (
+				SELECT e.org_id, e.metric, e.dimensions->>m.unique_dimension AS value,
+					g.granularity, d.dimension_key, d.dimension_value,
+					DATE_TRUNC(g.granularity, e.occurred_at AT TIME ZONE 'UTC') AS bucket
+				FROM usage_events e
+				JOIN metrics m ON m.key = e.metric AND m.aggregation = 'unique_count'
+				%s
+				WHERE e.dimensions ? m.unique_dimension AND %s
+			) AS b
+			WHERE %s
+			ON CONFLICT DO NOTHING
+			RETURNING org_id, metric, granularity, dimension_key, dimension_value, period_start
+		)
+		INSERT INTO usage_aggregates (org_id, metric, granularity, dimension_key, dimension_value, period_start, period_end, aggregation, total)
+		SELECT
+			org_id,
+			metric,
+			granularity,
+			dimension_key,
+			dimension_value,
+			period_start,
+			((period_start AT TIME ZONE 'UTC') + ('1 ' || granularity)::interval) AT TIME ZONE 'UTC' AS period_end,
+			'unique_count',
+			COUNT(*)
+		FROM new_values
+		GROUP BY org_id, metric, granularity, dimension_key, dimension_value, period_start
+		ON CONFLICT (org_id, metric, granularity, dimension_key, dimension_value, period_start)
+		DO UPDATE SET total = usage_aggregates.total + EXCLUDED.total
+	`, foldBucketsSQL, eventFilter, bucketFilter)
+}
+
+// foldEvents runs both fold statements for the events selected by eventFilter.
+func foldEvents(ctx context.Context, tx *sql.Tx, eventFilter, bucketFilter string, args ...interface{}) error {
+	if _, err := tx.ExecContext(ctx, foldEventsSQL(eventFilter, bucketFilter), args...); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, foldUniqueValuesSQL(eventFilter, bucketFilter), args...)
+	return err
+}
+
+// AggregateUsageEvents folds usage_events written since the last checkpoint into
+// the hourly, daily and monthly usage_aggregates. It runs passes of up to
+// aggregationBatchSize events until it catches up and returns the number of
+// events folded. Each pass queues one aggregate.updated event per org and
+// metric it touched in the usage outbox.
+func (s *Store) AggregateUsageEvents(ctx context.Context) (int64, error) {
+	var folded int64
+	for {
+		n, err := s.aggregatePass(ctx)
+		if err != nil {
+			return folded, err
+		}
+		if n == 0 {
+			return folded, nil
+		}
+		folded += n
+	}
+}
+
+// aggregatePass folds one batch and advances the checkpoint. The checkpoint
+// row is locked for the duration of the pass, so concurrent replicas never
+// fold the same events twice.
+func (s *Store) aggregatePass(ctx context.Context) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	last, err := lockAggregationCheckpoint(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	var upper aggregationPosition
+	err = tx.QueryRowContext(ctx, `
+		SELECT xid::text::bigint, id
+		FROM (
+			SELECT xid, id
+			FROM usage_events
+			WHERE (xid, id) > ($1::text::xid8, $2)
+			AND xid < pg_snapshot_xmin(pg_current_snapshot())
+			ORDER BY xid, id
+			LIMIT $3
+		) AS batch
+		ORDER BY xid DESC, id DESC
+		LIMIT 1
+	`, last.XID, last.ID, aggregationBatchSize).Scan(&upper.XID, &upper.ID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	const batchFilter = "(e.xid, e.id) > ($1::text::xid8, $2) AND (e.xid, e.id) <= ($3::text::xid8, $4)"
+	rows, err := tx.QueryContext(ctx, `
+		SELECT org_id, metric, MIN(occurred_at), MAX(occurred_at), COUNT(*)
+		FROM usage_events e
+		WHERE `+batchFilter+`
+		GROUP BY org_id, metric
+	`, last.XID, last.ID, upper.XID, upper.ID)
+	if err != nil {
+		return 0, err
+	}
+	var folded int64
+	var updates []interface{}
+	for rows.Next() {
+		var u AggregateUpdated
+		if err := rows.Scan(&u.OrgID, &u.Metric, &u.From, &u.To, &u.Events); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		folded += u.Events
+		updates = append(updates, u)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := foldEvents(ctx, tx, batchFilter, "TRUE", last.XID, last.ID, upper.XID, upper.ID); err != nil {
+		return 0, err
+	}
+	if err := s.outbox.Add(ctx, tx, SubjectAggregateUpdated, updates...); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE usage_aggregation_checkpoints
+		SET last_xid = $2::text::xid8, last_event_id = $3, updated_at = NOW()
+		WHERE name = $1
+	`, aggregationCheckpoint, upper.XID, upper.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	return folded, tx.Commit()
+}
+
+// Reaggregate rebuilds the aggregates of one org and metric from raw events,
+// for corrections after events were backfilled or amended, or to backfill
+// rollups for a newly declared dimension. Every hour, day and month bucket
+// overlapping [start, end) is replaced. Only events already covered by the
+// incremental checkpoint are used, so later passes do not count them twice.
+func (s *Store) Reaggregate(ctx context.Context, orgID, metric string, start, end time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	last, err := lockAggregationCheckpoint(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"usage_aggregates", "usage_aggregate_distinct_values"} {
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM `+table+` a
+			USING (VALUES ('hour'), ('day'), ('month')) AS g(granularity)
+			WHERE a.org_id = $1 AND a.metric = $2
+			AND a.granularity = g.granularity
+			AND a.period_start >= DATE_TRUNC(g.granularity, $3::timestamptz AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+			AND a.period_start < $4::timestamptz
+		`, orgID, metric, start, end)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = foldEvents(ctx, tx,
+		`e.org_id = $1 AND e.metric = $2 AND (e.xid, e.id) <= ($5::text::xid8, $6)
+			AND e.occurred_at >= DATE_TRUNC(g.granularity, $3::timestamptz AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+			AND e.occurred_at < $4::timestamptz + INTERVAL '1 month'`,
+		"bucket AT TIME ZONE 'UTC' < $4::timestamptz",
+		orgID, metric, start, end, last.XID, last.ID)
+	if err != nil {
+		return err
+	}
+
+	err = s.outbox.Add(ctx, tx, SubjectAggregateUpdated, AggregateUpdated{
+		OrgID:  orgID,
+		Metric: metric,
+		From:   start,
+		To:     end,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockAggregationCheckpoint locks the aggregation checkpoint row for the rest of
+// tx and returns the position of the last folded event.
+func lockAggregationCheckpoint(ctx context.Context, tx *sql.Tx) (aggregationPosition, error) {
+	var last aggregationPosition
+	err := tx.QueryRowContext(ctx, `
+		SELECT last_xid::text::bigint, last_event_id
+		FROM usage_aggregation_checkpoints
+		WHERE name = $1
+		FOR UPDATE
+	`, aggregationCheckpoint).Scan(&last.XID, &last.ID)
+	return last, err
+}
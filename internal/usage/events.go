@@ -0,0 +1,44 @@
+package usage
+
+import "time"
+
+// Subjects of the events usage-svc publishes.
+const (
+	SubjectUsageRecorded    = "usage.recorded"
+	SubjectAggregateUpdated = "aggregate.updated"
+)
+
+// UsageRecorded is published for every newly inserted usage event. Duplicates
+// rejected by their idempotency key are not published. Events are written to
+// the usage outbox in the same transaction as the rows they describe.
+type UsageRecorded struct {
+	OrgID          string            `json:"org_id"`
+	Metric         string            `json:"metric"`
+	Quantity       int64             `json:"quantity"`
+	OccurredAt     time.Time         `json:"occurred_at"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	Dimensions     map[string]string `json:"dimensions,omitempty"`
+}
+
+// AggregateUpdated is published after an aggregation pass or a Reaggregate
+// changed the aggregates of one org and metric. Every changed period overlaps
+// [From, To].
+type AggregateUpdated struct {
+	OrgID  string    `json:"org_id"`
+	Metric string    `json:"metric"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	// Events is the number of newly folded events; zero for a Reaggregate.
+	Events int64 `json:"events"`
+}
+
+func usageRecordedEvent(ev UsageEvent) UsageRecorded {
+	return UsageRecorded{
+		OrgID:          ev.OrgID,
+		Metric:         ev.Metric,
+		Quantity:       ev.Quantity,
+		OccurredAt:     ev.OccurredAt,
+		IdempotencyKey: ev.IdempotencyKey,
+		Dimensions:     ev.Dimensions,
+	}
+}
@@ -0,0 +1,203 @@
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	identityv1 "github.com/jackthomas00/polaris/proto/identityv1"
+	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
+)
+
+// maxIngestBodyBytes caps the size of a single POST /ingest body.
+const maxIngestBodyBytes = 1 << 20
+
+// IngestEvent is the JSON shape of one usage event accepted by POST /ingest.
+type IngestEvent struct {
+	Metric         string            `json:"metric"`
+	Quantity       int64             `json:"quantity"`
+	Timestamp      *time.Time        `json:"timestamp,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	Dimensions     map[string]string `json:"dimensions,omitempty"`
+}
+
+// IngestHandler serves the public POST /ingest endpoint. Callers authenticate
+// with an X-API-Key header, which is validated against identity-svc; the org_id
+// always comes from identity-svc, never from the request body. All events in a
+// request are written in one RecordUsageBatch call, after every one of them has
+// been checked against its metric definition.
+type IngestHandler struct {
+	identity identityv1.IdentityClient
+	usage    usagev1.UsageServer
+}
+
+func NewIngestHandler(identity identityv1.IdentityClient, usage usagev1.UsageServer) *IngestHandler {
+	return &IngestHandler{identity: identity, usage: usage}
+}
+
+func (h *IngestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeIngestError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		writeIngestError(w, http.StatusUnauthorized, "missing API key")
+		return
+	}
+
+	resp, err := h.identity.ValidateApiKey(r.Context(), &identityv1.ValidateApiKeyRequest{ApiKey: apiKey})
+	if err != nil {
+		writeIngestError(w, http.StatusBadGateway, "failed to validate API key")
+		return
+	}
+	if !resp.Valid {
+		writeIngestError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+
+	events, err := decodeIngestBody(http.MaxBytesReader(w, r.Body, maxIngestBodyBytes))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeIngestError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeIngestError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	reqs := buildRecordUsageRequests(resp.OrgId, r.Header.Get("Idempotency-Key"), events, time.Now().UTC())
+
+	// Validate the whole body up front so a bad event never leaves a partially
+	// recorded batch behind.
+	defs := make(map[string]*MetricDefinition)
+	for i, req := range reqs {
+		if err := validateRecordUsageRequest(req); err != nil {
+			writeIngestError(w, http.StatusBadRequest, fmt.Sprintf("event %d: %v", i, err))
+			return
+		}
+		def, ok := defs[req.Metric]
+		if !ok {
+			if def, err = h.metric(r.Context(), req.Metric); err != nil {
+				writeIngestError(w, http.StatusInternalServerError, "failed to load metric")
+				return
+			}
+			defs[req.Metric] = def
+		}
+		if err := validateEventForMetric(req, def); err != nil {
+			writeIngestError(w, http.StatusBadRequest, fmt.Sprintf("event %d: %v", i, err))
+			return
+		}
+	}
+
+	res, err := h.usage.RecordUsageBatch(r.Context(), &usagev1.RecordUsageBatchRequest{Events: reqs})
+	if err != nil {
+		writeIngestError(w, http.StatusInternalServerError, "failed to record usage")
+		return
+	}
+	for _, result := range res.Results {
+		if result.Status == usagev1.EventStatus_EVENT_STATUS_REJECTED {
+			writeIngestError(w, http.StatusBadRequest, fmt.Sprintf("event %d: %s", result.Index, result.Error))
+			return
+		}
+	}
+
+	writeIngestJSON(w, http.StatusAccepted, map[string]int32{
+		"accepted":   res.Accepted,
+		"duplicates": res.Duplicates,
+	})
+}
+
+// metric returns the definition of key, or nil when it is not registered.
+func (h *IngestHandler) metric(ctx context.Context, key string) (*MetricDefinition, error) {
+	m, err := h.usage.GetMetric(ctx, &usagev1.GetMetricRequest{Key: key})
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metricFromProto(m)
+}
+
+// decodeIngestBody accepts either a single event object or an array of events.
+func decodeIngestBody(body io.Reader) ([]IngestEvent, error) {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil, errors.New("request body is empty")
+	}
+
+	var events []IngestEvent
+	if raw[0] == '[' {
+		if err := json.Unmarshal(raw, &events); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		if len(events) == 0 {
+			return nil, errors.New("no events in request body")
+		}
+		return events, nil
+	}
+
+	var ev IngestEvent
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return []IngestEvent{ev}, nil
+}
+
+// buildRecordUsageRequests converts ingested events into RecordUsage requests.
+// An event's own idempotency_key wins; otherwise the Idempotency-Key header is
+// used as-is for a single event, or suffixed with the event's index for arrays
+// so that retrying the same request deduplicates every event in it.
+func buildRecordUsageRequests(orgID, idemHeader string, events []IngestEvent, now time.Time) []*usagev1.RecordUsageRequest {
+	reqs := make([]*usagev1.RecordUsageRequest, len(events))
+	for i, ev := range events {
+		key := ev.IdempotencyKey
+		if key == "" && idemHeader != "" {
+			key = idemHeader
+			if len(events) > 1 {
+				key = fmt.Sprintf("%s:%d", idemHeader, i)
+			}
+		}
+
+		ts := now
+		if ev.Timestamp != nil {
+			ts = ev.Timestamp.UTC()
+		}
+
+		reqs[i] = &usagev1.RecordUsageRequest{
+			OrgId:          orgID,
+			Metric:         ev.Metric,
+			Quantity:       ev.Quantity,
+			IdempotencyKey: key,
+			TimestampUnix:  ts.Unix(),
+			Dimensions:     ev.Dimensions,
+		}
+	}
+	return reqs
+}
+
+func writeIngestError(w http.ResponseWriter, status int, msg string) {
+	writeIngestJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeIngestJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
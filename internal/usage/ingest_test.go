@@ -0,0 +1,176 @@
+package usage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	identityv1 "github.com/jackthomas00/polaris/proto/identityv1"
+	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
+)
+
+type fakeIdentityClient struct {
+	identityv1.IdentityClient
+	keys map[string]string
+}
+
+func (f *fakeIdentityClient) ValidateApiKey(ctx context.Context, req *identityv1.ValidateApiKeyRequest, opts ...grpc.CallOption) (*identityv1.ValidateApiKeyResponse, error) {
+	orgID, ok := f.keys[req.ApiKey]
+	return &identityv1.ValidateApiKeyResponse{Valid: ok, OrgId: orgID}, nil
+}
+
+type recordingUsageServer struct {
+	usagev1.UnimplementedUsageServer
+	recorded []*usagev1.RecordUsageRequest
+}
+
+func (f *recordingUsageServer) GetMetric(ctx context.Context, req *usagev1.GetMetricRequest) (*usagev1.Metric, error) {
+	if req.Key != "api_calls" {
+		return nil, status.Errorf(codes.NotFound, "metric %q not found", req.Key)
+	}
+	return &usagev1.Metric{Key: "api_calls", Aggregation: usagev1.Aggregation_AGGREGATION_SUM, Dimensions: []string{"region"}}, nil
+}
+
+func (f *recordingUsageServer) RecordUsageBatch(ctx context.Context, req *usagev1.RecordUsageBatchRequest) (*usagev1.RecordUsageBatchResponse, error) {
+	f.recorded = append(f.recorded, req.Events...)
+	return &usagev1.RecordUsageBatchResponse{Accepted: int32(len(req.Events))}, nil
+}
+
+func newTestIngestHandler() (*IngestHandler, *recordingUsageServer) {
+	usage := &recordingUsageServer{}
+	identity := &fakeIdentityClient{keys: map[string]string{"test-key": "org-1"}}
+	return NewIngestHandler(identity, usage), usage
+}
+
+func TestIngestHandler_RequiresValidAPIKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		apiKey string
+	}{
+		{name: "missing key", apiKey: ""},
+		{name: "unknown key", apiKey: "nope"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, usage := newTestIngestHandler()
+			req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(`{"metric":"api_calls","quantity":1}`))
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-Key", tt.apiKey)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("expected status 401, got %d", rec.Code)
+			}
+			if len(usage.recorded) != 0 {
+				t.Errorf("expected no events recorded, got %d", len(usage.recorded))
+			}
+		})
+	}
+}
+
+func TestIngestHandler_UsesOrgIDFromIdentityService(t *testing.T) {
+	h, usage := newTestIngestHandler()
+	// org_id in the body must be ignored; only identity-svc decides the org
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(`{"org_id":"org-2","metric":"api_calls","quantity":5}`))
+	req.Header.Set("X-API-Key", "test-key")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(usage.recorded) != 1 {
+		t.Fatalf("expected 1 event recorded, got %d", len(usage.recorded))
+	}
+	if usage.recorded[0].OrgId != "org-1" {
+		t.Errorf("expected org_id org-1, got %s", usage.recorded[0].OrgId)
+	}
+}
+
+func TestIngestHandler_ArrayBody(t *testing.T) {
+	h, usage := newTestIngestHandler()
+	body := `[
+		{"metric":"api_calls","quantity":5,"timestamp":"2024-01-15T10:00:00Z","dimensions":{"region":"eu-west"}},
+		{"metric":"api_calls","quantity":3,"idempotency_key":"own-key"}
+	]`
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+	req.Header.Set("X-API-Key", "test-key")
+	req.Header.Set("Idempotency-Key", "batch-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(usage.recorded) != 2 {
+		t.Fatalf("expected 2 events recorded, got %d", len(usage.recorded))
+	}
+	if got := usage.recorded[0].IdempotencyKey; got != "batch-1:0" {
+		t.Errorf("expected idempotency key batch-1:0, got %q", got)
+	}
+	if got := usage.recorded[1].IdempotencyKey; got != "own-key" {
+		t.Errorf("expected idempotency key own-key, got %q", got)
+	}
+	if got := usage.recorded[0].Dimensions["region"]; got != "eu-west" {
+		t.Errorf("expected region dimension eu-west, got %q", got)
+	}
+	want := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC).Unix()
+	if got := usage.recorded[0].TimestampUnix; got != want {
+		t.Errorf("expected timestamp %d, got %d", want, got)
+	}
+}
+
+func TestIngestHandler_RejectsInvalidEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{name: "malformed JSON", body: `{"metric":`, code: http.StatusBadRequest},
+		{name: "empty body", body: ``, code: http.StatusBadRequest},
+		{name: "empty array", body: `[]`, code: http.StatusBadRequest},
+		{name: "missing metric", body: `{"quantity":1}`, code: http.StatusBadRequest},
+		{name: "non-positive quantity", body: `[{"metric":"api_calls","quantity":1},{"metric":"api_calls","quantity":0}]`, code: http.StatusBadRequest},
+		{name: "empty dimension key", body: `{"metric":"api_calls","quantity":1,"dimensions":{"":"eu"}}`, code: http.StatusBadRequest},
+		{name: "unknown metric", body: `[{"metric":"api_calls","quantity":1},{"metric":"gpu_hours","quantity":1}]`, code: http.StatusBadRequest},
+		{name: "undeclared dimension", body: `[{"metric":"api_calls","quantity":1},{"metric":"api_calls","quantity":1,"dimensions":{"customer":"acme"}}]`, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, usage := newTestIngestHandler()
+			req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(tt.body))
+			req.Header.Set("X-API-Key", "test-key")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Errorf("expected status %d, got %d", tt.code, rec.Code)
+			}
+			if len(usage.recorded) != 0 {
+				t.Errorf("expected no events recorded, got %d", len(usage.recorded))
+			}
+		})
+	}
+}
+
+func TestIngestHandler_RejectsNonPost(t *testing.T) {
+	h, _ := newTestIngestHandler()
+	req := httptest.NewRequest(http.MethodGet, "/ingest", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,179 @@
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// AggregationType decides how the events of one period combine into a total.
+type AggregationType string
+
+const (
+	AggregationSum         AggregationType = "sum"
+	AggregationMax         AggregationType = "max"
+	AggregationUniqueCount AggregationType = "unique_count"
+	AggregationLast        AggregationType = "last"
+)
+
+var (
+	ErrMetricNotFound = errors.New("metric not found")
+	ErrMetricExists   = errors.New("metric already exists")
+	ErrMetricInUse    = errors.New("metric has recorded usage")
+)
+
+// MetricDefinition is a metrics row.
+type MetricDefinition struct {
+	Key         string
+	DisplayName string
+	Unit        string
+	Aggregation AggregationType
+	// UniqueDimension is the dimension counted by AggregationUniqueCount. Events
+	// may always carry it, but it gets no rollup of its own.
+	UniqueDimension string
+	// Dimensions lists the dimension keys events may carry. Each gets a rollup.
+	Dimensions []string
+}
+
+// HasRollup reports whether the aggregator keeps a per-value rollup for key.
+func (m *MetricDefinition) HasRollup(key string) bool {
+	for _, d := range m.Dimensions {
+		if d == key {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsDimension reports whether events of m may carry the dimension key.
+func (m *MetricDefinition) AllowsDimension(key string) bool {
+	return key == m.UniqueDimension || m.HasRollup(key)
+}
+
+const metricColumns = `key, display_name, unit, aggregation, unique_dimension, dimensions`
+
+func scanMetric(row interface{ Scan(...interface{}) error }) (*MetricDefinition, error) {
+	var m MetricDefinition
+	var dims pq.StringArray
+	if err := row.Scan(&m.Key, &m.DisplayName, &m.Unit, &m.Aggregation, &m.UniqueDimension, &dims); err != nil {
+		return nil, err
+	}
+	m.Dimensions = dims
+	return &m, nil
+}
+
+func (s *Store) CreateMetric(ctx context.Context, m *MetricDefinition) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO metrics (key, display_name, unit, aggregation, unique_dimension, dimensions)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, m.Key, m.DisplayName, m.Unit, m.Aggregation, m.UniqueDimension, pq.Array(m.Dimensions))
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrMetricExists
+	}
+	return err
+}
+
+func (s *Store) GetMetric(ctx context.Context, key string) (*MetricDefinition, error) {
+	m, err := scanMetric(s.db.QueryRowContext(ctx, `
+		SELECT `+metricColumns+`
+		FROM metrics
+		WHERE key = $1
+	`, key))
+	if err == sql.ErrNoRows {
+		return nil, ErrMetricNotFound
+	}
+	return m, err
+}
+
+// GetMetrics returns the definitions of the given keys that exist, by key.
+func (s *Store) GetMetrics(ctx context.Context, keys []string) (map[string]*MetricDefinition, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+metricColumns+`
+		FROM metrics
+		WHERE key = ANY($1)
+	`, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]*MetricDefinition, len(keys))
+	for rows.Next() {
+		m, err := scanMetric(rows)
+		if err != nil {
+			return nil, err
+		}
+		res[m.Key] = m
+	}
+	return res, rows.Err()
+}
+
+func (s *Store) ListMetrics(ctx context.Context) ([]*MetricDefinition, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+metricColumns+`
+		FROM metrics
+		ORDER BY key
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []*MetricDefinition
+	for rows.Next() {
+		m, err := scanMetric(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+// UpdateMetric changes the display name, unit and dimensions of a metric. The
+// aggregation type is fixed at creation because existing aggregates were folded
+// with it. Rollups for newly added dimensions are backfilled by Reaggregate.
+func (s *Store) UpdateMetric(ctx context.Context, m *MetricDefinition) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE metrics
+		SET display_name = $2, unit = $3, dimensions = $4, updated_at = NOW()
+		WHERE key = $1
+	`, m.Key, m.DisplayName, m.Unit, pq.Array(m.Dimensions))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMetricNotFound
+	}
+	return nil
+}
+
+// DeleteMetric removes a metric that has no recorded events.
+func (s *Store) DeleteMetric(ctx context.Context, key string) error {
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM metrics
+		WHERE key = $1
+		AND NOT EXISTS (SELECT 1 FROM usage_events WHERE metric = $1)
+	`, key)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	if _, err := s.GetMetric(ctx, key); err != nil {
+		return err
+	}
+	return ErrMetricInUse
+}
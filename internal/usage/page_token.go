@@ -0,0 +1,63 @@
+package usage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 30
+	maxPageSize     = 1000
+	pageTokenPrefix = "v1:"
+	// ungroupedGroup is the group of aggregates without group-by dimensions.
+	ungroupedGroup = "{}"
+)
+
+// encodePageToken returns an opaque token that resumes a newest-first listing
+// right after the aggregate at cursor c.
+func encodePageToken(c AggregateCursor) string {
+	raw := pageTokenPrefix + strconv.FormatInt(c.PeriodStart.Unix(), 10) + ":" + c.Group
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodePageToken is the inverse of encodePageToken. An empty token decodes to
+// the zero cursor, meaning "start from the newest period".
+func decodePageToken(token string) (AggregateCursor, error) {
+	if token == "" {
+		return AggregateCursor{}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return AggregateCursor{}, fmt.Errorf("invalid page token")
+	}
+
+	rest, ok := strings.CutPrefix(string(raw), pageTokenPrefix)
+	if !ok {
+		return AggregateCursor{}, fmt.Errorf("invalid page token")
+	}
+	sec, group, ok := strings.Cut(rest, ":")
+	if !ok {
+		return AggregateCursor{}, fmt.Errorf("invalid page token")
+	}
+
+	unix, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return AggregateCursor{}, fmt.Errorf("invalid page token")
+	}
+	return AggregateCursor{PeriodStart: time.Unix(unix, 0).UTC(), Group: group}, nil
+}
+
+// normalizePageSize applies the default and maximum page size.
+func normalizePageSize(size int32) int {
+	switch {
+	case size <= 0:
+		return defaultPageSize
+	case size > maxPageSize:
+		return maxPageSize
+	default:
+		return int(size)
+	}
+}
@@ -0,0 +1,73 @@
+package usage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPageToken_RoundTrip(t *testing.T) {
+	tests := []AggregateCursor{
+		{PeriodStart: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Group: ungroupedGroup},
+		{PeriodStart: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Group: `{"region": "eu:west"}`},
+	}
+
+	for _, c := range tests {
+		got, err := decodePageToken(encodePageToken(c))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !got.PeriodStart.Equal(c.PeriodStart) || got.Group != c.Group {
+			t.Errorf("expected %+v, got %+v", c, got)
+		}
+	}
+}
+
+func TestDecodePageToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "empty token", token: ""},
+		{name: "not base64", token: "%%%", wantErr: true},
+		{name: "missing prefix", token: "MTIzNA", wantErr: true},
+		{name: "not a number", token: "djE6YWJjOnt9", wantErr: true},
+		{name: "without group", token: "djE6MTIzNA", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodePageToken(tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.IsZero() {
+				t.Errorf("expected zero cursor, got %+v", got)
+			}
+		})
+	}
+}
+
+func TestNormalizePageSize(t *testing.T) {
+	tests := []struct {
+		size     int32
+		expected int
+	}{
+		{size: 0, expected: defaultPageSize},
+		{size: -5, expected: defaultPageSize},
+		{size: 10, expected: 10},
+		{size: maxPageSize + 1, expected: maxPageSize},
+	}
+
+	for _, tt := range tests {
+		if got := normalizePageSize(tt.size); got != tt.expected {
+			t.Errorf("normalizePageSize(%d): expected %d, got %d", tt.size, tt.expected, got)
+		}
+	}
+}
@@ -2,11 +2,32 @@ package usage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
 	"time"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
 	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
 )
 
+const (
+	// maxBatchEvents caps the number of events in one RecordUsageBatch call or StreamUsage stream.
+	maxBatchEvents = 50000
+	// streamFlushSize is how many streamed events are buffered before they are written.
+	streamFlushSize = 5000
+	// maxEventDimensions caps the number of dimensions on one event.
+	maxEventDimensions = 16
+	// maxDimensionLength caps the length of a dimension key or value.
+	maxDimensionLength = 128
+	// maxGroupBy caps the number of group_by keys in a usage summary.
+	maxGroupBy = 4
+)
+
 type Service struct {
 	store *Store
 	usagev1.UnimplementedUsageServer
@@ -17,36 +38,496 @@ func NewService(store *Store) *Service {
 }
 
 func (s *Service) RecordUsage(ctx context.Context, req *usagev1.RecordUsageRequest) (*usagev1.RecordUsageResponse, error) {
-	if req.OrgId == "" || req.Metric == "" || req.Quantity <= 0 {
+	if validateRecordUsageRequest(req) != nil {
 		return &usagev1.RecordUsageResponse{Success: false}, nil
 	}
-
-	ts := time.Unix(req.TimestampUnix, 0).UTC()
-	if ts.IsZero() {
-		ts = time.Now().UTC()
+	def, err := s.store.GetMetric(ctx, req.Metric)
+	if err == ErrMetricNotFound {
+		return &usagev1.RecordUsageResponse{Success: false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if validateEventForMetric(req, def) != nil {
+		return &usagev1.RecordUsageResponse{Success: false}, nil
 	}
 
-	if err := s.store.InsertUsageEvent(ctx, req.OrgId, req.Metric, req.Quantity, ts, req.IdempotencyKey); err != nil {
+	if _, err := s.store.InsertUsageEvent(ctx, usageEventFromProto(req)); err != nil {
 		return nil, err
 	}
 
 	return &usagev1.RecordUsageResponse{Success: true}, nil
 }
 
+func (s *Service) RecordUsageBatch(ctx context.Context, req *usagev1.RecordUsageBatchRequest) (*usagev1.RecordUsageBatchResponse, error) {
+	if len(req.Events) > maxBatchEvents {
+		return nil, status.Errorf(codes.InvalidArgument, "batch has %d events, maximum is %d", len(req.Events), maxBatchEvents)
+	}
+
+	resp := &usagev1.RecordUsageBatchResponse{}
+	if err := s.recordBatch(ctx, req.Events, 0, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// StreamUsage accepts a client stream of events, writing them in chunks of
+// streamFlushSize as they arrive. Chunks already written stay committed if the
+// stream fails part-way, so clients should set idempotency keys and resend.
+func (s *Service) StreamUsage(stream usagev1.Usage_StreamUsageServer) error {
+	ctx := stream.Context()
+	resp := &usagev1.RecordUsageBatchResponse{}
+	buf := make([]*usagev1.RecordUsageRequest, 0, streamFlushSize)
+	offset := 0
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			if err := s.recordBatch(ctx, buf, offset, resp); err != nil {
+				return err
+			}
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+
+		if offset+len(buf) >= maxBatchEvents {
+			return status.Errorf(codes.InvalidArgument, "stream exceeds %d events", maxBatchEvents)
+		}
+		buf = append(buf, req)
+		if len(buf) == streamFlushSize {
+			if err := s.recordBatch(ctx, buf, offset, resp); err != nil {
+				return err
+			}
+			offset += len(buf)
+			buf = buf[:0]
+		}
+	}
+}
+
+// recordBatch validates and writes events, appending one result per event to resp.
+// offset is the index of events[0] within the overall batch or stream.
+func (s *Service) recordBatch(ctx context.Context, events []*usagev1.RecordUsageRequest, offset int, resp *usagev1.RecordUsageBatchResponse) error {
+	keys := make([]string, 0, len(events))
+	seen := make(map[string]bool)
+	for _, req := range events {
+		if !seen[req.Metric] {
+			seen[req.Metric] = true
+			keys = append(keys, req.Metric)
+		}
+	}
+	defs, err := s.store.GetMetrics(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("load metrics: %w", err)
+	}
+
+	results := make([]*usagev1.EventResult, len(events))
+	rows := make([]UsageEvent, 0, len(events))
+	rowIdx := make([]int, 0, len(events))
+
+	for i, req := range events {
+		results[i] = &usagev1.EventResult{Index: int32(offset + i)}
+		err := validateRecordUsageRequest(req)
+		if err == nil {
+			err = validateEventForMetric(req, defs[req.Metric])
+		}
+		if err != nil {
+			results[i].Status = usagev1.EventStatus_EVENT_STATUS_REJECTED
+			results[i].Error = err.Error()
+			continue
+		}
+		rows = append(rows, usageEventFromProto(req))
+		rowIdx = append(rowIdx, i)
+	}
+
+	if len(rows) > 0 {
+		inserted, err := s.store.InsertUsageEvents(ctx, rows)
+		if err != nil {
+			return fmt.Errorf("insert usage events: %w", err)
+		}
+		for j, ok := range inserted {
+			if ok {
+				results[rowIdx[j]].Status = usagev1.EventStatus_EVENT_STATUS_ACCEPTED
+			} else {
+				results[rowIdx[j]].Status = usagev1.EventStatus_EVENT_STATUS_DUPLICATE
+			}
+		}
+	}
+
+	for _, r := range results {
+		switch r.Status {
+		case usagev1.EventStatus_EVENT_STATUS_ACCEPTED:
+			resp.Accepted++
+		case usagev1.EventStatus_EVENT_STATUS_DUPLICATE:
+			resp.Duplicates++
+		case usagev1.EventStatus_EVENT_STATUS_REJECTED:
+			resp.Rejected++
+		}
+	}
+	resp.Results = append(resp.Results, results...)
+	return nil
+}
+
+// eventTime returns the event's timestamp, defaulting to now when it is unset.
+func eventTime(req *usagev1.RecordUsageRequest) time.Time {
+	if req.TimestampUnix > 0 {
+		return time.Unix(req.TimestampUnix, 0).UTC()
+	}
+	return time.Now().UTC()
+}
+
+func usageEventFromProto(req *usagev1.RecordUsageRequest) UsageEvent {
+	return UsageEvent{
+		OrgID:          req.OrgId,
+		Metric:         req.Metric,
+		Quantity:       req.Quantity,
+		OccurredAt:     eventTime(req),
+		IdempotencyKey: req.IdempotencyKey,
+		Dimensions:     req.Dimensions,
+	}
+}
+
+// validateRecordUsageRequest checks that req carries the fields every usage
+// event needs and that its dimensions are within limits.
+func validateRecordUsageRequest(req *usagev1.RecordUsageRequest) error {
+	if req.OrgId == "" || req.Metric == "" || req.Quantity <= 0 {
+		return errors.New("org_id and metric are required and quantity must be positive")
+	}
+	if len(req.Dimensions) > maxEventDimensions {
+		return fmt.Errorf("at most %d dimensions are allowed", maxEventDimensions)
+	}
+	for k, v := range req.Dimensions {
+		if k == "" {
+			return errors.New("dimension keys must not be empty")
+		}
+		if len(k) > maxDimensionLength || len(v) > maxDimensionLength {
+			return fmt.Errorf("dimension %q: keys and values are limited to %d bytes", k, maxDimensionLength)
+		}
+	}
+	return nil
+}
+
+// validateEventForMetric checks req against the definition of its metric; a
+// nil def means the metric is not registered.
+func validateEventForMetric(req *usagev1.RecordUsageRequest, def *MetricDefinition) error {
+	if def == nil {
+		return fmt.Errorf("unknown metric %q", req.Metric)
+	}
+	for k := range req.Dimensions {
+		if !def.AllowsDimension(k) {
+			return fmt.Errorf("dimension %q is not allowed for metric %q", k, req.Metric)
+		}
+	}
+	if def.Aggregation == AggregationUniqueCount {
+		if _, ok := req.Dimensions[def.UniqueDimension]; !ok {
+			return fmt.Errorf("metric %q requires dimension %q", req.Metric, def.UniqueDimension)
+		}
+	}
+	return nil
+}
+
 func (s *Service) GetUsageSummary(ctx context.Context, req *usagev1.GetUsageSummaryRequest) (*usagev1.GetUsageSummaryResponse, error) {
-	aggs, err := s.store.GetAggregates(ctx, req.OrgId, req.Metric)
+	granularity, err := granularityFromProto(req.Granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.StartUnix > 0 && req.EndUnix > 0 && req.EndUnix <= req.StartUnix {
+		return nil, status.Error(codes.InvalidArgument, "end_unix must be after start_unix")
+	}
+
+	if len(req.GroupBy) > maxGroupBy {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d group_by keys are allowed", maxGroupBy)
+	}
+	for _, key := range req.GroupBy {
+		if key == "" {
+			return nil, status.Error(codes.InvalidArgument, "group_by keys must not be empty")
+		}
+	}
+
+	after, err := decodePageToken(req.PageToken)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	q := AggregateQuery{
+		OrgID:       req.OrgId,
+		Metric:      req.Metric,
+		Granularity: granularity,
+		Filters:     req.Filters,
+		GroupBy:     req.GroupBy,
+		After:       after,
+		// Fetch one extra row to learn whether another page exists.
+		Limit: normalizePageSize(req.PageSize) + 1,
+	}
+	if req.StartUnix > 0 {
+		q.Start = time.Unix(req.StartUnix, 0).UTC()
+	}
+	if req.EndUnix > 0 {
+		q.End = time.Unix(req.EndUnix, 0).UTC()
+	}
+
+	aggs, err := s.store.GetAggregates(ctx, q)
+	if err == ErrMetricNotFound {
+		return nil, status.Errorf(codes.NotFound, "unknown metric %q", req.Metric)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	resp := &usagev1.GetUsageSummaryResponse{}
+	if len(aggs) == q.Limit {
+		aggs = aggs[:len(aggs)-1]
+		resp.NextPageToken = encodePageToken(aggs[len(aggs)-1].Cursor())
+	}
 	for _, a := range aggs {
 		resp.Aggregates = append(resp.Aggregates, &usagev1.UsageAggregate{
 			Metric:          a.Metric,
 			Total:           a.Total,
 			PeriodStartUnix: a.PeriodStart.Unix(),
 			PeriodEndUnix:   a.PeriodEnd.Unix(),
+			Granularity:     granularityToProto(a.Granularity),
+			Cursor:          encodePageToken(a.Cursor()),
+			Dimensions:      a.Dimensions,
 		})
 	}
 	return resp, nil
 }
+
+func granularityFromProto(g usagev1.Granularity) (Granularity, error) {
+	switch g {
+	case usagev1.Granularity_GRANULARITY_HOUR:
+		return GranularityHour, nil
+	case usagev1.Granularity_GRANULARITY_UNSPECIFIED, usagev1.Granularity_GRANULARITY_DAY:
+		return GranularityDay, nil
+	case usagev1.Granularity_GRANULARITY_MONTH:
+		return GranularityMonth, nil
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "unknown granularity %v", g)
+	}
+}
+
+func granularityToProto(g Granularity) usagev1.Granularity {
+	switch g {
+	case GranularityHour:
+		return usagev1.Granularity_GRANULARITY_HOUR
+	case GranularityDay:
+		return usagev1.Granularity_GRANULARITY_DAY
+	case GranularityMonth:
+		return usagev1.Granularity_GRANULARITY_MONTH
+	default:
+		return usagev1.Granularity_GRANULARITY_UNSPECIFIED
+	}
+}
+
+func (s *Service) Reaggregate(ctx context.Context, req *usagev1.ReaggregateRequest) (*usagev1.ReaggregateResponse, error) {
+	if req.OrgId == "" || req.Metric == "" {
+		return nil, status.Error(codes.InvalidArgument, "org_id and metric are required")
+	}
+	if req.EndUnix <= req.StartUnix {
+		return nil, status.Error(codes.InvalidArgument, "end_unix must be after start_unix")
+	}
+
+	start := time.Unix(req.StartUnix, 0).UTC()
+	end := time.Unix(req.EndUnix, 0).UTC()
+	if err := s.store.Reaggregate(ctx, req.OrgId, req.Metric, start, end); err != nil {
+		return nil, err
+	}
+	return &usagev1.ReaggregateResponse{Success: true}, nil
+}
+
+// GetUsageTotal returns the usage of one org and metric over a period. It is
+// how billing-svc reads the quantities it invoices.
+func (s *Service) GetUsageTotal(ctx context.Context, req *usagev1.GetUsageTotalRequest) (*usagev1.GetUsageTotalResponse, error) {
+	if req.OrgId == "" || req.Metric == "" {
+		return nil, status.Error(codes.InvalidArgument, "org_id and metric are required")
+	}
+	if req.EndUnix <= req.StartUnix {
+		return nil, status.Error(codes.InvalidArgument, "end_unix must be after start_unix")
+	}
+
+	start := time.Unix(req.StartUnix, 0).UTC()
+	end := time.Unix(req.EndUnix, 0).UTC()
+	total, err := s.store.GetUsageTotal(ctx, req.OrgId, req.Metric, start, end)
+	if err == ErrMetricNotFound {
+		return nil, status.Errorf(codes.NotFound, "unknown metric %q", req.Metric)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &usagev1.GetUsageTotalResponse{Total: total}, nil
+}
+
+// metricKeyPattern restricts the keys of newly created metrics.
+var metricKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_.]{0,63}$`)
+
+func (s *Service) CreateMetric(ctx context.Context, req *usagev1.CreateMetricRequest) (*usagev1.Metric, error) {
+	if req.Metric == nil {
+		return nil, status.Error(codes.InvalidArgument, "metric is required")
+	}
+	if !metricKeyPattern.MatchString(req.Metric.Key) {
+		return nil, status.Error(codes.InvalidArgument, "key must be lowercase letters, digits, '_' or '.', starting with a letter")
+	}
+	def, err := metricFromProto(req.Metric)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.store.CreateMetric(ctx, def); err != nil {
+		return nil, metricStatus(err, def.Key)
+	}
+	return metricToProto(def), nil
+}
+
+func (s *Service) GetMetric(ctx context.Context, req *usagev1.GetMetricRequest) (*usagev1.Metric, error) {
+	def, err := s.store.GetMetric(ctx, req.Key)
+	if err != nil {
+		return nil, metricStatus(err, req.Key)
+	}
+	return metricToProto(def), nil
+}
+
+func (s *Service) ListMetrics(ctx context.Context, req *usagev1.ListMetricsRequest) (*usagev1.ListMetricsResponse, error) {
+	defs, err := s.store.ListMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &usagev1.ListMetricsResponse{}
+	for _, def := range defs {
+		resp.Metrics = append(resp.Metrics, metricToProto(def))
+	}
+	return resp, nil
+}
+
+func (s *Service) UpdateMetric(ctx context.Context, req *usagev1.UpdateMetricRequest) (*usagev1.Metric, error) {
+	if req.Metric == nil {
+		return nil, status.Error(codes.InvalidArgument, "metric is required")
+	}
+	current, err := s.store.GetMetric(ctx, req.Metric.Key)
+	if err != nil {
+		return nil, metricStatus(err, req.Metric.Key)
+	}
+
+	update := proto.Clone(req.Metric).(*usagev1.Metric)
+	if update.Aggregation == usagev1.Aggregation_AGGREGATION_UNSPECIFIED {
+		update.Aggregation = aggregationToProto(current.Aggregation)
+	}
+	if update.UniqueDimension == "" {
+		update.UniqueDimension = current.UniqueDimension
+	}
+	def, err := metricFromProto(update)
+	if err != nil {
+		return nil, err
+	}
+	if def.Aggregation != current.Aggregation || def.UniqueDimension != current.UniqueDimension {
+		return nil, status.Error(codes.FailedPrecondition, "aggregation and unique_dimension cannot be changed")
+	}
+
+	if err := s.store.UpdateMetric(ctx, def); err != nil {
+		return nil, metricStatus(err, def.Key)
+	}
+	return metricToProto(def), nil
+}
+
+func (s *Service) DeleteMetric(ctx context.Context, req *usagev1.DeleteMetricRequest) (*usagev1.DeleteMetricResponse, error) {
+	if err := s.store.DeleteMetric(ctx, req.Key); err != nil {
+		return nil, metricStatus(err, req.Key)
+	}
+	return &usagev1.DeleteMetricResponse{Success: true}, nil
+}
+
+// metricStatus maps metric store errors to gRPC status errors.
+func metricStatus(err error, key string) error {
+	switch err {
+	case ErrMetricNotFound:
+		return status.Errorf(codes.NotFound, "unknown metric %q", key)
+	case ErrMetricExists:
+		return status.Errorf(codes.AlreadyExists, "metric %q already exists", key)
+	case ErrMetricInUse:
+		return status.Errorf(codes.FailedPrecondition, "metric %q has recorded usage", key)
+	default:
+		return err
+	}
+}
+
+// metricFromProto validates m and converts it to a MetricDefinition.
+func metricFromProto(m *usagev1.Metric) (*MetricDefinition, error) {
+	agg, err := aggregationFromProto(m.Aggregation)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Dimensions) > maxEventDimensions {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d dimensions are allowed", maxEventDimensions)
+	}
+	seen := make(map[string]bool)
+	for _, d := range m.Dimensions {
+		if d == "" || len(d) > maxDimensionLength {
+			return nil, status.Errorf(codes.InvalidArgument, "dimension keys must be 1 to %d bytes", maxDimensionLength)
+		}
+		if seen[d] {
+			return nil, status.Errorf(codes.InvalidArgument, "duplicate dimension %q", d)
+		}
+		seen[d] = true
+	}
+
+	switch {
+	case agg == AggregationUniqueCount && m.UniqueDimension == "":
+		return nil, status.Error(codes.InvalidArgument, "unique_dimension is required for unique count metrics")
+	case agg != AggregationUniqueCount && m.UniqueDimension != "":
+		return nil, status.Error(codes.InvalidArgument, "unique_dimension is only valid for unique count metrics")
+	case len(m.UniqueDimension) > maxDimensionLength:
+		return nil, status.Errorf(codes.InvalidArgument, "unique_dimension is limited to %d bytes", maxDimensionLength)
+	}
+
+	return &MetricDefinition{
+		Key:             m.Key,
+		DisplayName:     m.DisplayName,
+		Unit:            m.Unit,
+		Aggregation:     agg,
+		UniqueDimension: m.UniqueDimension,
+		Dimensions:      m.Dimensions,
+	}, nil
+}
+
+func metricToProto(def *MetricDefinition) *usagev1.Metric {
+	return &usagev1.Metric{
+		Key:             def.Key,
+		DisplayName:     def.DisplayName,
+		Unit:            def.Unit,
+		Aggregation:     aggregationToProto(def.Aggregation),
+		UniqueDimension: def.UniqueDimension,
+		Dimensions:      def.Dimensions,
+	}
+}
+
+func aggregationFromProto(a usagev1.Aggregation) (AggregationType, error) {
+	switch a {
+	case usagev1.Aggregation_AGGREGATION_UNSPECIFIED, usagev1.Aggregation_AGGREGATION_SUM:
+		return AggregationSum, nil
+	case usagev1.Aggregation_AGGREGATION_MAX:
+		return AggregationMax, nil
+	case usagev1.Aggregation_AGGREGATION_UNIQUE_COUNT:
+		return AggregationUniqueCount, nil
+	case usagev1.Aggregation_AGGREGATION_LAST:
+		return AggregationLast, nil
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "unknown aggregation %v", a)
+	}
+}
+
+func aggregationToProto(a AggregationType) usagev1.Aggregation {
+	switch a {
+	case AggregationSum:
+		return usagev1.Aggregation_AGGREGATION_SUM
+	case AggregationMax:
+		return usagev1.Aggregation_AGGREGATION_MAX
+	case AggregationUniqueCount:
+		return usagev1.Aggregation_AGGREGATION_UNIQUE_COUNT
+	case AggregationLast:
+		return usagev1.Aggregation_AGGREGATION_LAST
+	default:
+		return usagev1.Aggregation_AGGREGATION_UNSPECIFIED
+	}
+}
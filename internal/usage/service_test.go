@@ -1,7 +1,16 @@
 package usage
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	usagev1 "github.com/jackthomas00/polaris/proto/usagev1"
 )
 
 // TestService_RecordUsage_UsesRequestOrgID verifies that RecordUsage uses req.OrgId
@@ -61,3 +70,244 @@ func TestService_PreventsOrgIDFaking(t *testing.T) {
 	// - Service rejects requests with org_id that doesn't match authenticated user
 	// - Service only returns data for the authenticated org
 }
+
+func TestValidateEventForMetric(t *testing.T) {
+	seats := &MetricDefinition{Key: "seats", Aggregation: AggregationUniqueCount, UniqueDimension: "user_id", Dimensions: []string{"team"}}
+	calls := &MetricDefinition{Key: "api_calls", Aggregation: AggregationSum, Dimensions: []string{"region"}}
+
+	tests := []struct {
+		name    string
+		def     *MetricDefinition
+		dims    map[string]string
+		wantErr bool
+	}{
+		{name: "unknown metric", def: nil, wantErr: true},
+		{name: "no dimensions", def: calls},
+		{name: "allowed dimension", def: calls, dims: map[string]string{"region": "eu"}},
+		{name: "undeclared dimension", def: calls, dims: map[string]string{"customer": "acme"}, wantErr: true},
+		{name: "unique dimension present", def: seats, dims: map[string]string{"user_id": "u1", "team": "core"}},
+		{name: "unique dimension missing", def: seats, dims: map[string]string{"team": "core"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &usagev1.RecordUsageRequest{OrgId: "org-1", Metric: "m", Quantity: 1, Dimensions: tt.dims}
+			err := validateEventForMetric(req, tt.def)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMetricFromProto(t *testing.T) {
+	tests := []struct {
+		name     string
+		metric   *usagev1.Metric
+		wantCode codes.Code
+		wantAgg  AggregationType
+	}{
+		{name: "defaults to sum", metric: &usagev1.Metric{Key: "api_calls"}, wantAgg: AggregationSum},
+		{name: "max", metric: &usagev1.Metric{Key: "concurrency", Aggregation: usagev1.Aggregation_AGGREGATION_MAX}, wantAgg: AggregationMax},
+		{
+			name:    "unique count",
+			metric:  &usagev1.Metric{Key: "seats", Aggregation: usagev1.Aggregation_AGGREGATION_UNIQUE_COUNT, UniqueDimension: "user_id"},
+			wantAgg: AggregationUniqueCount,
+		},
+		{
+			name:     "unique count without dimension",
+			metric:   &usagev1.Metric{Key: "seats", Aggregation: usagev1.Aggregation_AGGREGATION_UNIQUE_COUNT},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "unique dimension on sum",
+			metric:   &usagev1.Metric{Key: "api_calls", UniqueDimension: "user_id"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "duplicate dimension",
+			metric:   &usagev1.Metric{Key: "api_calls", Dimensions: []string{"region", "region"}},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def, err := metricFromProto(tt.metric)
+			if tt.wantCode != codes.OK {
+				if status.Code(err) != tt.wantCode {
+					t.Errorf("expected code %v, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if def.Aggregation != tt.wantAgg {
+				t.Errorf("expected aggregation %s, got %s", tt.wantAgg, def.Aggregation)
+			}
+		})
+	}
+}
+
+func TestService_RecordUsageBatch(t *testing.T) {
+	calls := &MetricDefinition{Key: "api_calls", Aggregation: AggregationSum, Dimensions: []string{"region"}}
+	event := func(metric string, quantity int64, key string) *usagev1.RecordUsageRequest {
+		return &usagev1.RecordUsageRequest{OrgId: "org-1", Metric: metric, Quantity: quantity, IdempotencyKey: key}
+	}
+	const (
+		accepted  = usagev1.EventStatus_EVENT_STATUS_ACCEPTED
+		rejected  = usagev1.EventStatus_EVENT_STATUS_REJECTED
+		duplicate = usagev1.EventStatus_EVENT_STATUS_DUPLICATE
+	)
+
+	tests := []struct {
+		name     string
+		recorded [][2]string
+		events   []*usagev1.RecordUsageRequest
+		expected []usagev1.EventStatus
+	}{
+		{
+			name:     "all accepted",
+			events:   []*usagev1.RecordUsageRequest{event("api_calls", 1, "a"), event("api_calls", 2, ""), event("api_calls", 3, "b")},
+			expected: []usagev1.EventStatus{accepted, accepted, accepted},
+		},
+		{
+			name: "invalid events are rejected, the rest written",
+			events: []*usagev1.RecordUsageRequest{
+				event("api_calls", 1, "a"),
+				event("api_calls", 0, "b"),
+				event("gpu_hours", 1, "c"),
+				{OrgId: "org-1", Metric: "api_calls", Quantity: 1, Dimensions: map[string]string{"customer": "acme"}},
+			},
+			expected: []usagev1.EventStatus{accepted, rejected, rejected, rejected},
+		},
+		{
+			name:     "recorded keys are duplicates",
+			recorded: [][2]string{{"org-1", "a"}},
+			events:   []*usagev1.RecordUsageRequest{event("api_calls", 1, "a"), event("api_calls", 1, "b")},
+			expected: []usagev1.EventStatus{duplicate, accepted},
+		},
+		{
+			name:     "a key repeated in the batch is a duplicate",
+			events:   []*usagev1.RecordUsageRequest{event("api_calls", 1, "a"), event("api_calls", 1, "a")},
+			expected: []usagev1.EventStatus{accepted, duplicate},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeEvents(calls)
+			for _, k := range tt.recorded {
+				f.recorded[k] = true
+			}
+			resp, err := NewService(f.store(t)).RecordUsageBatch(context.Background(), &usagev1.RecordUsageBatchRequest{Events: tt.events})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(resp.Results) != len(tt.expected) {
+				t.Fatalf("expected %d results, got %d", len(tt.expected), len(resp.Results))
+			}
+			var counts [4]int32
+			for i, r := range resp.Results {
+				if r.Index != int32(i) || r.Status != tt.expected[i] {
+					t.Errorf("result %d: expected index %d status %v, got %d %v", i, i, tt.expected[i], r.Index, r.Status)
+				}
+				if (r.Status == rejected) != (r.Error != "") {
+					t.Errorf("result %d: error %q does not match status %v", i, r.Error, r.Status)
+				}
+				counts[tt.expected[i]]++
+			}
+			if resp.Accepted != counts[accepted] || resp.Rejected != counts[rejected] || resp.Duplicates != counts[duplicate] {
+				t.Errorf("expected %d accepted, %d rejected, %d duplicates, got %d, %d, %d",
+					counts[accepted], counts[rejected], counts[duplicate], resp.Accepted, resp.Rejected, resp.Duplicates)
+			}
+		})
+	}
+}
+
+func TestService_RecordUsageBatch_Limit(t *testing.T) {
+	f := newFakeEvents()
+	events := make([]*usagev1.RecordUsageRequest, maxBatchEvents+1)
+	_, err := NewService(f.store(t)).RecordUsageBatch(context.Background(), &usagev1.RecordUsageBatchRequest{Events: events})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	if len(f.committed) != 0 {
+		t.Errorf("expected nothing written, got %v", f.committed)
+	}
+}
+
+// fakeUsageStream sends events to StreamUsage.
+type fakeUsageStream struct {
+	grpc.ServerStream
+	events []*usagev1.RecordUsageRequest
+	resp   *usagev1.RecordUsageBatchResponse
+}
+
+func (s *fakeUsageStream) Context() context.Context { return context.Background() }
+
+func (s *fakeUsageStream) Recv() (*usagev1.RecordUsageRequest, error) {
+	if len(s.events) == 0 {
+		return nil, io.EOF
+	}
+	ev := s.events[0]
+	s.events = s.events[1:]
+	return ev, nil
+}
+
+func (s *fakeUsageStream) SendAndClose(resp *usagev1.RecordUsageBatchResponse) error {
+	s.resp = resp
+	return nil
+}
+
+func streamEvents(n int) []*usagev1.RecordUsageRequest {
+	events := make([]*usagev1.RecordUsageRequest, n)
+	for i := range events {
+		events[i] = &usagev1.RecordUsageRequest{OrgId: "org-1", Metric: "api_calls", Quantity: 1, IdempotencyKey: fmt.Sprintf("k%d", i)}
+	}
+	return events
+}
+
+func TestService_StreamUsage(t *testing.T) {
+	f := newFakeEvents(&MetricDefinition{Key: "api_calls", Aggregation: AggregationSum})
+	n := 2*streamFlushSize + 123
+	stream := &fakeUsageStream{events: streamEvents(n)}
+
+	if err := NewService(f.store(t)).StreamUsage(stream); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []int{streamFlushSize, streamFlushSize, 123}
+	if fmt.Sprint(f.committed) != fmt.Sprint(expected) {
+		t.Errorf("expected writes of %v events, got %v", expected, f.committed)
+	}
+	if stream.resp == nil || stream.resp.Accepted != int32(n) || len(stream.resp.Results) != n {
+		t.Fatalf("expected %d accepted results, got %+v", n, stream.resp)
+	}
+	for i, r := range stream.resp.Results {
+		if r.Index != int32(i) {
+			t.Fatalf("result %d has index %d", i, r.Index)
+		}
+	}
+}
+
+func TestService_StreamUsage_Limit(t *testing.T) {
+	f := newFakeEvents(&MetricDefinition{Key: "api_calls", Aggregation: AggregationSum})
+	stream := &fakeUsageStream{events: streamEvents(maxBatchEvents + 1)}
+
+	err := NewService(f.store(t)).StreamUsage(stream)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	// Chunks flushed before the limit stay written.
+	if len(f.committed) != maxBatchEvents/streamFlushSize {
+		t.Errorf("expected %d flushed chunks, got %d", maxBatchEvents/streamFlushSize, len(f.committed))
+	}
+	if stream.resp != nil {
+		t.Error("expected no response after the limit")
+	}
+}
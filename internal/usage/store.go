@@ -3,80 +3,200 @@ package usage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/jackthomas00/polaris/pkg/outbox"
 )
 
+// insertChunkSize is the number of rows written per multi-row INSERT statement.
+const insertChunkSize = 1000
+
 type Store struct {
-	db *sql.DB
+	db     *sql.DB
+	outbox *outbox.Outbox
 }
 
 func NewStore(db *sql.DB) *Store {
-	return &Store{db: db}
+	return &Store{db: db, outbox: outbox.New(outboxTable)}
+}
+
+// outboxTable holds the events usage-svc publishes.
+const outboxTable = "usage_outbox"
+
+// Outbox returns the outbox the store writes its events to.
+func (s *Store) Outbox() *outbox.Outbox {
+	return s.outbox
 }
 
-func (s *Store) InsertUsageEvent(ctx context.Context, orgID, metric string, quantity int64, ts time.Time, idemKey string) error {
+// InsertUsageEvent writes one event and queues its usage.recorded event. It
+// reports whether the event was inserted; false means its
+// (org_id, idempotency_key) was already recorded.
+func (s *Store) InsertUsageEvent(ctx context.Context, ev UsageEvent) (bool, error) {
+	dims, err := dimensionsJSON(ev.Dimensions)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
 	// Only enforce uniqueness if idempotency_key is provided
-	if idemKey != "" {
-		_, err := s.db.ExecContext(ctx, `
-			INSERT INTO usage_events (org_id, metric, quantity, occurred_at, idempotency_key)
-			VALUES ($1, $2, $3, $4, $5)
-			ON CONFLICT (org_id, idempotency_key) DO NOTHING
-		`, orgID, metric, quantity, ts, idemKey)
-		return err
+	if ev.IdempotencyKey != "" {
+		var id int64
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO usage_events (org_id, metric, quantity, occurred_at, idempotency_key, dimensions)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (org_id, idempotency_key) WHERE idempotency_key IS NOT NULL DO NOTHING
+			RETURNING id
+		`, ev.OrgID, ev.Metric, ev.Quantity, ev.OccurredAt, ev.IdempotencyKey, dims).Scan(&id)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+	} else {
+		// No idempotency key, just insert
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO usage_events (org_id, metric, quantity, occurred_at, idempotency_key, dimensions)
+			VALUES ($1, $2, $3, $4, NULL, $5)
+		`, ev.OrgID, ev.Metric, ev.Quantity, ev.OccurredAt, dims)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.outbox.Add(ctx, tx, SubjectUsageRecorded, usageRecordedEvent(ev)); err != nil {
+		return false, err
 	}
-	// No idempotency key, just insert
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO usage_events (org_id, metric, quantity, occurred_at, idempotency_key)
-		VALUES ($1, $2, $3, $4, NULL)
-	`, orgID, metric, quantity, ts)
-	return err
+	return true, tx.Commit()
 }
 
-type Aggregate struct {
-	Metric      string
-	Total       int64
-	PeriodStart time.Time
-	PeriodEnd   time.Time
+// UsageEvent is a single usage_events row.
+type UsageEvent struct {
+	OrgID          string
+	Metric         string
+	Quantity       int64
+	OccurredAt     time.Time
+	IdempotencyKey string
+	Dimensions     map[string]string
+}
+
+// dimensionsJSON encodes event dimensions for the usage_events.dimensions column.
+func dimensionsJSON(dims map[string]string) (string, error) {
+	if len(dims) == 0 {
+		return "{}", nil
+	}
+	b, err := json.Marshal(dims)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
-func (s *Store) GetAggregates(ctx context.Context, orgID, metric string) ([]Aggregate, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT metric, total, period_start, period_end
-		FROM usage_aggregates
-		WHERE org_id = $1 AND metric = $2
-		ORDER BY period_start DESC
-		LIMIT 30
-	`, orgID, metric)
+// InsertUsageEvents writes events in a single transaction using multi-row
+// INSERTs, queueing a usage.recorded event for each inserted one.
+// The returned slice reports, for each event, whether it was inserted (true) or
+// skipped because its (org_id, idempotency_key) was already recorded, either in
+// an earlier request or earlier in the same batch (false).
+func (s *Store) InsertUsageEvents(ctx context.Context, events []UsageEvent) ([]bool, error) {
+	inserted := make([]bool, len(events))
+
+	type idemKey struct{ orgID, key string }
+	seen := make(map[idemKey]bool)
+	pending := make([]int, 0, len(events))
+	for i, ev := range events {
+		if ev.IdempotencyKey == "" {
+			inserted[i] = true
+			pending = append(pending, i)
+			continue
+		}
+		k := idemKey{ev.OrgID, ev.IdempotencyKey}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		pending = append(pending, i)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var res []Aggregate
-	for rows.Next() {
-		var a Aggregate
-		if err := rows.Scan(&a.Metric, &a.Total, &a.PeriodStart, &a.PeriodEnd); err != nil {
+	for start := 0; start < len(pending); start += insertChunkSize {
+		end := start + insertChunkSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		chunk := pending[start:end]
+
+		orgIDs := make([]string, len(chunk))
+		metrics := make([]string, len(chunk))
+		quantities := make([]int64, len(chunk))
+		occurredAt := make([]string, len(chunk))
+		keys := make([]sql.NullString, len(chunk))
+		dims := make([]string, len(chunk))
+		byKey := make(map[idemKey]int)
+		for j, idx := range chunk {
+			ev := events[idx]
+			orgIDs[j] = ev.OrgID
+			metrics[j] = ev.Metric
+			quantities[j] = ev.Quantity
+			occurredAt[j] = ev.OccurredAt.UTC().Format(time.RFC3339Nano)
+			keys[j] = sql.NullString{String: ev.IdempotencyKey, Valid: ev.IdempotencyKey != ""}
+			if dims[j], err = dimensionsJSON(ev.Dimensions); err != nil {
+				return nil, err
+			}
+			if ev.IdempotencyKey != "" {
+				byKey[idemKey{ev.OrgID, ev.IdempotencyKey}] = idx
+			}
+		}
+
+		rows, err := tx.QueryContext(ctx, `
+			INSERT INTO usage_events (org_id, metric, quantity, occurred_at, idempotency_key, dimensions)
+			SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[], $4::timestamptz[], $5::text[], $6::jsonb[])
+			ON CONFLICT (org_id, idempotency_key) WHERE idempotency_key IS NOT NULL DO NOTHING
+			RETURNING org_id, idempotency_key
+		`, pq.Array(orgIDs), pq.Array(metrics), pq.Array(quantities), pq.Array(occurredAt), pq.Array(keys), pq.Array(dims))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var orgID string
+			var key sql.NullString
+			if err := rows.Scan(&orgID, &key); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if idx, ok := byKey[idemKey{orgID, key.String}]; ok && key.Valid {
+				inserted[idx] = true
+			}
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+		if err := rows.Err(); err != nil {
 			return nil, err
 		}
-		res = append(res, a)
 	}
-	return res, rows.Err()
-}
 
-// AggregateUsageEvents groups usage_events by (org, metric, day) and upserts into usage_aggregates
-func (s *Store) AggregateUsageEvents(ctx context.Context) error {
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO usage_aggregates (org_id, metric, period_start, period_end, total)
-		SELECT 
-			org_id,
-			metric,
-			DATE_TRUNC('day', occurred_at) AS period_start,
-			DATE_TRUNC('day', occurred_at) + INTERVAL '1 day' AS period_end,
-			SUM(quantity) AS total
-		FROM usage_events
-		GROUP BY org_id, metric, DATE_TRUNC('day', occurred_at)
-		ON CONFLICT (org_id, metric, period_start, period_end) 
-		DO UPDATE SET total = EXCLUDED.total
-	`)
-	return err
+	recorded := make([]interface{}, 0, len(events))
+	for i, ok := range inserted {
+		if ok {
+			recorded = append(recorded, usageRecordedEvent(events[i]))
+		}
+	}
+	if err := s.outbox.Add(ctx, tx, SubjectUsageRecorded, recorded...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inserted, nil
 }
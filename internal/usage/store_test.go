@@ -1,7 +1,17 @@
 package usage
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
 	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/jackthomas00/polaris/pkg/db/dbtest"
 )
 
 // TestStore_GetAggregates_FiltersByOrgID verifies that GetAggregates only returns aggregates for the specified org
@@ -42,6 +52,73 @@ func TestStore_InsertUsageEvent_UsesOrgID(t *testing.T) {
 	}
 }
 
+func TestStore_GetUsageTotal(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	metrics := map[string]*MetricDefinition{
+		"api_calls":    {Key: "api_calls", Aggregation: AggregationSum},
+		"active_users": {Key: "active_users", Aggregation: AggregationUniqueCount, UniqueDimension: "user_id"},
+	}
+
+	tests := []struct {
+		name     string
+		metric   string
+		expected string // aggregate the query computes
+		wantErr  error
+	}{
+		{name: "sum", metric: "api_calls", expected: "SUM(e.quantity)"},
+		{name: "unique count", metric: "active_users", expected: "COUNT(DISTINCT e.dimensions->>$5::text)"},
+		{name: "unknown metric", metric: "storage_gb", wantErr: ErrMetricNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var totalArgs []driver.NamedValue
+			db := dbtest.Open(t, func(query string, args []driver.NamedValue) (*dbtest.Result, error) {
+				switch {
+				case dbtest.Contains(query, "FROM metrics", "WHERE key = $1"):
+					res := dbtest.Rows([]string{"key", "display_name", "unit", "aggregation", "unique_dimension", "dimensions"})
+					if m, ok := metrics[args[0].Value.(string)]; ok {
+						res.Rows = append(res.Rows, []driver.Value{m.Key, m.DisplayName, m.Unit, string(m.Aggregation), m.UniqueDimension, "{}"})
+					}
+					return res, nil
+				case dbtest.Contains(query, "FROM usage_events e", "WHERE e.org_id = $1 AND e.metric = $2",
+					"AND e.occurred_at >= $3 AND e.occurred_at < $4"):
+					if !dbtest.Contains(query, "COALESCE("+tt.expected+", 0)") {
+						return nil, fmt.Errorf("expected %s, got query: %s", tt.expected, query)
+					}
+					totalArgs = args
+					return dbtest.Rows([]string{"total"}, []driver.Value{int64(42)}), nil
+				}
+				return nil, fmt.Errorf("unexpected query: %s", query)
+			})
+
+			total, err := NewStore(db).GetUsageTotal(context.Background(), "org-1", tt.metric, start, end)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if total != 42 {
+				t.Errorf("expected total 42, got %d", total)
+			}
+			want := []driver.Value{"org-1", tt.metric, start, end, metrics[tt.metric].UniqueDimension}
+			if len(totalArgs) != len(want) {
+				t.Fatalf("expected args %v, got %+v", want, totalArgs)
+			}
+			for i, arg := range totalArgs {
+				if arg.Value != want[i] {
+					t.Errorf("$%d: expected %v, got %v", i+1, want[i], arg.Value)
+				}
+			}
+		})
+	}
+}
+
 // TestStore_OrgIDIsolation verifies that queries cannot access data from other orgs
 func TestStore_OrgIDIsolation(t *testing.T) {
 	// This test documents the requirement that:
@@ -51,6 +128,7 @@ func TestStore_OrgIDIsolation(t *testing.T) {
 
 	// Verify store methods require orgID parameter by checking method signatures:
 	// - GetAggregates(ctx, orgID, metric) - filters by org_id in WHERE clause
+	// - GetUsageTotal(ctx, orgID, metric, start, end) - filters by org_id in WHERE clause
 	// - InsertUsageEvent(ctx, orgID, metric, quantity, ts, idemKey) - uses org_id in INSERT
 
 	// The key point: all methods require orgID as a parameter,
@@ -67,3 +145,235 @@ func contains(s, substr string) bool {
 	}
 	return false
 }
+
+// fakeEvents answers the statements of recording usage: metric lookups,
+// usage_events inserts, which skip (org_id, idempotency_key) pairs already
+// recorded as the unique index does, and usage_outbox inserts.
+type fakeEvents struct {
+	metrics map[string]*MetricDefinition
+	// recorded holds the idempotency keys already in usage_events.
+	recorded map[[2]string]bool
+	// committed is the number of rows inserted by each committed
+	// transaction, in order.
+	committed []int
+	// outboxed counts usage.recorded events queued.
+	outboxed int
+	pending  int
+}
+
+func newFakeEvents(metrics ...*MetricDefinition) *fakeEvents {
+	f := &fakeEvents{metrics: make(map[string]*MetricDefinition), recorded: make(map[[2]string]bool)}
+	for _, m := range metrics {
+		f.metrics[m.Key] = m
+	}
+	return f
+}
+
+func (f *fakeEvents) store(t *testing.T) *Store {
+	return NewStore(dbtest.Open(t, f.handle))
+}
+
+func (f *fakeEvents) handle(query string, args []driver.NamedValue) (*dbtest.Result, error) {
+	switch {
+	case query == dbtest.Begin, query == dbtest.Rollback:
+		f.pending = 0
+		return nil, nil
+	case query == dbtest.Commit:
+		f.committed = append(f.committed, f.pending)
+		return nil, nil
+	case dbtest.Contains(query, "FROM metrics", "WHERE key = ANY($1)"):
+		var keys []string
+		if err := pq.Array(&keys).Scan(args[0].Value); err != nil {
+			return nil, err
+		}
+		res := dbtest.Rows([]string{"key", "display_name", "unit", "aggregation", "unique_dimension", "dimensions"})
+		for _, k := range keys {
+			if m, ok := f.metrics[k]; ok {
+				dims, _ := pq.Array(m.Dimensions).Value()
+				res.Rows = append(res.Rows, []driver.Value{m.Key, m.DisplayName, m.Unit, string(m.Aggregation), m.UniqueDimension, dims})
+			}
+		}
+		return res, nil
+	case dbtest.Contains(query, "INSERT INTO usage_events", "unnest("):
+		var orgs []string
+		var keys []sql.NullString
+		if err := pq.Array(&orgs).Scan(args[0].Value); err != nil {
+			return nil, err
+		}
+		if err := pq.Array(&keys).Scan(args[4].Value); err != nil {
+			return nil, err
+		}
+		res := dbtest.Rows([]string{"org_id", "idempotency_key"})
+		for i, org := range orgs {
+			var key driver.Value
+			if keys[i].Valid {
+				k := [2]string{org, keys[i].String}
+				if f.recorded[k] {
+					continue
+				}
+				f.recorded[k] = true
+				key = keys[i].String
+			}
+			f.pending++
+			res.Rows = append(res.Rows, []driver.Value{org, key})
+		}
+		return res, nil
+	case dbtest.Contains(query, "INSERT INTO usage_outbox"):
+		var ids []string
+		if err := pq.Array(&ids).Scan(args[1].Value); err != nil {
+			return nil, err
+		}
+		f.outboxed += len(ids)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", query)
+}
+
+func TestStore_InsertUsageEvents(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	event := func(org, key string) UsageEvent {
+		return UsageEvent{OrgID: org, Metric: "api_calls", Quantity: 1, OccurredAt: at, IdempotencyKey: key}
+	}
+
+	tests := []struct {
+		name     string
+		recorded [][2]string
+		events   []UsageEvent
+		expected []bool
+	}{
+		{
+			name:     "new keys and events without keys are inserted",
+			events:   []UsageEvent{event("org-1", "a"), event("org-1", ""), event("org-1", ""), event("org-1", "b")},
+			expected: []bool{true, true, true, true},
+		},
+		{
+			name:     "keys recorded earlier are duplicates",
+			recorded: [][2]string{{"org-1", "a"}},
+			events:   []UsageEvent{event("org-1", "a"), event("org-1", "b")},
+			expected: []bool{false, true},
+		},
+		{
+			name:     "a key repeated in the batch is inserted once",
+			events:   []UsageEvent{event("org-1", "a"), event("org-1", "a"), event("org-1", "b")},
+			expected: []bool{true, false, true},
+		},
+		{
+			name:     "keys are scoped to the org",
+			recorded: [][2]string{{"org-1", "a"}},
+			events:   []UsageEvent{event("org-1", "a"), event("org-2", "a")},
+			expected: []bool{false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeEvents()
+			for _, k := range tt.recorded {
+				f.recorded[k] = true
+			}
+			inserted, err := f.store(t).InsertUsageEvents(context.Background(), tt.events)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprint(inserted) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, inserted)
+			}
+			var n int
+			for _, ok := range tt.expected {
+				if ok {
+					n++
+				}
+			}
+			if f.outboxed != n {
+				t.Errorf("expected %d usage.recorded events, got %d", n, f.outboxed)
+			}
+		})
+	}
+}
+
+func TestStore_InsertUsageEvents_MapsDuplicatesAcrossChunks(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := newFakeEvents()
+	events := make([]UsageEvent, insertChunkSize+500)
+	for i := range events {
+		events[i] = UsageEvent{OrgID: "org-1", Metric: "api_calls", Quantity: 1, OccurredAt: at, IdempotencyKey: fmt.Sprintf("k%d", i)}
+	}
+	// One key in each chunk was recorded by an earlier request.
+	f.recorded[[2]string{"org-1", "k10"}] = true
+	f.recorded[[2]string{"org-1", fmt.Sprintf("k%d", insertChunkSize+10)}] = true
+
+	inserted, err := f.store(t).InsertUsageEvents(context.Background(), events)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, ok := range inserted {
+		want := i != 10 && i != insertChunkSize+10
+		if ok != want {
+			t.Errorf("event %d: expected inserted %v, got %v", i, want, ok)
+		}
+	}
+	if len(f.committed) != 1 || f.committed[0] != len(events)-2 {
+		t.Errorf("expected one transaction of %d rows, got %v", len(events)-2, f.committed)
+	}
+}
+
+func TestStore_AggregatePass_AdvancesByTransaction(t *testing.T) {
+	tests := []struct {
+		name     string
+		batch    [][]driver.Value // last event of the batch, if any
+		expected []driver.Value   // checkpoint written, nil for none
+	}{
+		{name: "nothing finished since the checkpoint", batch: nil, expected: nil},
+		{name: "checkpoint moves to the last event of the batch", batch: [][]driver.Value{{int64(912), int64(48)}}, expected: []driver.Value{int64(912), int64(48)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var batchArgs, written []driver.Value
+			var folds int
+			db := dbtest.Open(t, func(query string, args []driver.NamedValue) (*dbtest.Result, error) {
+				switch {
+				case query == dbtest.Begin, query == dbtest.Commit, query == dbtest.Rollback:
+					return nil, nil
+				case dbtest.Contains(query, "FROM usage_aggregation_checkpoints", "FOR UPDATE"):
+					return dbtest.Rows([]string{"last_xid", "last_event_id"}, []driver.Value{int64(900), int64(52)}), nil
+				case dbtest.Contains(query, "FROM usage_events", "xid < pg_snapshot_xmin(pg_current_snapshot())"):
+					batchArgs = []driver.Value{args[0].Value, args[1].Value}
+					return dbtest.Rows([]string{"xid", "id"}, tt.batch...), nil
+				case dbtest.Contains(query, "INSERT INTO usage_aggregates"):
+					if !dbtest.Contains(query, "(e.xid, e.id) > ($1::text::xid8, $2) AND (e.xid, e.id) <= ($3::text::xid8, $4)") {
+						t.Errorf("fold does not select the batch by (xid, id): %s", query)
+					}
+					folds++
+					return nil, nil
+				case dbtest.Contains(query, "SELECT org_id, metric, MIN(occurred_at)"):
+					return dbtest.Rows([]string{"org_id", "metric", "min", "max", "count"},
+						[]driver.Value{"org-1", "api_calls", time.Now(), time.Now(), int64(3)}), nil
+				case dbtest.Contains(query, "INSERT INTO usage_outbox"):
+					return nil, nil
+				case dbtest.Contains(query, "UPDATE usage_aggregation_checkpoints"):
+					written = []driver.Value{args[1].Value, args[2].Value}
+					return nil, nil
+				}
+				return nil, fmt.Errorf("unexpected query: %s", query)
+			})
+
+			n, err := NewStore(db).aggregatePass(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprint(batchArgs) != "[900 52]" {
+				t.Errorf("expected the batch to start after (900, 52), got %v", batchArgs)
+			}
+			if fmt.Sprint(written) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected checkpoint %v, got %v", tt.expected, written)
+			}
+			if tt.expected == nil && (n != 0 || folds != 0) {
+				t.Errorf("expected nothing folded, got %d events in %d statements", n, folds)
+			}
+			if tt.expected != nil && (n != 3 || folds != 2) {
+				t.Errorf("expected 3 events folded by 2 statements, got %d in %d", n, folds)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+-- Transactional outbox: domain events are written here in the same
+-- transaction as the rows they describe and published by the outbox relay.
+CREATE TABLE IF NOT EXISTS billing_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_id TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error TEXT,
+    published_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS billing_outbox_pending_idx
+    ON billing_outbox (next_attempt_at, id)
+    WHERE published_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS billing_outbox_published_idx
+    ON billing_outbox (published_at)
+    WHERE published_at IS NOT NULL;
@@ -0,0 +1,3 @@
+-- Draft invoices are looked up by org and period when usage changes.
+CREATE INDEX IF NOT EXISTS invoices_org_period_idx
+    ON invoices (org_id, period_start, period_end);
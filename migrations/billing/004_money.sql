@@ -0,0 +1,20 @@
+-- Money is stored exactly: unit prices as high-precision decimals, invoice
+-- totals as integer minor units of the invoice currency.
+ALTER TABLE plans ALTER COLUMN unit_price TYPE NUMERIC(20, 10);
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
+
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS total_minor BIGINT;
+
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'invoices' AND column_name = 'total_amount'
+    ) THEN
+        UPDATE invoices SET total_minor = ROUND(total_amount * 100) WHERE total_minor IS NULL;
+        ALTER TABLE invoices DROP COLUMN total_amount;
+    END IF;
+END $$;
+
+ALTER TABLE invoices ALTER COLUMN total_minor SET NOT NULL;
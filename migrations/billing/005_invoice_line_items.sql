@@ -0,0 +1,15 @@
+-- One row per plan charged on an invoice, so every total can be explained.
+CREATE TABLE IF NOT EXISTS invoice_line_items (
+    id BIGSERIAL PRIMARY KEY,
+    invoice_id TEXT NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    plan_id TEXT NOT NULL,
+    metric TEXT NOT NULL,
+    quantity BIGINT NOT NULL,
+    free_quota_applied BIGINT NOT NULL,
+    chargeable_quantity BIGINT NOT NULL,
+    unit_price NUMERIC(20, 10) NOT NULL,
+    currency TEXT NOT NULL,
+    amount_minor BIGINT NOT NULL,
+    UNIQUE (invoice_id, position)
+);
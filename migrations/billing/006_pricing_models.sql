@@ -0,0 +1,55 @@
+-- Pricing models. Usage beyond the free quota is priced by the plan's model:
+--   per_unit   chargeable quantity * unit_price
+--   graduated  each tier prices the units that fall into it, plus its flat fee
+--   volume     the whole quantity is priced at the tier it lands in
+--   package    unit_price per started block of package_size units
+ALTER TABLE plans
+    ADD COLUMN IF NOT EXISTS pricing_model TEXT NOT NULL DEFAULT 'per_unit',
+    ADD COLUMN IF NOT EXISTS package_size BIGINT;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.table_constraints
+        WHERE table_name = 'plans' AND constraint_name = 'plans_pricing_model_check'
+    ) THEN
+        ALTER TABLE plans ADD CONSTRAINT plans_pricing_model_check CHECK (
+            pricing_model IN ('per_unit', 'graduated', 'volume')
+            OR (pricing_model = 'package' AND package_size > 0)
+        );
+    END IF;
+END $$;
+
+-- Tiers of graduated and volume plans, in ascending order. up_to is the
+-- inclusive upper bound of the tier; the last tier has none.
+CREATE TABLE IF NOT EXISTS plan_tiers (
+    plan_id TEXT NOT NULL REFERENCES plans(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    up_to BIGINT,
+    unit_price NUMERIC(20, 10) NOT NULL DEFAULT 0,
+    flat_fee NUMERIC(20, 10) NOT NULL DEFAULT 0,
+    PRIMARY KEY (plan_id, position)
+);
+
+-- Line items record the model they were priced with. Graduated lines have no
+-- single unit price; their tiers carry the detail.
+ALTER TABLE invoice_line_items
+    ADD COLUMN IF NOT EXISTS pricing_model TEXT NOT NULL DEFAULT 'per_unit',
+    ADD COLUMN IF NOT EXISTS package_size BIGINT;
+ALTER TABLE invoice_line_items ALTER COLUMN unit_price DROP NOT NULL;
+
+CREATE TABLE IF NOT EXISTS invoice_line_item_tiers (
+    invoice_id TEXT NOT NULL,
+    line_position INT NOT NULL,
+    tier INT NOT NULL,
+    from_quantity BIGINT NOT NULL,
+    up_to BIGINT,
+    quantity BIGINT NOT NULL,
+    unit_price NUMERIC(20, 10) NOT NULL,
+    flat_fee NUMERIC(20, 10) NOT NULL,
+    currency TEXT NOT NULL,
+    amount_minor BIGINT NOT NULL,
+    PRIMARY KEY (invoice_id, line_position, tier),
+    FOREIGN KEY (invoice_id, line_position)
+        REFERENCES invoice_line_items (invoice_id, position) ON DELETE CASCADE
+);
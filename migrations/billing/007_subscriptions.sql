@@ -0,0 +1,59 @@
+-- Price book: plans an org can subscribe to. A price plan charges base_fee
+-- every billing interval and includes metered components, which are rows of
+-- plans with price_plan_id set instead of org_id.
+CREATE TABLE IF NOT EXISTS price_plans (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'USD',
+    base_fee NUMERIC(20, 10) NOT NULL DEFAULT 0,
+    billing_interval TEXT NOT NULL DEFAULT 'month'
+        CHECK (billing_interval IN ('month', 'year')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS price_plan_id TEXT REFERENCES price_plans(id) ON DELETE CASCADE;
+ALTER TABLE plans ALTER COLUMN org_id DROP NOT NULL;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.table_constraints
+        WHERE table_name = 'plans' AND constraint_name = 'plans_owner_check'
+    ) THEN
+        ALTER TABLE plans ADD CONSTRAINT plans_owner_check CHECK (
+            (org_id IS NULL) <> (price_plan_id IS NULL)
+        );
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS plans_price_plan_idx ON plans (price_plan_id) WHERE price_plan_id IS NOT NULL;
+
+-- Subscriptions tie an org to a price plan. Billing periods start on
+-- anchor_day and last one billing interval. A subscription is billed until
+-- ended_at; cancelling sets status 'canceled' and ended_at, which may be the
+-- end of the current period.
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id TEXT PRIMARY KEY,
+    org_id TEXT NOT NULL,
+    price_plan_id TEXT NOT NULL REFERENCES price_plans(id),
+    status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'canceled')),
+    anchor_day INT NOT NULL CHECK (anchor_day BETWEEN 1 AND 28),
+    started_at TIMESTAMPTZ NOT NULL,
+    ended_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- At most one subscription per org that has not been cancelled.
+CREATE UNIQUE INDEX IF NOT EXISTS subscriptions_org_active_idx
+    ON subscriptions (org_id) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS subscriptions_org_idx ON subscriptions (org_id, started_at);
+
+-- Line items now also carry recurring fees.
+ALTER TABLE invoice_line_items
+    ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'usage',
+    ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+
+INSERT INTO price_plans (id, name, currency, base_fee, billing_interval)
+VALUES ('platform-monthly', 'Platform', 'USD', 49, 'month')
+ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,33 @@
+-- Plan assignments record which price plan a subscription was on and when.
+-- Invoices price each assignment's slice of the period separately: base fees
+-- are prorated by time and usage is priced by the components of the plan in
+-- effect when it occurred. effective_to is NULL while open-ended.
+CREATE TABLE IF NOT EXISTS plan_assignments (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id TEXT NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    org_id TEXT NOT NULL,
+    price_plan_id TEXT NOT NULL REFERENCES price_plans(id),
+    effective_from TIMESTAMPTZ NOT NULL,
+    effective_to TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (effective_to IS NULL OR effective_to > effective_from)
+);
+
+CREATE INDEX IF NOT EXISTS plan_assignments_org_idx
+    ON plan_assignments (org_id, effective_from);
+CREATE INDEX IF NOT EXISTS plan_assignments_subscription_idx
+    ON plan_assignments (subscription_id, effective_from);
+
+-- Existing subscriptions were on their current plan for their whole life.
+INSERT INTO plan_assignments (subscription_id, org_id, price_plan_id, effective_from, effective_to)
+SELECT s.id, s.org_id, s.price_plan_id, s.started_at, s.ended_at
+FROM subscriptions s
+WHERE NOT EXISTS (SELECT 1 FROM plan_assignments a WHERE a.subscription_id = s.id)
+    AND (s.ended_at IS NULL OR s.ended_at > s.started_at);
+
+-- Line items of a prorated segment record its range and the fraction of the
+-- billing period it covers.
+ALTER TABLE invoice_line_items
+    ADD COLUMN IF NOT EXISTS period_start TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS period_end TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS proration NUMERIC(20, 10);
@@ -0,0 +1,91 @@
+-- Invoice lifecycle:
+--   draft          kept current from usage; the only editable status
+--   finalized      issued to the customer; amounts and line items are locked
+--   paid           settled
+--   void           cancelled, never to be collected
+--   uncollectible  written off; may still be paid or voided later
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.table_constraints
+        WHERE table_name = 'invoices' AND constraint_name = 'invoices_status_check'
+    ) THEN
+        ALTER TABLE invoices ADD CONSTRAINT invoices_status_check CHECK (
+            status IN ('draft', 'finalized', 'paid', 'void', 'uncollectible')
+        );
+    END IF;
+END $$;
+
+ALTER TABLE invoices
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- Every status change, with who made it and when.
+CREATE TABLE IF NOT EXISTS invoice_status_transitions (
+    id BIGSERIAL PRIMARY KEY,
+    invoice_id TEXT NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    from_status TEXT NOT NULL,
+    to_status TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS invoice_status_transitions_invoice_idx
+    ON invoice_status_transitions (invoice_id, created_at);
+
+-- Only drafts may change their amounts or line items; past finalization the
+-- status is all that moves. Enforced here as well as in billing-svc so no
+-- writer can alter an issued invoice.
+CREATE OR REPLACE FUNCTION invoices_lock_issued() RETURNS trigger AS $$
+BEGIN
+    IF OLD.status <> 'draft' AND (
+        NEW.org_id IS DISTINCT FROM OLD.org_id
+        OR NEW.period_start IS DISTINCT FROM OLD.period_start
+        OR NEW.period_end IS DISTINCT FROM OLD.period_end
+        OR NEW.currency IS DISTINCT FROM OLD.currency
+        OR NEW.total_minor IS DISTINCT FROM OLD.total_minor
+        OR NEW.status = 'draft'
+    ) THEN
+        RAISE EXCEPTION 'invoice % is %: only its status can change', OLD.id, OLD.status
+            USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS invoices_lock_issued ON invoices;
+CREATE TRIGGER invoices_lock_issued
+    BEFORE UPDATE ON invoices
+    FOR EACH ROW EXECUTE FUNCTION invoices_lock_issued();
+
+CREATE OR REPLACE FUNCTION invoice_lines_lock_issued() RETURNS trigger AS $$
+DECLARE
+    invoice TEXT;
+    invoice_status TEXT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        invoice := OLD.invoice_id;
+    ELSE
+        invoice := NEW.invoice_id;
+    END IF;
+    SELECT status INTO invoice_status FROM invoices WHERE id = invoice;
+    IF invoice_status IS NOT NULL AND invoice_status <> 'draft' THEN
+        RAISE EXCEPTION 'invoice % is %: its line items are frozen', invoice, invoice_status
+            USING ERRCODE = 'check_violation';
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS invoice_line_items_lock_issued ON invoice_line_items;
+CREATE TRIGGER invoice_line_items_lock_issued
+    BEFORE INSERT OR UPDATE OR DELETE ON invoice_line_items
+    FOR EACH ROW EXECUTE FUNCTION invoice_lines_lock_issued();
+
+DROP TRIGGER IF EXISTS invoice_line_item_tiers_lock_issued ON invoice_line_item_tiers;
+CREATE TRIGGER invoice_line_item_tiers_lock_issued
+    BEFORE INSERT OR UPDATE OR DELETE ON invoice_line_item_tiers
+    FOR EACH ROW EXECUTE FUNCTION invoice_lines_lock_issued();
@@ -0,0 +1,53 @@
+-- At most one live invoice per org and period, and no two whose periods
+-- overlap: regenerating a period recomputes its draft in place instead of
+-- adding another, and no fee or usage is billed twice. Voided invoices step
+-- aside, so a voided period can be invoiced again.
+--
+-- Earlier versions minted a new draft on every GenerateInvoice call, for any
+-- period. Rank each org's invoices, most advanced first and the newest among
+-- equals, and void the drafts overlapping a higher-ranked one before the
+-- constraint can be created. Overlapping issued invoices have to be resolved
+-- by hand.
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+WITH ranked AS (
+    SELECT id, org_id, status, tstzrange(period_start, period_end) AS period,
+        ROW_NUMBER() OVER (
+            PARTITION BY org_id
+            ORDER BY status <> 'draft' DESC, created_at DESC, id DESC
+        ) AS rank
+    FROM invoices
+    WHERE status <> 'void'
+),
+voided AS (
+    UPDATE invoices i SET status = 'void', updated_at = NOW()
+    FROM ranked r
+    WHERE i.id = r.id AND r.status = 'draft' AND EXISTS (
+        SELECT 1 FROM ranked o
+        WHERE o.org_id = r.org_id AND o.rank < r.rank AND o.period && r.period
+    )
+    RETURNING i.id
+)
+INSERT INTO invoice_status_transitions (invoice_id, from_status, to_status, actor, reason)
+SELECT id, 'draft', 'void', 'migration', 'overlaps another invoice of the org'
+FROM voided;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint WHERE conname = 'invoices_org_period_live_excl'
+    ) THEN
+        ALTER TABLE invoices ADD CONSTRAINT invoices_org_period_live_excl
+            EXCLUDE USING gist (org_id WITH =, tstzrange(period_start, period_end) WITH &&)
+            WHERE (status <> 'void');
+    END IF;
+END $$;
+
+-- Client-supplied idempotency keys: a retried GenerateInvoice with the same
+-- key returns the invoice of the first call.
+ALTER TABLE invoices
+    ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS invoices_org_idempotency_key_idx
+    ON invoices (org_id, idempotency_key)
+    WHERE idempotency_key IS NOT NULL;
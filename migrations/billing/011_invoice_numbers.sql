@@ -0,0 +1,36 @@
+-- Sequential invoice numbers, e.g. POL-2026-000123, assigned when an invoice
+-- is finalized. Each sequence is one row, incremented inside the finalizing
+-- transaction: its row lock serializes finalizations and a rollback returns
+-- the number, so the numbers issued have no gaps. Invoices finalized before
+-- numbering existed keep a NULL number.
+CREATE TABLE IF NOT EXISTS invoice_number_sequences (
+    key TEXT PRIMARY KEY,
+    last_value BIGINT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE invoices
+    ADD COLUMN IF NOT EXISTS number TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS invoices_number_idx
+    ON invoices (number)
+    WHERE number IS NOT NULL;
+
+-- The number is fixed once issued, like the amounts.
+CREATE OR REPLACE FUNCTION invoices_lock_issued() RETURNS trigger AS $$
+BEGIN
+    IF OLD.status <> 'draft' AND (
+        NEW.org_id IS DISTINCT FROM OLD.org_id
+        OR NEW.period_start IS DISTINCT FROM OLD.period_start
+        OR NEW.period_end IS DISTINCT FROM OLD.period_end
+        OR NEW.currency IS DISTINCT FROM OLD.currency
+        OR NEW.total_minor IS DISTINCT FROM OLD.total_minor
+        OR NEW.number IS DISTINCT FROM OLD.number
+        OR NEW.status = 'draft'
+    ) THEN
+        RAISE EXCEPTION 'invoice % is %: only its status can change', OLD.id, OLD.status
+            USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,18 @@
+-- Leader election: billing-svc replicas compete for named leases, and only
+-- the holder of "billing-scheduler" closes billing periods.
+CREATE TABLE IF NOT EXISTS billing_leases (
+    name TEXT PRIMARY KEY,
+    holder TEXT NOT NULL,
+    acquired_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- How far the scheduler has closed each org's billing periods: every period
+-- ending at or before closed_through has been invoiced. Orgs start at the
+-- period that was open when the scheduler first saw them; earlier periods are
+-- only invoiced by hand.
+CREATE TABLE IF NOT EXISTS billing_cycles (
+    org_id TEXT PRIMARY KEY,
+    closed_through TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
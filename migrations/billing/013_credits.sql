@@ -0,0 +1,41 @@
+-- Prepaid credits. A grant adds an amount to an org's balance from
+-- effective_at until expires_at (never, when NULL). Grants are append-only;
+-- what is left of one is its amount minus the credit lines drawn from it on
+-- invoices that are not void, so every movement of the balance is an invoice
+-- line and voiding an invoice returns its credits.
+CREATE TABLE IF NOT EXISTS credit_grants (
+    id TEXT PRIMARY KEY,
+    org_id TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    amount_minor BIGINT NOT NULL CHECK (amount_minor > 0),
+    -- Among grants expiring together, higher priorities are drawn first.
+    priority INT NOT NULL DEFAULT 0,
+    effective_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ,
+    description TEXT NOT NULL DEFAULT '',
+    actor TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (expires_at IS NULL OR expires_at > effective_at)
+);
+
+CREATE INDEX IF NOT EXISTS credit_grants_org_idx ON credit_grants (org_id, expires_at);
+
+CREATE OR REPLACE FUNCTION credit_grants_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'credit grant % cannot be changed', OLD.id
+        USING ERRCODE = 'check_violation';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS credit_grants_append_only ON credit_grants;
+CREATE TRIGGER credit_grants_append_only
+    BEFORE UPDATE OR DELETE ON credit_grants
+    FOR EACH ROW EXECUTE FUNCTION credit_grants_append_only();
+
+-- Credit lines name the grant they draw from; their amounts are negative.
+ALTER TABLE invoice_line_items
+    ADD COLUMN IF NOT EXISTS credit_grant_id TEXT REFERENCES credit_grants(id);
+
+CREATE INDEX IF NOT EXISTS invoice_line_items_credit_grant_idx
+    ON invoice_line_items (credit_grant_id)
+    WHERE credit_grant_id IS NOT NULL;
@@ -0,0 +1,39 @@
+-- Coupons: discounts orgs redeem by code. A coupon takes percent_off percent
+-- or amount_off_minor (in currency) off an invoice's charges, or off the
+-- charges of the listed metrics only, for the billing period it is redeemed
+-- in (once), that period and the next duration_periods - 1 (repeating), or
+-- every period from then on (forever).
+CREATE TABLE IF NOT EXISTS coupons (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    percent_off NUMERIC(7, 4),
+    amount_off_minor BIGINT,
+    currency TEXT,
+    duration TEXT NOT NULL CHECK (duration IN ('once', 'repeating', 'forever')),
+    duration_periods INT,
+    metrics TEXT[] NOT NULL DEFAULT '{}',
+    max_redemptions INT CHECK (max_redemptions IS NULL OR max_redemptions > 0),
+    redeem_by TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (
+        (percent_off > 0 AND percent_off <= 100 AND amount_off_minor IS NULL AND currency IS NULL)
+        OR (percent_off IS NULL AND amount_off_minor > 0 AND currency IS NOT NULL)
+    ),
+    CHECK ((duration = 'repeating') = (duration_periods IS NOT NULL AND duration_periods > 0))
+);
+
+-- Each org redeems a coupon at most once.
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    id TEXT PRIMARY KEY,
+    coupon_id TEXT NOT NULL REFERENCES coupons(id),
+    org_id TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    redeemed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (coupon_id, org_id)
+);
+
+CREATE INDEX IF NOT EXISTS coupon_redemptions_org_idx ON coupon_redemptions (org_id, redeemed_at);
+
+-- Discount lines name the coupon they apply; their amounts are negative.
+ALTER TABLE invoice_line_items
+    ADD COLUMN IF NOT EXISTS coupon_id TEXT REFERENCES coupons(id);
@@ -0,0 +1,19 @@
+-- Minimum commitments: a subscription may commit to commitment_minor of
+-- usage charges, in its price plan's currency, per commitment_interval. The
+-- invoice closing a commitment period adds a true-up line for any shortfall.
+ALTER TABLE subscriptions
+    ADD COLUMN IF NOT EXISTS commitment_minor BIGINT CHECK (commitment_minor > 0),
+    ADD COLUMN IF NOT EXISTS commitment_interval TEXT CHECK (commitment_interval IN ('month', 'year'));
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.table_constraints
+        WHERE table_name = 'subscriptions' AND constraint_name = 'subscriptions_commitment_check'
+    ) THEN
+        ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_commitment_check CHECK (
+            (commitment_minor IS NULL) = (commitment_interval IS NULL)
+        );
+    END IF;
+END $$;
+
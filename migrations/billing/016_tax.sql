@@ -0,0 +1,30 @@
+-- Tax. Charges carry the product tax code of their plan or price plan; an
+-- empty code is the general rate.
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS tax_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE price_plans ADD COLUMN IF NOT EXISTS tax_code TEXT NOT NULL DEFAULT '';
+
+-- Rule table of the built-in tax provider: the rate charged in a
+-- jurisdiction (a country, optionally narrowed to a region) on a tax code.
+-- An empty region or tax_code matches any; the most specific rule wins.
+-- rate_percent is e.g. 19 for 19%.
+CREATE TABLE IF NOT EXISTS tax_rules (
+    id TEXT PRIMARY KEY,
+    country TEXT NOT NULL CHECK (country ~ '^[A-Z]{2}$'),
+    region TEXT NOT NULL DEFAULT '',
+    tax_code TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    rate_percent NUMERIC(7, 4) NOT NULL CHECK (rate_percent >= 0 AND rate_percent <= 100),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (country, region, tax_code)
+);
+
+-- Every line item records its tax code. Tax lines also record what they
+-- taxed: the jurisdiction, rate, basis (the net charges taxed, in the
+-- invoice's currency) and treatment ('exempt' or 'reverse_charge' for orgs
+-- not charged the tax, NULL otherwise).
+ALTER TABLE invoice_line_items
+    ADD COLUMN IF NOT EXISTS tax_code TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tax_jurisdiction TEXT,
+    ADD COLUMN IF NOT EXISTS tax_rate_percent NUMERIC(7, 4),
+    ADD COLUMN IF NOT EXISTS tax_basis_minor BIGINT,
+    ADD COLUMN IF NOT EXISTS tax_treatment TEXT;
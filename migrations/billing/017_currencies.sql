@@ -0,0 +1,28 @@
+-- Currencies are ISO 4217 codes. Plans and price plans are priced in one, and
+-- every invoice is in its org's billing currency.
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['plans', 'price_plans', 'invoices'] LOOP
+        IF NOT EXISTS (
+            SELECT 1 FROM information_schema.table_constraints
+            WHERE table_name = t AND constraint_name = t || '_currency_check'
+        ) THEN
+            EXECUTE format('ALTER TABLE %I ADD CONSTRAINT %I CHECK (currency ~ ''^[A-Z]{3}$'')', t, t || '_currency_check');
+        END IF;
+    END LOOP;
+END $$;
+
+-- Optional exchange rates for reporting invoice totals in a base currency:
+-- from effective_at on, one unit of currency is worth rate units of
+-- base_currency. Rates are appended, never updated, so reports of past
+-- periods do not change.
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    base_currency TEXT NOT NULL CHECK (base_currency ~ '^[A-Z]{3}$'),
+    currency TEXT NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    rate NUMERIC(20, 10) NOT NULL CHECK (rate > 0),
+    effective_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (base_currency, currency, effective_at)
+);
@@ -0,0 +1,4 @@
+-- When the pricing a draft holds started. Drafts are priced outside the
+-- transaction that writes them, so a refresh that started earlier than the
+-- draft's pricing must not overwrite it with older usage.
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS priced_at TIMESTAMPTZ;
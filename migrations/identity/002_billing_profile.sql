@@ -0,0 +1,14 @@
+-- Billing profile of an org: the address invoices are taxed by, its tax ID
+-- (e.g. a VAT number), and its tax status. tax_status 'exempt' and
+-- 'reverse_charge' are set by operators once the org's exemption or business
+-- status has been verified.
+ALTER TABLE organizations
+    ADD COLUMN IF NOT EXISTS address_line1 TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS address_line2 TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS city TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS region TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS postal_code TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tax_id TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tax_status TEXT NOT NULL DEFAULT 'taxable'
+        CHECK (tax_status IN ('taxable', 'exempt', 'reverse_charge'));
@@ -0,0 +1,6 @@
+-- The ISO 4217 currency an org is invoiced in. Its plans and price plan must
+-- be priced in it; set by operators. Until then it is empty and invoices take
+-- the currency of the org's plans.
+ALTER TABLE organizations
+    ADD COLUMN IF NOT EXISTS billing_currency TEXT NOT NULL DEFAULT ''
+        CHECK (billing_currency = '' OR billing_currency ~ '^[A-Z]{3}$');
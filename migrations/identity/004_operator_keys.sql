@@ -0,0 +1,3 @@
+-- Keys of the platform's operators. Through the gateway they may also void
+-- any org's invoices, record their payment and write them off.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS operator BOOLEAN NOT NULL DEFAULT false;
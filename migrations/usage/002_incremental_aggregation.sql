@@ -0,0 +1,18 @@
+-- High-water mark for incremental aggregation: every usage_events row with
+-- id <= last_event_id has already been folded into usage_aggregates.
+CREATE TABLE IF NOT EXISTS usage_aggregation_checkpoints (
+    name TEXT PRIMARY KEY,
+    last_event_id BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Aggregates written by the old full-rescan job may lag the events table, so
+-- the first time this migration runs, clear them and let the incremental
+-- aggregator rebuild everything from event id 0.
+WITH created AS (
+    INSERT INTO usage_aggregation_checkpoints (name, last_event_id)
+    VALUES ('usage_aggregates', 0)
+    ON CONFLICT (name) DO NOTHING
+    RETURNING name
+)
+DELETE FROM usage_aggregates WHERE EXISTS (SELECT 1 FROM created);
@@ -0,0 +1,19 @@
+-- Aggregates are kept at hour, day and month granularity. The first time this
+-- runs, existing (daily-only) aggregates are dropped and the checkpoint reset
+-- so the aggregator rebuilds all three rollups from the raw events.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'usage_aggregates' AND column_name = 'granularity'
+    ) THEN
+        ALTER TABLE usage_aggregates ADD COLUMN granularity TEXT NOT NULL DEFAULT 'day'; -- 'hour', 'day', 'month'
+        ALTER TABLE usage_aggregates DROP CONSTRAINT usage_aggregates_pkey;
+        ALTER TABLE usage_aggregates ADD PRIMARY KEY (org_id, metric, granularity, period_start);
+
+        DELETE FROM usage_aggregates;
+        UPDATE usage_aggregation_checkpoints
+        SET last_event_id = 0, updated_at = NOW()
+        WHERE name = 'usage_aggregates';
+    END IF;
+END $$;
@@ -0,0 +1,37 @@
+-- Free-form string dimensions attached to each event (project, region, endpoint, ...)
+ALTER TABLE usage_events ADD COLUMN IF NOT EXISTS dimensions JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS usage_events_dimensions_idx
+    ON usage_events USING GIN (dimensions jsonb_path_ops);
+CREATE INDEX IF NOT EXISTS usage_events_org_metric_occurred_idx
+    ON usage_events (org_id, metric, occurred_at);
+
+-- Metric declarations. The aggregator keeps a per-value rollup for every
+-- dimension key declared here; other keys can still be filtered and grouped
+-- on, but those queries read the raw events.
+CREATE TABLE IF NOT EXISTS metrics (
+    key TEXT PRIMARY KEY,
+    dimensions TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO metrics (key) VALUES ('api_calls')
+ON CONFLICT (key) DO NOTHING;
+
+-- Aggregate rows gain a (dimension_key, dimension_value) pair. The metric total
+-- is stored with both set to ''. Rollups for keys declared after events were
+-- aggregated can be backfilled with the Reaggregate RPC.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'usage_aggregates' AND column_name = 'dimension_key'
+    ) THEN
+        ALTER TABLE usage_aggregates
+            ADD COLUMN dimension_key TEXT NOT NULL DEFAULT '',
+            ADD COLUMN dimension_value TEXT NOT NULL DEFAULT '';
+        ALTER TABLE usage_aggregates DROP CONSTRAINT usage_aggregates_pkey;
+        ALTER TABLE usage_aggregates
+            ADD PRIMARY KEY (org_id, metric, granularity, dimension_key, dimension_value, period_start);
+    END IF;
+END $$;
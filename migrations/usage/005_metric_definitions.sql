@@ -0,0 +1,71 @@
+-- Metric definitions: every ingested metric must be registered here. The
+-- aggregation type decides how events within a period combine:
+--   sum           total of quantity
+--   max           largest quantity (peak concurrency)
+--   unique_count  number of distinct values of unique_dimension (seats, active users)
+--   last          quantity of the latest event in the period (gauges)
+ALTER TABLE metrics
+    ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS unit TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS aggregation TEXT NOT NULL DEFAULT 'sum',
+    ADD COLUMN IF NOT EXISTS unique_dimension TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.table_constraints
+        WHERE table_name = 'metrics' AND constraint_name = 'metrics_aggregation_check'
+    ) THEN
+        ALTER TABLE metrics ADD CONSTRAINT metrics_aggregation_check CHECK (
+            aggregation IN ('sum', 'max', 'last')
+            OR (aggregation = 'unique_count' AND unique_dimension <> '')
+        );
+    END IF;
+END $$;
+
+-- Ingestion now rejects unknown metrics, so register every metric that already
+-- has events as a plain sum to keep existing producers working.
+INSERT INTO metrics (key)
+SELECT DISTINCT metric FROM usage_events
+ON CONFLICT (key) DO NOTHING;
+
+-- Distinct values seen per unique_count aggregate, so incremental passes only
+-- count values that are new to the period.
+CREATE TABLE IF NOT EXISTS usage_aggregate_distinct_values (
+    org_id TEXT NOT NULL,
+    metric TEXT NOT NULL,
+    granularity TEXT NOT NULL,
+    dimension_key TEXT NOT NULL,
+    dimension_value TEXT NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (org_id, metric, granularity, dimension_key, dimension_value, period_start, value)
+);
+
+-- Aggregate rows record the aggregation they were folded with, and "last"
+-- aggregates remember which event they currently reflect. The first time this
+-- runs, api_calls gets its region and endpoint rollups; existing aggregates
+-- are dropped and the checkpoint reset so the aggregator rebuilds every rollup,
+-- those included, from the raw events.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'usage_aggregates' AND column_name = 'aggregation'
+    ) THEN
+        ALTER TABLE usage_aggregates
+            ADD COLUMN aggregation TEXT NOT NULL DEFAULT 'sum',
+            ADD COLUMN last_occurred_at TIMESTAMPTZ;
+
+        UPDATE metrics
+        SET display_name = 'API calls', unit = 'requests', dimensions = ARRAY['region', 'endpoint']
+        WHERE key = 'api_calls' AND display_name = '';
+
+        DELETE FROM usage_aggregates;
+        DELETE FROM usage_aggregate_distinct_values;
+        UPDATE usage_aggregation_checkpoints
+        SET last_event_id = 0, updated_at = NOW()
+        WHERE name = 'usage_aggregates';
+    END IF;
+END $$;
@@ -0,0 +1,22 @@
+-- Transaction that wrote each event. Event ids are assigned at insert but rows
+-- become visible at commit, so a slow transaction can commit ids below the
+-- aggregation checkpoint. The aggregator therefore orders events by (xid, id)
+-- and only folds those written by transactions older than every running one,
+-- which can no longer change. Events written before this migration get xid 0,
+-- so they sort before every later transaction and the unfolded ones among them
+-- (id > last_event_id) are still picked up by the next pass.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'usage_events' AND column_name = 'xid'
+    ) THEN
+        ALTER TABLE usage_events ADD COLUMN xid xid8 NOT NULL DEFAULT '0';
+        ALTER TABLE usage_events ALTER COLUMN xid SET DEFAULT pg_current_xact_id();
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS usage_events_xid_id_idx ON usage_events (xid, id);
+
+-- The checkpoint is the (last_xid, last_event_id) position of the last folded event.
+ALTER TABLE usage_aggregation_checkpoints ADD COLUMN IF NOT EXISTS last_xid xid8 NOT NULL DEFAULT '0';
@@ -0,0 +1,169 @@
+// Package dbtest is a scripted database/sql driver for unit tests of code that
+// talks to Postgres. Every statement, including BEGIN, COMMIT and ROLLBACK, is
+// passed to the test's Handler, which answers it; nothing is parsed or stored.
+// Arguments arrive as database/sql converts them, so pq.Array values are
+// array literals that pq.Array can scan back.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Handler answers one statement. A nil Result is an empty one.
+type Handler func(query string, args []driver.NamedValue) (*Result, error)
+
+// Result is the answer to a statement: rows for queries, a count for execs.
+type Result struct {
+	Columns      []string
+	Rows         [][]driver.Value
+	RowsAffected int64
+}
+
+// Rows returns a query result with columns and rows.
+func Rows(columns []string, rows ...[]driver.Value) *Result {
+	return &Result{Columns: columns, Rows: rows}
+}
+
+// Statement markers passed to the Handler for transaction control.
+const (
+	Begin    = "BEGIN"
+	Commit   = "COMMIT"
+	Rollback = "ROLLBACK"
+)
+
+var (
+	registerOnce sync.Once
+	mu           sync.Mutex
+	handlers     = make(map[string]Handler)
+	nextDSN      int
+)
+
+// Open returns a database whose statements are answered by h. It is closed
+// when the test ends.
+func Open(t testing.TB, h Handler) *sql.DB {
+	t.Helper()
+	registerOnce.Do(func() { sql.Register("dbtest", fakeDriver{}) })
+
+	mu.Lock()
+	nextDSN++
+	dsn := fmt.Sprintf("dbtest-%d", nextDSN)
+	handlers[dsn] = h
+	mu.Unlock()
+
+	db, err := sql.Open("dbtest", dsn)
+	if err != nil {
+		t.Fatalf("open dbtest: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		mu.Lock()
+		delete(handlers, dsn)
+		mu.Unlock()
+	})
+	return db
+}
+
+// Contains reports whether query contains every one of parts, ignoring
+// differences in whitespace.
+func Contains(query string, parts ...string) bool {
+	q := strings.Join(strings.Fields(query), " ")
+	for _, p := range parts {
+		if !strings.Contains(q, strings.Join(strings.Fields(p), " ")) {
+			return false
+		}
+	}
+	return true
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	mu.Lock()
+	h, ok := handlers[dsn]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dbtest: unknown database %q", dsn)
+	}
+	return &conn{handler: h}, nil
+}
+
+type conn struct {
+	handler Handler
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("dbtest: prepared statements are not supported")
+}
+
+func (c *conn) Close() error { return nil }
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if _, err := c.handler(Begin, nil); err != nil {
+		return nil, err
+	}
+	return tx{c}, nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.handler(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res = &Result{}
+	}
+	return &rows{res: res}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.handler(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res = &Result{}
+	}
+	return driver.RowsAffected(res.RowsAffected), nil
+}
+
+type tx struct{ c *conn }
+
+func (t tx) Commit() error {
+	_, err := t.c.handler(Commit, nil)
+	return err
+}
+
+func (t tx) Rollback() error {
+	_, err := t.c.handler(Rollback, nil)
+	return err
+}
+
+type rows struct {
+	res  *Result
+	next int
+}
+
+func (r *rows) Columns() []string { return r.res.Columns }
+
+func (r *rows) Close() error { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.res.Rows) {
+		return io.EOF
+	}
+	copy(dest, r.res.Rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,88 @@
+// Package lease implements leader election on a Postgres table. Replicas of a
+// service compete for a named lease; the holder keeps it by renewing it before
+// it expires, and another replica takes over once it lapses.
+//
+// Every lease table has the same shape:
+//
+//	name TEXT PRIMARY KEY,
+//	holder TEXT NOT NULL,
+//	acquired_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+//	expires_at TIMESTAMPTZ NOT NULL
+//
+// A lease bounds how long two replicas can both believe they lead: a holder
+// that stalls for longer than the TTL may find its work overlapping a
+// successor's, so leased work must still be idempotent.
+package lease
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Lease is one replica's claim on a named lease.
+type Lease struct {
+	db     *sql.DB
+	table  string
+	name   string
+	holder string
+	ttl    time.Duration
+}
+
+// New returns a claim on lease name in table, which must be a trusted
+// identifier, held for ttl after each successful Acquire.
+func New(db *sql.DB, table, name string, ttl time.Duration) *Lease {
+	return &Lease{db: db, table: table, name: name, holder: holderID(), ttl: ttl}
+}
+
+// holderID identifies this process: its hostname, which is the pod name on
+// Kubernetes, plus a random suffix.
+func holderID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%s", host, uuid.New().String()[:8])
+}
+
+// Holder returns the ID this replica holds the lease under.
+func (l *Lease) Holder() string {
+	return l.holder
+}
+
+// Acquire takes the lease if it is free or expired, or renews it if this
+// replica already holds it, and reports whether this replica holds it now.
+func (l *Lease) Acquire(ctx context.Context) (bool, error) {
+	var holder string
+	err := l.db.QueryRowContext(ctx, `
+		INSERT INTO `+l.table+` (name, holder, acquired_at, expires_at)
+		VALUES ($1, $2, NOW(), NOW() + $3 * INTERVAL '1 second')
+		ON CONFLICT (name) DO UPDATE SET
+			holder = EXCLUDED.holder,
+			acquired_at = CASE WHEN `+l.table+`.holder = EXCLUDED.holder
+				THEN `+l.table+`.acquired_at ELSE NOW() END,
+			expires_at = EXCLUDED.expires_at
+		WHERE `+l.table+`.holder = EXCLUDED.holder OR `+l.table+`.expires_at < NOW()
+		RETURNING holder
+	`, l.name, l.holder, l.ttl.Seconds()).Scan(&holder)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return holder == l.holder, nil
+}
+
+// Release gives the lease up if this replica holds it, so another replica
+// can take over without waiting for it to expire.
+func (l *Lease) Release(ctx context.Context) error {
+	_, err := l.db.ExecContext(ctx, `
+		DELETE FROM `+l.table+` WHERE name = $1 AND holder = $2
+	`, l.name, l.holder)
+	return err
+}
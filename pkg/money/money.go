@@ -0,0 +1,155 @@
+// Package money represents monetary amounts exactly, as an integer number of
+// minor units (cents for USD) in an ISO 4217 currency. Prices that need more
+// precision than the minor unit are kept as *big.Rat and rounded into Money
+// with an explicit RoundingMode once the amount to charge is known.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// DefaultCurrency is used when nothing determines an amount's currency.
+const DefaultCurrency = "USD"
+
+var (
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrOverflow         = errors.New("amount out of range")
+)
+
+// exponents maps supported currencies to their number of minor unit digits.
+var exponents = map[string]int{
+	"AUD": 2, "BRL": 2, "CAD": 2, "CHF": 2, "CNY": 2, "CZK": 2, "DKK": 2,
+	"EUR": 2, "GBP": 2, "HKD": 2, "INR": 2, "MXN": 2, "NOK": 2, "NZD": 2,
+	"PLN": 2, "SEK": 2, "SGD": 2, "USD": 2, "ZAR": 2,
+	"CLP": 0, "ISK": 0, "JPY": 0, "KRW": 0, "VND": 0,
+	"BHD": 3, "JOD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+// Exponent returns the number of minor unit digits of currency.
+func Exponent(currency string) (int, error) {
+	exp, ok := exponents[currency]
+	if !ok {
+		return 0, fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+	return exp, nil
+}
+
+// Money is an exact amount of one currency.
+type Money struct {
+	MinorUnits int64  `json:"minor_units"`
+	Currency   string `json:"currency"`
+}
+
+// New returns minor minor units of currency.
+func New(minor int64, currency string) (Money, error) {
+	if _, err := Exponent(currency); err != nil {
+		return Money{}, err
+	}
+	return Money{MinorUnits: minor, Currency: currency}, nil
+}
+
+// Zero returns a zero amount of currency.
+func Zero(currency string) Money {
+	return Money{Currency: currency}
+}
+
+// IsZero reports whether m is a zero amount.
+func (m Money) IsZero() bool {
+	return m.MinorUnits == 0
+}
+
+// Add returns m + o. Both must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	sum := m.MinorUnits + o.MinorUnits
+	if (o.MinorUnits > 0 && sum < m.MinorUnits) || (o.MinorUnits < 0 && sum > m.MinorUnits) {
+		return Money{}, ErrOverflow
+	}
+	return Money{MinorUnits: sum, Currency: m.Currency}, nil
+}
+
+// Rat returns m in major units, e.g. 12.34 for 1234 US cents.
+func (m Money) Rat() *big.Rat {
+	exp := exponents[m.Currency]
+	return new(big.Rat).SetFrac(big.NewInt(m.MinorUnits), pow10(exp))
+}
+
+// Decimal formats m in major units with exactly the currency's number of
+// minor unit digits, e.g. "12.34" or "-0.05".
+func (m Money) Decimal() string {
+	exp := exponents[m.Currency]
+	return m.Rat().FloatString(exp)
+}
+
+// String formats m as "12.34 USD".
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// ParseDecimal parses a decimal string such as "12.34" as an amount of
+// currency. Amounts with more digits than the currency's minor unit are
+// rejected rather than rounded.
+func ParseDecimal(amount, currency string) (Money, error) {
+	r, err := ParseRat(amount)
+	if err != nil {
+		return Money{}, err
+	}
+	m, err := FromRat(r, currency, RoundDown)
+	if err != nil {
+		return Money{}, err
+	}
+	if m.Rat().Cmp(r) != 0 {
+		return Money{}, fmt.Errorf("amount %q has more precision than %s allows", amount, currency)
+	}
+	return m, nil
+}
+
+// ParseRat parses an exact decimal number such as "0.0125".
+func ParseRat(s string) (*big.Rat, error) {
+	s = strings.TrimSpace(s)
+	// Rat.SetString also accepts fractions and exponents; prices are plain decimals.
+	if s == "" || strings.ContainsAny(s, "/eE") {
+		return nil, fmt.Errorf("invalid decimal %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal %q", s)
+	}
+	return r, nil
+}
+
+// FromRat rounds r, in major units, to a whole number of minor units of
+// currency using mode.
+func FromRat(r *big.Rat, currency string, mode RoundingMode) (Money, error) {
+	exp, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow10(exp)))
+	minor := mode.round(scaled)
+	if !minor.IsInt64() {
+		return Money{}, ErrOverflow
+	}
+	return Money{MinorUnits: minor.Int64(), Currency: currency}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// PriceScale is the number of fractional digits stored for prices.
+const PriceScale = 10
+
+// FormatRat formats a price as a plain decimal, rounded to PriceScale digits
+// and without trailing zeros, e.g. "0.0025".
+func FormatRat(r *big.Rat) string {
+	s := r.FloatString(PriceScale)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
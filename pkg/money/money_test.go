@@ -0,0 +1,169 @@
+package money
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFromRat_Rounding(t *testing.T) {
+	tests := []struct {
+		amount   string
+		mode     RoundingMode
+		expected int64
+	}{
+		{amount: "1.005", mode: RoundHalfUp, expected: 101},
+		{amount: "1.005", mode: RoundHalfEven, expected: 100},
+		{amount: "1.015", mode: RoundHalfEven, expected: 102},
+		{amount: "1.0049", mode: RoundHalfUp, expected: 100},
+		{amount: "1.001", mode: RoundUp, expected: 101},
+		{amount: "1.009", mode: RoundDown, expected: 100},
+		{amount: "-1.005", mode: RoundHalfUp, expected: -101},
+		{amount: "-1.009", mode: RoundDown, expected: -100},
+		{amount: "-1.001", mode: RoundUp, expected: -101},
+		{amount: "12.34", mode: RoundHalfEven, expected: 1234},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRat(tt.amount)
+		if err != nil {
+			t.Fatalf("ParseRat(%q): unexpected error: %v", tt.amount, err)
+		}
+		m, err := FromRat(r, "USD", tt.mode)
+		if err != nil {
+			t.Fatalf("FromRat(%s, %s): unexpected error: %v", tt.amount, tt.mode, err)
+		}
+		if m.MinorUnits != tt.expected {
+			t.Errorf("FromRat(%s, %s): expected %d, got %d", tt.amount, tt.mode, tt.expected, m.MinorUnits)
+		}
+	}
+}
+
+func TestFromRat_CurrencyExponent(t *testing.T) {
+	r, _ := ParseRat("1234.5")
+	tests := []struct {
+		currency string
+		expected int64
+	}{
+		{currency: "USD", expected: 123450},
+		{currency: "JPY", expected: 1235},
+		{currency: "KWD", expected: 1234500},
+	}
+
+	for _, tt := range tests {
+		m, err := FromRat(r, tt.currency, RoundHalfUp)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.currency, err)
+		}
+		if m.MinorUnits != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.currency, tt.expected, m.MinorUnits)
+		}
+	}
+
+	if _, err := FromRat(r, "XYZ", RoundHalfUp); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("expected ErrUnknownCurrency, got %v", err)
+	}
+}
+
+func TestMoney_Decimal(t *testing.T) {
+	tests := []struct {
+		money    Money
+		expected string
+	}{
+		{money: Money{MinorUnits: 1234, Currency: "USD"}, expected: "12.34"},
+		{money: Money{MinorUnits: -5, Currency: "EUR"}, expected: "-0.05"},
+		{money: Money{MinorUnits: 0, Currency: "USD"}, expected: "0.00"},
+		{money: Money{MinorUnits: 1500, Currency: "JPY"}, expected: "1500"},
+		{money: Money{MinorUnits: 1, Currency: "BHD"}, expected: "0.001"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.money.Decimal(); got != tt.expected {
+			t.Errorf("%v: expected %q, got %q", tt.money, tt.expected, got)
+		}
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		expected int64
+		wantErr  bool
+	}{
+		{amount: "12.34", currency: "USD", expected: 1234},
+		{amount: "12", currency: "USD", expected: 1200},
+		{amount: "-0.5", currency: "USD", expected: -50},
+		{amount: "12.345", currency: "USD", wantErr: true},
+		{amount: "1e3", currency: "USD", wantErr: true},
+		{amount: "1/3", currency: "USD", wantErr: true},
+		{amount: "abc", currency: "USD", wantErr: true},
+		{amount: "1.5", currency: "JPY", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		m, err := ParseDecimal(tt.amount, tt.currency)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseDecimal(%q, %s): expected an error", tt.amount, tt.currency)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDecimal(%q, %s): unexpected error: %v", tt.amount, tt.currency, err)
+			continue
+		}
+		if m.MinorUnits != tt.expected {
+			t.Errorf("ParseDecimal(%q, %s): expected %d, got %d", tt.amount, tt.currency, tt.expected, m.MinorUnits)
+		}
+	}
+}
+
+func TestMoney_Add(t *testing.T) {
+	a := Money{MinorUnits: 150, Currency: "USD"}
+	sum, err := a.Add(Money{MinorUnits: 275, Currency: "USD"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sum.MinorUnits != 425 {
+		t.Errorf("expected 425, got %d", sum.MinorUnits)
+	}
+
+	if _, err := a.Add(Money{MinorUnits: 1, Currency: "EUR"}); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("expected ErrCurrencyMismatch, got %v", err)
+	}
+}
+
+func TestParseRoundingMode(t *testing.T) {
+	if m, err := ParseRoundingMode(""); err != nil || m != DefaultRoundingMode {
+		t.Errorf("expected default mode, got %q, %v", m, err)
+	}
+	if m, err := ParseRoundingMode("half_even"); err != nil || m != RoundHalfEven {
+		t.Errorf("expected half_even, got %q, %v", m, err)
+	}
+	if _, err := ParseRoundingMode("nearest"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func TestFormatRat(t *testing.T) {
+	tests := []struct {
+		price    string
+		expected string
+	}{
+		{price: "0.0100000000", expected: "0.01"},
+		{price: "0.0025", expected: "0.0025"},
+		{price: "100", expected: "100"},
+		{price: "0", expected: "0"},
+		{price: "5.50", expected: "5.5"},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRat(tt.price)
+		if err != nil {
+			t.Fatalf("ParseRat(%q): unexpected error: %v", tt.price, err)
+		}
+		if got := FormatRat(r); got != tt.expected {
+			t.Errorf("FormatRat(%s): expected %q, got %q", tt.price, tt.expected, got)
+		}
+	}
+}
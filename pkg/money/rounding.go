@@ -0,0 +1,65 @@
+package money
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// RoundingMode decides how an exact amount is rounded to whole minor units.
+type RoundingMode string
+
+const (
+	// RoundHalfUp rounds to the nearest minor unit, halves away from zero.
+	RoundHalfUp RoundingMode = "half_up"
+	// RoundHalfEven rounds to the nearest minor unit, halves to the even
+	// neighbour (banker's rounding).
+	RoundHalfEven RoundingMode = "half_even"
+	// RoundDown truncates towards zero.
+	RoundDown RoundingMode = "down"
+	// RoundUp rounds away from zero.
+	RoundUp RoundingMode = "up"
+)
+
+// DefaultRoundingMode is used when no mode is configured.
+const DefaultRoundingMode = RoundHalfUp
+
+// ParseRoundingMode parses a mode name, returning DefaultRoundingMode for "".
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	switch m := RoundingMode(s); m {
+	case "":
+		return DefaultRoundingMode, nil
+	case RoundHalfUp, RoundHalfEven, RoundDown, RoundUp:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown rounding mode %q", s)
+}
+
+// round returns r rounded to an integer according to m.
+func (m RoundingMode) round(r *big.Rat) *big.Int {
+	num, den := r.Num(), r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		return q
+	}
+
+	away := false
+	switch m {
+	case RoundDown:
+	case RoundUp:
+		away = true
+	default:
+		// Compare the discarded fraction with one half.
+		twice := new(big.Int).Abs(rem)
+		twice.Lsh(twice, 1)
+		switch twice.Cmp(den) {
+		case 1:
+			away = true
+		case 0:
+			away = m != RoundHalfEven || q.Bit(0) == 1
+		}
+	}
+	if away {
+		q.Add(q, big.NewInt(int64(num.Sign())))
+	}
+	return q
+}
@@ -0,0 +1,119 @@
+package nats
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+)
+
+// MemoryBus is an in-process Bus. Publish delivers to matching subscribers
+// synchronously, before it returns; handler errors are logged and the event
+// is not redelivered.
+type MemoryBus struct {
+	source string
+
+	mu     sync.Mutex
+	subs   map[int]*memorySubscription
+	nextID int
+	// next round-robins queue group deliveries, keyed by queue name.
+	next map[string]int
+}
+
+func NewMemoryBus(source string) *MemoryBus {
+	return &MemoryBus{
+		source: source,
+		subs:   make(map[int]*memorySubscription),
+		next:   make(map[string]int),
+	}
+}
+
+type memorySubscription struct {
+	bus     *MemoryBus
+	id      int
+	subject string
+	queue   string
+	handler Handler
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	delete(s.bus.subs, s.id)
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(subject, queue string, h Handler) (Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	sub := &memorySubscription{bus: b, id: b.nextID, subject: subject, queue: queue, handler: h}
+	b.subs[sub.id] = sub
+	return sub, nil
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, subject string, data interface{}) error {
+	env, err := NewEnvelope(b.source, subject, data)
+	if err != nil {
+		return err
+	}
+	return b.PublishEnvelope(ctx, env)
+}
+
+func (b *MemoryBus) PublishEnvelope(ctx context.Context, env Envelope) error {
+	for _, sub := range b.recipients(env.Subject) {
+		if err := sub.handler(ctx, env); err != nil {
+			log.Printf("nats: handler for %s failed on event %s: %v", env.Subject, env.ID, err)
+		}
+	}
+	return nil
+}
+
+// recipients returns every plain subscriber of subject plus one member of each
+// matching queue group.
+func (b *MemoryBus) recipients(subject string) []*memorySubscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var res []*memorySubscription
+	groups := make(map[string][]*memorySubscription)
+	for id := 1; id <= b.nextID; id++ {
+		sub, ok := b.subs[id]
+		if !ok || !subjectMatches(sub.subject, subject) {
+			continue
+		}
+		if sub.queue == "" {
+			res = append(res, sub)
+			continue
+		}
+		groups[sub.queue] = append(groups[sub.queue], sub)
+	}
+	for queue, members := range groups {
+		res = append(res, members[b.next[queue]%len(members)])
+		b.next[queue]++
+	}
+	return res
+}
+
+func (b *MemoryBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = make(map[int]*memorySubscription)
+	return nil
+}
+
+// subjectMatches reports whether subject matches pattern, where "*" matches a
+// single token and a trailing ">" matches one or more tokens.
+func subjectMatches(pattern, subject string) bool {
+	pt := strings.Split(pattern, ".")
+	st := strings.Split(subject, ".")
+	for i, p := range pt {
+		if p == ">" {
+			return i == len(pt)-1 && len(st) > i
+		}
+		if i >= len(st) || (p != "*" && p != st[i]) {
+			return false
+		}
+	}
+	return len(pt) == len(st)
+}
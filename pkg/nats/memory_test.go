@@ -0,0 +1,106 @@
+package nats
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		subject  string
+		expected bool
+	}{
+		{pattern: "usage.recorded", subject: "usage.recorded", expected: true},
+		{pattern: "usage.recorded", subject: "usage.other", expected: false},
+		{pattern: "usage.*", subject: "usage.recorded", expected: true},
+		{pattern: "usage.*", subject: "usage.recorded.v2", expected: false},
+		{pattern: "usage.>", subject: "usage.recorded.v2", expected: true},
+		{pattern: "usage.>", subject: "usage", expected: false},
+		{pattern: "usage.recorded.v2", subject: "usage.recorded", expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := subjectMatches(tt.pattern, tt.subject); got != tt.expected {
+			t.Errorf("subjectMatches(%q, %q): expected %v, got %v", tt.pattern, tt.subject, tt.expected, got)
+		}
+	}
+}
+
+func TestMemoryBus_DeliversEnvelope(t *testing.T) {
+	bus := NewMemoryBus("test-svc")
+
+	var got []Envelope
+	_, err := bus.Subscribe("usage.*", "", func(ctx context.Context, env Envelope) error {
+		got = append(got, env)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := bus.Publish(context.Background(), "usage.recorded", map[string]int{"quantity": 5}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(got))
+	}
+	if got[0].Subject != "usage.recorded" || got[0].Source != "test-svc" || got[0].ID == "" {
+		t.Errorf("unexpected envelope %+v", got[0])
+	}
+	var data map[string]int
+	if err := got[0].Decode(&data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data["quantity"] != 5 {
+		t.Errorf("expected quantity 5, got %d", data["quantity"])
+	}
+}
+
+func TestMemoryBus_QueueGroupDeliversOnce(t *testing.T) {
+	bus := NewMemoryBus("test-svc")
+
+	counts := make([]int, 2)
+	for i := range counts {
+		i := i
+		_, err := bus.Subscribe("aggregate.updated", "billing", func(ctx context.Context, env Envelope) error {
+			counts[i]++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := bus.Publish(context.Background(), "aggregate.updated", struct{}{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if counts[0]+counts[1] != 4 {
+		t.Errorf("expected 4 deliveries in total, got %v", counts)
+	}
+	if counts[0] != 2 || counts[1] != 2 {
+		t.Errorf("expected deliveries to be split evenly, got %v", counts)
+	}
+}
+
+func TestMemoryBus_Unsubscribe(t *testing.T) {
+	bus := NewMemoryBus("test-svc")
+
+	calls := 0
+	sub, _ := bus.Subscribe("usage.recorded", "", func(ctx context.Context, env Envelope) error {
+		calls++
+		return nil
+	})
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = bus.Publish(context.Background(), "usage.recorded", struct{}{})
+
+	if calls != 0 {
+		t.Errorf("expected no deliveries after unsubscribe, got %d", calls)
+	}
+}
@@ -1 +1,297 @@
+// Package nats is the event bus shared by the Polaris services. Events are
+// published as JSON envelopes; Conn carries them over a NATS server with
+// JetStream and MemoryBus delivers them in-process for tests and local runs.
 package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	natsgo "github.com/nats-io/nats.go"
+)
+
+// Envelope wraps every published event.
+type Envelope struct {
+	ID      string          `json:"id"`
+	Subject string          `json:"subject"`
+	Source  string          `json:"source"` // name of the publishing service
+	Time    time.Time       `json:"time"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Decode unmarshals the event payload into v.
+func (e Envelope) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// Handler processes one delivered event. An event whose handler fails is
+// delivered again later, unless the error wraps ErrDropEvent.
+type Handler func(ctx context.Context, env Envelope) error
+
+// ErrDropEvent marks a handler error that retrying cannot fix, such as a
+// malformed payload. The event is logged and dropped instead of redelivered.
+var ErrDropEvent = errors.New("event dropped")
+
+type Publisher interface {
+	// Publish sends data, encoded as JSON, on subject.
+	Publish(ctx context.Context, subject string, data interface{}) error
+	// PublishEnvelope sends a prepared envelope on env.Subject. Resending the
+	// same envelope keeps its ID, so consumers can deduplicate redeliveries.
+	PublishEnvelope(ctx context.Context, env Envelope) error
+}
+
+// Flusher is implemented by publishers that buffer messages. Callers that must
+// know an event left the process, such as the outbox relay, flush before
+// treating it as sent.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+type Subscriber interface {
+	// Subscribe delivers events on subject to h. Subjects may use the NATS
+	// wildcards "*" and ">" after their first token. Subscribers sharing a
+	// non-empty queue name split the events between them instead of each
+	// receiving every event.
+	Subscribe(subject, queue string, h Handler) (Subscription, error)
+}
+
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Bus is both ends of the event bus.
+type Bus interface {
+	Publisher
+	Subscriber
+	Close() error
+}
+
+// NewEnvelope wraps data for publishing on subject.
+func NewEnvelope(source, subject string, data interface{}) (Envelope, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("encode %s event: %w", subject, err)
+	}
+	return Envelope{
+		ID:      uuid.New().String(),
+		Subject: subject,
+		Source:  source,
+		Time:    time.Now().UTC(),
+		Data:    raw,
+	}, nil
+}
+
+// FromEnv connects to the server named by NATS_URL, or returns an in-memory
+// bus when it is unset so services run without NATS locally.
+func FromEnv(source string) (Bus, error) {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		log.Printf("NATS_URL not set, %s publishes events in-process only", source)
+		return NewMemoryBus(source), nil
+	}
+	return Connect(url, source)
+}
+
+const (
+	// streamMaxAge is how long JetStream keeps events, delivered or not.
+	streamMaxAge = 7 * 24 * time.Hour
+	// publishTimeout bounds how long a publish waits for JetStream to store the event.
+	publishTimeout = 10 * time.Second
+	// ackWait is how long a handler may run before its event is redelivered.
+	ackWait = time.Minute
+	// maxRedeliveryDelay caps the delay before redelivering an event whose handler failed.
+	maxRedeliveryDelay = 5 * time.Minute
+)
+
+// Conn is a Bus backed by a NATS server with JetStream enabled. Events are
+// stored in one stream per first subject token ("aggregate.updated" goes to
+// EVENTS_AGGREGATE) and publishing waits until the event is stored, with the
+// envelope ID as the message ID so JetStream drops resends it already has.
+//
+// Queue subscribers read through a durable consumer named after the queue and
+// subject, so events published while no member is running are delivered when
+// one starts. An event is acknowledged once the handler returns nil; when it
+// fails, or does not finish within ackWait, the event is redelivered with
+// increasing delay. Handlers must therefore be idempotent.
+type Conn struct {
+	nc     *natsgo.Conn
+	js     natsgo.JetStreamContext
+	source string
+
+	mu      sync.Mutex
+	streams map[string]bool // streams known to exist
+}
+
+// Connect dials the NATS server at url. source names the publishing service
+// in the envelopes it sends.
+func Connect(url, source string) (*Conn, error) {
+	nc, err := natsgo.Connect(url, natsgo.Name(source), natsgo.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &Conn{nc: nc, js: js, source: source, streams: make(map[string]bool)}, nil
+}
+
+func (c *Conn) Publish(ctx context.Context, subject string, data interface{}) error {
+	env, err := NewEnvelope(c.source, subject, data)
+	if err != nil {
+		return err
+	}
+	return c.PublishEnvelope(ctx, env)
+}
+
+func (c *Conn) PublishEnvelope(ctx context.Context, env Envelope) error {
+	raw, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	if _, err := c.ensureStream(env.Subject); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	_, err = c.js.PublishMsg(&natsgo.Msg{Subject: env.Subject, Data: raw}, natsgo.MsgId(env.ID), natsgo.Context(ctx))
+	return err
+}
+
+// Flush waits until the server has received every message published so far.
+func (c *Conn) Flush(ctx context.Context) error {
+	return c.nc.FlushWithContext(ctx)
+}
+
+func (c *Conn) Subscribe(subject, queue string, h Handler) (Subscription, error) {
+	stream, err := c.ensureStream(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	cb := func(msg *natsgo.Msg) {
+		var env Envelope
+		if err := json.Unmarshal(msg.Data, &env); err != nil {
+			log.Printf("nats: dropping malformed message on %s: %v", msg.Subject, err)
+			msg.Term()
+			return
+		}
+		err := h(context.Background(), env)
+		if errors.Is(err, ErrDropEvent) {
+			log.Printf("nats: handler for %s dropped event %s: %v", msg.Subject, env.ID, err)
+			msg.Term()
+			return
+		}
+		if err != nil {
+			delivered := uint64(1)
+			if meta, err := msg.Metadata(); err == nil {
+				delivered = meta.NumDelivered
+			}
+			delay := redeliveryDelay(delivered)
+			log.Printf("nats: handler for %s failed on event %s (delivery %d), retrying in %s: %v", msg.Subject, env.ID, delivered, delay, err)
+			msg.NakWithDelay(delay)
+			return
+		}
+		msg.Ack()
+	}
+
+	if queue == "" {
+		// Plain subscribers see events from now on, like a core NATS subscription.
+		return c.js.Subscribe(subject, cb, natsgo.BindStream(stream), natsgo.DeliverNew(), natsgo.ManualAck(), natsgo.AckWait(ackWait))
+	}
+
+	// The consumer is created here rather than by QueueSubscribe, which would
+	// delete it again on Unsubscribe or Close and lose events published while
+	// the service is down.
+	durable := durableName(queue, subject)
+	cfg := &natsgo.ConsumerConfig{
+		Durable:        durable,
+		DeliverSubject: "_polaris.deliver." + durable,
+		DeliverGroup:   queue,
+		DeliverPolicy:  natsgo.DeliverAllPolicy,
+		FilterSubject:  subject,
+		AckPolicy:      natsgo.AckExplicitPolicy,
+		AckWait:        ackWait,
+	}
+	_, err = c.js.AddConsumer(stream, cfg)
+	if errors.Is(err, natsgo.ErrConsumerNameAlreadyInUse) {
+		_, err = c.js.UpdateConsumer(stream, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create consumer %s: %w", durable, err)
+	}
+	return c.js.QueueSubscribe(subject, queue, cb, natsgo.Bind(stream, durable), natsgo.ManualAck())
+}
+
+// ensureStream creates the stream holding subject unless it is known to exist
+// and returns its name.
+func (c *Conn) ensureStream(subject string) (string, error) {
+	name, err := streamName(subject)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.streams[name] {
+		return name, nil
+	}
+	_, err = c.js.AddStream(&natsgo.StreamConfig{
+		Name:     name,
+		Subjects: []string{strings.SplitN(subject, ".", 2)[0] + ".>"},
+		Storage:  natsgo.FileStorage,
+		MaxAge:   streamMaxAge,
+	})
+	// A stream created with other limits, e.g. by an operator, is used as is.
+	if err != nil && !errors.Is(err, natsgo.ErrStreamNameAlreadyInUse) {
+		return "", fmt.Errorf("create stream %s: %w", name, err)
+	}
+	c.streams[name] = true
+	return name, nil
+}
+
+// Close flushes pending messages and closes the connection. Durable consumers
+// are kept, so queue groups resume where they left off.
+func (c *Conn) Close() error {
+	return c.nc.Drain()
+}
+
+// streamName returns the name of the stream holding subject's events.
+func streamName(subject string) (string, error) {
+	token := strings.SplitN(subject, ".", 2)[0]
+	if token == "" || token == "*" || token == ">" || !strings.Contains(subject, ".") {
+		return "", fmt.Errorf("nats: subject %q needs a literal first token and at least two tokens", subject)
+	}
+	return "EVENTS_" + strings.ToUpper(token), nil
+}
+
+// durableName returns the durable consumer name of queue's subscription to
+// subject. Consumer names cannot contain dots or wildcards.
+func durableName(queue, subject string) string {
+	r := strings.NewReplacer(".", "_", "*", "any", ">", "all")
+	return r.Replace(queue + "_" + subject)
+}
+
+// redeliveryDelay returns how long to wait before redelivering an event whose
+// handler has failed on delivered attempts: one second, doubling up to
+// maxRedeliveryDelay.
+func redeliveryDelay(delivered uint64) time.Duration {
+	d := time.Second
+	for i := uint64(1); i < delivered && d < maxRedeliveryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRedeliveryDelay {
+		return maxRedeliveryDelay
+	}
+	return d
+}
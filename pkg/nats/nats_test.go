@@ -0,0 +1,62 @@
+package nats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamName(t *testing.T) {
+	tests := []struct {
+		subject  string
+		expected string // empty for an error
+	}{
+		{subject: "aggregate.updated", expected: "EVENTS_AGGREGATE"},
+		{subject: "usage.*", expected: "EVENTS_USAGE"},
+		{subject: "invoice.>", expected: "EVENTS_INVOICE"},
+		{subject: "usage", expected: ""},
+		{subject: "*.updated", expected: ""},
+		{subject: ">", expected: ""},
+	}
+
+	for _, tt := range tests {
+		got, err := streamName(tt.subject)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("streamName(%q): expected an error, got %q", tt.subject, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.expected {
+			t.Errorf("streamName(%q): expected %q, got %q (%v)", tt.subject, tt.expected, got, err)
+		}
+	}
+}
+
+func TestDurableName(t *testing.T) {
+	if got := durableName("billing-svc", "aggregate.updated"); got != "billing-svc_aggregate_updated" {
+		t.Errorf("unexpected durable name %q", got)
+	}
+	if got := durableName("audit", "invoice.>"); got != "audit_invoice_all" {
+		t.Errorf("unexpected durable name %q", got)
+	}
+}
+
+func TestRedeliveryDelay(t *testing.T) {
+	tests := []struct {
+		delivered uint64
+		expected  time.Duration
+	}{
+		{delivered: 0, expected: time.Second},
+		{delivered: 1, expected: time.Second},
+		{delivered: 2, expected: 2 * time.Second},
+		{delivered: 9, expected: 256 * time.Second},
+		{delivered: 10, expected: maxRedeliveryDelay},
+		{delivered: 1000, expected: maxRedeliveryDelay},
+	}
+
+	for _, tt := range tests {
+		if got := redeliveryDelay(tt.delivered); got != tt.expected {
+			t.Errorf("redeliveryDelay(%d): expected %v, got %v", tt.delivered, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package outbox implements the transactional outbox. Services write their
+// domain events into an outbox table in the same transaction as the rows the
+// events describe, and a Relay publishes them to the event bus afterwards, so
+// a crash between commit and publish delays an event instead of losing it.
+//
+// Every outbox table has the same shape:
+//
+//	id BIGSERIAL PRIMARY KEY,
+//	event_id TEXT NOT NULL,
+//	subject TEXT NOT NULL,
+//	payload JSONB NOT NULL,
+//	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+//	attempts INT NOT NULL DEFAULT 0,
+//	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+//	last_error TEXT,
+//	published_at TIMESTAMPTZ
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Outbox writes events into one outbox table.
+type Outbox struct {
+	table string
+}
+
+// New returns an Outbox for table, which must be a trusted identifier.
+func New(table string) *Outbox {
+	return &Outbox{table: table}
+}
+
+// Table returns the name of the outbox table.
+func (o *Outbox) Table() string {
+	return o.table
+}
+
+// Add queues events for publishing on subject as part of tx. Each event is
+// encoded as JSON and gets its own envelope ID.
+func (o *Outbox) Add(ctx context.Context, tx *sql.Tx, subject string, events ...interface{}) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(events))
+	payloads := make([]string, len(events))
+	for i, ev := range events {
+		raw, err := json.Marshal(ev)
+		if err != nil {
+			return fmt.Errorf("encode %s event: %w", subject, err)
+		}
+		ids[i] = uuid.New().String()
+		payloads[i] = string(raw)
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO `+o.table+` (event_id, subject, payload)
+		SELECT id, $1, payload FROM unnest($2::text[], $3::jsonb[]) AS e(id, payload)
+	`, subject, pq.Array(ids), pq.Array(payloads))
+	return err
+}
@@ -0,0 +1,230 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/jackthomas00/polaris/pkg/nats"
+)
+
+const (
+	// relayBatchSize bounds how many events one drain publishes.
+	relayBatchSize = 500
+	// relayInterval is how often an idle relay polls its table.
+	relayInterval = time.Second
+	// relayFlushTimeout bounds how long a drain waits for the bus to confirm a batch.
+	relayFlushTimeout = 10 * time.Second
+	// maxRetryBackoff caps the delay between attempts to publish a failing event.
+	maxRetryBackoff = 5 * time.Minute
+	// publishedRetention is how long published events are kept before they are pruned.
+	publishedRetention = 7 * 24 * time.Hour
+)
+
+var (
+	publishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polaris_outbox_published_total",
+		Help: "Outbox events published to the event bus.",
+	}, []string{"table", "subject"})
+	failuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polaris_outbox_publish_failures_total",
+		Help: "Failed attempts to publish an outbox event.",
+	}, []string{"table", "subject"})
+	pendingEvents = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "polaris_outbox_pending_events",
+		Help: "Outbox events not yet published.",
+	}, []string{"table"})
+	deliveryLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "polaris_outbox_delivery_lag_seconds",
+		Help:    "Time from writing an outbox event to publishing it.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"table"})
+)
+
+// Relay drains an outbox table to the event bus. Delivery is at-least-once:
+// an event is marked published only after the bus accepted it, so a crash in
+// between publishes it again with the same envelope ID. Several relays may
+// drain the same table; rows are claimed with FOR UPDATE SKIP LOCKED.
+type Relay struct {
+	db     *sql.DB
+	outbox *Outbox
+	bus    nats.Publisher
+	source string
+}
+
+// NewRelay returns a relay publishing the events of o through bus. source
+// names the service in the published envelopes.
+func NewRelay(db *sql.DB, o *Outbox, bus nats.Publisher, source string) *Relay {
+	return &Relay{db: db, outbox: o, bus: bus, source: source}
+}
+
+// Run drains the outbox until ctx is cancelled. A full batch is followed
+// immediately by the next; otherwise the relay waits relayInterval.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+
+	lastPrune := time.Time{}
+	for {
+		n, err := r.Drain(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("outbox %s: drain: %v", r.outbox.table, err)
+		}
+		if time.Since(lastPrune) > time.Hour {
+			if err := r.prune(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("outbox %s: prune: %v", r.outbox.table, err)
+			}
+			lastPrune = time.Now()
+		}
+		if err == nil && n == relayBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type pendingEvent struct {
+	id       int64
+	env      nats.Envelope
+	attempts int
+}
+
+// Drain publishes one batch of due events and returns how many were claimed.
+// Events that fail to publish are retried with exponential backoff, so
+// consumers must not rely on events arriving in order.
+func (r *Relay) Drain(ctx context.Context) (int, error) {
+	table := r.outbox.table
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, event_id, subject, payload, created_at, attempts
+		FROM `+table+`
+		WHERE published_at IS NULL AND next_attempt_at <= NOW()
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, relayBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var batch []pendingEvent
+	for rows.Next() {
+		var p pendingEvent
+		var payload []byte
+		if err := rows.Scan(&p.id, &p.env.ID, &p.env.Subject, &payload, &p.env.Time, &p.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		p.env.Source = r.source
+		p.env.Data = json.RawMessage(payload)
+		p.env.Time = p.env.Time.UTC()
+		batch = append(batch, p)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var published []pendingEvent
+	var publishedIDs []int64
+	var publishErr error
+	for _, p := range batch {
+		if err := r.bus.PublishEnvelope(ctx, p.env); err != nil {
+			publishErr = err
+			failuresTotal.WithLabelValues(table, p.env.Subject).Inc()
+			_, err := tx.ExecContext(ctx, `
+				UPDATE `+table+`
+				SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second', last_error = $3
+				WHERE id = $1
+			`, p.id, retryBackoff(p.attempts+1).Seconds(), publishErr.Error())
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		published = append(published, p)
+		publishedIDs = append(publishedIDs, p.id)
+	}
+
+	if f, ok := r.bus.(nats.Flusher); ok && len(published) > 0 {
+		flushCtx, cancel := context.WithTimeout(ctx, relayFlushTimeout)
+		err := f.Flush(flushCtx)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE `+table+`
+		SET published_at = NOW(), attempts = attempts + 1, last_error = NULL
+		WHERE id = ANY($1)
+	`, pq.Array(publishedIDs))
+	if err != nil {
+		return 0, err
+	}
+
+	var pending float64
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM `+table+` WHERE published_at IS NULL
+	`).Scan(&pending)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, p := range published {
+		publishedTotal.WithLabelValues(table, p.env.Subject).Inc()
+		deliveryLag.WithLabelValues(table).Observe(now.Sub(p.env.Time).Seconds())
+	}
+	pendingEvents.WithLabelValues(table).Set(pending)
+
+	if publishErr != nil {
+		return len(batch), publishErr
+	}
+	return len(batch), nil
+}
+
+// prune deletes events published more than publishedRetention ago.
+func (r *Relay) prune(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, `
+		DELETE FROM `+r.outbox.table+`
+		WHERE published_at < NOW() - $1 * INTERVAL '1 second'
+	`, publishedRetention.Seconds())
+	return err
+}
+
+// retryBackoff returns the delay before retrying an event that has failed
+// attempts times: one second, doubling up to maxRetryBackoff.
+func retryBackoff(attempts int) time.Duration {
+	d := time.Second
+	for i := 1; i < attempts && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return d
+}
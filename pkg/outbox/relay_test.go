@@ -0,0 +1,202 @@
+package outbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/jackthomas00/polaris/pkg/db/dbtest"
+	"github.com/jackthomas00/polaris/pkg/nats"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{attempts: 1, expected: time.Second},
+		{attempts: 2, expected: 2 * time.Second},
+		{attempts: 5, expected: 16 * time.Second},
+		{attempts: 9, expected: 256 * time.Second},
+		{attempts: 10, expected: maxRetryBackoff},
+		{attempts: 1000, expected: maxRetryBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := retryBackoff(tt.attempts); got != tt.expected {
+			t.Errorf("retryBackoff(%d): expected %v, got %v", tt.attempts, tt.expected, got)
+		}
+	}
+}
+
+// fakeRow is one row of the fake outbox table.
+type fakeRow struct {
+	id        int64
+	eventID   string
+	subject   string
+	attempts  int64
+	published bool
+	lastError string
+	// backoff is the retry delay in seconds set by the last failure.
+	backoff float64
+}
+
+// fakeTable answers the relay's statements against rows. Changes are applied
+// when the transaction commits.
+type fakeTable struct {
+	rows    []*fakeRow
+	staged  []func()
+	commits int
+}
+
+func (f *fakeTable) handle(query string, args []driver.NamedValue) (*dbtest.Result, error) {
+	switch {
+	case query == dbtest.Begin, query == dbtest.Rollback:
+		f.staged = nil
+		return nil, nil
+	case query == dbtest.Commit:
+		for _, apply := range f.staged {
+			apply()
+		}
+		f.staged = nil
+		f.commits++
+		return nil, nil
+	case dbtest.Contains(query, "SELECT id, event_id, subject, payload", "FOR UPDATE SKIP LOCKED"):
+		res := dbtest.Rows([]string{"id", "event_id", "subject", "payload", "created_at", "attempts"})
+		for _, r := range f.rows {
+			if !r.published {
+				res.Rows = append(res.Rows, []driver.Value{r.id, r.eventID, r.subject, []byte(`{"n":1}`), time.Now(), r.attempts})
+			}
+		}
+		return res, nil
+	case dbtest.Contains(query, "SET attempts = attempts + 1, next_attempt_at"):
+		id, backoff, msg := args[0].Value.(int64), args[1].Value.(float64), args[2].Value.(string)
+		f.staged = append(f.staged, func() {
+			r := f.row(id)
+			r.attempts++
+			r.backoff = backoff
+			r.lastError = msg
+		})
+		return nil, nil
+	case dbtest.Contains(query, "SET published_at = NOW()"):
+		var ids []int64
+		if err := pq.Array(&ids).Scan(args[0].Value); err != nil {
+			return nil, err
+		}
+		f.staged = append(f.staged, func() {
+			for _, id := range ids {
+				r := f.row(id)
+				r.published = true
+				r.attempts++
+				r.lastError = ""
+			}
+		})
+		return nil, nil
+	case dbtest.Contains(query, "SELECT COUNT(*)"):
+		return dbtest.Rows([]string{"count"}, []driver.Value{int64(0)}), nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", query)
+}
+
+func (f *fakeTable) row(id int64) *fakeRow {
+	for _, r := range f.rows {
+		if r.id == id {
+			return r
+		}
+	}
+	panic(fmt.Sprintf("no row %d", id))
+}
+
+// fakeBus records published envelopes and fails the subjects in fail.
+type fakeBus struct {
+	nats.Publisher
+	fail      map[string]bool
+	flushErr  error
+	published []nats.Envelope
+}
+
+func (b *fakeBus) PublishEnvelope(ctx context.Context, env nats.Envelope) error {
+	if b.fail[env.Subject] {
+		return errors.New("no responders")
+	}
+	b.published = append(b.published, env)
+	return nil
+}
+
+func (b *fakeBus) Flush(ctx context.Context) error {
+	return b.flushErr
+}
+
+func TestRelay_Drain(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     map[string]bool
+		flushErr error
+		// expected lists, per row, whether it ends up published.
+		expected []bool
+		wantErr  bool
+	}{
+		{
+			name:     "published events are marked published",
+			expected: []bool{true, true},
+		},
+		{
+			name:     "a failed publish leaves the row pending",
+			fail:     map[string]bool{"invoice.updated": true},
+			expected: []bool{true, false},
+			wantErr:  true,
+		},
+		{
+			name:     "nothing is marked published when the flush fails",
+			flushErr: errors.New("timeout"),
+			expected: []bool{false, false},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &fakeTable{rows: []*fakeRow{
+				{id: 1, eventID: "ev-1", subject: "usage.recorded"},
+				{id: 2, eventID: "ev-2", subject: "invoice.updated", attempts: 2},
+			}}
+			bus := &fakeBus{fail: tt.fail, flushErr: tt.flushErr}
+			relay := NewRelay(dbtest.Open(t, table.handle), New("test_outbox"), bus, "test-svc")
+
+			n, err := relay.Drain(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if n != 2 && tt.flushErr == nil {
+				t.Errorf("expected 2 events claimed, got %d", n)
+			}
+
+			for i, r := range table.rows {
+				if r.published != tt.expected[i] {
+					t.Errorf("row %d: expected published %v, got %v", r.id, tt.expected[i], r.published)
+				}
+			}
+			if len(bus.published) > 0 {
+				env := bus.published[0]
+				if env.ID != "ev-1" || env.Subject != "usage.recorded" || env.Source != "test-svc" || string(env.Data) != `{"n":1}` {
+					t.Errorf("unexpected envelope %+v", env)
+				}
+			}
+
+			if tt.fail != nil {
+				r := table.row(2)
+				if r.attempts != 3 || r.lastError == "" || r.backoff != retryBackoff(3).Seconds() {
+					t.Errorf("expected the failure recorded with a %v backoff, got %+v", retryBackoff(3), r)
+				}
+			}
+			if tt.flushErr != nil && table.commits != 0 {
+				t.Error("expected the drain to roll back")
+			}
+		})
+	}
+}